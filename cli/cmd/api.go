@@ -0,0 +1,44 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/client"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//newClient Creates an API client for the server of the saved session
+func newClient() *client.Client {
+	apiClient := client.New(viper.GetString("ServerHostname"), viper.GetBool("UseHTTPS"), viper.GetBool("IgnoreSSLErrors"))
+	apiClient.Token = viper.GetString("AuthenticationToken")
+	return apiClient
+}
+
+//exitOnError Prints what went wrong and exits if err is not nil
+func exitOnError(action string, err error) {
+	if err == nil {
+		return
+	}
+	if client.IsCode(err, mds.ErrorCodeTokenExpired) || client.IsCode(err, mds.ErrorCodeUnauthorized) {
+		fmt.Printf("%s: %s, please run 'connect' again\n", action, err.(*client.Error).Message)
+	} else {
+		fmt.Printf("%s: %s\n", action, err.Error())
+	}
+	os.Exit(1)
+}
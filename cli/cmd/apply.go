@@ -0,0 +1,350 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/twa16/meteor-deploy-system/client"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+var applyManifestPath string
+var applyDryRun bool
+var applyUpdateSecrets bool
+var detachApply bool
+
+// applyCmd represents the apply command
+var applyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Create or update a deployment from mds.yaml",
+	Long: `Makes the deployment named in a manifest match it. The deployment is created if it does not exist,
+otherwise only what differs is sent: the bundle and settings are compared by checksum and the environment
+variables, domains, resource limits and health check by value. Variables missing from the manifest are removed.
+Secret values cannot be read back so they are only sent when they are new or with --update-secrets.
+Running apply again without changing anything does nothing.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		manifest, err := loadManifest(applyManifestPath)
+		exitOnError("Failed to read "+applyManifestPath, err)
+		settings, err := manifest.ReadSettings()
+		exitOnError("Failed to read settings file", err)
+		bundleChecksum := ""
+		if manifest.Bundle != "" {
+			bundleChecksum, err = checksumFile(manifest.Bundle)
+			exitOnError("Failed to read bundle", err)
+		}
+
+		apiClient := newClient()
+		deployment, err := findDeploymentByName(apiClient, manifest.Name)
+		exitOnError("Failed to find deployment", err)
+		if deployment == nil {
+			request := planCreate(manifest, settings)
+			if applyDryRun {
+				return
+			}
+			statusf("Uploading Deployment...\n")
+			job, err := apiClient.CreateDeployment(request)
+			exitOnError("Failed to create deployment", err)
+			waitForSubmittedJob(job, detachApply)
+			return
+		}
+
+		detail, err := apiClient.GetDeployment(deployment.ID)
+		exitOnError("Failed to get deployment", err)
+		variables, err := apiClient.ListEnvironment(deployment.ID)
+		exitOnError("Failed to get environment variables", err)
+		request, changed := planUpdate(manifest, detail, variables, bundleChecksum, settings)
+		if !changed {
+			color.Green("No changes, %s matches %s", manifest.Name, applyManifestPath)
+			return
+		}
+		if applyDryRun {
+			return
+		}
+		if request.BundlePath != "" {
+			statusf("Uploading Update...\n")
+		}
+		job, err := apiClient.UpdateDeployment(deployment.ID, request)
+		exitOnError("Failed to update deployment", err)
+		waitForSubmittedJob(job, detachApply)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(applyCmd)
+
+	applyCmd.Flags().StringVarP(&applyManifestPath, "file", "f", defaultManifestPath, "Path to the manifest")
+	applyCmd.Flags().BoolVar(&applyDryRun, "dry-run", false, "Only print what would change")
+	applyCmd.Flags().BoolVar(&applyUpdateSecrets, "update-secrets", false, "Send every secret variable again, even if it already exists")
+	applyCmd.Flags().BoolVar(&detachApply, "detach", false, "Return once the job is submitted instead of following its progress")
+}
+
+//findDeploymentByName Gets the deployment with a project name, nil if there is none
+func findDeploymentByName(apiClient *client.Client, name string) (*mds.Deployment, error) {
+	deployments, err := apiClient.ListDeployments()
+	if err != nil {
+		return nil, err
+	}
+	var found *mds.Deployment
+	for i := range deployments {
+		if deployments[i].ProjectName != name {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("More than one deployment is named %s (IDs %d and %d)", name, found.ID, deployments[i].ID)
+		}
+		found = &deployments[i]
+	}
+	return found, nil
+}
+
+//planCreate Prints what a new deployment will have and builds the request that creates it
+func planCreate(manifest *Manifest, settings string) client.CreateDeploymentRequest {
+	spec := manifest.Spec()
+	fmt.Printf("Deployment %s does not exist and will be created:\n", manifest.Name)
+	if manifest.Bundle != "" {
+		printAddition("%s %s", manifest.DeploymentType(), manifest.Bundle)
+	} else {
+		printAddition("image %s", spec.Image)
+	}
+	if settings != "" {
+		printAddition("settings %s", manifest.Settings)
+	}
+	if len(spec.Domains) > 0 {
+		printAddition("domains %s", joinOrNone(spec.Domains))
+	}
+	if spec.MongoMode != "" {
+		printAddition("mongo %s", spec.MongoMode)
+	}
+	if spec.Resources != (mds.ResourceLimits{}) {
+		printAddition("resources %s", describeResources(spec.Resources))
+	}
+	if spec.HealthCheck != nil {
+		printAddition("healthCheck %s", describeHealthCheck(spec.HealthCheck))
+	}
+	if spec.Network != "" {
+		printAddition("network %s", spec.Network)
+	}
+	for _, name := range sortedNames(manifest.Env) {
+		printAddition("env %s", name)
+	}
+	for _, name := range sortedNames(manifest.SecretEnv) {
+		printAddition("env %s (secret)", name)
+	}
+	return client.CreateDeploymentRequest{
+		ProjectName: manifest.Name,
+		Type:        manifest.DeploymentType(),
+		BundlePath:  manifest.Bundle,
+		Settings:    settings,
+		Env:         sortedVariables(manifest.Env),
+		SecretEnv:   sortedVariables(manifest.SecretEnv),
+		Spec:        &spec,
+	}
+}
+
+//planUpdate Prints how a deployment differs from the manifest and builds the request that makes them match.
+//Returns false if nothing differs.
+func planUpdate(manifest *Manifest, detail mds.DeploymentDetail, variables []mds.EnvironmentVariable, bundleChecksum string, settings string) (client.UpdateDeploymentRequest, bool) {
+	var request client.UpdateDeploymentRequest
+	changed := false
+	fmt.Printf("Deployment %s (ID %d):\n", detail.ProjectName, detail.ID)
+	deploymentType := detail.Type
+	if deploymentType == "" {
+		deploymentType = mds.DeploymentTypeBundle
+	}
+	if manifest.DeploymentType() != deploymentType {
+		fmt.Printf("The type of a deployment cannot be changed from %s to %s. Create a new deployment instead.\n", deploymentType, manifest.DeploymentType())
+		os.Exit(1)
+	}
+
+	if bundleChecksum != "" && bundleChecksum != detail.BundleChecksum {
+		printChange("bundle %s -> %s", shortChecksum(detail.BundleChecksum), shortChecksum(bundleChecksum))
+		request.BundlePath = manifest.Bundle
+		changed = true
+	}
+	if checksumString(settings) != detail.SettingsChecksum {
+		if settings == "" {
+			printRemoval("settings")
+		} else {
+			printChange("settings %s", manifest.Settings)
+		}
+		request.Settings = &settings
+		changed = true
+	}
+
+	//Environment variables are merged by name on the server, so only the differences are sent
+	current := make(map[string]mds.EnvironmentVariable)
+	for _, variable := range variables {
+		current[variable.Name] = variable
+	}
+	for _, name := range sortedNames(manifest.Env) {
+		value := manifest.Env[name]
+		existing, ok := current[name]
+		switch {
+		case !ok:
+			printAddition("env %s", name)
+		case existing.Secret:
+			printChange("env %s is no longer secret", name)
+		case existing.Value != value:
+			printChange("env %s: %s -> %s", name, existing.Value, value)
+		default:
+			continue
+		}
+		request.Env = append(request.Env, name+"="+value)
+	}
+	for _, name := range sortedNames(manifest.SecretEnv) {
+		existing, ok := current[name]
+		switch {
+		case !ok:
+			printAddition("env %s (secret)", name)
+		case !existing.Secret:
+			printChange("env %s becomes secret", name)
+		case applyUpdateSecrets:
+			printChange("env %s (secret, sent again)", name)
+		default:
+			continue
+		}
+		request.SecretEnv = append(request.SecretEnv, name+"="+manifest.SecretEnv[name])
+	}
+	for _, variable := range variables {
+		_, inEnv := manifest.Env[variable.Name]
+		_, inSecretEnv := manifest.SecretEnv[variable.Name]
+		if !inEnv && !inSecretEnv {
+			printRemoval("env %s", variable.Name)
+			request.Unset = append(request.Unset, variable.Name)
+		}
+	}
+	changed = changed || len(request.Env) > 0 || len(request.SecretEnv) > 0 || len(request.Unset) > 0
+
+	if spec, specChanged := planSpec(manifest.Spec(), detail); specChanged {
+		request.Spec = &spec
+		changed = true
+	}
+	return request, changed
+}
+
+//planSpec Compares the spec of the manifest with the deployment. The primary domain and MongoDB mode
+//are fixed when a deployment is created, so a manifest that changes them is rejected before anything is sent.
+func planSpec(spec mds.DeploymentSpec, detail mds.DeploymentDetail) (mds.DeploymentSpec, bool) {
+	if primary := spec.PrimaryDomain(); primary != "" && primary != detail.URL {
+		fmt.Printf("The primary domain cannot be changed from %s to %s. Create a new deployment instead.\n", detail.URL, primary)
+		os.Exit(1)
+	}
+	if spec.MongoMode != "" && spec.MongoMode != detail.MongoMode {
+		fmt.Printf("The MongoDB mode cannot be changed from %s to %s. Create a new deployment instead.\n", detail.MongoMode, spec.MongoMode)
+		os.Exit(1)
+	}
+	current := detail.Spec
+	changed := false
+	if strings.Join(spec.Aliases(), " ") != strings.Join(current.Aliases(), " ") {
+		printChange("domain aliases %s -> %s", joinOrNone(current.Aliases()), joinOrNone(spec.Aliases()))
+		changed = true
+	}
+	if spec.Resources != current.Resources {
+		printChange("resources %s -> %s", describeResources(current.Resources), describeResources(spec.Resources))
+		changed = true
+	}
+	if !reflect.DeepEqual(spec.HealthCheck, current.HealthCheck) {
+		printChange("healthCheck %s -> %s", describeHealthCheck(current.HealthCheck), describeHealthCheck(spec.HealthCheck))
+		changed = true
+	}
+	if spec.BaseImage != current.BaseImage {
+		printChange("baseImage %s -> %s", describeBaseImage(current.BaseImage), describeBaseImage(spec.BaseImage))
+		changed = true
+	}
+	if spec.Image != "" && spec.Image != current.Image {
+		printChange("image %s -> %s", describeImage(current.Image), spec.Image)
+		changed = true
+	}
+	if spec.ApplicationPort() != current.ApplicationPort() {
+		printChange("containerPort %d -> %d", current.ApplicationPort(), spec.ApplicationPort())
+		changed = true
+	}
+	if spec.Network != current.Network {
+		printChange("network %s -> %s", describeNetwork(current.Network), describeNetwork(spec.Network))
+		changed = true
+	}
+	return spec, changed
+}
+
+func printAddition(format string, a ...interface{}) {
+	color.Green("  + "+format, a...)
+}
+
+func printRemoval(format string, a ...interface{}) {
+	color.Red("  - "+format, a...)
+}
+
+func printChange(format string, a ...interface{}) {
+	color.Yellow("  ~ "+format, a...)
+}
+
+func describeResources(resources mds.ResourceLimits) string {
+	if resources == (mds.ResourceLimits{}) {
+		return "(unlimited)"
+	}
+	var limits []string
+	if resources.MemoryMB > 0 {
+		limits = append(limits, fmt.Sprintf("memory=%dMB", resources.MemoryMB))
+	}
+	if resources.CPUShares > 0 {
+		limits = append(limits, fmt.Sprintf("cpuShares=%d", resources.CPUShares))
+	}
+	return strings.Join(limits, " ")
+}
+
+func describeHealthCheck(check *mds.HealthCheck) string {
+	if check == nil {
+		return "(none)"
+	}
+	return fmt.Sprintf("GET %s every %ds, timeout %ds, %d retries", check.Path, check.Interval, check.Timeout, check.Retries)
+}
+
+func describeBaseImage(image string) string {
+	if image == "" {
+		return "(from Node version)"
+	}
+	return image
+}
+
+func describeNetwork(network string) string {
+	if network == "" {
+		return "(own network only)"
+	}
+	return network
+}
+
+func describeImage(image string) string {
+	if image == "" {
+		return "(uploaded tarball)"
+	}
+	return image
+}
+
+//sortedNames Gets the names of a map of variables in order
+func sortedNames(variables map[string]string) []string {
+	var names []string
+	for name := range variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
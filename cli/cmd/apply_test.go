@@ -0,0 +1,147 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+const testSettings = `{"public":{}}`
+
+//testManifest A manifest matching the deployment of testDeployment
+func testManifest() *Manifest {
+	return &Manifest{
+		Name:      "app",
+		Domains:   []string{"app.example.com", "www.example.com"},
+		Bundle:    "app.tar.gz",
+		Settings:  "settings.json",
+		Env:       map[string]string{"MODE": "production"},
+		SecretEnv: map[string]string{"API_KEY": "abc"},
+	}
+}
+
+//testDeployment A deployment as the server describes it after testManifest was applied
+func testDeployment() (mds.DeploymentDetail, []mds.EnvironmentVariable) {
+	var detail mds.DeploymentDetail
+	detail.ID = 1
+	detail.ProjectName = "app"
+	detail.URL = "app.example.com"
+	detail.BundleChecksum = "0123"
+	detail.SettingsChecksum = checksumString(testSettings)
+	detail.Spec = testManifest().Spec()
+	variables := []mds.EnvironmentVariable{
+		{Name: "MODE", Value: "production"},
+		{Name: "API_KEY", Value: mds.RedactedValue, Secret: true},
+	}
+	return detail, variables
+}
+
+func TestPlanUpdate(t *testing.T) {
+	cases := []struct {
+		name           string
+		change         func(manifest *Manifest, detail *mds.DeploymentDetail)
+		bundleChecksum string
+		settings       string
+		updateSecrets  bool
+		changed        bool
+		bundle         bool
+		newSettings    *string
+		env            []string
+		secretEnv      []string
+		unset          []string
+		spec           bool
+	}{
+		{name: "unchanged", bundleChecksum: "0123", settings: testSettings},
+		{name: "image without a bundle", bundleChecksum: "", settings: testSettings},
+		{name: "new bundle", bundleChecksum: "4567", settings: testSettings, changed: true, bundle: true},
+		{name: "new settings", bundleChecksum: "0123", settings: `{"public":{"a":1}}`, changed: true, newSettings: strPointer(`{"public":{"a":1}}`)},
+		{name: "settings removed", bundleChecksum: "0123", settings: "", changed: true, newSettings: strPointer("")},
+		{name: "variable added", bundleChecksum: "0123", settings: testSettings, changed: true, env: []string{"DEBUG=1"}, change: func(m *Manifest, d *mds.DeploymentDetail) {
+			m.Env["DEBUG"] = "1"
+		}},
+		{name: "variable changed", bundleChecksum: "0123", settings: testSettings, changed: true, env: []string{"MODE=staging"}, change: func(m *Manifest, d *mds.DeploymentDetail) {
+			m.Env["MODE"] = "staging"
+		}},
+		{name: "variable unset", bundleChecksum: "0123", settings: testSettings, changed: true, unset: []string{"MODE"}, change: func(m *Manifest, d *mds.DeploymentDetail) {
+			delete(m.Env, "MODE")
+		}},
+		{name: "variable becomes secret", bundleChecksum: "0123", settings: testSettings, changed: true, secretEnv: []string{"MODE=production"}, change: func(m *Manifest, d *mds.DeploymentDetail) {
+			delete(m.Env, "MODE")
+			m.SecretEnv["MODE"] = "production"
+		}},
+		{name: "secret no longer secret", bundleChecksum: "0123", settings: testSettings, changed: true, env: []string{"API_KEY=abc"}, change: func(m *Manifest, d *mds.DeploymentDetail) {
+			delete(m.SecretEnv, "API_KEY")
+			m.Env["API_KEY"] = "abc"
+		}},
+		{name: "secrets sent again", bundleChecksum: "0123", settings: testSettings, updateSecrets: true, changed: true, secretEnv: []string{"API_KEY=abc"}},
+		{name: "alias added", bundleChecksum: "0123", settings: testSettings, changed: true, spec: true, change: func(m *Manifest, d *mds.DeploymentDetail) {
+			m.Domains = append(m.Domains, "api.example.com")
+		}},
+		{name: "resources changed", bundleChecksum: "0123", settings: testSettings, changed: true, spec: true, change: func(m *Manifest, d *mds.DeploymentDetail) {
+			m.Resources.Memory = 512
+		}},
+		{name: "health check added", bundleChecksum: "0123", settings: testSettings, changed: true, spec: true, change: func(m *Manifest, d *mds.DeploymentDetail) {
+			m.HealthCheck = &manifestHealthCheck{Path: "/health"}
+		}},
+		{name: "image changed", bundleChecksum: "", settings: testSettings, changed: true, spec: true, change: func(m *Manifest, d *mds.DeploymentDetail) {
+			m.Image = "app:2"
+			d.Spec.Image = "app:1"
+		}},
+		{name: "image left out", bundleChecksum: "", settings: testSettings, change: func(m *Manifest, d *mds.DeploymentDetail) {
+			d.Spec.Image = "app:1"
+		}},
+		{name: "default container port", bundleChecksum: "0123", settings: testSettings, change: func(m *Manifest, d *mds.DeploymentDetail) {
+			m.ContainerPort = mds.DefaultContainerPort
+		}},
+		{name: "network changed", bundleChecksum: "0123", settings: testSettings, changed: true, spec: true, change: func(m *Manifest, d *mds.DeploymentDetail) {
+			m.Network = "team"
+		}},
+	}
+	defer func() { applyUpdateSecrets = false }()
+	for _, c := range cases {
+		manifest := testManifest()
+		detail, variables := testDeployment()
+		if c.change != nil {
+			c.change(manifest, &detail)
+		}
+		applyUpdateSecrets = c.updateSecrets
+		request, changed := planUpdate(manifest, detail, variables, c.bundleChecksum, c.settings)
+		if changed != c.changed {
+			t.Errorf("%s: expected changed to be %v", c.name, c.changed)
+		}
+		if (request.BundlePath != "") != c.bundle {
+			t.Errorf("%s: unexpected bundle %q", c.name, request.BundlePath)
+		}
+		if !reflect.DeepEqual(request.Settings, c.newSettings) {
+			t.Errorf("%s: unexpected settings %v", c.name, request.Settings)
+		}
+		if strings.Join(request.Env, ",") != strings.Join(c.env, ",") || strings.Join(request.SecretEnv, ",") != strings.Join(c.secretEnv, ",") || strings.Join(request.Unset, ",") != strings.Join(c.unset, ",") {
+			t.Errorf("%s: unexpected variables %v %v unset %v", c.name, request.Env, request.SecretEnv, request.Unset)
+		}
+		if (request.Spec != nil) != c.spec {
+			t.Errorf("%s: unexpected spec %+v", c.name, request.Spec)
+		} else if c.spec && !reflect.DeepEqual(*request.Spec, manifest.Spec()) {
+			t.Errorf("%s: expected the spec of the manifest, got %+v", c.name, *request.Spec)
+		}
+	}
+}
+
+func strPointer(value string) *string {
+	return &value
+}
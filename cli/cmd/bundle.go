@@ -0,0 +1,154 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+//ignoreFileName File in a project directory listing what to leave out of the uploaded bundle
+const ignoreFileName = ".mdsignore"
+
+//isMeteorProject Checks for the .meteor/release file every Meteor project has
+func isMeteorProject(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, ".meteor", "release"))
+	return err == nil
+}
+
+//buildMeteorBundle Runs meteor build for the project in dir and returns the path of the tarball it wrote to outputDir.
+//The output of meteor is passed through to stderr.
+func buildMeteorBundle(dir string, outputDir string) (string, error) {
+	meteor, err := exec.LookPath("meteor")
+	if err != nil {
+		return "", errors.New("meteor was not found in PATH, install it or pass --bundle")
+	}
+	build := exec.Command(meteor, "build", outputDir, "--server-only")
+	build.Dir = dir
+	build.Stdout = os.Stderr
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		return "", fmt.Errorf("meteor build failed: %s", err.Error())
+	}
+	tarballs, err := filepath.Glob(filepath.Join(outputDir, "*.tar.gz"))
+	if err != nil {
+		return "", err
+	}
+	if len(tarballs) != 1 {
+		return "", fmt.Errorf("Expected meteor build to write one tarball to %s, found %d", outputDir, len(tarballs))
+	}
+	return tarballs[0], nil
+}
+
+//readIgnoreFile Reads the patterns in the .mdsignore of a project. Blank lines and lines starting with # are skipped.
+//Returns no patterns if the file does not exist.
+func readIgnoreFile(dir string) ([]string, error) {
+	f, err := os.Open(filepath.Join(dir, ignoreFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern := strings.TrimSuffix(line, "/")
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid pattern '%s' in %s", line, ignoreFileName)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, scanner.Err()
+}
+
+//isIgnored Checks a path inside the bundle directory against .mdsignore patterns.
+//Patterns without a slash match a file or directory name anywhere, like in .gitignore.
+//Patterns with a slash match from the top of the bundle. Everything inside a matched directory is ignored.
+func isIgnored(name string, patterns []string) bool {
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	for _, pattern := range patterns {
+		anchored := strings.Contains(pattern, "/")
+		pattern = strings.TrimPrefix(pattern, "/")
+		for i := range parts {
+			candidate := parts[i]
+			if anchored {
+				candidate = strings.Join(parts[:i+1], "/")
+			}
+			if matched, _ := path.Match(pattern, candidate); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//filterBundle Copies a bundle tarball to outputPath without the entries that match patterns.
+//Paths are matched relative to the bundle directory at the top of the tarball. Returns how many entries were left out.
+func filterBundle(bundlePath string, outputPath string, patterns []string) (int, error) {
+	in, err := os.Open(bundlePath)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	gzipReader, err := gzip.NewReader(in)
+	if err != nil {
+		return 0, err
+	}
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	gzipWriter := gzip.NewWriter(out)
+	tarWriter := tar.NewWriter(gzipWriter)
+	tarReader := tar.NewReader(gzipReader)
+	skipped := 0
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return skipped, err
+		}
+		if isIgnored(strings.TrimPrefix(path.Clean(header.Name), "bundle/"), patterns) {
+			skipped++
+			continue
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return skipped, err
+		}
+		if _, err := io.Copy(tarWriter, tarReader); err != nil {
+			return skipped, err
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return skipped, err
+	}
+	return skipped, gzipWriter.Close()
+}
@@ -21,69 +21,58 @@
 package cmd
 
 import (
-	"bufio"
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"net/http"
-	"net/url"
 	"os"
-	"strconv"
-	"strings"
-	"syscall"
 
 	"github.com/spf13/viper"
 
 	"github.com/spf13/cobra"
+	"github.com/twa16/meteor-deploy-system/client"
 	"github.com/twa16/meteor-deploy-system/common"
-	"golang.org/x/crypto/ssh/terminal"
-	"crypto/tls"
 )
 
+var connectUsername string
+var connectPasswordStdin bool
+var connectInsecure bool
+
 // connectCmd represents the connect command
 var connectCmd = &cobra.Command{
 	Use:   "connect",
 	Short: "Connect the mds cli to a server",
 	Long: `Use this command to specify how to connect to an MDS server
 	connect [hostname]
+
+Anything not given as a flag is asked for when running in a terminal. Scripts can pass
+--username (or set MDS_USERNAME), --password-stdin (or set MDS_PASSWORD) and --insecure.
 	`,
 	Run: func(cmd *cobra.Command, args []string) {
-		reader := bufio.NewReader(os.Stdin)
 		var host string
-		if len(args) == 0 {
-			fmt.Print("Enter Host: ")
-			host, _ = reader.ReadString('\n')
-			host = strings.TrimSpace(host)
-		} else {
+		if len(args) > 0 {
 			host = args[0]
 		}
+		host = requireValue(host, "Enter Host: ", "hostname", isInteractive())
 		if viper.GetString("AuthToken") != "" {
 			fmt.Println("Session exists.")
 			return
 		}
 		fmt.Println("Attempting to connect to: " + host)
-		data := url.Values{}
-
-
 
 		//Get credentials
-		username, password := credentials()
-		data.Set("username", username)
-		data.Add("password", password)
-		data.Add("persistent", "false")
-
-		//Check to see if we should ignore SSL errors
-		ignoreSSL := false
-		for true {
-			fmt.Print("\nIgnore SSL Errors (true/false)? ")
-			ignoreSSLString, _ := reader.ReadString('\n')
-			ignoreSSLString = strings.TrimSpace(ignoreSSLString)
-			if ignoreSSLString != "true" && ignoreSSLString != "false" {
+		username, password := credentials(connectUsername, connectPasswordStdin)
+		data := mds.LoginRequest{Username: username, Password: password, Persistent: false}
+
+		//Check to see if we should ignore SSL errors, only asking if the flag was left out
+		ignoreSSL := connectInsecure
+		if !cmd.Flags().Changed("insecure") && isInteractive() {
+			for {
+				ignoreSSLString := prompt("\nIgnore SSL Errors (true/false)? ")
+				if ignoreSSLString == "true" || ignoreSSLString == "false" {
+					ignoreSSL = ignoreSSLString == "true"
+					break
+				}
 				fmt.Println("Please enter true or false")
-			} else if ignoreSSLString == "true" {
-				ignoreSSL = true
-				break
 			}
 		}
 
@@ -91,55 +80,18 @@ var connectCmd = &cobra.Command{
 	},
 }
 
-func credentials() (string, string) {
-	reader := bufio.NewReader(os.Stdin)
-
-	fmt.Print("Enter Username: ")
-	username, _ := reader.ReadString('\n')
-
-	fmt.Print("Enter Password: ")
-	bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
-	if err != nil {
-		panic("Failed to get password")
+//credentials Gets the username and password from the flags, the environment or prompts
+func credentials(username string, passwordStdin bool) (string, string) {
+	if username == "" {
+		username = os.Getenv(usernameEnvironmentVariable)
 	}
-	password := string(bytePassword)
-
-	return strings.TrimSpace(username), strings.TrimSpace(password)
+	username = requireValue(username, "Enter Username: ", "--username", isInteractive())
+	return username, readPassword(passwordStdin)
 }
 
-func login(hostname string, data url.Values, secure bool, ignoreSSL bool) {
-	//Let's build the url
-	urlString := hostname + "/login"
-	//Check if the connection should be secure and prepend the proper protocol
-	if secure {
-		urlString = "https://" + urlString
-	} else {
-		urlString = "http://" + urlString
-	}
-	//Create the client
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: ignoreSSL},
-	}
-	client := &http.Client{Transport: tr}
-	r, _ := http.NewRequest("POST", urlString, bytes.NewBufferString(data.Encode())) // <-- URL-encoded payload
-	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	r.Header.Add("Content-Length", strconv.Itoa(len(data.Encode())))
-
-	//Send the data and get the response
-	resp, err := client.Do(r)
-	if err != nil {
-		fmt.Errorf("Error Connecting to Daemon: %s\n", err.Error())
-		os.Exit(1)
-	}
-	//Get the body of the response as a string
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-	//Convert the JSON into an AutenticationToken struct
-	var authenticationToken mds.AuthenticationToken
-	if err = json.Unmarshal(buf.Bytes(), &authenticationToken); err != nil {
-		fmt.Errorf("Error Processing Session Response: %s\n", err.Error())
-		os.Exit(1)
-	}
+func login(hostname string, data mds.LoginRequest, secure bool, ignoreSSL bool) {
+	authenticationToken, err := client.New(hostname, secure, ignoreSSL).Login(data.Username, data.Password, data.Persistent)
+	exitOnError("Login Failed", err)
 	viper.Set("AuthenticationToken", authenticationToken.AuthenticationToken)
 	sessionRecord := SessionRecord{}
 	sessionRecord.Token = authenticationToken.AuthenticationToken
@@ -157,6 +109,10 @@ func login(hostname string, data url.Values, secure bool, ignoreSSL bool) {
 func init() {
 	RootCmd.AddCommand(connectCmd)
 
+	connectCmd.Flags().StringVarP(&connectUsername, "username", "u", "", "Username to log in with, defaults to $"+usernameEnvironmentVariable)
+	connectCmd.Flags().BoolVar(&connectPasswordStdin, "password-stdin", false, "Read the password from the first line of stdin instead of $"+passwordEnvironmentVariable+" or a prompt")
+	connectCmd.Flags().BoolVar(&connectInsecure, "insecure", false, "Do not verify the certificate of the server")
+
 	// Here you will define your flags and configuration settings.
 
 	// Cobra supports Persistent Flags which will work for this command
@@ -0,0 +1,78 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+// startCmd represents the deployment start command
+var startCmd = &cobra.Command{
+	Use:   "start [deployment id]",
+	Short: "Start a stopped deployment",
+	Long:  `Starts the MongoDB container of a deployment, if the daemon manages one, and then its application container.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		controlDeployment(cmd, args, "start", func(id uint) (mds.DeploymentDetail, error) {
+			return newClient().StartDeployment(id)
+		})
+	},
+}
+
+// stopCmd represents the deployment stop command
+var stopCmd = &cobra.Command{
+	Use:   "stop [deployment id]",
+	Short: "Stop a deployment without deleting it",
+	Long:  `Stops the application container of a deployment and then its MongoDB container. Nothing is removed, use start to bring it back.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		controlDeployment(cmd, args, "stop", func(id uint) (mds.DeploymentDetail, error) {
+			return newClient().StopDeployment(id)
+		})
+	},
+}
+
+// restartCmd represents the deployment restart command
+var restartCmd = &cobra.Command{
+	Use:   "restart [deployment id]",
+	Short: "Restart a deployment",
+	Long:  `Stops and then starts the containers of a deployment.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		controlDeployment(cmd, args, "restart", func(id uint) (mds.DeploymentDetail, error) {
+			return newClient().RestartDeployment(id)
+		})
+	},
+}
+
+func init() {
+	deploymentCmd.AddCommand(startCmd)
+	deploymentCmd.AddCommand(stopCmd)
+	deploymentCmd.AddCommand(restartCmd)
+}
+
+//controlDeployment Runs a start, stop or restart command and prints the resulting status
+func controlDeployment(cmd *cobra.Command, args []string, action string, send func(uint) (mds.DeploymentDetail, error)) {
+	if len(args) != 1 {
+		cmd.Help()
+		os.Exit(1)
+	}
+	detail, err := send(parseDeploymentID(args[0]))
+	exitOnError("Failed to "+action+" deployment", err)
+	printResource(detail, func(wide bool) {
+		color.Green("Deployment %d (%s) is now %s", detail.ID, detail.ProjectName, detail.Status)
+	})
+}
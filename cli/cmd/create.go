@@ -22,27 +22,38 @@ package cmd
 
 import (
 	"fmt"
-
-	"github.com/spf13/cobra"
-	"net/http"
-	"bytes"
-	"github.com/spf13/viper"
-	"mime/multipart"
+	"io/ioutil"
 	"os"
-	"io"
-	"net/url"
-	"bufio"
 	"strings"
+
 	"github.com/k0kubun/pp"
-	"io/ioutil"
-	"crypto/tls"
+	"github.com/spf13/cobra"
+	"github.com/twa16/meteor-deploy-system/client"
+	"github.com/twa16/meteor-deploy-system/common"
 )
 
+var detachCreate bool
+var createSecretEnvVars []string
+var createProjectName string
+var createSettingsPath string
+var createEnvVars []string
+var createAssumeYes bool
+var createType string
+var createImage string
+var createContainerPort int
+var createNetwork string
+
 // createCmd represents the create command
 var createCmd = &cobra.Command{
 	Use:   "create [path to tarball] [path to settings.json]",
 	Short: "Create a deployment",
-	Long: `Creates a deployment on the MDS server`,
+	Long: `Creates a deployment on the MDS server.
+
+When running in a terminal anything missing is asked for. With --yes, or without a terminal,
+nothing is asked: the tarball and --name are required and the settings and variables are optional.
+
+A docker image can be deployed instead of a Meteor bundle. With --image the server runs an image
+from a registry and no tarball is needed. With --type image the tarball is an image written by docker save.`,
 	Run: func(cmd *cobra.Command, args []string) {
 
 		type ProjectData struct {
@@ -51,185 +62,126 @@ var createCmd = &cobra.Command{
 			settingsPath string
 			envVars []string
 		}
-		var project ProjectData
+		project := ProjectData{projectName: createProjectName, settingsPath: createSettingsPath, envVars: createEnvVars}
 		//Check if the files have been passed as parameters
 		if len(args) > 0 {
-			if len(args) > 0 {
-				project.tarballPath = args[0]
-				if _, err := os.Stat(project.tarballPath); os.IsNotExist(err) {
-					fmt.Println("The specified project tarball does not exist")
-				}
-			}
-			if len(args) > 1 {
-				project.settingsPath = args[1]
-				if _, err := os.Stat(project.settingsPath); os.IsNotExist(err) {
-					fmt.Println("The specified settings file does not exist")
-				}
+			project.tarballPath = args[0]
+		}
+		if len(args) > 1 {
+			project.settingsPath = args[1]
+		}
+		interactive := isInteractive() && !createAssumeYes
+		if createImage != "" {
+			createType = mds.DeploymentTypeImage
+			if project.tarballPath != "" {
+				fmt.Println("Either deploy an image with --image or upload a tarball, not both")
+				os.Exit(1)
 			}
 		}
 
-		//Get input for other parameters
-		reader := bufio.NewReader(os.Stdin)
-
 		//Get file paths if needed
-		if project.tarballPath == "" {
-			fmt.Print("Path to Tarball: ")
-			project.tarballPath, _ = reader.ReadString('\n')
-			project.tarballPath = strings.TrimSpace(project.tarballPath)
+		if createImage == "" {
+			project.tarballPath = requireValue(project.tarballPath, "Path to Tarball: ", "path to tarball", interactive)
 			if _, err := os.Stat(project.tarballPath); os.IsNotExist(err) {
 				fmt.Println("The specified project tarball does not exist")
+				os.Exit(1)
 			}
 		}
-		if project.settingsPath == "" {
-			fmt.Print("Path to Settings Json(optional): ")
-			project.settingsPath, _ = reader.ReadString('\n')
-			project.settingsPath = strings.TrimSpace(project.settingsPath)
-			if project.settingsPath != "" {
-				if _, err := os.Stat(project.settingsPath); os.IsNotExist(err) {
-					fmt.Println("The specified project tarball does not exist")
-				}
+		if project.settingsPath == "" && interactive {
+			project.settingsPath = prompt("Path to Settings Json(optional): ")
+		}
+		if project.settingsPath != "" {
+			if _, err := os.Stat(project.settingsPath); os.IsNotExist(err) {
+				fmt.Println("The specified settings file does not exist")
+				os.Exit(1)
 			}
 		}
 
 		//Get Project Name
-		fmt.Print("Enter Project Name: ")
-		project.projectName, _ = reader.ReadString('\n')
-		project.projectName = strings.TrimSpace(project.projectName)
-
-		//Get Env Variables
-		fmt.Println("Please enter environmental variables as KEY=VALUE. If you are finished, enter 'done' as the value.")
-		//Loop until the user is done
-		for true {
-			fmt.Print("Enter EnvVar(KEY=VALUE): ")
-			envVar, _ := reader.ReadString('\n')
-			envVar = strings.TrimSpace(envVar)
-			//Check if the input is our escape word
-			if strings.ToLower(envVar) == "done" {
-				break
-			}
-			//Ignore blanks
-			if envVar != "" {
-				//Otherwise, add it to our array
-				project.envVars = append(project.envVars, envVar)
-				//Print what has been entered
-				fmt.Println("Current Env Vars:")
-				for _, val := range(project.envVars) {
-					fmt.Println("  "+val)
+		project.projectName = requireValue(project.projectName, "Enter Project Name: ", "--name", interactive)
+
+		//Get Env Variables, unless they were given as flags
+		if len(project.envVars) == 0 && interactive {
+			fmt.Println("Please enter environmental variables as KEY=VALUE. If you are finished, enter 'done' as the value.")
+			//Loop until the user is done
+			for true {
+				envVar := prompt("Enter EnvVar(KEY=VALUE): ")
+				//Check if the input is our escape word
+				if strings.ToLower(envVar) == "done" {
+					break
+				}
+				//Ignore blanks
+				if envVar != "" {
+					//Otherwise, add it to our array
+					project.envVars = append(project.envVars, envVar)
+					//Print what has been entered
+					fmt.Println("Current Env Vars:")
+					for _, val := range(project.envVars) {
+						fmt.Println("  "+val)
+					}
+					fmt.Print("\nEnter 'done' when finished.\n\n")
 				}
-				fmt.Print("\nEnter 'done' when finished.\n\n")
 			}
 		}
 
-		pp.Println(project)
-		fmt.Print("Do you wish to create this project. Please type in 'yes' or 'no': ")
-		input, _ := reader.ReadString('\n')
-		if strings.TrimSpace(input) == "yes" {
-			fmt.Print("Processing Settings File ")
+		if interactive {
+			pp.Println(project)
+		}
+		if !confirm("Do you wish to create this project?", createAssumeYes) {
+			return
+		}
+		//Settings are optional
+		settings := ""
+		if project.settingsPath != "" {
+			statusf("Processing Settings File ")
 			settingBytes, err := ioutil.ReadFile(project.settingsPath)
 			if err != nil {
 				fmt.Println("     FAIL!")
 				fmt.Println("Error: "+err.Error())
-				return
+				os.Exit(1)
 			}
-			fmt.Println("     OK.")
-
-			createDeployment(project.tarballPath, project.projectName, string(settingBytes), project.envVars)
+			statusf("     OK.\n")
+			settings = string(settingBytes)
 		}
+
+		createDeployment(project.tarballPath, project.projectName, settings, project.envVars)
 	},
 }
 
 func createDeployment(pathToTarball string, projectName string, settings string, envVars []string) {
-	//Let's build the url
-	hostname := viper.GetString("ServerHostname")
-	isSecure := viper.GetBool("UseHTTPS")
-	authToken := viper.GetString("AuthenticationToken")
-
-	urlString := hostname + "/deployment"
-	//Check if the connection should be secure and prepend the proper protocol
-	if isSecure {
-		urlString = "https://" + urlString
-	} else {
-		urlString = "http://" + urlString
-	}
-
-	//Parse URL
-	reqURL, err := url.Parse(urlString)
-	if err != nil {
-		fmt.Println("Invalid URL Specified!")
-		return
-	}
-
-	//Store projectname in URL
-	q := reqURL.Query()
-	q.Add("projectname", projectName)
-	//Store the file and settings as byte buffer for body
-	data, fw := createForm(settings, pathToTarball, envVars)
-
-	//Create the client
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: viper.GetBool("IgnoreSSLErrors")},
-	}
-	client := &http.Client{Transport: tr}
-	r, _ := http.NewRequest("POST", urlString, data)
-	r.URL.RawQuery = q.Encode()
-	r.Header.Add("Content-Type", fw.FormDataContentType())
-	r.Header.Add("X-Auth-Token", authToken)
-	fmt.Println("Creating Deployment...")
-	resp, err := client.Do(r)
-	if err != nil {
-		fmt.Println("Failed to create deployment")
-		fmt.Errorf("Error: %s\n", err.Error())
-		os.Exit(1)
-	}
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-	fmt.Println("output: "+buf.String())
-}
-
-func createForm(settings string, file string, envVars []string) (*bytes.Buffer, *multipart.Writer) {
-	// Prepare a form that you will submit to that URL.
-	var b bytes.Buffer
-	w := multipart.NewWriter(&b)
-	// Add your image file
-	f, err := os.Open(file)
-	if err != nil {
-		return nil, w
-	}
-	defer f.Close()
-	fw, err := w.CreateFormFile("uploadfile", file)
-	if err != nil {
-		return nil, w
-	}
-	if _, err = io.Copy(fw, f); err != nil {
-		return nil, w
-	}
-	// Add the settings
-	if fw, err = w.CreateFormField("settings"); err != nil {
-		return nil, w
-	}
-	if _, err = fw.Write([]byte(settings)); err != nil {
-		return nil, w
+	statusf("Uploading Deployment...\n")
+	request := client.CreateDeploymentRequest{
+		ProjectName: projectName,
+		Type:        createType,
+		BundlePath:  pathToTarball,
+		Settings:    settings,
+		Env:         envVars,
+		SecretEnv:   createSecretEnvVars,
+		Progress:    uploadProgress(),
 	}
-
-	//Add any env vars
-	for _, envVar := range(envVars) {
-		if fw, err = w.CreateFormField("Env-Var"); err != nil {
-			return nil, w
-		}
-		if _, err = fw.Write([]byte(envVar)); err != nil {
-			return nil, w
-		}
+	if createImage != "" || createContainerPort != 0 || createNetwork != "" {
+		request.Spec = &mds.DeploymentSpec{Image: createImage, ContainerPort: createContainerPort, Network: createNetwork}
 	}
-
-	// Don't forget to close the multipart writer.
-	// If you don't close it, your request will be missing the terminating boundary.
-	w.Close()
-	return &b, w
+	job, err := newClient().CreateDeployment(request)
+	exitOnError("Failed to create deployment", err)
+	//The server creates the deployment in a background job
+	waitForSubmittedJob(job, detachCreate)
 }
 
 func init() {
 	deploymentCmd.AddCommand(createCmd)
 
+	createCmd.Flags().BoolVar(&detachCreate, "detach", false, "Return once the job is submitted instead of following its progress")
+	createCmd.Flags().StringArrayVar(&createSecretEnvVars, "secret-env", nil, "Secret environment variable as KEY=VALUE whose value is hidden from listings and logs, can be repeated")
+	createCmd.Flags().StringVar(&createProjectName, "name", "", "Name of the project")
+	createCmd.Flags().StringVar(&createSettingsPath, "settings", "", "Path to settings.json, instead of the second argument")
+	createCmd.Flags().StringArrayVar(&createEnvVars, "env", nil, "Environment variable as KEY=VALUE, can be repeated")
+	createCmd.Flags().BoolVarP(&createAssumeYes, "yes", "y", false, "Do not ask for anything, fail if something required is missing")
+	createCmd.Flags().StringVar(&createType, "type", "", "bundle for a Meteor bundle, the default, or image for a tarball written by docker save")
+	createCmd.Flags().StringVar(&createImage, "image", "", "Image reference to deploy from a registry instead of a tarball")
+	createCmd.Flags().IntVar(&createContainerPort, "container-port", 0, "Port the application listens on inside its container, 80 if not set")
+	createCmd.Flags().StringVar(&createNetwork, "network", "", "Shared network to join, where deployments on it reach each other by project name")
+
 	// Here you will define your flags and configuration settings.
 
 	// Cobra supports Persistent Flags which will work for this command
@@ -0,0 +1,282 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/client"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+var deployName string
+var deployBundlePath string
+var deploySettingsPath string
+var deployEnvVars []string
+var deploySecretEnvVars []string
+var detachDeploy bool
+
+//localDeployConfigPath Where deploy remembers the deployment of a project, relative to the project directory.
+//Meteor leaves directories starting with a dot out of the build.
+const localDeployConfigPath = ".mds/deploy.json"
+
+//localDeployConfig The deployment a project directory was last deployed to
+type localDeployConfig struct {
+	Server       string //Hostname of the server the deployment is on
+	DeploymentID uint   //0 until the deployment has been created
+	ProjectName  string
+	Settings     string `json:",omitempty"` //Path to settings.json relative to the project directory
+}
+
+// deployCmd represents the deploy command
+var deployCmd = &cobra.Command{
+	Use:   "deploy [project directory]",
+	Short: "Build a Meteor project and deploy it",
+	Long: `Runs meteor build --server-only in a Meteor project directory, the current one by default, and uploads the result.
+The first deploy creates a deployment named after the directory, or --name. The deployment is remembered in
+.mds/deploy.json so later deploys of the same directory update it.
+
+Use --bundle to upload an existing tarball instead of building. Entries of the bundle matching the patterns
+in .mdsignore are left out, for example:
+  # Any file or directory with this name
+  *.map
+  # A path from the top of the bundle
+  programs/web.browser/app/videos`,
+	Run: func(cmd *cobra.Command, args []string) {
+		dir := "."
+		if len(args) > 0 {
+			dir = args[0]
+		}
+		dir, err := filepath.Abs(dir)
+		exitOnError("Invalid project directory", err)
+		config, err := readLocalDeployConfig(dir)
+		exitOnError("Failed to read "+localDeployConfigPath, err)
+		server := viper.GetString("ServerHostname")
+		if config.Server != "" && config.Server != server {
+			statusf("%s points at %s, not the connected server %s. A new deployment will be looked for.\n", localDeployConfigPath, config.Server, server)
+			config = localDeployConfig{ProjectName: config.ProjectName, Settings: config.Settings}
+		}
+		config.Server = server
+		if deployName != "" {
+			config.ProjectName = deployName
+		} else if config.ProjectName == "" {
+			config.ProjectName = filepath.Base(dir)
+		}
+		if deploySettingsPath != "" {
+			config.Settings = relativeToProject(dir, deploySettingsPath)
+		}
+		settings := ""
+		if config.Settings != "" {
+			//Settings outside the project are remembered by their absolute path
+			settingsPath := config.Settings
+			if !filepath.IsAbs(settingsPath) {
+				settingsPath = filepath.Join(dir, settingsPath)
+			}
+			settingBytes, err := ioutil.ReadFile(settingsPath)
+			exitOnError("Failed to read settings file", err)
+			settings = string(settingBytes)
+		}
+
+		//Build into a temporary directory that is removed once the bundle is uploaded
+		workDir, err := ioutil.TempDir("", "mds-deploy")
+		exitOnError("Failed to create build directory", err)
+		bundlePath, err := prepareBundle(dir, workDir)
+		if err != nil {
+			os.RemoveAll(workDir)
+			exitOnError("Failed to prepare bundle", err)
+		}
+
+		apiClient := newClient()
+		deploymentID, err := findDeployTarget(apiClient, config)
+		if err != nil {
+			os.RemoveAll(workDir)
+			exitOnError("Failed to find deployment", err)
+		}
+		var job mds.Job
+		if deploymentID == 0 {
+			statusf("Creating deployment %s\n", config.ProjectName)
+			job, err = apiClient.CreateDeployment(client.CreateDeploymentRequest{
+				ProjectName: config.ProjectName,
+				BundlePath:  bundlePath,
+				Settings:    settings,
+				Env:         deployEnvVars,
+				SecretEnv:   deploySecretEnvVars,
+				Progress:    uploadProgress(),
+			})
+		} else {
+			statusf("Updating deployment %d (%s)\n", deploymentID, config.ProjectName)
+			request := client.UpdateDeploymentRequest{BundlePath: bundlePath, Env: deployEnvVars, SecretEnv: deploySecretEnvVars, Progress: uploadProgress()}
+			if settings != "" {
+				request.Settings = &settings
+			}
+			job, err = apiClient.UpdateDeployment(deploymentID, request)
+		}
+		os.RemoveAll(workDir)
+		exitOnError("Failed to upload bundle", err)
+
+		//Remembered before following so a detached or interrupted deploy still finds the deployment by name next time
+		config.DeploymentID = deploymentID
+		exitOnError("Failed to save "+localDeployConfigPath, writeLocalDeployConfig(dir, config))
+		waitForSubmittedJob(job, detachDeploy)
+		if deploymentID == 0 && !detachDeploy {
+			finished, err := apiClient.GetJob(job.ID)
+			exitOnError("Failed to get job", err)
+			config.DeploymentID = finished.DeploymentID
+			exitOnError("Failed to save "+localDeployConfigPath, writeLocalDeployConfig(dir, config))
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(deployCmd)
+
+	deployCmd.Flags().StringVar(&deployName, "name", "", "Name of the deployment, defaults to the remembered name or the directory name")
+	deployCmd.Flags().StringVar(&deployBundlePath, "bundle", "", "Upload this tarball instead of running meteor build")
+	deployCmd.Flags().StringVar(&deploySettingsPath, "settings", "", "Path to settings.json, remembered for later deploys")
+	deployCmd.Flags().StringArrayVar(&deployEnvVars, "env", nil, "Environment variable to add or replace as KEY=VALUE, can be repeated")
+	deployCmd.Flags().StringArrayVar(&deploySecretEnvVars, "secret-env", nil, "Like --env but the value is hidden from listings and logs")
+	deployCmd.Flags().BoolVar(&detachDeploy, "detach", false, "Return once the job is submitted instead of following its progress")
+}
+
+//prepareBundle Builds the project, or takes --bundle, and applies .mdsignore. Returns the tarball to upload.
+func prepareBundle(dir string, workDir string) (string, error) {
+	bundlePath := deployBundlePath
+	if bundlePath == "" {
+		if !isMeteorProject(dir) {
+			return "", fmt.Errorf("%s is not a Meteor project (no .meteor/release), pass --bundle to upload a tarball", dir)
+		}
+		statusf("Building %s\n", dir)
+		buildDir := filepath.Join(workDir, "build")
+		if err := os.Mkdir(buildDir, 0700); err != nil {
+			return "", err
+		}
+		var err error
+		if bundlePath, err = buildMeteorBundle(dir, buildDir); err != nil {
+			return "", err
+		}
+	}
+	patterns, err := readIgnoreFile(dir)
+	if err != nil || len(patterns) == 0 {
+		return bundlePath, err
+	}
+	filteredPath := filepath.Join(workDir, "filtered.tar.gz")
+	skipped, err := filterBundle(bundlePath, filteredPath, patterns)
+	if err != nil {
+		return "", fmt.Errorf("Failed to apply %s: %s", ignoreFileName, err.Error())
+	}
+	statusf("Left out %d entries matching %s\n", skipped, ignoreFileName)
+	return filteredPath, nil
+}
+
+//findDeployTarget Gets the ID of the deployment to update, 0 if a new one should be created.
+//The remembered ID is used if it still exists, otherwise the deployment is looked up by name.
+func findDeployTarget(apiClient *client.Client, config localDeployConfig) (uint, error) {
+	if config.DeploymentID != 0 {
+		detail, err := apiClient.GetDeployment(config.DeploymentID)
+		if err == nil && detail.ProjectName == config.ProjectName {
+			return detail.ID, nil
+		} else if err != nil && !client.IsCode(err, mds.ErrorCodeNotFound) {
+			return 0, err
+		}
+	}
+	deployment, err := findDeploymentByName(apiClient, config.ProjectName)
+	if err != nil || deployment == nil {
+		return 0, err
+	}
+	return deployment.ID, nil
+}
+
+//uploadProgress Shows how much of the upload has been sent on stderr, nil with machine readable output
+func uploadProgress() client.UploadProgress {
+	if machineOutput() {
+		return nil
+	}
+	lastPercent := int64(-1)
+	return func(sent int64, total int64) {
+		if total <= 0 {
+			return
+		}
+		percent := sent * 100 / total
+		if percent == lastPercent {
+			return
+		}
+		lastPercent = percent
+		fmt.Fprintf(os.Stderr, "\rUploading %3d%% (%s of %s)", percent, formatBytes(sent), formatBytes(total))
+		if sent >= total {
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+}
+
+//formatBytes Formats a size for people
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+//relativeToProject Makes a path given on the command line relative to the project directory so it can be remembered
+func relativeToProject(dir string, path string) string {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	relative, err := filepath.Rel(dir, absolute)
+	//Only a leading .. element leaves the project, a file named ..settings.json is still inside it
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return absolute
+	}
+	return relative
+}
+
+//readLocalDeployConfig Reads the remembered deployment of a project, empty if it has never been deployed
+func readLocalDeployConfig(dir string) (localDeployConfig, error) {
+	var config localDeployConfig
+	configBytes, err := ioutil.ReadFile(filepath.Join(dir, localDeployConfigPath))
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(configBytes, &config)
+	return config, err
+}
+
+//writeLocalDeployConfig Remembers the deployment of a project
+func writeLocalDeployConfig(dir string, config localDeployConfig) error {
+	configPath := filepath.Join(dir, localDeployConfigPath)
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		return err
+	}
+	configBytes, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(configPath, append(configBytes, '\n'), 0644)
+}
@@ -0,0 +1,120 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+var detachEnv bool
+var secretEnv bool
+
+// envCmd represents the deployment env command
+var envCmd = &cobra.Command{
+	Use:   "env",
+	Short: "Manage the environment variables of a deployment",
+	Long: `Lists and changes the custom environment variables of a deployment. Each change recreates
+the application container from the bundle already on the server, nothing is uploaded again.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// envListCmd represents the deployment env list command
+var envListCmd = &cobra.Command{
+	Use:   "list [deployment id]",
+	Short: "List the environment variables of a deployment",
+	Long:  `Prints the custom environment variables of a deployment with their values. The values of secrets are hidden.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Help()
+			os.Exit(1)
+		}
+		variables, err := newClient().ListEnvironment(parseDeploymentID(args[0]))
+		exitOnError("Failed to get environment variables", err)
+		printResource(variables, func(wide bool) {
+			if len(variables) == 0 {
+				fmt.Println("No custom environment variables")
+				return
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			for _, variable := range variables {
+				if variable.Secret {
+					fmt.Fprintf(w, "%s\t%s\t(secret)\n", variable.Name, variable.Value)
+				} else {
+					fmt.Fprintf(w, "%s\t%s\n", variable.Name, variable.Value)
+				}
+			}
+			w.Flush()
+		})
+	},
+}
+
+// envSetCmd represents the deployment env set command
+var envSetCmd = &cobra.Command{
+	Use:   "set [deployment id] [KEY=VALUE]...",
+	Short: "Add or replace environment variables",
+	Long: `Adds or replaces environment variables of a deployment and recreates its container. Other variables are kept.
+Use --secret for passwords and API keys so their values are never shown again.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		changeEnvironment(cmd, args, false)
+	},
+}
+
+// envUnsetCmd represents the deployment env unset command
+var envUnsetCmd = &cobra.Command{
+	Use:   "unset [deployment id] [KEY]...",
+	Short: "Remove environment variables",
+	Long:  `Removes environment variables from a deployment and recreates its container. Other variables are kept.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		changeEnvironment(cmd, args, true)
+	},
+}
+
+func init() {
+	deploymentCmd.AddCommand(envCmd)
+	envCmd.AddCommand(envListCmd)
+	envCmd.AddCommand(envSetCmd)
+	envCmd.AddCommand(envUnsetCmd)
+
+	envSetCmd.Flags().BoolVar(&detachEnv, "detach", false, "Return once the job is submitted instead of following its progress")
+	envSetCmd.Flags().BoolVar(&secretEnv, "secret", false, "Hide the values from listings and logs")
+	envUnsetCmd.Flags().BoolVar(&detachEnv, "detach", false, "Return once the job is submitted instead of following its progress")
+}
+
+//changeEnvironment Sends a set or unset command and follows the redeploy
+func changeEnvironment(cmd *cobra.Command, args []string, unset bool) {
+	if len(args) < 2 {
+		cmd.Help()
+		os.Exit(1)
+	}
+	var change mds.EnvironmentChange
+	switch {
+	case unset:
+		change.Unset = args[1:]
+	case secretEnv:
+		change.SetSecret = args[1:]
+	default:
+		change.Set = args[1:]
+	}
+	job, err := newClient().ChangeEnvironment(parseDeploymentID(args[0]), change)
+	exitOnError("Failed to change environment variables", err)
+	waitForSubmittedJob(job, detachEnv)
+}
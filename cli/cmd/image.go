@@ -0,0 +1,115 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+var detachRefresh bool
+
+// imageCmd represents the image command
+var imageCmd = &cobra.Command{
+	Use:   "image",
+	Short: "Commands for the images the server keeps pulled",
+	Long: `The server pulls base images, MongoDB and the images of image deployments in the background, retries pulls
+that fail and pulls images with a tag again on a schedule to find newer versions.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// imageListCmd represents the image list command
+var imageListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the images the server keeps pulled",
+	Long:  `Shows every image the server keeps pulled, how far a running pull got and why the last pull failed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		images, err := newClient().ListImages()
+		exitOnError("Failed to list images", err)
+		printResource(images, func(wide bool) {
+			table := tablewriter.NewWriter(os.Stdout)
+			header := []string{"Image", "State", "Deployments", "Next Check"}
+			if wide {
+				header = append(header, "Digest", "Checked")
+			}
+			table.SetHeader(header)
+			for _, image := range images {
+				var deployments []string
+				for _, id := range image.Deployments {
+					deployments = append(deployments, strconv.Itoa(int(id)))
+				}
+				line := []string{image.Reference, describeImageState(image), strings.Join(deployments, ", "), formatOptionalTime(image.NextCheckAt)}
+				if wide {
+					line = append(line, image.Digest, formatOptionalTime(image.CheckedAt))
+				}
+				table.Append(line)
+			}
+			table.Render()
+		})
+	},
+}
+
+// imageRefreshCmd represents the image refresh command
+var imageRefreshCmd = &cobra.Command{
+	Use:   "refresh [deployment ids...]",
+	Short: "Recreate deployments with the newest version of their image",
+	Long: `Pulls the images of deployments and recreates every deployment running an outdated image, or the
+deployments given, one after another. The next deployment is only recreated once the previous one is running,
+and healthy if it has a health check. The first deployment that fails stops the refresh.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var request mds.ImageRefreshRequest
+		for _, arg := range args {
+			request.Deployments = append(request.Deployments, parseDeploymentID(arg))
+		}
+		job, err := newClient().RefreshImages(request)
+		exitOnError("Failed to start refresh", err)
+		waitForSubmittedJob(job, detachRefresh)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(imageCmd)
+	imageCmd.AddCommand(imageListCmd)
+	imageCmd.AddCommand(imageRefreshCmd)
+
+	imageRefreshCmd.Flags().BoolVar(&detachRefresh, "detach", false, "Return once the job is submitted instead of following its progress")
+}
+
+//describeImageState Gets the state of an image with the progress of its pull or the error of its last pull
+func describeImageState(image mds.ImageStatus) string {
+	switch {
+	case image.State == mds.ImageStatePulling && image.Progress != "":
+		return image.State + ": " + image.Progress
+	case image.State == mds.ImageStateFailed:
+		return image.State + " " + strconv.Itoa(image.Attempts) + "x: " + image.Error
+	}
+	return image.State
+}
+
+//formatOptionalTime Formats a time the way tables show them, - if it is not set
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04")
+}
@@ -0,0 +1,171 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/twa16/meteor-deploy-system/client"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//How often a job is polled while following it
+const jobPollInterval = time.Second
+
+// jobCmd represents the job command
+var jobCmd = &cobra.Command{
+	Use:   "job",
+	Short: "Commands for managing background jobs",
+	Long:  `Deployments are created and updated by background jobs on the server. These commands show and control those jobs.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// jobShowCmd represents the job show command
+var jobShowCmd = &cobra.Command{
+	Use:   "show [job id]",
+	Short: "Show the progress of a job",
+	Long:  `Prints every step a job has completed so far and its current status.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Help()
+			os.Exit(1)
+		}
+		job, err := newClient().GetJob(parseJobID(args[0]))
+		exitOnError("Failed to get job", err)
+		printResource(job, func(wide bool) {
+			for _, step := range job.Steps {
+				printJobStep(step)
+			}
+			printJobResult(job)
+		})
+	},
+}
+
+// jobFollowCmd represents the job follow command
+var jobFollowCmd = &cobra.Command{
+	Use:   "follow [job id]",
+	Short: "Follow the progress of a job until it finishes",
+	Long:  `Prints the steps of a job as they complete and exits once the job has finished.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Help()
+			os.Exit(1)
+		}
+		if !followJob(parseJobID(args[0])) {
+			os.Exit(1)
+		}
+	},
+}
+
+// jobCancelCmd represents the job cancel command
+var jobCancelCmd = &cobra.Command{
+	Use:   "cancel [job id]",
+	Short: "Cancel a running job",
+	Long:  `Asks the server to stop a job. The job stops after the step it is currently working on.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Help()
+			os.Exit(1)
+		}
+		err := newClient().CancelJob(parseJobID(args[0]))
+		exitOnError("Failed to cancel job", err)
+		color.Yellow("Cancelling job %s", args[0])
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(jobCmd)
+	jobCmd.AddCommand(jobShowCmd)
+	jobCmd.AddCommand(jobFollowCmd)
+	jobCmd.AddCommand(jobCancelCmd)
+}
+
+//parseJobID Converts a job ID given on the command line, exiting if it is not a number
+func parseJobID(jobID string) uint {
+	id, err := strconv.Atoi(jobID)
+	if err != nil || id <= 0 {
+		fmt.Println("Invalid Job ID: " + jobID)
+		os.Exit(1)
+	}
+	return uint(id)
+}
+
+//waitForSubmittedJob Follows a job the server just started unless detach is set, exiting if the job does not succeed
+func waitForSubmittedJob(job mds.Job, detach bool) {
+	if detach {
+		printResource(job, func(wide bool) {
+			fmt.Printf("Submitted job %d. Use 'job follow %d' to see its progress.\n", job.ID, job.ID)
+		})
+		return
+	}
+	if !machineOutput() {
+		fmt.Printf("Submitted job %d. Following its progress, Ctrl+C stops following but not the job.\n", job.ID)
+	}
+	if !followJob(job.ID) {
+		os.Exit(1)
+	}
+}
+
+//followJob Polls a job and prints its steps until it finishes. Returns true if the job succeeded.
+//Machine readable output only gets the finished job.
+func followJob(jobID uint) bool {
+	return followJobOn(newClient(), jobID)
+}
+
+//followJobOn Follows a job like followJob on the server of apiClient
+func followJobOn(apiClient *client.Client, jobID uint) bool {
+	printed := 0
+	for {
+		job, err := apiClient.GetJob(jobID)
+		if err != nil {
+			fmt.Println("Error: " + err.Error())
+			return false
+		}
+		for ; printed < len(job.Steps) && !machineOutput(); printed++ {
+			printJobStep(job.Steps[printed])
+		}
+		if job.IsFinished() {
+			printResource(job, func(wide bool) {
+				printJobResult(job)
+			})
+			return job.Status == mds.JobStatusSucceeded
+		}
+		time.Sleep(jobPollInterval)
+	}
+}
+
+func printJobStep(step mds.JobStep) {
+	fmt.Printf("%s %s %s\n", step.CreatedAt.Local().Format("15:04:05"), color.CyanString("["+step.Name+"]"), step.Message)
+}
+
+func printJobResult(job mds.Job) {
+	switch job.Status {
+	case mds.JobStatusSucceeded:
+		color.Green("Job %d succeeded", job.ID)
+	case mds.JobStatusFailed:
+		color.Red("Job %d failed: %s", job.ID, job.Error)
+	case mds.JobStatusCancelled:
+		color.Yellow("Job %d was cancelled", job.ID)
+	default:
+		fmt.Printf("Job %d is %s\n", job.ID, job.Status)
+	}
+}
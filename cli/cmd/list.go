@@ -15,18 +15,12 @@
 package cmd
 
 import (
-	"bytes"
-	"encoding/json"
-	"net/http"
-
-	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
-	"github.com/twa16/meteor-deploy-system/common"
 	"fmt"
-	"crypto/tls"
-	"github.com/olekukonko/tablewriter"
 	"os"
 	"strconv"
+
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
 )
 
 // listCmd represents the list command
@@ -61,47 +55,37 @@ func init() {
 }
 
 func getDeployments() {
-	//Let's build the url
-	urlString := viper.GetString("ServerHostname") + "/deployments"
-	//Check if the connection should be secure and prepend the proper protocol
-	if viper.GetBool("UseHTTPS") {
-		urlString = "https://" + urlString
-	} else {
-		urlString = "http://" + urlString
-	}
-	//Create the client
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: viper.GetBool("IgnoreSSLErrors")},
-	}
-	client := &http.Client{Transport: tr}
-	r, _ := http.NewRequest("GET", urlString, nil) // <-- URL-encoded payload
-	r.Header.Add("X-Auth-Token", viper.GetString("AuthenticationToken"))
-
-	//Send the data and get the response
-	resp, err := client.Do(r)
-	if err != nil {
-		panic(err)
-	}
-	//Get the body of the response as a string
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(resp.Body)
-	//Convert the JSON into an AutenticationToken struct
-	var deployments []mds.Deployment
-	if err = json.Unmarshal(buf.Bytes(), &deployments); err != nil {
-		panic(err)
-	}
+	deployments, err := newClient().ListDeployments()
+	exitOnError("Failed to list deployments", err)
 
-	fmt.Printf("Got %d Deployments\n", len(deployments))
-	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"ID", "Name", "URL", "State"})
-	for _, deployment := range deployments {
-		line := []string{
-			strconv.Itoa(int(deployment.ID)),
-			deployment.ProjectName,
-			deployment.URL,
-			deployment.Status,
+	printResource(deployments, func(wide bool) {
+		fmt.Printf("Got %d Deployments\n", len(deployments))
+		table := tablewriter.NewWriter(os.Stdout)
+		header := []string{"ID", "Name", "URL", "State"}
+		if wide {
+			header = append(header, "Health", "Port", "Container", "Created")
 		}
-		table.Append(line)
+		table.SetHeader(header)
+		for _, deployment := range deployments {
+			line := []string{
+				strconv.Itoa(int(deployment.ID)),
+				deployment.ProjectName,
+				deployment.URL,
+				deployment.Status,
+			}
+			if wide {
+				line = append(line, deployment.Health, deployment.Port, shortID(deployment.ContainerID), deployment.CreatedAt.Local().Format("2006-01-02 15:04"))
+			}
+			table.Append(line)
+		}
+		table.Render()
+	})
+}
+
+//shortID Shortens a docker ID the way docker does
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
 	}
-	table.Render()
+	return id
 }
@@ -0,0 +1,234 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/twa16/meteor-deploy-system/common"
+	"gopkg.in/yaml.v2"
+)
+
+//manifestVersion The version of mds.yaml this CLI understands
+const manifestVersion = 1
+
+//defaultManifestPath Manifest read by apply when -f is not given
+const defaultManifestPath = "mds.yaml"
+
+//Manifest A deployment as it should be, read from mds.yaml
+type Manifest struct {
+	Version     int                  `yaml:"version"`
+	Name        string               `yaml:"name"`      //Project name, used to find the deployment
+	Type        string               `yaml:"type"`      //bundle or image, bundle if empty
+	Domains     []string             `yaml:"domains"`   //The first is the primary domain, the rest are aliases
+	Bundle      string               `yaml:"bundle"`    //Path to the tarball built with meteor build, or written by docker save for images
+	Image       string               `yaml:"image"`     //Image reference run by a deployment of type image instead of a tarball
+	Settings    string               `yaml:"settings"`  //Path to settings.json, optional
+	Env         map[string]string    `yaml:"env"`       //Custom environment variables
+	SecretEnv   map[string]string    `yaml:"secretEnv"` //Custom environment variables whose values are hidden
+	Mongo       string               `yaml:"mongo"`     //managed or external, the server decides if empty
+	Resources   manifestResources    `yaml:"resources"`
+	HealthCheck *manifestHealthCheck `yaml:"healthCheck"`
+	BaseImage   string               `yaml:"baseImage"` //Image to run the bundle in, the server picks one from the Node version if empty
+	Network     string               `yaml:"network"`   //Shared network to join besides the network of the deployment
+	//Port the application listens on inside its container, 80 if empty
+	ContainerPort int `yaml:"containerPort"`
+}
+
+type manifestResources struct {
+	Memory    int64 `yaml:"memory"`    //Memory limit in megabytes
+	CPUShares int64 `yaml:"cpuShares"` //Relative CPU weight
+}
+
+type manifestHealthCheck struct {
+	Path     string `yaml:"path"`
+	Interval int    `yaml:"interval"` //Seconds between checks
+	Timeout  int    `yaml:"timeout"`  //Seconds before a check fails
+	Retries  int    `yaml:"retries"`  //Failed checks in a row before the deployment is unhealthy
+}
+
+//manifestKeys Top level keys of mds.yaml, used to catch typos that would otherwise be ignored
+var manifestKeys = map[string]bool{
+	"version": true, "name": true, "domains": true, "bundle": true, "settings": true, "env": true,
+	"secretEnv": true, "mongo": true, "resources": true, "healthCheck": true, "baseImage": true, "type": true,
+	"image": true, "containerPort": true, "network": true,
+}
+
+//loadManifest Reads and checks a manifest. Paths in it are made relative to the directory of the manifest
+//and environment variable values have $VAR and ${VAR} replaced from the environment of the CLI.
+func loadManifest(path string) (*Manifest, error) {
+	manifestBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys map[string]interface{}
+	if err := yaml.Unmarshal(manifestBytes, &keys); err != nil {
+		return nil, err
+	}
+	for key := range keys {
+		if !manifestKeys[key] {
+			return nil, fmt.Errorf("Unknown key '%s'", key)
+		}
+	}
+	var manifest Manifest
+	if err := yaml.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, err
+	}
+	if manifest.Version != manifestVersion {
+		return nil, fmt.Errorf("Unsupported version %d, expected 'version: %d'", manifest.Version, manifestVersion)
+	}
+	if manifest.Name == "" {
+		return nil, errors.New("'name' is required")
+	}
+	if manifest.Image != "" && manifest.Type == "" {
+		manifest.Type = mds.DeploymentTypeImage
+	}
+	switch manifest.Type {
+	case "", mds.DeploymentTypeBundle:
+		if manifest.Bundle == "" {
+			return nil, errors.New("'bundle' is required")
+		}
+	case mds.DeploymentTypeImage:
+		if (manifest.Bundle == "") == (manifest.Image == "") {
+			return nil, errors.New("Deployments of type image need either 'image' or 'bundle'")
+		}
+	default:
+		return nil, fmt.Errorf("'type' must be %s or %s", mds.DeploymentTypeBundle, mds.DeploymentTypeImage)
+	}
+	for name := range manifest.SecretEnv {
+		if _, ok := manifest.Env[name]; ok {
+			return nil, fmt.Errorf("%s is in both 'env' and 'secretEnv'", name)
+		}
+	}
+	dir := filepath.Dir(path)
+	manifest.Bundle = resolveManifestPath(dir, manifest.Bundle)
+	manifest.Settings = resolveManifestPath(dir, manifest.Settings)
+	for name, value := range manifest.Env {
+		manifest.Env[name] = os.ExpandEnv(value)
+	}
+	for name, value := range manifest.SecretEnv {
+		manifest.SecretEnv[name] = os.ExpandEnv(value)
+	}
+	spec := manifest.Spec()
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+//resolveManifestPath Makes a relative path from a manifest relative to the directory of the manifest
+func resolveManifestPath(dir string, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+//Spec Gets the normalized spec the manifest asks for
+func (m *Manifest) Spec() mds.DeploymentSpec {
+	spec := mds.DeploymentSpec{
+		Domains:       append([]string(nil), m.Domains...),
+		MongoMode:     m.Mongo,
+		Resources:     mds.ResourceLimits{MemoryMB: m.Resources.Memory, CPUShares: m.Resources.CPUShares},
+		BaseImage:     m.BaseImage,
+		Image:         m.Image,
+		ContainerPort: m.ContainerPort,
+		Network:       m.Network,
+	}
+	if m.HealthCheck != nil {
+		check := mds.HealthCheck(*m.HealthCheck)
+		spec.HealthCheck = &check
+	}
+	spec.Normalize()
+	return spec
+}
+
+//DeploymentType Gets the type of deployment the manifest describes
+func (m *Manifest) DeploymentType() string {
+	if m.Type == "" {
+		return mds.DeploymentTypeBundle
+	}
+	return m.Type
+}
+
+//ReadSettings Gets the contents of the settings file, empty if the manifest has none
+func (m *Manifest) ReadSettings() (string, error) {
+	if m.Settings == "" {
+		return "", nil
+	}
+	settingBytes, err := ioutil.ReadFile(m.Settings)
+	return string(settingBytes), err
+}
+
+//sortedVariables Converts a map of variables to KEY=VALUE pairs sorted by name
+func sortedVariables(variables map[string]string) []string {
+	var pairs []string
+	for name, value := range variables {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+//checksumFile Gets the hex SHA-256 of a file, the same way the server does for bundles
+func checksumFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+//checksumString Gets the hex SHA-256 of settings, empty if there are none, the same way the server does
+func checksumString(value string) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+//shortChecksum Shortens a checksum for display
+func shortChecksum(checksum string) string {
+	if checksum == "" {
+		return "unknown"
+	}
+	if len(checksum) > 12 {
+		return checksum[:12]
+	}
+	return checksum
+}
+
+//joinOrNone Joins values for display
+func joinOrNone(values []string) string {
+	if len(values) == 0 {
+		return "(none)"
+	}
+	return strings.Join(values, ", ")
+}
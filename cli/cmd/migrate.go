@@ -0,0 +1,133 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/twa16/meteor-deploy-system/client"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+var migrateTarget string
+var migrateUsername string
+var migratePasswordStdin bool
+var migrateInsecure bool
+var migrateDeleteSource bool
+var migrateAssumeYes bool
+
+// migrateCmd represents the deployment migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate [deployment id] --to [hostname]",
+	Short: "Move a deployment to another server",
+	Long: `Moves a deployment from the server of the saved session to another one. Its bundle, settings,
+environment variables, domain names, certificate and MongoDB data go with it.
+
+The deployment is stopped before its MongoDB is dumped so nothing written during the move is lost.
+It is down until the other server has recreated it, then point the DNS of its domains at that server.
+If anything fails the deployment is started again where it was.
+
+The deployment is left stopped on this server unless --delete-source is passed. The other server is
+logged in to with --username (or MDS_USERNAME) and --password-stdin (or MDS_PASSWORD), or prompts.
+Exporting needs the deployment.export and deployment.control permissions.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 || migrateTarget == "" {
+			cmd.Help()
+			os.Exit(1)
+		}
+		source := newClient()
+		detail, err := source.GetDeployment(parseDeploymentID(args[0]))
+		exitOnError("Failed to get deployment", err)
+
+		target := client.New(migrateTarget, true, migrateInsecure)
+		username, password := credentials(migrateUsername, migratePasswordStdin)
+		_, err = target.Login(username, password, false)
+		exitOnError("Failed to log in to "+migrateTarget, err)
+		question := fmt.Sprintf("Move %s (%s) to %s? It is down until %s has recreated it.", detail.ProjectName, detail.URL, migrateTarget, migrateTarget)
+		if !confirm(question, migrateAssumeYes) {
+			return
+		}
+		migrateDeployment(source, target, detail.Deployment)
+	},
+}
+
+func init() {
+	deploymentCmd.AddCommand(migrateCmd)
+
+	migrateCmd.Flags().StringVar(&migrateTarget, "to", "", "Hostname of the server to move the deployment to, with the port if it is not 443")
+	migrateCmd.Flags().StringVarP(&migrateUsername, "username", "u", "", "Username to log in to the other server with, defaults to $"+usernameEnvironmentVariable)
+	migrateCmd.Flags().BoolVar(&migratePasswordStdin, "password-stdin", false, "Read the password of the other server from the first line of stdin instead of $"+passwordEnvironmentVariable+" or a prompt")
+	migrateCmd.Flags().BoolVar(&migrateInsecure, "insecure", false, "Do not verify the certificate of the other server")
+	migrateCmd.Flags().BoolVar(&migrateDeleteSource, "delete-source", false, "Delete the deployment from this server once it runs on the other one")
+	migrateCmd.Flags().BoolVarP(&migrateAssumeYes, "yes", "y", false, "Do not ask for confirmation")
+}
+
+//migrateDeployment Exports a deployment from source, stopping it, and imports it on target.
+//The deployment is started on source again if it was running and the import does not succeed.
+func migrateDeployment(source *client.Client, target *client.Client, deployment mds.Deployment) {
+	archive, err := ioutil.TempFile("", "mds-export")
+	exitOnError("Failed to create export archive", err)
+	//Puts everything back the way it was and exits
+	fail := func(action string, err error) {
+		archive.Close()
+		os.Remove(archive.Name())
+		if err != nil {
+			fmt.Printf("%s: %s\n", action, err.Error())
+		}
+		if deployment.AutoStart {
+			statusf("Starting %s again\n", deployment.ProjectName)
+			if _, err := source.StartDeployment(deployment.ID); err != nil {
+				color.Red("Failed to start %s again: %s", deployment.ProjectName, err.Error())
+			}
+		}
+		os.Exit(1)
+	}
+
+	statusf("Stopping %s and exporting it...\n", deployment.ProjectName)
+	if err := source.ExportDeployment(deployment.ID, true, archive); err != nil {
+		fail("Failed to export deployment", err)
+	}
+	if err := archive.Close(); err != nil {
+		fail("Failed to save export archive", err)
+	}
+	defer os.Remove(archive.Name())
+
+	statusf("Importing %s on %s...\n", deployment.ProjectName, migrateTarget)
+	job, err := target.ImportDeployment(archive.Name(), uploadProgress())
+	if err != nil {
+		fail("Failed to import deployment", err)
+	}
+	if !machineOutput() {
+		fmt.Printf("Submitted job %d on %s.\n", job.ID, migrateTarget)
+	}
+	if !followJobOn(target, job.ID) {
+		fail("", nil)
+	}
+
+	if migrateDeleteSource {
+		if err := source.DeleteDeployment(deployment.ID); err != nil {
+			color.Red("Failed to delete %s from this server, it is stopped: %s", deployment.ProjectName, err.Error())
+		} else {
+			statusf("Deleted %s from this server\n", deployment.ProjectName)
+		}
+	} else {
+		statusf("%s is stopped on this server, delete it once the move is confirmed\n", deployment.ProjectName)
+	}
+	statusf("Point the DNS of %s at %s\n", deployment.URL, migrateTarget)
+}
@@ -0,0 +1,166 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+//Values of --output
+const (
+	outputTable = "table" //Human readable, the default
+	outputWide  = "wide"  //Table with extra columns
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+var outputFormat string
+var outputTemplate string
+
+//parsedOutputTemplate The --format template, nil if it was not given
+var parsedOutputTemplate *template.Template
+
+//templateFunctions Extra functions available to --format templates
+var templateFunctions = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		jsonBytes, err := json.Marshal(value)
+		return string(jsonBytes), err
+	},
+}
+
+//checkOutputFlags Exits if --output has an unknown value or --format is not a valid template
+func checkOutputFlags() {
+	switch outputFormat {
+	case outputTable, outputWide, outputJSON, outputYAML:
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown output '%s', use table, wide, json or yaml\n", outputFormat)
+		os.Exit(1)
+	}
+	if outputTemplate == "" {
+		return
+	}
+	parsed, err := template.New("format").Funcs(templateFunctions).Parse(outputTemplate)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --format: %s\n", err.Error())
+		os.Exit(1)
+	}
+	parsedOutputTemplate = parsed
+}
+
+//machineOutput Whether the output is meant for programs, in which case only the requested resource is printed
+func machineOutput() bool {
+	return parsedOutputTemplate != nil || outputFormat == outputJSON || outputFormat == outputYAML
+}
+
+//printResource Prints a resource in the format chosen with --output or --format.
+//table prints it for people and is told whether --output wide was given.
+//A --format template is run once for every item if the resource is a list.
+func printResource(resource interface{}, table func(wide bool)) {
+	var err error
+	switch {
+	case parsedOutputTemplate != nil:
+		err = executeOutputTemplate(resource)
+	case outputFormat == outputJSON:
+		var jsonBytes []byte
+		jsonBytes, err = json.MarshalIndent(resource, "", "  ")
+		if err == nil {
+			fmt.Println(string(jsonBytes))
+		}
+	case outputFormat == outputYAML:
+		var yamlBytes []byte
+		yamlBytes, err = marshalYAML(resource)
+		if err == nil {
+			fmt.Print(string(yamlBytes))
+		}
+	default:
+		table(outputFormat == outputWide)
+	}
+	exitOnError("Failed to print output", err)
+}
+
+//printStreamedResource Prints one item of a stream, such as an event, so each can be read as soon as it arrives.
+//JSON is printed on a single line and YAML documents are separated by ---.
+func printStreamedResource(resource interface{}, table func(wide bool)) {
+	var err error
+	switch {
+	case parsedOutputTemplate != nil:
+		err = executeOutputTemplate(resource)
+	case outputFormat == outputJSON:
+		var jsonBytes []byte
+		jsonBytes, err = json.Marshal(resource)
+		if err == nil {
+			fmt.Println(string(jsonBytes))
+		}
+	case outputFormat == outputYAML:
+		var yamlBytes []byte
+		yamlBytes, err = marshalYAML(resource)
+		if err == nil {
+			fmt.Print("---\n" + string(yamlBytes))
+		}
+	default:
+		table(outputFormat == outputWide)
+	}
+	exitOnError("Failed to print output", err)
+}
+
+//executeOutputTemplate Runs the --format template on a resource, or on each item of a list, followed by a new line
+func executeOutputTemplate(resource interface{}) error {
+	value := reflect.ValueOf(resource)
+	if value.Kind() != reflect.Slice {
+		return executeOutputTemplateOnce(resource)
+	}
+	for i := 0; i < value.Len(); i++ {
+		if err := executeOutputTemplateOnce(value.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func executeOutputTemplateOnce(resource interface{}) error {
+	if err := parsedOutputTemplate.Execute(os.Stdout, resource); err != nil {
+		return err
+	}
+	fmt.Println()
+	return nil
+}
+
+//marshalYAML Converts a resource to YAML with the same field names as its JSON
+func marshalYAML(resource interface{}) ([]byte, error) {
+	jsonBytes, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(jsonBytes, &generic); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(generic)
+}
+
+//statusf Prints a progress message. It goes to stderr with machine readable output so stdout only holds the resource.
+func statusf(format string, a ...interface{}) {
+	if machineOutput() {
+		fmt.Fprintf(os.Stderr, format, a...)
+		return
+	}
+	fmt.Printf(format, a...)
+}
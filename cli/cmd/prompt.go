@@ -0,0 +1,111 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+//Environment variables that can be used instead of prompts
+const (
+	usernameEnvironmentVariable = "MDS_USERNAME"
+	passwordEnvironmentVariable = "MDS_PASSWORD"
+)
+
+//stdinReader Shared by every prompt so input that was piped in is not lost between them
+var stdinReader = bufio.NewReader(os.Stdin)
+
+//isInteractive Whether someone can answer prompts. False when stdin is piped or redirected.
+func isInteractive() bool {
+	return terminal.IsTerminal(int(os.Stdin.Fd()))
+}
+
+//prompt Asks for a line of input and returns it without surrounding whitespace
+func prompt(question string) string {
+	fmt.Print(question)
+	answer, _ := stdinReader.ReadString('\n')
+	return strings.TrimSpace(answer)
+}
+
+//requireValue Returns value if it is set. Otherwise it is asked for if interactive is set,
+//or the command exits telling the user which flag to pass.
+func requireValue(value string, question string, flag string, interactive bool) string {
+	for value == "" {
+		if !interactive {
+			fmt.Printf("Missing %s\n", flag)
+			os.Exit(1)
+		}
+		value = prompt(question)
+	}
+	return value
+}
+
+//confirm Asks a yes or no question. assumeYes skips the question, which is required without a terminal.
+func confirm(question string, assumeYes bool) bool {
+	if assumeYes {
+		return true
+	}
+	if !isInteractive() {
+		fmt.Println("Pass --yes to confirm when not running in a terminal")
+		os.Exit(1)
+	}
+	for {
+		switch strings.ToLower(prompt(question + " [yes/no]: ")) {
+		case "yes", "y":
+			return true
+		case "no", "n":
+			return false
+		}
+		fmt.Println("Please enter yes or no")
+	}
+}
+
+//readPassword Gets a password from the first line of stdin if fromStdin is set, then from MDS_PASSWORD,
+//and finally by asking for it without echoing when a terminal is attached
+func readPassword(fromStdin bool) string {
+	if fromStdin {
+		password, err := stdinReader.ReadString('\n')
+		if err != nil && password == "" {
+			fmt.Println("Failed to read password from stdin: " + err.Error())
+			os.Exit(1)
+		}
+		return strings.TrimRight(password, "\r\n")
+	}
+	if password := os.Getenv(passwordEnvironmentVariable); password != "" {
+		return password
+	}
+	if !isInteractive() {
+		fmt.Printf("Missing password, pass --password-stdin or set %s\n", passwordEnvironmentVariable)
+		os.Exit(1)
+	}
+	return promptPassword("Enter Password: ")
+}
+
+//promptPassword Asks for a password without echoing it. A terminal has to be attached.
+func promptPassword(question string) string {
+	fmt.Print(question)
+	bytePassword, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		fmt.Println("Failed to read password: " + err.Error())
+		os.Exit(1)
+	}
+	return strings.TrimSpace(string(bytePassword))
+}
@@ -0,0 +1,116 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/fatih/color"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+var registryUsername string
+var registryPasswordStdin bool
+
+// registryCmd represents the registry command
+var registryCmd = &cobra.Command{
+	Use:   "registry",
+	Short: "Commands for managing the credentials of private registries",
+	Long: `The server pulls base images, MongoDB and the images of image deployments with the credentials stored
+for their registry. Images from registries without credentials are pulled anonymously.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// registryListCmd represents the registry list command
+var registryListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the registries the server has credentials for",
+	Long:  `Lists the registries with credentials stored on the server. Passwords are never shown.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		credentials, err := newClient().ListRegistryCredentials()
+		exitOnError("Failed to list registries", err)
+		printResource(credentials, func(wide bool) {
+			table := tablewriter.NewWriter(os.Stdout)
+			table.SetHeader([]string{"Registry", "Username", "Updated"})
+			for _, credential := range credentials {
+				table.Append([]string{credential.Registry, credential.Username, credential.UpdatedAt.Local().Format("2006-01-02 15:04")})
+			}
+			table.Render()
+		})
+	},
+}
+
+// registrySetCmd represents the registry set command
+var registrySetCmd = &cobra.Command{
+	Use:   "set [registry]",
+	Short: "Store the credentials of a registry",
+	Long: `Stores the username and password images from a registry are pulled with, replacing any it had.
+The registry is its host with the port if it has one, e.g. registry.example.com:5000, or docker.io for Docker Hub.
+The password is read from the first line of stdin with --password-stdin, otherwise it is asked for.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Help()
+			os.Exit(1)
+		}
+		interactive := isInteractive() && !registryPasswordStdin
+		request := mds.RegistryCredentialRequest{
+			Username: requireValue(registryUsername, "Username: ", "--username", interactive),
+		}
+		if registryPasswordStdin {
+			request.Password = readPassword(true)
+		} else if interactive {
+			request.Password = promptPassword("Password: ")
+		} else {
+			fmt.Println("Missing password, pass --password-stdin")
+			os.Exit(1)
+		}
+		credential, err := newClient().PutRegistryCredential(args[0], request)
+		exitOnError("Failed to store credentials", err)
+		printResource(credential, func(wide bool) {
+			color.Green("Stored credentials of %s for %s", credential.Registry, credential.Username)
+		})
+	},
+}
+
+// registryRemoveCmd represents the registry remove command
+var registryRemoveCmd = &cobra.Command{
+	Use:   "remove [registry]",
+	Short: "Remove the credentials of a registry",
+	Long:  `Removes the credentials stored for a registry. Its images are pulled anonymously afterwards.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Help()
+			os.Exit(1)
+		}
+		err := newClient().DeleteRegistryCredential(args[0])
+		exitOnError("Failed to remove credentials", err)
+		color.Yellow("Removed credentials of %s", args[0])
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(registryCmd)
+	registryCmd.AddCommand(registryListCmd)
+	registryCmd.AddCommand(registrySetCmd)
+	registryCmd.AddCommand(registryRemoveCmd)
+
+	registrySetCmd.Flags().StringVarP(&registryUsername, "username", "u", "", "Username to log in to the registry with")
+	registrySetCmd.Flags().BoolVar(&registryPasswordStdin, "password-stdin", false, "Read the password from the first line of stdin")
+}
@@ -55,6 +55,9 @@ to quickly create a Cobra application.`,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	//	Run: func(cmd *cobra.Command, args []string) { },
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		checkOutputFlags()
+	},
 }
 
 // Execute adds all child commands to the root command sets flags appropriately.
@@ -74,6 +77,8 @@ func init() {
 	// will be global for your application.
 
 	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.mds-cli.yaml)")
+	RootCmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", outputTable, "Output format: table, wide, json or yaml")
+	RootCmd.PersistentFlags().StringVar(&outputTemplate, "format", "", "Go template applied to each resource printed, e.g. '{{.ID}} {{.Status}}'")
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	RootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
@@ -82,12 +87,13 @@ func init() {
 	homeDirectory, _ := homedir.Dir()
 	sessionRecordBytes, err := ioutil.ReadFile(homeDirectory + "/.mds-session")
 	if err != nil {
-		fmt.Println("No Session Found.")
+		//Kept off stdout so it does not end up in machine readable output
+		fmt.Fprintln(os.Stderr, "No Session Found.")
 	} else {
 		sessionRecord := SessionRecord{}
 		err = json.Unmarshal(sessionRecordBytes, &sessionRecord)
 		if err != nil {
-			fmt.Printf("Invalid Session Record. Please delete %s\n", homeDirectory+"/.mds-session")
+			fmt.Fprintf(os.Stderr, "Invalid Session Record. Please delete %s\n", homeDirectory+"/.mds-session")
 			return
 		}
 		viper.Set("AuthenticationToken", sessionRecord.Token)
@@ -114,7 +120,7 @@ func initConfig() {
 	viper.Set("HomeDirectory", homeDirectory)
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 	}
 
 }
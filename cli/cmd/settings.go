@@ -0,0 +1,61 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var detachSettings bool
+
+// settingsCmd represents the deployment settings command
+var settingsCmd = &cobra.Command{
+	Use:   "settings",
+	Short: "Manage the settings of a deployment",
+	Long:  `Changes the settings.json a deployment is run with.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+// settingsPushCmd represents the deployment settings push command
+var settingsPushCmd = &cobra.Command{
+	Use:   "push [deployment id] [path to settings.json]",
+	Short: "Replace the settings of a deployment",
+	Long: `Sends a new settings.json and recreates the application container from the bundle already
+on the server. The environment variables are kept.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			cmd.Help()
+			os.Exit(1)
+		}
+		deploymentID := parseDeploymentID(args[0])
+		settingBytes, err := ioutil.ReadFile(args[1])
+		exitOnError("Failed to read settings file", err)
+		job, err := newClient().PushSettings(deploymentID, string(settingBytes))
+		exitOnError("Failed to push settings", err)
+		waitForSubmittedJob(job, detachSettings)
+	},
+}
+
+func init() {
+	deploymentCmd.AddCommand(settingsCmd)
+	settingsCmd.AddCommand(settingsPushCmd)
+
+	settingsPushCmd.Flags().BoolVar(&detachSettings, "detach", false, "Return once the job is submitted instead of following its progress")
+}
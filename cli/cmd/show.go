@@ -0,0 +1,111 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+// showCmd represents the deployment show command
+var showCmd = &cobra.Command{
+	Use:   "show [deployment id]",
+	Short: "Show everything about a deployment",
+	Long: `Prints the containers, port, URL, proxy and certificate, MongoDB mode and the names
+of the environment variables of a deployment. Values of environment variables are never shown.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Help()
+			os.Exit(1)
+		}
+		detail, err := newClient().GetDeployment(parseDeploymentID(args[0]))
+		exitOnError("Failed to get deployment", err)
+		printResource(detail, func(wide bool) {
+			printDeploymentDetail(detail)
+		})
+	},
+}
+
+func init() {
+	deploymentCmd.AddCommand(showCmd)
+}
+
+//parseDeploymentID Converts a deployment ID given on the command line, exiting if it is not a number
+func parseDeploymentID(deploymentID string) uint {
+	id, err := strconv.Atoi(deploymentID)
+	if err != nil || id <= 0 {
+		fmt.Println("Invalid Deployment ID: " + deploymentID)
+		os.Exit(1)
+	}
+	return uint(id)
+}
+
+//printDeploymentDetail Prints a deployment as a list of fields
+func printDeploymentDetail(detail mds.DeploymentDetail) {
+	field := func(name string, value string) {
+		if value == "" {
+			value = "-"
+		}
+		fmt.Printf("%-22s %s\n", name+":", value)
+	}
+	color.Cyan("Deployment %d: %s", detail.ID, detail.ProjectName)
+	field("Type", detail.Type)
+	field("Status", detail.Status)
+	field("Health", detail.Health)
+	field("URL", detail.URL)
+	field("Port", detail.Port)
+	field("Application Container", detail.ContainerID)
+	field("Created", detail.CreatedAt.Local().Format("2006-01-02 15:04:05"))
+	field("Meteor Release", detail.MeteorRelease)
+	field("Node Version", detail.NodeVersion)
+	field("Image", detail.BaseImage)
+	field("Image Digest", detail.ImageDigest)
+	if detail.ImageOutdated {
+		field("Image Outdated", fmt.Sprintf("a newer version was pulled, run 'image refresh %d' to use it", detail.ID))
+	}
+	if detail.Network == "" {
+		field("Network", "default bridge with links, moved to its own network on the next update")
+	} else {
+		field("Network", detail.Network)
+	}
+	field("Shared Network", detail.Spec.Network)
+	field("MongoDB Mode", detail.MongoMode)
+	if detail.MongoMode == mds.MongoModeManaged {
+		field("MongoDB Container", detail.MongoContainerID)
+		field("MongoDB Status", detail.MongoStatus)
+	}
+	field("Environment Variables", strings.Join(detail.EnvironmentVariables, ", "))
+	if detail.Proxy == nil {
+		field("Proxy", "not configured")
+		return
+	}
+	field("Domain", detail.Proxy.DomainName)
+	field("Proxying To", detail.Proxy.Destination)
+	field("HTTPS", strconv.FormatBool(detail.Proxy.IsHTTPS))
+	if detail.Proxy.IsHTTPS {
+		field("Certificate", detail.Proxy.CertificatePath)
+		field("Certificate Subject", detail.Proxy.CertificateSubject)
+		field("Certificate Issuer", detail.Proxy.CertificateIssuer)
+		if detail.Proxy.CertificateExpires != nil {
+			field("Certificate Expires", detail.Proxy.CertificateExpires.Local().Format("2006-01-02 15:04:05"))
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/twa16/meteor-deploy-system/client"
+)
+
+var updateBundlePath string
+var updateSettingsPath string
+var updateEnvVars []string
+var updateSecretEnvVars []string
+var detachUpdate bool
+var updateImage string
+
+// updateCmd represents the deployment update command
+var updateCmd = &cobra.Command{
+	Use:   "update [deployment id]",
+	Short: "Update a deployment",
+	Long: `Replaces the containers of a deployment with a new bundle, new settings or new environment variables.
+Anything not given is kept, so an update with only --env keeps the current bundle and settings
+and every variable that is not overridden. Deployments of type image take a tarball written by
+docker save as --bundle, or a new image reference with --image.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Help()
+			os.Exit(1)
+		}
+		deploymentID := parseDeploymentID(args[0])
+		request := client.UpdateDeploymentRequest{BundlePath: updateBundlePath, Env: updateEnvVars, SecretEnv: updateSecretEnvVars, Progress: uploadProgress()}
+		if request.BundlePath != "" {
+			if _, err := os.Stat(request.BundlePath); os.IsNotExist(err) {
+				fmt.Println("The specified project tarball does not exist")
+				os.Exit(1)
+			}
+		}
+		if updateSettingsPath != "" {
+			settingBytes, err := ioutil.ReadFile(updateSettingsPath)
+			exitOnError("Failed to read settings file", err)
+			settings := string(settingBytes)
+			request.Settings = &settings
+		}
+		if request.BundlePath == "" && request.Settings == nil && len(request.Env) == 0 && len(request.SecretEnv) == 0 && updateImage == "" {
+			fmt.Println("Nothing to update. Pass --bundle, --image, --settings, --env or --secret-env.")
+			os.Exit(1)
+		}
+		apiClient := newClient()
+		if updateImage != "" {
+			//A spec replaces the whole spec, so the rest of it is sent as it is
+			detail, err := apiClient.GetDeployment(deploymentID)
+			exitOnError("Failed to get deployment", err)
+			spec := detail.Spec
+			spec.Image = updateImage
+			request.Spec = &spec
+		}
+
+		statusf("Uploading Update...\n")
+		job, err := apiClient.UpdateDeployment(deploymentID, request)
+		exitOnError("Failed to update deployment", err)
+		waitForSubmittedJob(job, detachUpdate)
+	},
+}
+
+func init() {
+	deploymentCmd.AddCommand(updateCmd)
+
+	updateCmd.Flags().StringVar(&updateBundlePath, "bundle", "", "Path to the tarball of the new version")
+	updateCmd.Flags().StringVar(&updateSettingsPath, "settings", "", "Path to a settings.json that replaces the current settings")
+	updateCmd.Flags().StringArrayVar(&updateEnvVars, "env", nil, "Environment variable to add or replace as KEY=VALUE, can be repeated")
+	updateCmd.Flags().StringArrayVar(&updateSecretEnvVars, "secret-env", nil, "Like --env but the value is hidden from listings and logs")
+	updateCmd.Flags().BoolVar(&detachUpdate, "detach", false, "Return once the job is submitted instead of following its progress")
+	updateCmd.Flags().StringVar(&updateImage, "image", "", "Image reference a deployment of type image should run from now on")
+}
@@ -0,0 +1,102 @@
+// Copyright © 2016 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+var watchDeploymentID string
+
+// watchCmd represents the watch command
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Follow deployment changes as they happen",
+	Long: `Streams status changes, deployment progress and health changes from the MDS server
+until interrupted. Use --deployment to only follow a single deployment.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		watchEvents(watchDeploymentID)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(watchCmd)
+
+	watchCmd.Flags().StringVarP(&watchDeploymentID, "deployment", "d", "", "Only show events for the deployment with this ID")
+}
+
+func watchEvents(deploymentID string) {
+	var filter uint
+	if deploymentID != "" {
+		id, err := strconv.Atoi(deploymentID)
+		if err != nil || id <= 0 {
+			fmt.Println("Invalid Deployment ID: " + deploymentID)
+			os.Exit(1)
+		}
+		filter = uint(id)
+	}
+	if !machineOutput() {
+		color.Cyan("Watching for events. Press Ctrl+C to stop.")
+	}
+	err := newClient().WatchEvents(context.Background(), filter, func(event mds.DeploymentEvent) {
+		printStreamedResource(event, func(wide bool) {
+			printEvent(event)
+		})
+	})
+	exitOnError("Event stream ended", err)
+	fmt.Fprintln(os.Stderr, "Event stream closed by server.")
+}
+
+//printEvent Renders a single event as one line
+func printEvent(event mds.DeploymentEvent) {
+	timestamp := time.Unix(event.Timestamp, 0).Format("15:04:05")
+	prefix := fmt.Sprintf("%s #%d %s", timestamp, event.DeploymentID, event.ProjectName)
+	switch event.Type {
+	case mds.EventTypeStatus:
+		statusColor := color.YellowString
+		if event.Status == "running" {
+			statusColor = color.GreenString
+		} else if event.Status == "exited" || event.Status == "dead" || event.Status == "deleted" {
+			statusColor = color.RedString
+		}
+		fmt.Printf("%s status: %s -> %s\n", prefix, event.PreviousStatus, statusColor(event.Status))
+	case mds.EventTypeHealth:
+		healthColor := color.YellowString
+		if event.Health == "healthy" {
+			healthColor = color.GreenString
+		} else if event.Health == "unhealthy" {
+			healthColor = color.RedString
+		}
+		fmt.Printf("%s health: %s -> %s\n", prefix, event.PreviousHealth, healthColor(event.Health))
+	case mds.EventTypeProgress:
+		fmt.Printf("%s %s %s\n", prefix, color.CyanString("["+event.Step+"]"), event.Message)
+	case mds.EventTypeImage:
+		//Pulls are not about one deployment
+		if event.DeploymentID == 0 {
+			prefix = timestamp + " " + event.Image
+		}
+		fmt.Printf("%s %s %s\n", prefix, color.MagentaString("[image]"), event.Message)
+	default:
+		fmt.Printf("%s %s: %s\n", prefix, event.Type, event.Message)
+	}
+}
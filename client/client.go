@@ -0,0 +1,168 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+//Package client is a Go client for the API of the MDS daemon. It follows the OpenAPI document served at /openapi.json.
+package client
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//APIPrefix Path under which the version of the API this client speaks is served
+const APIPrefix = "/api/v1"
+
+//Client Sends requests to a single MDS daemon
+type Client struct {
+	BaseURL      string       //Scheme and host of the daemon, e.g. https://mds.example.com:8000
+	Token        string       //Authentication token sent with every request, set by Login
+	HTTPClient   *http.Client //Client used for requests that finish quickly
+	StreamClient *http.Client //Client without a timeout, used for uploads and the event stream
+}
+
+//Error Returned when the daemon answers with an error response
+type Error struct {
+	StatusCode int //HTTP status of the response
+	mds.APIError
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d %s)", e.Message, e.StatusCode, e.Code)
+}
+
+//IsCode Returns true if err is an Error from the daemon with the given error code
+func IsCode(err error, code string) bool {
+	apiErr, ok := err.(*Error)
+	return ok && apiErr.Code == code
+}
+
+//New Creates a client for the daemon at hostname, which may include a port.
+//If ignoreSSLErrors is true the certificate of the daemon is not verified.
+func New(hostname string, secure bool, ignoreSSLErrors bool) *Client {
+	scheme := "http://"
+	if secure {
+		scheme = "https://"
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: ignoreSSLErrors},
+	}
+	return &Client{
+		BaseURL:      scheme + hostname,
+		HTTPClient:   &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		StreamClient: &http.Client{Transport: transport},
+	}
+}
+
+//newRequest Builds a request for a path of the API
+func (c *Client) newRequest(method string, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	urlString := c.BaseURL + APIPrefix + path
+	if len(query) > 0 {
+		urlString += "?" + query.Encode()
+	}
+	r, err := http.NewRequest(method, urlString, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		r.Header.Set("X-Auth-Token", c.Token)
+	}
+	r.Header.Set("Accept", "application/json")
+	return r, nil
+}
+
+//do Sends a request and decodes the response into result, which may be nil.
+//Any status other than expectedStatus is returned as an *Error.
+func (c *Client) do(httpClient *http.Client, r *http.Request, expectedStatus int, result interface{}) error {
+	resp, err := httpClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectedStatus {
+		return decodeError(resp)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("Invalid response from daemon: %s", err.Error())
+	}
+	return nil
+}
+
+//doJSON Sends a request with an optional JSON body and decodes the JSON response into result
+func (c *Client) doJSON(method string, path string, body interface{}, expectedStatus int, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		jsonBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(jsonBytes)
+	}
+	r, err := c.newRequest(method, path, nil, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	return c.do(c.HTTPClient, r, expectedStatus, result)
+}
+
+//decodeError Reads the error envelope of a response
+func decodeError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	var envelope mds.APIErrorResponse
+	if err := json.Unmarshal(body, &envelope); err != nil || envelope.Error.Code == "" {
+		//The response did not come from the API, keep what we can
+		apiErr.Code = mds.ErrorCodeInternal
+		apiErr.Message = http.StatusText(resp.StatusCode)
+		if len(body) > 0 {
+			apiErr.Message = string(bytes.TrimSpace(body))
+		}
+		return apiErr
+	}
+	apiErr.APIError = envelope.Error
+	return apiErr
+}
+
+//Ping Checks that the daemon is reachable
+func (c *Client) Ping() error {
+	return c.doJSON("GET", "/ping", nil, http.StatusOK, nil)
+}
+
+//Login Exchanges a username and password for an authentication token. The token is used for later requests.
+func (c *Client) Login(username string, password string, persistent bool) (mds.AuthenticationToken, error) {
+	var token mds.AuthenticationToken
+	login := mds.LoginRequest{Username: username, Password: password, Persistent: persistent}
+	if err := c.doJSON("POST", "/login", login, http.StatusOK, &token); err != nil {
+		return token, err
+	}
+	c.Token = token.AuthenticationToken
+	return token, nil
+}
@@ -0,0 +1,313 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//CreateDeploymentRequest Describes a deployment to create
+type CreateDeploymentRequest struct {
+	ProjectName string              //Name of the project, used for its domain name
+	Type        string              //mds.DeploymentTypeBundle if empty. Image deployments run Spec.Image or the image tarball in BundlePath.
+	BundlePath  string              //Path to the tarball of the meteor application, or of the image written by docker save
+	UploadID    string              //ID of a complete upload to use as the bundle instead of BundlePath
+	Settings    string              //Contents of settings.json, may be empty
+	Env         []string            //Custom environment variables as KEY=VALUE
+	SecretEnv   []string            //Custom environment variables as KEY=VALUE whose values are never shown again
+	Spec        *mds.DeploymentSpec //Domains, MongoDB mode, resource limits and health check, nil for the defaults of the daemon
+	Progress    UploadProgress      //Told how much of the bundle has been sent, may be nil
+}
+
+//UpdateDeploymentRequest Describes what to change about a deployment. Anything left empty is kept as it is.
+type UpdateDeploymentRequest struct {
+	BundlePath string              //Path to the tarball of the new version or image, empty to keep the current one
+	UploadID   string              //ID of a complete upload to use as the new bundle instead of BundlePath
+	Settings   *string             //Contents of settings.json, nil to keep the current settings
+	Env        []string            //Custom environment variables to add or replace as KEY=VALUE
+	SecretEnv  []string            //Custom environment variables to add or replace whose values are never shown again
+	Unset      []string            //Names of custom environment variables to remove
+	Spec       *mds.DeploymentSpec //New aliases, resource limits and health check, nil to keep the current spec
+	Progress   UploadProgress      //Told how much of the bundle has been sent, may be nil
+}
+
+//UploadProgress Called while a bundle is sent with the bytes sent so far and the size of the whole bundle
+type UploadProgress func(sent int64, total int64)
+
+//ListDeployments Gets every deployment on the daemon
+func (c *Client) ListDeployments() ([]mds.Deployment, error) {
+	var deployments []mds.Deployment
+	err := c.doJSON("GET", "/deployments", nil, http.StatusOK, &deployments)
+	return deployments, err
+}
+
+//GetDeployment Gets a deployment with its proxy, MongoDB and container configuration
+func (c *Client) GetDeployment(deploymentID uint) (mds.DeploymentDetail, error) {
+	var detail mds.DeploymentDetail
+	err := c.doJSON("GET", deploymentPath(deploymentID), nil, http.StatusOK, &detail)
+	return detail, err
+}
+
+//StartDeployment Starts the containers of a stopped deployment
+func (c *Client) StartDeployment(deploymentID uint) (mds.DeploymentDetail, error) {
+	return c.deploymentAction(deploymentID, "start")
+}
+
+//StopDeployment Stops the containers of a deployment without removing anything
+func (c *Client) StopDeployment(deploymentID uint) (mds.DeploymentDetail, error) {
+	return c.deploymentAction(deploymentID, "stop")
+}
+
+//RestartDeployment Stops and starts the containers of a deployment
+func (c *Client) RestartDeployment(deploymentID uint) (mds.DeploymentDetail, error) {
+	return c.deploymentAction(deploymentID, "restart")
+}
+
+//deploymentAction Asks the daemon to start, stop or restart a deployment. The containers can take a while to stop.
+func (c *Client) deploymentAction(deploymentID uint, action string) (mds.DeploymentDetail, error) {
+	var detail mds.DeploymentDetail
+	r, err := c.newRequest("POST", deploymentPath(deploymentID)+"/"+action, nil, nil)
+	if err != nil {
+		return detail, err
+	}
+	err = c.do(c.StreamClient, r, http.StatusOK, &detail)
+	return detail, err
+}
+
+//CreateDeployment Uploads an application and starts creating a deployment for it.
+//The deployment is created by the returned job, use GetJob to follow it.
+func (c *Client) CreateDeployment(request CreateDeploymentRequest) (mds.Job, error) {
+	fields := map[string]string{"projectname": request.ProjectName, "settings": request.Settings}
+	if request.Type != "" {
+		fields["type"] = request.Type
+	}
+	if request.UploadID != "" {
+		fields["upload"] = request.UploadID
+	}
+	if err := addSpecField(fields, request.Spec); err != nil {
+		return mds.Job{}, err
+	}
+	variables := map[string][]string{"Env-Var": request.Env, "Secret-Env-Var": request.SecretEnv}
+	return c.submitDeploymentForm("POST", "/deployment", fields, variables, request.BundlePath, request.Progress)
+}
+
+//UpdateDeployment Starts replacing the containers of a deployment with the new bundle, settings or environment variables.
+//The deployment is updated by the returned job, use GetJob to follow it.
+func (c *Client) UpdateDeployment(deploymentID uint, request UpdateDeploymentRequest) (mds.Job, error) {
+	fields := map[string]string{}
+	if request.UploadID != "" {
+		fields["upload"] = request.UploadID
+	}
+	if request.Settings != nil {
+		fields["settings"] = *request.Settings
+	}
+	if err := addSpecField(fields, request.Spec); err != nil {
+		return mds.Job{}, err
+	}
+	variables := map[string][]string{"Env-Var": request.Env, "Secret-Env-Var": request.SecretEnv, "Unset-Env-Var": request.Unset}
+	return c.submitDeploymentForm("PUT", deploymentPath(deploymentID), fields, variables, request.BundlePath, request.Progress)
+}
+
+//ExportDeployment Writes the export archive of a deployment to out, for ImportDeployment on another daemon.
+//With stop the deployment is stopped before its MongoDB is dumped so nothing written afterwards is lost.
+//It is left stopped, use StartDeployment if the archive is not imported.
+func (c *Client) ExportDeployment(deploymentID uint, stop bool, out io.Writer) error {
+	method := "GET"
+	if stop {
+		method = "POST"
+	}
+	r, err := c.newRequest(method, deploymentPath(deploymentID)+"/export", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.StreamClient.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return decodeError(resp)
+	}
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+//ImportDeployment Uploads an export archive written by ExportDeployment and starts recreating the deployment
+//under the same domain names. The deployment is created by the returned job, use GetJob to follow it.
+func (c *Client) ImportDeployment(archivePath string, progress UploadProgress) (mds.Job, error) {
+	return c.submitDeploymentForm("POST", "/deployment/import", map[string]string{}, nil, archivePath, progress)
+}
+
+//addSpecField Adds spec to the fields of a deployment form as JSON, unless it is nil
+func addSpecField(fields map[string]string, spec *mds.DeploymentSpec) error {
+	if spec == nil {
+		return nil
+	}
+	specJSON, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	fields["spec"] = string(specJSON)
+	return nil
+}
+
+//ListEnvironment Gets the custom environment variables of a deployment. The values of secrets are replaced by mds.RedactedValue.
+func (c *Client) ListEnvironment(deploymentID uint) ([]mds.EnvironmentVariable, error) {
+	var variables []mds.EnvironmentVariable
+	err := c.doJSON("GET", deploymentPath(deploymentID)+"/env", nil, http.StatusOK, &variables)
+	return variables, err
+}
+
+//ChangeEnvironment Sets and removes custom environment variables of a deployment.
+//The container is recreated from the bundle on the server by the returned job.
+func (c *Client) ChangeEnvironment(deploymentID uint, change mds.EnvironmentChange) (mds.Job, error) {
+	var job mds.Job
+	err := c.doJSON("PATCH", deploymentPath(deploymentID)+"/env", change, http.StatusAccepted, &job)
+	return job, err
+}
+
+//PushSettings Replaces the settings of a deployment.
+//The container is recreated from the bundle on the server by the returned job.
+func (c *Client) PushSettings(deploymentID uint, settings string) (mds.Job, error) {
+	var job mds.Job
+	err := c.doJSON("PUT", deploymentPath(deploymentID)+"/settings", mds.SettingsChange{Settings: settings}, http.StatusAccepted, &job)
+	return job, err
+}
+
+//submitDeploymentForm Sends a multipart deployment form and returns the job the daemon started for it.
+//The bundle is streamed from disk, or sent as a resumable upload first if it is at least ResumableUploadSize.
+func (c *Client) submitDeploymentForm(method string, path string, fields map[string]string, variables map[string][]string, bundlePath string, progress UploadProgress) (mds.Job, error) {
+	var job mds.Job
+	var bundle *os.File
+	if bundlePath != "" {
+		var err error
+		if bundle, err = os.Open(bundlePath); err != nil {
+			return job, err
+		}
+		defer bundle.Close()
+		info, err := bundle.Stat()
+		if err != nil {
+			return job, err
+		}
+		if info.Size() >= ResumableUploadSize {
+			upload, err := c.UploadBundle(bundlePath, DefaultChunkSize, progress)
+			if err != nil {
+				return job, err
+			}
+			fields["upload"] = upload.ID
+			bundle = nil
+		}
+	}
+	body, contentType := deploymentForm(fields, variables, bundle, progress)
+	r, err := c.newRequest(method, path, nil, body)
+	if err != nil {
+		body.Close()
+		return job, err
+	}
+	r.Header.Set("Content-Type", contentType)
+	//Uploads can take longer than the normal timeout
+	err = c.do(c.StreamClient, r, http.StatusAccepted, &job)
+	return job, err
+}
+
+//DeleteDeployment Removes a deployment, its containers and its proxy configuration
+func (c *Client) DeleteDeployment(deploymentID uint) error {
+	return c.doJSON("DELETE", deploymentPath(deploymentID), nil, http.StatusNoContent, nil)
+}
+
+//deploymentPath Gets the path of a single deployment
+func deploymentPath(deploymentID uint) string {
+	return "/deployment/" + strconv.Itoa(int(deploymentID))
+}
+
+//deploymentForm Streams the multipart body of a create or update request. The bundle is left out if it is nil.
+//variables maps the environment variable fields to their values, which are sent in order.
+//The body is written as it is read, so the bundle is never held in memory.
+func deploymentForm(fields map[string]string, variables map[string][]string, bundle *os.File, progress UploadProgress) (io.ReadCloser, string) {
+	reader, writer := io.Pipe()
+	w := multipart.NewWriter(writer)
+	go func() {
+		//Closing with nil tells the reader the body is complete
+		writer.CloseWithError(writeDeploymentForm(w, fields, variables, bundle, progress))
+	}()
+	return reader, w.FormDataContentType()
+}
+
+//writeDeploymentForm Writes the parts of a deployment form. The SHA-256 of the bundle is sent after it
+//so it can be computed on the way, the daemon rejects the bundle if it does not match.
+func writeDeploymentForm(w *multipart.Writer, fields map[string]string, variables map[string][]string, bundle *os.File, progress UploadProgress) error {
+	for name, value := range fields {
+		if err := w.WriteField(name, value); err != nil {
+			return err
+		}
+	}
+	for name, values := range variables {
+		for _, value := range values {
+			if err := w.WriteField(name, value); err != nil {
+				return err
+			}
+		}
+	}
+	if bundle != nil {
+		info, err := bundle.Stat()
+		if err != nil {
+			return err
+		}
+		fw, err := w.CreateFormFile("uploadfile", filepath.Base(bundle.Name()))
+		if err != nil {
+			return err
+		}
+		var reader io.Reader = bundle
+		if progress != nil {
+			reader = &progressReader{reader: bundle, total: info.Size(), progress: progress}
+		}
+		hash := sha256.New()
+		if _, err = io.Copy(io.MultiWriter(fw, hash), reader); err != nil {
+			return err
+		}
+		if err := w.WriteField("sha256", hex.EncodeToString(hash.Sum(nil))); err != nil {
+			return err
+		}
+	}
+	//Closing writes the terminating boundary
+	return w.Close()
+}
+
+//progressReader Reports how much of an upload has been read
+type progressReader struct {
+	reader   io.Reader
+	total    int64
+	sent     int64 //Starts at the offset when resuming
+	progress UploadProgress
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	p.sent += int64(n)
+	p.progress(p.sent, p.total)
+	return n, err
+}
@@ -0,0 +1,38 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package client
+
+import (
+	"net/http"
+
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//ListImages Gets the images the daemon keeps pulled and the progress of pulls that are running
+func (c *Client) ListImages() ([]mds.ImageStatus, error) {
+	var images []mds.ImageStatus
+	err := c.doJSON("GET", "/images", nil, http.StatusOK, &images)
+	return images, err
+}
+
+//RefreshImages Starts a job that pulls the images of deployments and recreates the deployments running an outdated
+//image one at a time. The deployments in the request are recreated whether or not they are outdated.
+func (c *Client) RefreshImages(request mds.ImageRefreshRequest) (mds.Job, error) {
+	var job mds.Job
+	err := c.doJSON("POST", "/images/refresh", request, http.StatusAccepted, &job)
+	return job, err
+}
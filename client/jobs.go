@@ -0,0 +1,95 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//ListJobs Gets the most recent jobs without their steps
+func (c *Client) ListJobs() ([]mds.Job, error) {
+	var jobs []mds.Job
+	err := c.doJSON("GET", "/jobs", nil, http.StatusOK, &jobs)
+	return jobs, err
+}
+
+//GetJob Gets a job and the steps it has completed so far
+func (c *Client) GetJob(jobID uint) (mds.Job, error) {
+	var job mds.Job
+	err := c.doJSON("GET", "/jobs/"+strconv.Itoa(int(jobID)), nil, http.StatusOK, &job)
+	return job, err
+}
+
+//CancelJob Asks the daemon to stop a running job. The job stops after its current step.
+func (c *Client) CancelJob(jobID uint) error {
+	return c.doJSON("DELETE", "/jobs/"+strconv.Itoa(int(jobID)), nil, http.StatusAccepted, nil)
+}
+
+//WatchEvents Calls handler for each deployment event until ctx is cancelled or the daemon closes the stream.
+//If deploymentID is not 0 only events about that deployment are received.
+func (c *Client) WatchEvents(ctx context.Context, deploymentID uint, handler func(mds.DeploymentEvent)) error {
+	query := url.Values{}
+	if deploymentID != 0 {
+		query.Set("deployment", strconv.Itoa(int(deploymentID)))
+	}
+	r, err := c.newRequest("GET", "/events", query, nil)
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Accept", "text/event-stream")
+	resp, err := c.StreamClient.Do(r.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return decodeError(resp)
+	}
+
+	//Events are separated by a blank line. Only the data field is used, the event field repeats its type.
+	var eventData string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "data:"):
+			eventData += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		case line == "":
+			if eventData != "" {
+				var event mds.DeploymentEvent
+				if err := json.Unmarshal([]byte(eventData), &event); err != nil {
+					return fmt.Errorf("Invalid event from daemon: %s", err.Error())
+				}
+				handler(event)
+			}
+			eventData = ""
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return scanner.Err()
+}
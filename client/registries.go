@@ -0,0 +1,49 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package client
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//registryPath Gets the path of the credentials of a registry
+func registryPath(registry string) string {
+	return "/registries/" + url.PathEscape(registry)
+}
+
+//ListRegistryCredentials Gets the registries the daemon has credentials for. Passwords are not returned.
+func (c *Client) ListRegistryCredentials() ([]mds.RegistryCredential, error) {
+	var credentials []mds.RegistryCredential
+	err := c.doJSON("GET", "/registries", nil, http.StatusOK, &credentials)
+	return credentials, err
+}
+
+//PutRegistryCredential Stores the credentials images from a registry are pulled with, replacing any it had.
+//registry is a host with an optional port, e.g. registry.example.com:5000, or docker.io for Docker Hub.
+func (c *Client) PutRegistryCredential(registry string, request mds.RegistryCredentialRequest) (mds.RegistryCredential, error) {
+	var credential mds.RegistryCredential
+	err := c.doJSON("PUT", registryPath(registry), request, http.StatusOK, &credential)
+	return credential, err
+}
+
+//DeleteRegistryCredential Removes the credentials of a registry, its images are pulled anonymously afterwards
+func (c *Client) DeleteRegistryCredential(registry string) error {
+	return c.doJSON("DELETE", registryPath(registry), nil, http.StatusNoContent, nil)
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//ResumableUploadSize Bundles at least this large are sent as a resumable upload by CreateDeployment and UpdateDeployment
+const ResumableUploadSize = 64 << 20
+
+//DefaultChunkSize Size of the chunks of a resumable upload. A dropped connection loses at most one chunk.
+const DefaultChunkSize = 8 << 20
+
+//uploadRetries Times a chunk is retried after the connection fails before the upload is given up
+const uploadRetries = 5
+
+//CreateUpload Starts a resumable upload of a bundle. Send it with UploadChunk or ResumeUpload.
+func (c *Client) CreateUpload(request mds.UploadRequest) (mds.Upload, error) {
+	var upload mds.Upload
+	err := c.doJSON("POST", "/uploads", request, http.StatusCreated, &upload)
+	return upload, err
+}
+
+//GetUpload Gets an upload, its offset is where the next chunk has to start
+func (c *Client) GetUpload(uploadID string) (mds.Upload, error) {
+	var upload mds.Upload
+	err := c.doJSON("GET", "/uploads/"+uploadID, nil, http.StatusOK, &upload)
+	return upload, err
+}
+
+//CancelUpload Removes an upload and everything sent for it
+func (c *Client) CancelUpload(uploadID string) error {
+	return c.doJSON("DELETE", "/uploads/"+uploadID, nil, http.StatusNoContent, nil)
+}
+
+//UploadChunk Sends size bytes of chunk to be written at offset, which has to be the offset of the upload.
+//The daemon verifies the checksum when the last chunk arrives.
+func (c *Client) UploadChunk(uploadID string, offset int64, chunk io.Reader, size int64) (mds.Upload, error) {
+	var upload mds.Upload
+	r, err := c.newRequest("PATCH", "/uploads/"+uploadID, nil, chunk)
+	if err != nil {
+		return upload, err
+	}
+	r.ContentLength = size
+	r.Header.Set("Content-Type", "application/octet-stream")
+	r.Header.Set(mds.UploadOffsetHeader, strconv.FormatInt(offset, 10))
+	err = c.do(c.StreamClient, r, http.StatusOK, &upload)
+	return upload, err
+}
+
+//UploadBundle Sends a bundle as a resumable upload in chunks of chunkSize, resuming after connection failures.
+//The returned upload is complete and its ID can be used in a CreateDeploymentRequest or UpdateDeploymentRequest.
+func (c *Client) UploadBundle(bundlePath string, chunkSize int64, progress UploadProgress) (mds.Upload, error) {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return mds.Upload{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return mds.Upload{}, err
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return mds.Upload{}, err
+	}
+	upload, err := c.CreateUpload(mds.UploadRequest{Size: info.Size(), SHA256: hex.EncodeToString(hash.Sum(nil))})
+	if err != nil {
+		return upload, err
+	}
+	complete, err := c.ResumeUpload(upload, f, chunkSize, progress)
+	if err != nil {
+		//Nothing else knows about the upload, so it cannot be resumed later
+		c.CancelUpload(upload.ID)
+	}
+	return complete, err
+}
+
+//ResumeUpload Sends the rest of an upload from bundle, starting at the offset of the upload.
+//When a chunk fails because of the connection the offset is asked for again and sending continues from there.
+func (c *Client) ResumeUpload(upload mds.Upload, bundle io.ReaderAt, chunkSize int64, progress UploadProgress) (mds.Upload, error) {
+	failures := 0
+	for !upload.Complete {
+		size := upload.Size - upload.Offset
+		if size > chunkSize {
+			size = chunkSize
+		}
+		var chunk io.Reader = io.NewSectionReader(bundle, upload.Offset, size)
+		if progress != nil {
+			chunk = &progressReader{reader: chunk, total: upload.Size, sent: upload.Offset, progress: progress}
+		}
+		next, err := c.UploadChunk(upload.ID, upload.Offset, chunk, size)
+		if err == nil {
+			upload = next
+			failures = 0
+			continue
+		}
+		//Errors from the daemon other than a wrong offset will not go away by sending again
+		if apiErr, ok := err.(*Error); ok && apiErr.StatusCode != http.StatusConflict {
+			return upload, err
+		}
+		failures++
+		if failures > uploadRetries {
+			return upload, err
+		}
+		time.Sleep(time.Duration(failures) * time.Second)
+		//Part of the chunk may have been written, the daemon knows how much
+		if next, err = c.GetUpload(upload.ID); err != nil {
+			return upload, err
+		}
+		upload = next
+	}
+	return upload, nil
+}
@@ -17,6 +17,8 @@
 package mds
 
 import (
+	"time"
+
 	"github.com/jinzhu/gorm"
 )
 
@@ -32,6 +34,7 @@ type AuthenticationToken struct {
 type Deployment struct {
 	gorm.Model
 	ProjectName      string //Name of this project
+	Type             string //DeploymentTypeBundle or DeploymentTypeImage, empty for deployments made before images could be deployed
 	ownerID          uint   //ID of user that owns this project
 	VolumePath       string //Path to the folder that contains the meteor application on the hose
 	AutoStart        bool   //Should the container be started automatically
@@ -40,6 +43,112 @@ type Deployment struct {
 	Status           string //Status of the container, updated on inspect
 	URL              string //URL used to reach the service. Blank until deployment is complete
 	MongoContainerID string //The ID of the container that is running this app's mongo instance
+	Health           string //Health of the container as reported by docker, empty if the image has no health check
+	//Contents of settings.json passed as METEOR_SETTINGS. Kept out of listings because it can hold credentials.
+	Settings string `json:"-" sql:"type:text"`
+	//Whether Settings and the environment variables are stored. Older deployments only have them in their container.
+	ConfigurationSaved bool           `json:"-"`
+	Spec               DeploymentSpec `sql:"type:text"` //Domains, MongoDB mode, resource limits and health check
+	BundleChecksum     string         //SHA-256 of the bundle the container runs
+	MeteorRelease      string         //Release the bundle was built with, read from its star.json
+	NodeVersion        string         //Version of Node the bundle needs, empty if the bundle does not say
+	BaseImage          string         //Image the application container runs
+	ImageDigest        string         //Digest of BaseImage when the container was created, its ID if it has none
+	ImageOutdated      bool           //Whether a newer image was pulled for BaseImage since the container was created
+	Network            string         //Docker network of the containers of the deployment, empty for deployments that still use links
+	SettingsChecksum   string         //SHA-256 of the settings, so they can be compared without being shown
+}
+
+//RedactedValue Returned instead of the value of a secret environment variable
+const RedactedValue = "********"
+
+//EnvironmentVariable A custom environment variable of a deployment
+type EnvironmentVariable struct {
+	ID           uint   `json:"-"`
+	DeploymentID uint   `json:"-" gorm:"index"`
+	Name         string //Name of the variable
+	Value        string `sql:"type:text"` //Value given to the application container, returned as RedactedValue if Secret
+	Secret       bool   //Whether the value is hidden from API responses and logs
+}
+
+//EnvironmentChange Custom environment variables to change in a single redeploy
+type EnvironmentChange struct {
+	Set       []string //Variables to add or replace as KEY=VALUE
+	SetSecret []string //Variables to add or replace as KEY=VALUE whose values are never shown again
+	Unset     []string //Names of variables to remove
+}
+
+//SettingsChange New settings for a deployment
+type SettingsChange struct {
+	Settings string //Contents of settings.json, empty to remove the settings
+}
+
+//UploadOffsetHeader Header of a chunk request holding where in the bundle the chunk starts
+const UploadOffsetHeader = "Upload-Offset"
+
+//Upload A bundle sent in chunks so an interrupted upload can be resumed.
+//Once complete its ID can be sent instead of the bundle when creating or updating a deployment.
+type Upload struct {
+	ID        string `gorm:"primary_key"` //Random ID used in the path of the upload
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	UserID    uint      `json:"-"` //ID of the user that started the upload, nobody else can use it
+	Size      int64     //Size of the whole bundle in bytes
+	Offset    int64     //Bytes received so far, the next chunk has to start here
+	SHA256    string    //Hex SHA-256 the whole bundle has to match
+	Complete  bool      //True once every byte was received and the checksum matched
+	ExpiresAt time.Time //When the upload is removed if it has not been used
+}
+
+//UploadRequest Starts a resumable upload
+type UploadRequest struct {
+	Size   int64  //Size of the whole bundle in bytes
+	SHA256 string //Hex SHA-256 of the whole bundle
+}
+
+//DockerHubRegistry Name of the registry of images whose reference does not start with a registry host
+const DockerHubRegistry = "docker.io"
+
+//RegistryCredential Credentials the daemon pulls images from a private registry with
+type RegistryCredential struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Registry  string `gorm:"unique_index"` //Host of the registry with its port, DockerHubRegistry for Docker Hub
+	Username  string
+	Password  string `json:"-"` //Encrypted with the master key, never returned
+}
+
+//RegistryCredentialRequest The body of a request that stores the credentials of a registry
+type RegistryCredentialRequest struct {
+	Username string
+	Password string //Password or access token
+}
+
+//States of an image kept pulled by the daemon
+const (
+	ImageStateQueued  = "queued"  //Waiting to be pulled or checked for a newer version
+	ImageStatePulling = "pulling" //Being pulled
+	ImageStateReady   = "ready"   //Pulled, the registry had nothing newer at the last check
+	ImageStateFailed  = "failed"  //The last pull failed and will be retried
+)
+
+//ImageStatus An image the daemon keeps pulled, because it is configured or because a deployment runs it
+type ImageStatus struct {
+	Reference   string     //Image reference with its tag or digest
+	State       string     //One of the ImageState constants
+	Progress    string     //What the current pull has downloaded so far, empty unless pulling
+	Digest      string     //Digest of the image docker has, empty until it is pulled
+	Attempts    int        //Pulls that failed in a row
+	Error       string     //Why the last pull failed, empty once one succeeds
+	CheckedAt   *time.Time //When the image was last pulled or found to be up to date
+	NextCheckAt *time.Time //When the image is pulled again, nil if it is pinned to a digest and present
+	Deployments []uint     //IDs of the deployments that run the image
+}
+
+//ImageRefreshRequest Recreates deployments with the newest version of their image, one after another
+type ImageRefreshRequest struct {
+	Deployments []uint //Deployments to recreate, every deployment running an outdated image if empty
 }
 
 type User struct {
@@ -57,3 +166,131 @@ type UserPermission struct {
 	UserID     uint
 	Permission string
 }
+
+//Types of events that can be sent over the event stream
+const (
+	EventTypeStatus   = "status"   //The status of a deployment changed
+	EventTypeProgress = "progress" //A step of a deployment operation completed
+	EventTypeHealth   = "health"   //The health of a deployment changed
+	EventTypeImage    = "image"    //An image was pulled or found to be newer than the one a deployment runs
+)
+
+//DeploymentEvent Represents a change to a deployment that is pushed to event stream subscribers
+type DeploymentEvent struct {
+	Type           string //One of the EventType constants
+	DeploymentID   uint   //ID of the deployment this event is about
+	ProjectName    string //Name of the deployment this event is about
+	Status         string //Current status of the deployment
+	PreviousStatus string //Status before the change, only set for status events
+	Health         string //Current health of the deployment
+	PreviousHealth string //Health before the change, only set for health events
+	Step           string //Name of the step that completed, only set for progress events
+	Image          string //Reference of the image, only set for image events
+	Message        string //Human readable description of the event
+	Timestamp      int64  //Linux time the event was created
+}
+
+//States a job can be in
+const (
+	JobStatusQueued    = "queued"    //Accepted but not started yet
+	JobStatusRunning   = "running"   //Currently being worked on
+	JobStatusSucceeded = "succeeded" //Finished without errors
+	JobStatusFailed    = "failed"    //Stopped because a step returned an error
+	JobStatusCancelled = "cancelled" //Stopped because a user cancelled it
+)
+
+//Job Represents a long running operation, such as creating a deployment, that runs in the background
+type Job struct {
+	gorm.Model
+	Type         string     //What the job does, e.g. deployment.create
+	Status       string     //One of the JobStatus constants
+	UserID       uint       //ID of the user that submitted the job
+	DeploymentID uint       //ID of the deployment the job acts on. 0 until the deployment record exists
+	Error        string     `sql:"type:text"` //Why the job failed or was cancelled
+	FailedStep   string     //Name of the step that failed. Changes made before it were rolled back
+	FinishedAt   *time.Time //When the job stopped running, nil while it is queued or running
+	Steps        []JobStep  //Steps that have completed so far, in order
+}
+
+//IsFinished Returns true if the job will not make any more progress
+func (j Job) IsFinished() bool {
+	return j.Status == JobStatusSucceeded || j.Status == JobStatusFailed || j.Status == JobStatusCancelled
+}
+
+//JobStep A single step of a job that has completed
+type JobStep struct {
+	gorm.Model
+	JobID   uint   //ID of the job this step belongs to
+	Name    string //Short machine friendly name of the step
+	Message string `sql:"type:text"` //Human readable description of what happened
+}
+
+//Error codes used in APIError
+const (
+	ErrorCodeBadRequest         = "bad_request"         //The request was missing something or was malformed
+	ErrorCodeInvalidCredentials = "invalid_credentials" //The username or password was wrong
+	ErrorCodeUnauthorized       = "unauthorized"        //No valid authentication token was sent
+	ErrorCodeTokenExpired       = "token_expired"       //The authentication token has expired, log in again
+	ErrorCodeForbidden          = "forbidden"           //The user does not have the permission needed
+	ErrorCodeNotFound           = "not_found"           //The requested object does not exist
+	ErrorCodeConflict           = "conflict"            //The object is not in a state that allows the request
+	ErrorCodeInvalidBundle      = "invalid_bundle"      //The uploaded bundle is damaged, unsafe or not built by meteor build
+	ErrorCodeInvalidImage       = "invalid_image"       //The uploaded image tarball was not written by docker save
+	ErrorCodeInvalidExport      = "invalid_export"      //The uploaded export archive is damaged or was written by an incompatible mds-daemon
+	ErrorCodeInternal           = "internal_error"      //Something went wrong on the server
+)
+
+//APIError Describes why an API request failed
+type APIError struct {
+	Code    string      `json:"code"`              //One of the ErrorCode constants
+	Message string      `json:"message"`           //Human readable description of the problem
+	Details interface{} `json:"details,omitempty"` //Extra information that depends on the code
+}
+
+func (e APIError) Error() string {
+	return e.Message
+}
+
+//APIErrorResponse The body of every error response sent by the API
+type APIErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+//LoginRequest The body of a login request
+type LoginRequest struct {
+	Username   string
+	Password   string
+	Persistent bool //If true the token never expires
+}
+
+//What a deployment runs
+const (
+	DeploymentTypeBundle = "bundle" //A Meteor bundle mounted into a base image
+	DeploymentTypeImage  = "image"  //A docker image from a registry or from a tarball written by docker save
+)
+
+//Ways a deployment can get its MongoDB database
+const (
+	MongoModeManaged  = "managed"  //The daemon runs a MongoDB container for the deployment
+	MongoModeExternal = "external" //The deployment uses the MongoDB server set in the daemon configuration
+)
+
+//ProxyDetail How requests reach a deployment through nginx
+type ProxyDetail struct {
+	DomainName         string
+	IsHTTPS            bool
+	Destination        string     //Address nginx forwards requests to
+	CertificatePath    string     //Empty if the proxy is not using HTTPS
+	CertificateSubject string     //Common name of the certificate
+	CertificateIssuer  string     //Common name of whoever signed the certificate
+	CertificateExpires *time.Time //nil if the certificate could not be read
+}
+
+//DeploymentDetail Everything the daemon knows about a single deployment
+type DeploymentDetail struct {
+	Deployment
+	MongoMode            string       //One of the MongoMode constants
+	MongoStatus          string       //Status of the MongoDB container, empty unless MongoMode is managed
+	EnvironmentVariables []string     //Names of the variables set in the application container. Values are never sent.
+	Proxy                *ProxyDetail //nil if no proxy has been configured
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package mds
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+//Defaults for the parts of a health check that are left out
+const (
+	DefaultHealthCheckInterval = 30
+	DefaultHealthCheckTimeout  = 5
+	DefaultHealthCheckRetries  = 3
+)
+
+//Docker refuses containers with less memory than this
+const MinimumMemoryMB = 6
+
+//DefaultContainerPort Port the application listens on inside its container, the one meteord uses
+const DefaultContainerPort = 80
+
+//DeploymentSpec How a deployment should run, beyond its bundle, settings and environment variables.
+//Everything is optional. The first domain and the MongoDB mode cannot be changed once the deployment exists.
+type DeploymentSpec struct {
+	Domains     []string       `json:",omitempty"` //The first is the primary domain, the rest are aliases. One is generated if empty.
+	MongoMode   string         `json:",omitempty"` //MongoModeManaged or MongoModeExternal, the daemon configuration decides if empty
+	Resources   ResourceLimits //Limits of the application container
+	HealthCheck *HealthCheck   `json:",omitempty"` //HTTP check run by the daemon, nil to rely on the image
+	BaseImage   string         `json:",omitempty"` //Image the bundle runs in, picked from the Node version of the bundle if empty
+	Image       string         `json:",omitempty"` //Image run by a deployment of type image, empty if its tarball was uploaded
+	//Port the application listens on inside its container, DefaultContainerPort if zero
+	ContainerPort int `json:",omitempty"`
+	//Network shared with the other deployments naming it, the application joins it besides the network of its own
+	Network string `json:",omitempty"`
+}
+
+//ResourceLimits Limits of an application container. Zero means unlimited.
+type ResourceLimits struct {
+	MemoryMB  int64 `json:",omitempty"` //Memory limit in megabytes
+	CPUShares int64 `json:",omitempty"` //Relative CPU weight, docker uses 1024 when unset
+}
+
+//HealthCheck An HTTP request the daemon makes to the application to decide if it is healthy
+type HealthCheck struct {
+	Path     string //Path requested, 2xx and 3xx responses are healthy
+	Interval int    //Seconds between checks
+	Timeout  int    //Seconds before a check fails
+	Retries  int    //Failed checks in a row before the deployment is unhealthy
+}
+
+//Value Stores the spec as JSON
+func (s DeploymentSpec) Value() (driver.Value, error) {
+	b, err := json.Marshal(s)
+	return string(b), err
+}
+
+//Scan Reads a spec stored as JSON. Deployments created before specs existed have an empty spec.
+func (s *DeploymentSpec) Scan(value interface{}) error {
+	var b []byte
+	switch v := value.(type) {
+	case nil:
+		*s = DeploymentSpec{}
+		return nil
+	case string:
+		b = []byte(v)
+	case []byte:
+		b = v
+	default:
+		return fmt.Errorf("Cannot read a deployment spec from %T", value)
+	}
+	if len(b) == 0 {
+		*s = DeploymentSpec{}
+		return nil
+	}
+	return json.Unmarshal(b, s)
+}
+
+//PrimaryDomain Gets the domain the application is served under, empty if one should be generated
+func (s DeploymentSpec) PrimaryDomain() string {
+	if len(s.Domains) == 0 {
+		return ""
+	}
+	return s.Domains[0]
+}
+
+//Aliases Gets the domains the application is also served under
+func (s DeploymentSpec) Aliases() []string {
+	if len(s.Domains) < 2 {
+		return nil
+	}
+	return s.Domains[1:]
+}
+
+//ApplicationPort Gets the port the application listens on inside its container
+func (s DeploymentSpec) ApplicationPort() int {
+	if s.ContainerPort == 0 {
+		return DefaultContainerPort
+	}
+	return s.ContainerPort
+}
+
+//Normalize Lower cases the domains and fills in the defaults of the health check
+func (s *DeploymentSpec) Normalize() {
+	for i, domain := range s.Domains {
+		s.Domains[i] = strings.ToLower(strings.TrimSpace(domain))
+	}
+	s.BaseImage = strings.TrimSpace(s.BaseImage)
+	s.Image = strings.TrimSpace(s.Image)
+	s.Network = strings.ToLower(strings.TrimSpace(s.Network))
+	if s.HealthCheck != nil {
+		if s.HealthCheck.Path == "" {
+			s.HealthCheck.Path = "/"
+		}
+		if s.HealthCheck.Interval == 0 {
+			s.HealthCheck.Interval = DefaultHealthCheckInterval
+		}
+		if s.HealthCheck.Timeout == 0 {
+			s.HealthCheck.Timeout = DefaultHealthCheckTimeout
+		}
+		if s.HealthCheck.Retries == 0 {
+			s.HealthCheck.Retries = DefaultHealthCheckRetries
+		}
+	}
+}
+
+//Validate Checks a normalized spec
+func (s DeploymentSpec) Validate() error {
+	seen := make(map[string]bool)
+	for _, domain := range s.Domains {
+		if !isDomainName(domain) {
+			return fmt.Errorf("'%s' is not a domain name", domain)
+		}
+		if seen[domain] {
+			return fmt.Errorf("%s is listed twice", domain)
+		}
+		seen[domain] = true
+	}
+	switch s.MongoMode {
+	case "", MongoModeManaged, MongoModeExternal:
+	default:
+		return fmt.Errorf("MongoDB mode must be %s or %s", MongoModeManaged, MongoModeExternal)
+	}
+	if s.Resources.MemoryMB < 0 || (s.Resources.MemoryMB > 0 && s.Resources.MemoryMB < MinimumMemoryMB) {
+		return fmt.Errorf("Memory limit must be at least %d MB", MinimumMemoryMB)
+	}
+	if s.Resources.CPUShares < 0 {
+		return errors.New("CPU shares cannot be negative")
+	}
+	if s.BaseImage != "" && !isImageReference(s.BaseImage) {
+		return fmt.Errorf("'%s' is not an image reference", s.BaseImage)
+	}
+	if s.Image != "" && !isImageReference(s.Image) {
+		return fmt.Errorf("'%s' is not an image reference", s.Image)
+	}
+	if s.Image != "" && s.BaseImage != "" {
+		return errors.New("A deployment runs either an image or a bundle in a base image, not both")
+	}
+	if s.ContainerPort < 0 || s.ContainerPort > 65535 {
+		return errors.New("Container port must be between 1 and 65535")
+	}
+	if s.Network != "" && !isNetworkName(s.Network) {
+		return fmt.Errorf("'%s' is not a network name, use up to %d letters, digits, - and _", s.Network, maxNetworkNameLength)
+	}
+	if check := s.HealthCheck; check != nil {
+		if !strings.HasPrefix(check.Path, "/") {
+			return errors.New("Health check path must start with /")
+		}
+		if check.Interval < 1 || check.Timeout < 1 || check.Retries < 1 {
+			return errors.New("Health check interval, timeout and retries must be positive")
+		}
+		if check.Timeout > check.Interval {
+			return errors.New("Health check timeout cannot be longer than its interval")
+		}
+	}
+	return nil
+}
+
+//isDomainName Checks that a name is made of letters, digits and hyphens separated by dots
+func isDomainName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+//Longest name of a shared network, docker gets it with a prefix
+const maxNetworkNameLength = 48
+
+//isNetworkName Checks that a name of a shared network is lower case letters, digits, - and _ starting with a letter or digit
+func isNetworkName(name string) bool {
+	if name == "" || len(name) > maxNetworkNameLength || name[0] == '-' || name[0] == '_' {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+//isImageReference Checks that a name could be a docker image reference such as node:8 or registry:5000/team/app@sha256:...
+func isImageReference(reference string) bool {
+	if reference == "" || len(reference) > 255 || strings.HasPrefix(reference, "-") {
+		return false
+	}
+	for _, c := range reference {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("./:@_-", c)) {
+			return false
+		}
+	}
+	return true
+}
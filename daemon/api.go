@@ -17,62 +17,214 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/jinzhu/gorm"
 	uuid "github.com/satori/go.uuid"
 	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
 	"goji.io"
 	"goji.io/pat"
+	"goji.io/pattern"
 	"golang.org/x/crypto/bcrypt"
-	"github.com/twa16/meteor-deploy-system/common"
-	"strconv"
 )
 
 var dClient *docker.Client
 var database *gorm.DB
 
 const (
-	CreateDeploymentPermission = "deployment.create"
-	ListDeploymentPermission = "deployment.list"
-	DeleteDeploymentPermission = "deployment.delete"
+	CreateDeploymentPermission  = "deployment.create"
+	ListDeploymentPermission    = "deployment.list"
+	DeleteDeploymentPermission  = "deployment.delete"
+	ControlDeploymentPermission = "deployment.control" //Start, stop and restart
+	UpdateDeploymentPermission  = "deployment.update"  //New bundle, settings or environment variables
+	ManageRegistryPermission    = "registry.manage"    //Credentials of private registries
+	ExportDeploymentPermission  = "deployment.export"  //Archives holding the secrets and private key of a deployment
+
 )
 
+//Results of checkAuthentication
+const (
+	AuthOK           = 0 //The token is valid and grants the permission
+	AuthUnauthorized = 1 //The token does not exist
+	AuthExpired      = 2 //The token has not been used in too long
+	AuthForbidden    = 3 //The token is valid but its user lacks the permission
+)
+
+//APIV1Prefix Path under which version 1 of the API is served
+const APIV1Prefix = "/api/v1"
+
+//Key used to store the ID of the authenticated user on the request context
+type contextKey string
+
+const userIDContextKey contextKey = "userID"
+
+//writeJSON Sends a value as the JSON body of a response
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	jsonBytes, err := json.Marshal(value)
+	if err != nil {
+		writeInternalError(w, "Failed to encode response", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+}
+
+//readJSON Decodes the JSON body of a request, responding with a bad request if it cannot be decoded
+func readJSON(w http.ResponseWriter, r *http.Request, value interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(value); err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Invalid JSON body", err.Error())
+		return false
+	}
+	return true
+}
+
+//writeError Sends an error envelope as the body of a response
+func writeError(w http.ResponseWriter, status int, code string, message string, details interface{}) {
+	jsonBytes, _ := json.Marshal(mds.APIErrorResponse{Error: mds.APIError{Code: code, Message: message, Details: details}})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+}
+
+//writeInternalError Logs an unexpected error and sends a generic error to the client
+func writeInternalError(w http.ResponseWriter, logMessage string, err error) {
+	log.Criticalf("%s: %s", logMessage, err.Error())
+	writeError(w, http.StatusInternalServerError, mds.ErrorCodeInternal, "Internal Server Error", nil)
+}
+
+//writeAuthError Sends the error that matches a result of checkAuthentication
+func writeAuthError(w http.ResponseWriter, authCode int) {
+	switch authCode {
+	case AuthExpired:
+		writeError(w, http.StatusUnauthorized, mds.ErrorCodeTokenExpired, "Token Expired", nil)
+	case AuthForbidden:
+		writeError(w, http.StatusForbidden, mds.ErrorCodeForbidden, "Permission Denied", nil)
+	default:
+		writeError(w, http.StatusUnauthorized, mds.ErrorCodeUnauthorized, "Unauthorized", nil)
+	}
+}
+
+//missingFields Builds the details of an error about required fields that were not sent
+func missingFields(fields ...string) map[string][]string {
+	return map[string][]string{"missing": fields}
+}
+
+//requirePermission Wraps a handler so it only runs for requests whose token grants the permission.
+//The ID of the authenticated user can be read with requestUserID.
+func requirePermission(permission string, handler http.HandlerFunc) http.HandlerFunc {
+	return requireAnyPermission([]string{permission}, handler)
+}
+
+//requireAnyPermission Wraps a handler so it only runs for requests whose token grants one of the permissions
+func requireAnyPermission(permissions []string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-Auth-Token")
+		var authCode int
+		for _, permission := range permissions {
+			if authCode = checkAuthentication(database, key, permission); authCode == AuthOK {
+				break
+			}
+		}
+		if authCode != AuthOK {
+			writeAuthError(w, authCode)
+			return
+		}
+		ctx := context.WithValue(r.Context(), userIDContextKey, getAuthenticatedUserID(database, key))
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+//requestUserID Gets the ID of the user that made a request that went through requirePermission
+func requestUserID(r *http.Request) uint {
+	userID, _ := r.Context().Value(userIDContextKey).(uint)
+	return userID
+}
+
+//pathParam Gets a parameter from the path of the request, or false if the route does not have it
+func pathParam(r *http.Request, name string) (string, bool) {
+	value, ok := r.Context().Value(pattern.Variable(name)).(string)
+	return value, ok
+}
+
+//requestDeploymentID Gets the deployment ID from the path, or from the id parameter on legacy routes
+func requestDeploymentID(r *http.Request) (uint, error) {
+	idString, ok := pathParam(r, "id")
+	if !ok {
+		idString = r.FormValue("id")
+	}
+	id, err := strconv.Atoi(idString)
+	if err != nil || id <= 0 {
+		return 0, errors.New("Invalid Deployment ID")
+	}
+	return uint(id), nil
+}
+
+//deprecated Wraps a handler for a route that only exists for clients written before the API was versioned
+func deprecated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Warning", `299 - "Deprecated API route, use `+APIV1Prefix+` instead"`)
+		handler(w, r)
+	}
+}
+
 func ping(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "PONG")
+	writeJSON(w, http.StatusOK, map[string]string{"Message": "PONG"})
 }
 
-//Called when /loginAPIHandler is called
+//Called for routes under /api/v1 that do not exist
+func notFoundAPIHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusNotFound, mds.ErrorCodeNotFound, "No such API route", map[string]string{"method": r.Method, "path": r.URL.Path})
+}
+
+//Called when /login is called. Accepts a JSON LoginRequest or the equivalent form parameters.
 func loginAPIHandler(w http.ResponseWriter, r *http.Request) {
-	//Process the query parameters
-	r.ParseForm()
+	var login mds.LoginRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&login); err != nil {
+			writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Invalid JSON body", err.Error())
+			return
+		}
+	} else {
+		//Process the query parameters
+		r.ParseForm()
+		login.Username = r.Form.Get("username")
+		login.Password = r.Form.Get("password")
+		login.Persistent = r.Form.Get("persistent") == "true"
+	}
 	//Ensure the proper parameters were sent
-	if len(r.Form["username"]) == 0 || len(r.Form["password"]) == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(w, "Record Not Found")
-		return
+	var missing []string
+	if login.Username == "" {
+		missing = append(missing, "username")
+	}
+	if login.Password == "" {
+		missing = append(missing, "password")
 	}
-	if len(r.Form["persistent"]) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprint(w, "Persistence setting not set")
+	if len(missing) > 0 {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Username and password are required", missingFields(missing...))
 		return
 	}
-	var isPersistent = r.Form["persistent"][0] == "true"
-	token, err := handleLoginAttempt(r.Form["username"][0], r.Form["password"][0], isPersistent)
+	token, err := handleLoginAttempt(login.Username, login.Password, login.Persistent)
 	if err != nil {
-		fmt.Fprint(w, err.Error())
+		writeError(w, http.StatusUnauthorized, mds.ErrorCodeInvalidCredentials, err.Error(), nil)
 		return
 	}
-	jsonBytes, _ := json.Marshal(token)
-	fmt.Fprintf(w, string(jsonBytes))
+	writeJSON(w, http.StatusOK, token)
 }
 
 func handleLoginAttempt(username string, password string, persistentToken bool) (mds.AuthenticationToken, error) {
@@ -95,94 +247,162 @@ func handleLoginAttempt(username string, password string, persistentToken bool)
 	token.AuthenticationToken = tokenGen
 	token.UserID = user.ID
 	token.LastSeen = time.Now().Unix()
+	token.Persistent = persistentToken
 
 	//Save it and return it
 	database.Create(&token)
 	return token, nil
 }
 
-//CreateDeployment Called when POST /deployment is called
-func createDeploymentEndpoint(w http.ResponseWriter, r *http.Request) {
-	//Check authentication
-	authCode := checkAuthentication(database, r.Header["X-Auth-Token"][0], CreateDeploymentPermission)
-	if authCode == 0 {
-		//Process the query parameters
-		r.ParseForm()
-
-		//Check if they sent a projectName
-		if len(r.Form["projectname"]) == 0 {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprintf(w, "Please provide a project name")
-			return
-		}
-		//Get the project name they want
-		projectName := r.Form["projectname"][0]
+//hasUploadedFile Checks whether a parsed multipart form carries an application archive without opening it
+func hasUploadedFile(r *http.Request) bool {
+	return r.MultipartForm != nil && len(r.MultipartForm.File["uploadfile"]) > 0
+}
 
-		//Handle file upload t get the archive of the application
-		r.ParseMultipartForm(32 << 20)
-		file, _, err := r.FormFile("uploadfile")
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
-		defer file.Close()
-		//Get destination directory
-		destination, err := GetNewApplicationDirectory()
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "Internal Server Error")
-			log.Criticalf("Error creating new application directory: %s", err.Error())
-			return
-		}
-		//Copy tarball to volume
-		//Create destination
-		desFile, err := os.Create(destination + "/application.tar.gz")
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "Internal Server Error")
-			log.Criticalf("Failed to create destination file(%s): %s", destination, err.Error())
-			return
-		}
-		defer desFile.Close()
-		//Copy content
-		_, err = io.Copy(desFile, file)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "Internal Server Error")
-			log.Criticalf("Failed to copy tarball to volume: %s", err.Error())
-			return
-		}
+//saveUploadedApplication Copies the uploaded application archive into a new application directory.
+//Returns that directory and the hex SHA-256 of the archive.
+func saveUploadedApplication(r *http.Request) (string, string, error) {
+	file, _, err := r.FormFile("uploadfile")
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+	//Get destination directory
+	destination, err := GetNewApplicationDirectory()
+	if err != nil {
+		return "", "", err
+	}
+	//Copy tarball to volume
+	//Create destination
+	desFile, err := os.Create(destination + "/application.tar.gz")
+	if err != nil {
+		os.RemoveAll(destination)
+		return "", "", err
+	}
+	defer desFile.Close()
+	//Copy content, hashing it on the way
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(desFile, hash), file); err == nil {
 		//Sync
 		err = desFile.Sync()
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "Internal Server Error")
-			log.Criticalf("Failed to copy tarball to volume: %s", err.Error())
-			return
-		}
+	}
+	if err != nil {
+		os.RemoveAll(destination)
+		return "", "", err
+	}
+	return destination, hex.EncodeToString(hash.Sum(nil)), nil
+}
 
-		//Get custom environmental Variables
-		data := r.Form["Env-Var"]
-		customEnvironmentalVariables := make([]string, 1)
-		for _, entry := range data {
-			log.Debugf("Got custom environmental variable: %s", entry)
-			customEnvironmentalVariables = append(customEnvironmentalVariables, entry)
-		}
-		//Start creating deployment
-		deployment, err := createDeployment(dClient, database, projectName, destination, r.Form["settings"][0], customEnvironmentalVariables)
-		if err != nil {
-			fmt.Fprintf(w,"Error: %s\n", err.Error())
+//Form field holding a DeploymentSpec as JSON
+const specField = "spec"
+
+//readDeploymentSpec Reads the spec form field. Returns nil if it was not sent.
+//The spec is normalized and validated, an error means the spec is not acceptable.
+func readDeploymentSpec(r *http.Request) (*mds.DeploymentSpec, error) {
+	value := r.FormValue(specField)
+	if value == "" {
+		return nil, nil
+	}
+	var spec mds.DeploymentSpec
+	if err := json.Unmarshal([]byte(value), &spec); err != nil {
+		return nil, errors.New("Spec is not valid JSON: " + err.Error())
+	}
+	spec.Normalize()
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	return &spec, nil
+}
+
+//Form fields holding custom environment variables as KEY=VALUE
+const (
+	environmentVariableField       = "Env-Var"
+	secretEnvironmentVariableField = "Secret-Env-Var" //Values are never shown again
+	unsetEnvironmentVariableField  = "Unset-Env-Var"  //Only holds the names of variables to remove
+)
+
+//getCustomEnvironmentalVariables Gets the KEY=VALUE pairs sent as values of a form field
+func getCustomEnvironmentalVariables(r *http.Request, field string) []string {
+	var customEnvironmentalVariables []string
+	for _, entry := range r.Form[field] {
+		if entry == "" {
+			continue
 		}
-		fmt.Fprint(w, "Created: %s\n", deployment.ProjectName)
-	} else if authCode == 2 {
-		//Unauthorized 401
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, "Token Expired")
-	} else {
-		//Unauthorized 401
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, "Unauthorized")
+		customEnvironmentalVariables = append(customEnvironmentalVariables, entry)
 	}
+	log.Debugf("Got %d custom environmental variables from %s", len(customEnvironmentalVariables), field)
+	return customEnvironmentalVariables
+}
+
+//CreateDeployment Called when POST /deployment is called
+func createDeploymentEndpoint(w http.ResponseWriter, r *http.Request) {
+	//Handle file upload to get the archive of the application
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Expected a multipart form", err.Error())
+		return
+	}
+	//Check if they sent a projectName
+	projectName := r.FormValue("projectname")
+	if projectName == "" {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Please provide a project name", missingFields("projectname"))
+		return
+	}
+	deploymentType := r.FormValue(typeField)
+	if deploymentType == "" {
+		deploymentType = mds.DeploymentTypeBundle
+	}
+	upload, ok := readUploadField(w, r)
+	if !ok {
+		return
+	}
+	hasArchive := hasUploadedFile(r) || upload != nil
+	var configuration applicationConfiguration
+	configuration.apply(getCustomEnvironmentalVariables(r, environmentVariableField), getCustomEnvironmentalVariables(r, secretEnvironmentVariableField), nil)
+	if err := validateEnvironment(configuration.Environment); err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, err.Error(), nil)
+		return
+	}
+	spec, err := readDeploymentSpec(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, err.Error(), nil)
+		return
+	}
+	if spec == nil {
+		spec = &mds.DeploymentSpec{}
+	}
+	if err := checkDeploymentSource(deploymentType, spec, hasArchive, false); err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, err.Error(), nil)
+		return
+	}
+	//Checked again when the job reserves them, this just gives a quicker answer
+	if taken := UnavailableDomainNames(database, spec.Domains, 0); len(taken) > 0 {
+		writeError(w, http.StatusConflict, mds.ErrorCodeConflict, "Domain names already in use", map[string][]string{"domains": taken})
+		return
+	}
+	var destination string
+	var bundle bundleInfo
+	switch {
+	case deploymentType == mds.DeploymentTypeBundle:
+		destination, bundle, ok = receiveBundle(w, r, upload)
+	case hasArchive:
+		destination, bundle, ok = receiveImageArchive(w, r, upload)
+	}
+	if !ok {
+		return
+	}
+
+	//Start creating the deployment in the background so a slow step or disconnect does not affect it
+	configuration.Settings = r.FormValue("settings")
+	//No other job can hold a deployment that does not exist yet
+	job, _ := jobs.Submit(database, CreateDeploymentJob, requestUserID(r), nil, func(ctx context.Context, progress deploymentProgress) error {
+		_, err := createDeployment(dClient, database, projectName, deploymentType, destination, bundle, configuration, *spec, progress)
+		if err != nil && destination != "" {
+			//Nothing refers to the uploaded application once creation has been rolled back
+			os.RemoveAll(destination)
+		}
+		return err
+	})
+	writeJSON(w, http.StatusAccepted, job)
 }
 
 //GetNewApplicationDirectory Returns a new path for the application files.
@@ -233,180 +453,335 @@ func pathExists(path string) (bool, error) {
 
 //Called when /deployments is called
 func getDeploymentsAPIHandler(w http.ResponseWriter, r *http.Request) {
-	authCode := checkAuthentication(database, r.Header["X-Auth-Token"][0], ListDeploymentPermission)
-	if authCode == 0 {
-		var deployments []mds.Deployment
-		database.Find(&deployments)
-		for i, deployment := range deployments {
-			inspectResult, err := inspectDeployment(dClient, database, deployment.ID)
-			if err != nil {
-				log.Warning(err)
-			}
-			deployments[i] = *inspectResult
+	deployments := []mds.Deployment{}
+	database.Find(&deployments)
+	for i, deployment := range deployments {
+		inspectResult, err := inspectDeployment(dClient, database, deployment.ID)
+		if err != nil {
+			//Fall back to what was last saved
+			log.Warning(err)
+			continue
 		}
-		jsonBytes, _ := json.Marshal(deployments)
-		fmt.Fprintf(w, string(jsonBytes))
-	} else if authCode == 2 {
-		//Unauthorized 401
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, "Token Expired")
-	} else {
-		//Unauthorized 401
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, "Unauthorized")
+		deployments[i] = *inspectResult
 	}
+	writeJSON(w, http.StatusOK, deployments)
 }
 
-func updateDeploymentAPIHandler(w http.ResponseWriter, r *http.Request) {
-	authCode := checkAuthentication(database, r.Header["X-Auth-Token"][0], ListDeploymentPermission)
-	if authCode == 0 {
-		//Process the query parameters
-		r.ParseForm()
+//Called when GET /deployment/:id is called
+func getDeploymentAPIHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := requestDeploymentID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, err.Error(), nil)
+		return
+	}
+	detail, err := getDeploymentDetail(dClient, database, id)
+	if err == gorm.ErrRecordNotFound {
+		writeError(w, http.StatusNotFound, mds.ErrorCodeNotFound, "Deployment Not Found", nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, detail)
+}
 
-		//Check if they sent a projectName
-		if len(r.Form["projectid"]) == 0 {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprint(w, "Please provide a project name")
-			return
-		}
-		//Get the project name they want
-		projectidstring := r.Form["projectid"][0]
-		projectId, err := strconv.Atoi(projectidstring)
+//deploymentActionAPIHandler Builds the handler for POST /deployment/:id/<action>. Responds with the deployment once the action is done.
+func deploymentActionAPIHandler(action string) http.HandlerFunc {
+	actions := map[string]func(*docker.Client, *gorm.DB, *mds.Deployment) error{
+		StartDeploymentAction:   startDeployment,
+		StopDeploymentAction:    stopDeployment,
+		RestartDeploymentAction: restartDeployment,
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := requestDeploymentID(r)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprint(w, "Invalid Deployment ID")
+			writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, err.Error(), nil)
 			return
 		}
-
-		//Handle file upload t get the archive of the application
-		r.ParseMultipartForm(32 << 20)
-		file, _, err := r.FormFile("uploadfile")
-		if err != nil {
-			fmt.Println(err)
+		//Held for the whole action so no job replaces the container while it is being started or stopped
+		if !jobs.LockDeployments(id) {
+			writeBusyError(w, nil)
 			return
 		}
-		defer file.Close()
-		//Get destination directory
-		destination, err := GetNewApplicationDirectory()
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Internal Server Error")
-			log.Criticalf("Error creating new application directory: %s", err.Error())
+		defer jobs.UnlockDeployments(id)
+		var deployment mds.Deployment
+		if database.First(&deployment, id).RecordNotFound() {
+			writeError(w, http.StatusNotFound, mds.ErrorCodeNotFound, "Deployment Not Found", nil)
 			return
 		}
-		//Copy tarball to volume
-		//Create destination
-		desFile, err := os.Create(destination + "/application.tar.gz")
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Internal Server Error")
-			log.Criticalf("Failed to create destination file(%s): %s", destination, err.Error())
+		log.Infof("Deployment %d: %s requested", deployment.ID, action)
+		err = actions[action](dClient, database, &deployment)
+		if err == errNoContainer {
+			writeError(w, http.StatusConflict, mds.ErrorCodeConflict, err.Error(), map[string]string{"status": deployment.Status})
 			return
-		}
-		defer desFile.Close()
-		//Copy content
-		_, err = io.Copy(desFile, file)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Internal Server Error")
-			log.Criticalf("Failed to copy tarball to volume: %s", err.Error())
+		} else if err != nil {
+			log.Criticalf("Failed to %s deployment %d: %s", action, deployment.ID, err.Error())
+			writeError(w, http.StatusInternalServerError, mds.ErrorCodeInternal, "Failed to "+action+" deployment: "+err.Error(), nil)
 			return
 		}
-		//Sync
-		err = desFile.Sync()
+		detail, err := getDeploymentDetail(dClient, database, id)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprint(w, "Internal Server Error")
-			log.Criticalf("Failed to copy tarball to volume: %s", err.Error())
+			writeInternalError(w, "Failed to get deployment after "+action, err)
 			return
 		}
+		writeJSON(w, http.StatusOK, detail)
+	}
+}
 
-		//Get custom environmental Variables
-		data := r.Form["Env-Var"]
-		customEnvironmentalVariables := make([]string, 1)
-		for _, entry := range data {
-			log.Debugf("Got custom environmental variable: %s", entry)
-			customEnvironmentalVariables = append(customEnvironmentalVariables, entry)
-		}
-		//Start creating deployment
-		updateDeployment(dClient, database, projectId, destination, r.Form["settings"][0], customEnvironmentalVariables)
-		fmt.Fprint(w, "")
-	} else if authCode == 2 {
-		//Unauthorized 401
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, "Token Expired")
+//Called when PUT /deployment/:id is called. The bundle, settings and environment variables are all optional
+//but at least one of them has to be sent. Anything not sent is kept as it is.
+func updateDeploymentAPIHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := requestDeploymentID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, err.Error(), nil)
+		return
+	}
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Expected a multipart form", err.Error())
+		return
+	}
+	var update deploymentUpdate
+	update.Environment = getCustomEnvironmentalVariables(r, environmentVariableField)
+	update.Secrets = getCustomEnvironmentalVariables(r, secretEnvironmentVariableField)
+	update.Unset = getCustomEnvironmentalVariables(r, unsetEnvironmentVariableField)
+	if err := validateEnvironment(append(update.Environment, update.Secrets...)); err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, err.Error(), nil)
+		return
+	}
+	if err := validateVariableNames(update.Unset); err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, err.Error(), nil)
+		return
+	}
+	//An empty settings field clears the settings, a missing one keeps them
+	if settings, ok := r.MultipartForm.Value["settings"]; ok && len(settings) > 0 {
+		update.Settings = &settings[0]
+	}
+	update.Spec, err = readDeploymentSpec(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, err.Error(), nil)
+		return
+	}
+	upload, ok := readUploadField(w, r)
+	if !ok {
+		return
+	}
+	hasBundle := hasUploadedFile(r) || upload != nil
+	if !hasBundle && update.Settings == nil && update.Spec == nil && len(update.Environment) == 0 && len(update.Secrets) == 0 && len(update.Unset) == 0 {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Nothing to update", missingFields("uploadfile", uploadField, "settings", specField, environmentVariableField, secretEnvironmentVariableField, unsetEnvironmentVariableField))
+		return
+	}
+
+	deployment, ok := updatableDeployment(w, id)
+	if !ok {
+		return
+	}
+	deploymentType := deployment.Type
+	if deploymentType == "" {
+		deploymentType = mds.DeploymentTypeBundle
+	}
+	if err := checkDeploymentSource(deploymentType, update.Spec, hasBundle, true); err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, err.Error(), nil)
+		return
+	}
+	if update.Spec != nil && !checkSpecChange(w, deployment, update.Spec) {
+		return
+	}
+	//A spec without an image keeps running the current one, unless a tarball replaces it
+	if update.Spec != nil && update.Spec.Image == "" && !hasBundle {
+		update.Spec.Image = deployment.Spec.Image
+	}
+	if hasBundle && deploymentType == mds.DeploymentTypeImage {
+		update.ApplicationDirectory, update.Bundle, ok = receiveImageArchive(w, r, upload)
+	} else if hasBundle {
+		update.ApplicationDirectory, update.Bundle, ok = receiveBundle(w, r, upload)
+	}
+	if !ok {
+		return
+	}
+	submitUpdateJob(w, r, deployment, update)
+}
+
+//checkSpecChange Makes sure a new spec only changes what an update can change.
+//The primary domain and the MongoDB mode are fixed when the deployment is created.
+//Writes an error response and returns false if the spec cannot be applied.
+func checkSpecChange(w http.ResponseWriter, deployment mds.Deployment, spec *mds.DeploymentSpec) bool {
+	var nginxConfig NginxProxyConfiguration
+	if database.Where("deployment_id = ?", deployment.ID).First(&nginxConfig).RecordNotFound() {
+		writeError(w, http.StatusConflict, mds.ErrorCodeConflict, "Deployment has no proxy", nil)
+		return false
+	}
+	if primary := spec.PrimaryDomain(); primary != "" && primary != nginxConfig.DomainName {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "The primary domain of a deployment cannot be changed", map[string]string{"current": nginxConfig.DomainName, "requested": primary})
+		return false
+	}
+	mongoMode := deploymentMongoMode(deployment)
+	if spec.MongoMode != "" && spec.MongoMode != mongoMode {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "The MongoDB mode of a deployment cannot be changed", map[string]string{"current": mongoMode, "requested": spec.MongoMode})
+		return false
+	}
+	//Keep what was fixed at creation so the stored spec stays complete
+	spec.MongoMode = mongoMode
+	if len(spec.Domains) == 0 {
+		spec.Domains = []string{nginxConfig.DomainName}
 	} else {
-		//Unauthorized 401
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, "Unauthorized")
+		spec.Domains[0] = nginxConfig.DomainName
+	}
+	if taken := UnavailableDomainNames(database, spec.Aliases(), nginxConfig.ID); len(taken) > 0 {
+		writeError(w, http.StatusConflict, mds.ErrorCodeConflict, "Domain names already in use", map[string][]string{"domains": taken})
+		return false
 	}
+	return true
 }
 
-//Called when DELETE /deployment is called an id should be passed as a query parameter
-func deleteDeploymentAPIHandler(w http.ResponseWriter, r *http.Request) {
-	//TODO: Tear this apart and redo it
-	authCode := checkAuthentication(database, r.Header["X-Auth-Token"][0], DeleteDeploymentPermission)
-	if authCode == 0 {
-		//Process the query parameters
-		r.ParseForm()
-		//Make sure an id was submitted
-		if len(r.Form["id"]) == 0 {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Fprint(w, "Invalid Request")
-			return
-		}
-		//Get the id of the item to remove and retrieve the item
-		var id = r.Form["id"][0]
-		var deployment mds.Deployment
-		recordExists := database.First(&deployment, id).RecordNotFound()
-		//Check to see if the item exists
-		if recordExists {
-			w.WriteHeader(http.StatusNotFound)
-			fmt.Fprint(w, "Record Not Found")
-			return
-		}
+//Called when GET /deployment/:id/env is called
+func getEnvironmentAPIHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := requestDeploymentID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, err.Error(), nil)
+		return
+	}
+	var deployment mds.Deployment
+	if database.First(&deployment, id).RecordNotFound() {
+		writeError(w, http.StatusNotFound, mds.ErrorCodeNotFound, "Deployment Not Found", nil)
+		return
+	}
+	configuration, err := loadApplicationConfiguration(dClient, database, &deployment)
+	if err != nil {
+		writeInternalError(w, "Failed to get environment variables", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, configuration.variables())
+}
 
-		//=====Delete Logic=====
-		//Stop the container
-		err := dClient.StopContainer(deployment.ContainerID, 10)
-		if err != nil {
-			log.Warning(err)
-			//w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, err.Error()+"\n")
-			//return
+//Called when PATCH /deployment/:id/env is called. Recreates the container from the bundle already on disk.
+func changeEnvironmentAPIHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := requestDeploymentID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, err.Error(), nil)
+		return
+	}
+	var change mds.EnvironmentChange
+	if !readJSON(w, r, &change) {
+		return
+	}
+	if len(change.Set) == 0 && len(change.SetSecret) == 0 && len(change.Unset) == 0 {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Nothing to change", missingFields("Set", "SetSecret", "Unset"))
+		return
+	}
+	if err := validateEnvironment(append(change.Set, change.SetSecret...)); err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, err.Error(), nil)
+		return
+	}
+	if err := validateVariableNames(change.Unset); err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, err.Error(), nil)
+		return
+	}
+	deployment, ok := updatableDeployment(w, id)
+	if !ok {
+		return
+	}
+	submitUpdateJob(w, r, deployment, deploymentUpdate{Environment: change.Set, Secrets: change.SetSecret, Unset: change.Unset})
+}
+
+//Called when PUT /deployment/:id/settings is called. Recreates the container from the bundle already on disk.
+func pushSettingsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := requestDeploymentID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, err.Error(), nil)
+		return
+	}
+	var change mds.SettingsChange
+	if !readJSON(w, r, &change) {
+		return
+	}
+	//Meteor refuses to start if METEOR_SETTINGS is not valid JSON
+	if change.Settings != "" && !json.Valid([]byte(change.Settings)) {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Settings are not valid JSON", nil)
+		return
+	}
+	deployment, ok := updatableDeployment(w, id)
+	if !ok {
+		return
+	}
+	submitUpdateJob(w, r, deployment, deploymentUpdate{Settings: &change.Settings})
+}
+
+//updatableDeployment Gets a deployment that is not already being changed, responding with an error if there is none.
+//Jobs that change a deployment also hold it, which is what keeps two requests that get here at once apart.
+func updatableDeployment(w http.ResponseWriter, id uint) (mds.Deployment, bool) {
+	var deployment mds.Deployment
+	if database.First(&deployment, id).RecordNotFound() {
+		writeError(w, http.StatusNotFound, mds.ErrorCodeNotFound, "Deployment Not Found", nil)
+		return deployment, false
+	}
+	//Another job is already replacing its containers
+	if deployment.Status == "deploying" || deployment.Status == "updating" {
+		writeBusyError(w, map[string]string{"status": deployment.Status})
+		return deployment, false
+	}
+	return deployment, true
+}
+
+//writeBusyError Responds that another job is already changing a deployment
+func writeBusyError(w http.ResponseWriter, details interface{}) {
+	writeError(w, http.StatusConflict, mds.ErrorCodeConflict, "Deployment is busy", details)
+}
+
+//submitUpdateJob Starts updating a deployment in the background and responds with the job
+func submitUpdateJob(w http.ResponseWriter, r *http.Request, deployment mds.Deployment, update deploymentUpdate) {
+	job, ok := jobs.Submit(database, UpdateDeploymentJob, requestUserID(r), []uint{deployment.ID}, func(ctx context.Context, progress deploymentProgress) error {
+		_, err := updateDeployment(dClient, database, deployment.ID, update, progress)
+		if err != nil && update.ApplicationDirectory != "" {
+			//The deployment is still using its previous bundle
+			os.RemoveAll(update.ApplicationDirectory)
 		}
-		//Remove the container
-		err = removeContainer(dClient, deployment.ContainerID)
-		if err != nil {
-			log.Warning(err)
-			//w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, err.Error()+"\n")
-			//return
+		return err
+	})
+	if !ok {
+		if update.ApplicationDirectory != "" {
+			os.RemoveAll(update.ApplicationDirectory)
 		}
-		//Delete Record
-		database.Delete(&deployment)
-		fmt.Fprint(w, "Deleted")
-	} else if authCode == 2 {
-		//Unauthorized 401
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, "Token Expired")
-	} else {
-		//Unauthorized 401
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprint(w, "Unauthorized")
+		writeBusyError(w, nil)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+//Called when DELETE /deployment/:id is called. The legacy route takes the id as a query parameter.
+func deleteDeploymentAPIHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := requestDeploymentID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, err.Error(), nil)
+		return
+	}
+	//Held until it is gone so a job cannot bring back the row or leave containers behind
+	if !jobs.LockDeployments(id) {
+		writeBusyError(w, nil)
+		return
+	}
+	defer jobs.UnlockDeployments(id)
+	//Check to see if the item exists
+	var deployment mds.Deployment
+	if database.First(&deployment, id).RecordNotFound() {
+		writeError(w, http.StatusNotFound, mds.ErrorCodeNotFound, "Deployment Not Found", nil)
+		return
+	}
+	if err := DeleteDeployment(dClient, database, id); err != nil {
+		writeInternalError(w, "Failed to delete deployment", err)
+		return
 	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // Checks authentication
-// Returns 0 if ok, 1 if unauthorized, 2 if expired session
+// Returns one of the Auth constants
 func checkAuthentication(db *gorm.DB, key string, permissionNeeded string) int {
 	//Get the auth token
 	var authenticationKey mds.AuthenticationToken
-	db.Where("authentication_token=?", key).Find(&authenticationKey).First(&authenticationKey)
+	if key == "" || db.Where("authentication_token=?", key).First(&authenticationKey).RecordNotFound() {
+		return AuthUnauthorized
+	}
 
 	//If the token hasn't been used in a week. Force a relogin.
-	if authenticationKey.Persistent == false && (time.Now().Unix() - authenticationKey.LastSeen) > (60 * 60 * 24 * 7) {
-		return 2
+	if authenticationKey.Persistent == false && (time.Now().Unix()-authenticationKey.LastSeen) > (60*60*24*7) {
+		return AuthExpired
 	}
 
 	//Get user of the token
@@ -418,34 +793,97 @@ func checkAuthentication(db *gorm.DB, key string, permissionNeeded string) int {
 		//*.* should be good for everything
 		if permission.Permission == "*.*" {
 			updateLastSeen(db, authenticationKey)
-			return 0
+			return AuthOK
 		}
 		//Check for a match, return 0 if it exists
 		if permission.Permission == permissionNeeded {
 			updateLastSeen(db, authenticationKey)
-			return 0
+			return AuthOK
 		}
 	}
 
-	//Otherwise, they are unauthorized
-	return 1
+	//Otherwise, they are not allowed to do this
+	return AuthForbidden
+}
+
+//getAuthenticatedUserID Gets the ID of the user that owns an authentication token, 0 if the token is unknown
+func getAuthenticatedUserID(db *gorm.DB, key string) uint {
+	var authenticationKey mds.AuthenticationToken
+	db.Where("authentication_token=?", key).First(&authenticationKey)
+	return authenticationKey.UserID
 }
 
 // Updates the lastseen field on the AuthenticationToken and saves it to the DB
 func updateLastSeen(db *gorm.DB, authenticationKey mds.AuthenticationToken) {
 	authenticationKey.LastSeen = time.Now().Unix()
-	db.Save(authenticationKey)
+	db.Save(&authenticationKey)
+}
+
+//registerV1Routes Adds the routes of version 1 of the API to a mux
+func registerV1Routes(mux *goji.Mux) {
+	mux.HandleFunc(pat.Get("/ping"), ping)
+	mux.HandleFunc(pat.Post("/login"), loginAPIHandler)
+	mux.HandleFunc(pat.Get("/deployments"), requirePermission(ListDeploymentPermission, getDeploymentsAPIHandler))
+	mux.HandleFunc(pat.Post("/deployment"), requirePermission(CreateDeploymentPermission, createDeploymentEndpoint))
+	mux.HandleFunc(pat.Get("/deployment/:id"), requirePermission(ListDeploymentPermission, getDeploymentAPIHandler))
+	mux.HandleFunc(pat.Put("/deployment/:id"), requirePermission(UpdateDeploymentPermission, updateDeploymentAPIHandler))
+	mux.HandleFunc(pat.Delete("/deployment/:id"), requirePermission(DeleteDeploymentPermission, deleteDeploymentAPIHandler))
+	mux.HandleFunc(pat.Post("/deployment/import"), requirePermission(CreateDeploymentPermission, importDeploymentAPIHandler))
+	mux.HandleFunc(pat.Get("/deployment/:id/export"), requirePermission(ExportDeploymentPermission, exportDeploymentAPIHandler))
+	mux.HandleFunc(pat.Post("/deployment/:id/export"), requirePermission(ExportDeploymentPermission, exportDeploymentAPIHandler))
+	mux.HandleFunc(pat.Get("/deployment/:id/env"), requirePermission(UpdateDeploymentPermission, getEnvironmentAPIHandler))
+	mux.HandleFunc(pat.Patch("/deployment/:id/env"), requirePermission(UpdateDeploymentPermission, changeEnvironmentAPIHandler))
+	mux.HandleFunc(pat.Put("/deployment/:id/settings"), requirePermission(UpdateDeploymentPermission, pushSettingsAPIHandler))
+	mux.HandleFunc(pat.Post("/deployment/:id/start"), requirePermission(ControlDeploymentPermission, deploymentActionAPIHandler(StartDeploymentAction)))
+	mux.HandleFunc(pat.Post("/deployment/:id/stop"), requirePermission(ControlDeploymentPermission, deploymentActionAPIHandler(StopDeploymentAction)))
+	mux.HandleFunc(pat.Post("/deployment/:id/restart"), requirePermission(ControlDeploymentPermission, deploymentActionAPIHandler(RestartDeploymentAction)))
+	//Uploads become the bundle of a new or updated deployment
+	uploadPermissions := []string{CreateDeploymentPermission, UpdateDeploymentPermission}
+	mux.HandleFunc(pat.Post("/uploads"), requireAnyPermission(uploadPermissions, createUploadAPIHandler))
+	mux.HandleFunc(pat.Get("/uploads/:id"), requireAnyPermission(uploadPermissions, getUploadAPIHandler))
+	mux.HandleFunc(pat.Patch("/uploads/:id"), requireAnyPermission(uploadPermissions, uploadChunkAPIHandler))
+	mux.HandleFunc(pat.Delete("/uploads/:id"), requireAnyPermission(uploadPermissions, deleteUploadAPIHandler))
+	mux.HandleFunc(pat.Get("/registries"), requirePermission(ManageRegistryPermission, getRegistriesAPIHandler))
+	mux.HandleFunc(pat.Put("/registries/:registry"), requirePermission(ManageRegistryPermission, putRegistryAPIHandler))
+	mux.HandleFunc(pat.Delete("/registries/:registry"), requirePermission(ManageRegistryPermission, deleteRegistryAPIHandler))
+	mux.HandleFunc(pat.Get("/images"), requirePermission(ListDeploymentPermission, getImagesAPIHandler))
+	mux.HandleFunc(pat.Post("/images/refresh"), requirePermission(UpdateDeploymentPermission, refreshImagesAPIHandler))
+	mux.HandleFunc(pat.Get("/events"), requirePermission(ListDeploymentPermission, eventsAPIHandler))
+	mux.HandleFunc(pat.Get("/jobs"), requirePermission(ListDeploymentPermission, getJobsAPIHandler))
+	mux.HandleFunc(pat.Get("/jobs/:id"), requirePermission(ListDeploymentPermission, getJobAPIHandler))
+	//The permission needed depends on the type of the job so the handler checks it
+	mux.HandleFunc(pat.Delete("/jobs/:id"), cancelJobAPIHandler)
+	mux.HandleFunc(pat.New("/*"), notFoundAPIHandler)
+}
+
+//registerLegacyRoutes Adds the routes that existed before the API was versioned
+func registerLegacyRoutes(mux *goji.Mux) {
+	mux.HandleFunc(pat.Get("/ping"), deprecated(ping))
+	mux.HandleFunc(pat.Post("/login"), deprecated(loginAPIHandler))
+	mux.HandleFunc(pat.Get("/deployments"), deprecated(requirePermission(ListDeploymentPermission, getDeploymentsAPIHandler)))
+	mux.HandleFunc(pat.Post("/deployment"), deprecated(requirePermission(CreateDeploymentPermission, createDeploymentEndpoint)))
+	mux.HandleFunc(pat.Delete("/deployment"), deprecated(requirePermission(DeleteDeploymentPermission, deleteDeploymentAPIHandler)))
+	mux.HandleFunc(pat.Get("/events"), deprecated(requirePermission(ListDeploymentPermission, eventsAPIHandler)))
+	mux.HandleFunc(pat.Get("/jobs"), deprecated(requirePermission(ListDeploymentPermission, getJobsAPIHandler)))
+	mux.HandleFunc(pat.Get("/jobs/:id"), deprecated(requirePermission(ListDeploymentPermission, getJobAPIHandler)))
+	mux.HandleFunc(pat.Delete("/jobs/:id"), deprecated(cancelJobAPIHandler))
+}
+
+//newAPIMux Builds the mux that serves the whole API
+func newAPIMux() *goji.Mux {
+	mux := goji.NewMux()
+	v1 := goji.SubMux()
+	registerV1Routes(v1)
+	mux.Handle(pat.New(APIV1Prefix+"/*"), v1)
+	mux.HandleFunc(pat.Get("/openapi.json"), openAPIHandler)
+	registerLegacyRoutes(mux)
+	return mux
 }
 
 func startAPI(dockerParam *docker.Client, db *gorm.DB) {
 	dClient = dockerParam
 	database = db
-	mux := goji.NewMux()
-	mux.HandleFunc(pat.Get("/ping"), ping)
-	mux.HandleFunc(pat.Get("/deployments"), getDeploymentsAPIHandler)
-	mux.HandleFunc(pat.Delete("/deployment"), deleteDeploymentAPIHandler)
-	mux.HandleFunc(pat.Post("/deployment"), createDeploymentEndpoint)
-	mux.HandleFunc(pat.Post("/login"), loginAPIHandler)
+	mux := newAPIMux()
 
 	apiCertFile := viper.GetString("ApiHttpsCertificate")
 	apiKeyFile := viper.GetString("ApiHttpsKey")
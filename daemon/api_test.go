@@ -0,0 +1,844 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/client"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//Contract tests: the client package is run against the real handlers so the two cannot drift apart.
+
+const testPassword = "correct horse battery staple"
+
+//newTestAPI Serves the API from a fresh database and returns a client pointed at it
+func newTestAPI(t *testing.T) (*client.Client, func()) {
+	dir, err := ioutil.TempDir("", "mds-api-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open("sqlite3", filepath.Join(dir, "mds.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	if err := migrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	createUser(db, "Admin", "User", "admin", "admin@example.com", testPassword, []string{"*.*"})
+	createUser(db, "Read", "Only", "viewer", "viewer@example.com", testPassword, []string{ListDeploymentPermission})
+	database = db
+	dClient = nil
+	secrets, err = newSecretBox(make([]byte, masterKeyLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewTLSServer(newAPIMux())
+	apiClient := client.New(strings.TrimPrefix(server.URL, "https://"), true, true)
+	return apiClient, func() {
+		server.Close()
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+//waitForJob Polls a job until it has finished and returns it, failing the test if that takes too long
+func waitForJob(t *testing.T, apiClient *client.Client, jobID uint) mds.Job {
+	for i := 0; i < 100; i++ {
+		job, err := apiClient.GetJob(jobID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job.IsFinished() {
+			return job
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("Job %d did not finish", jobID)
+	return mds.Job{}
+}
+
+//login Logs the client in or fails the test
+func login(t *testing.T, apiClient *client.Client, username string) {
+	if _, err := apiClient.Login(username, testPassword, false); err != nil {
+		t.Fatalf("Login as %s failed: %s", username, err)
+	}
+}
+
+//expectAPIError Fails the test unless err is an API error with the status and code
+func expectAPIError(t *testing.T, err error, status int, code string) {
+	apiErr, ok := err.(*client.Error)
+	if !ok {
+		t.Fatalf("Expected an API error with code %s, got %v", code, err)
+	}
+	if apiErr.StatusCode != status || apiErr.Code != code {
+		t.Fatalf("Expected %d %s, got %d %s (%s)", status, code, apiErr.StatusCode, apiErr.Code, apiErr.Message)
+	}
+}
+
+func TestPing(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+	if err := apiClient.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+
+	_, err := apiClient.Login("admin", "wrong", false)
+	expectAPIError(t, err, http.StatusUnauthorized, mds.ErrorCodeInvalidCredentials)
+	_, err = apiClient.Login("", "", false)
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+
+	token, err := apiClient.Login("admin", testPassword, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AuthenticationToken == "" || apiClient.Token != token.AuthenticationToken {
+		t.Fatalf("Client did not keep the token: %+v", token)
+	}
+	if !token.Persistent {
+		t.Fatal("Persistent login returned a token that expires")
+	}
+}
+
+func TestAuthenticationErrors(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+
+	_, err := apiClient.ListDeployments()
+	expectAPIError(t, err, http.StatusUnauthorized, mds.ErrorCodeUnauthorized)
+	apiClient.Token = "not-a-token"
+	_, err = apiClient.ListDeployments()
+	expectAPIError(t, err, http.StatusUnauthorized, mds.ErrorCodeUnauthorized)
+
+	login(t, apiClient, "viewer")
+	if _, err = apiClient.ListDeployments(); err != nil {
+		t.Fatal(err)
+	}
+	err = apiClient.DeleteDeployment(1)
+	expectAPIError(t, err, http.StatusForbidden, mds.ErrorCodeForbidden)
+}
+
+func TestDeployments(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+	login(t, apiClient, "admin")
+
+	deployments, err := apiClient.ListDeployments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deployments == nil || len(deployments) != 0 {
+		t.Fatalf("Expected an empty list, got %v", deployments)
+	}
+
+	err = apiClient.DeleteDeployment(42)
+	expectAPIError(t, err, http.StatusNotFound, mds.ErrorCodeNotFound)
+
+	bundle, err := ioutil.TempFile("", "mds-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle.Close()
+	defer os.Remove(bundle.Name())
+	_, err = apiClient.CreateDeployment(client.CreateDeploymentRequest{BundlePath: bundle.Name()})
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+}
+
+func TestDeploymentDetail(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+	login(t, apiClient, "admin")
+
+	//A deployment whose containers have not been created yet, so docker is never asked about it
+	deployment := mds.Deployment{ProjectName: "detail", Port: "30001", URL: "detail.example.com", Status: "deploying"}
+	database.Create(&deployment)
+	database.Create(&NginxProxyConfiguration{DomainName: "detail.example.com", Destination: "http://127.0.0.1:30001", DeploymentID: deployment.ID})
+
+	detail, err := apiClient.GetDeployment(deployment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.ID != deployment.ID || detail.Port != "30001" || detail.MongoMode != mds.MongoModeExternal {
+		t.Fatalf("Unexpected detail: %+v", detail)
+	}
+	if detail.Proxy == nil || detail.Proxy.DomainName != "detail.example.com" || detail.Proxy.IsHTTPS {
+		t.Fatalf("Unexpected proxy: %+v", detail.Proxy)
+	}
+
+	_, err = apiClient.GetDeployment(999)
+	expectAPIError(t, err, http.StatusNotFound, mds.ErrorCodeNotFound)
+	_, err = apiClient.StartDeployment(999)
+	expectAPIError(t, err, http.StatusNotFound, mds.ErrorCodeNotFound)
+	_, err = apiClient.StopDeployment(deployment.ID)
+	expectAPIError(t, err, http.StatusConflict, mds.ErrorCodeConflict)
+	//Nothing is started or stopped while a job holds the deployment
+	jobs.LockDeployments(deployment.ID)
+	_, err = apiClient.StartDeployment(deployment.ID)
+	jobs.UnlockDeployments(deployment.ID)
+	expectAPIError(t, err, http.StatusConflict, mds.ErrorCodeConflict)
+	if !strings.Contains(err.Error(), "busy") {
+		t.Fatalf("Expected the deployment to be busy, got %v", err)
+	}
+
+	login(t, apiClient, "viewer")
+	_, err = apiClient.RestartDeployment(deployment.ID)
+	expectAPIError(t, err, http.StatusForbidden, mds.ErrorCodeForbidden)
+}
+
+func TestUpdateDeployment(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+	login(t, apiClient, "admin")
+
+	deployment := mds.Deployment{ProjectName: "update", Port: "30002", Status: "running"}
+	database.Create(&deployment)
+	settings := `{"public":{}}`
+
+	_, err := apiClient.UpdateDeployment(999, client.UpdateDeploymentRequest{Settings: &settings})
+	expectAPIError(t, err, http.StatusNotFound, mds.ErrorCodeNotFound)
+	_, err = apiClient.UpdateDeployment(deployment.ID, client.UpdateDeploymentRequest{})
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+	_, err = apiClient.UpdateDeployment(deployment.ID, client.UpdateDeploymentRequest{Env: []string{"MONGO_URL=mongodb://elsewhere"}})
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+	_, err = apiClient.UpdateDeployment(deployment.ID, client.UpdateDeploymentRequest{Env: []string{"NOT A PAIR"}})
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+
+	database.Model(&deployment).Update("status", "updating")
+	_, err = apiClient.UpdateDeployment(deployment.ID, client.UpdateDeploymentRequest{Settings: &settings})
+	expectAPIError(t, err, http.StatusConflict, mds.ErrorCodeConflict)
+	//A deployment is not deleted from under the job holding it
+	jobs.LockDeployments(deployment.ID)
+	err = apiClient.DeleteDeployment(deployment.ID)
+	jobs.UnlockDeployments(deployment.ID)
+	expectAPIError(t, err, http.StatusConflict, mds.ErrorCodeConflict)
+	if database.First(&mds.Deployment{}, deployment.ID).RecordNotFound() {
+		t.Fatal("Deployment held by a job was deleted")
+	}
+
+	login(t, apiClient, "viewer")
+	_, err = apiClient.UpdateDeployment(deployment.ID, client.UpdateDeploymentRequest{Settings: &settings})
+	expectAPIError(t, err, http.StatusForbidden, mds.ErrorCodeForbidden)
+}
+
+func TestOverlappingUpdates(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+	login(t, apiClient, "admin")
+	//The engine holds the first update on its first request until the test lets it go
+	inspected := make(chan bool, 1)
+	release := make(chan bool)
+	engine := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case inspected <- true:
+		default:
+		}
+		<-release
+		http.NotFound(w, r)
+	}))
+	defer engine.Close()
+	dClient, _ = docker.NewClient(engine.URL)
+
+	deployment := mds.Deployment{ProjectName: "overlap", ContainerID: "app1", Port: "30009", Status: "running"}
+	database.Create(&deployment)
+	database.Create(&NginxProxyConfiguration{DomainName: "overlap.example.com", DeploymentID: deployment.ID})
+	settings := `{"public":{}}`
+
+	first, err := apiClient.UpdateDeployment(deployment.ID, client.UpdateDeploymentRequest{Settings: &settings})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = apiClient.PushSettings(deployment.ID, "{}")
+	expectAPIError(t, err, http.StatusConflict, mds.ErrorCodeConflict)
+
+	//The job holds the deployment even while its status does not say so
+	<-inspected
+	database.Model(&deployment).Update("status", "running")
+	_, err = apiClient.UpdateDeployment(deployment.ID, client.UpdateDeploymentRequest{Settings: &settings})
+	expectAPIError(t, err, http.StatusConflict, mds.ErrorCodeConflict)
+
+	//Once the first update ends the deployment can be updated again
+	close(release)
+	waitForJob(t, apiClient, first.ID)
+	if _, err := apiClient.PushSettings(deployment.ID, "{}"); err != nil {
+		t.Fatalf("Update after the first one ended was rejected: %v", err)
+	}
+}
+
+func TestConfigurationRedeploys(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+	login(t, apiClient, "admin")
+
+	deployment := mds.Deployment{ProjectName: "configured", Port: "30003", Status: "running"}
+	database.Create(&deployment)
+	var configuration applicationConfiguration
+	configuration.Settings = `{"public":{}}`
+	configuration.apply([]string{"MODE=a=b"}, []string{"API_KEY=abc"}, nil)
+	if err := saveApplicationConfiguration(database, &deployment, configuration); err != nil {
+		t.Fatal(err)
+	}
+
+	//Nothing is stored in plaintext
+	var stored mds.EnvironmentVariable
+	database.Where("name = ?", "API_KEY").First(&stored)
+	if !stored.Secret || strings.Contains(stored.Value, "abc") || !strings.HasPrefix(deployment.Settings, encryptedValuePrefix) {
+		t.Fatalf("Configuration was not encrypted: %+v %q", stored, deployment.Settings)
+	}
+	//The checksum lets clients compare settings without reading them
+	if deployment.SettingsChecksum != checksumSettings(configuration.Settings) || deployment.SettingsChecksum == "" {
+		t.Fatalf("Unexpected settings checksum %q", deployment.SettingsChecksum)
+	}
+
+	variables, err := apiClient.ListEnvironment(deployment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(variables) != 2 || variables[0].Value != "a=b" || variables[0].Secret {
+		t.Fatalf("Unexpected variables: %+v", variables)
+	}
+	if variables[1].Name != "API_KEY" || !variables[1].Secret || variables[1].Value != mds.RedactedValue {
+		t.Fatalf("Secret was not redacted: %+v", variables[1])
+	}
+	detail, err := apiClient.GetDeployment(deployment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(detail.EnvironmentVariables, ",") != "MODE,API_KEY" {
+		t.Fatalf("Expected the stored variable names, got %v", detail.EnvironmentVariables)
+	}
+
+	_, err = apiClient.ChangeEnvironment(deployment.ID, mds.EnvironmentChange{})
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+	_, err = apiClient.ChangeEnvironment(deployment.ID, mds.EnvironmentChange{Unset: []string{"ROOT_URL"}})
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+	_, err = apiClient.ChangeEnvironment(999, mds.EnvironmentChange{Set: []string{"A=1"}})
+	expectAPIError(t, err, http.StatusNotFound, mds.ErrorCodeNotFound)
+	_, err = apiClient.PushSettings(deployment.ID, "{not json")
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+
+	database.Model(&deployment).Update("status", "updating")
+	_, err = apiClient.PushSettings(deployment.ID, "{}")
+	expectAPIError(t, err, http.StatusConflict, mds.ErrorCodeConflict)
+
+	//Values can hold credentials so only users that can change them can read them
+	login(t, apiClient, "viewer")
+	_, err = apiClient.ListEnvironment(deployment.ID)
+	expectAPIError(t, err, http.StatusForbidden, mds.ErrorCodeForbidden)
+}
+
+func TestDeploymentSpecs(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+	login(t, apiClient, "admin")
+
+	bundle, err := ioutil.TempFile("", "mds-bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundle.Close()
+	defer os.Remove(bundle.Name())
+
+	deployment := mds.Deployment{ProjectName: "spec", Port: "30004", Status: "running"}
+	database.Create(&deployment)
+	database.Create(&NginxProxyConfiguration{DomainName: "app.example.com", Aliases: "www.example.com", DeploymentID: deployment.ID})
+	database.Create(&NginxProxyConfiguration{DomainName: "other.example.com", DeploymentID: 999})
+
+	//Checked before the bundle is saved
+	create := client.CreateDeploymentRequest{ProjectName: "taken", BundlePath: bundle.Name()}
+	create.Spec = &mds.DeploymentSpec{Domains: []string{"new.example.com", "WWW.example.com"}}
+	_, err = apiClient.CreateDeployment(create)
+	expectAPIError(t, err, http.StatusConflict, mds.ErrorCodeConflict)
+	create.Spec = &mds.DeploymentSpec{Resources: mds.ResourceLimits{MemoryMB: 1}}
+	_, err = apiClient.CreateDeployment(create)
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+
+	//The primary domain and MongoDB mode are fixed once the deployment exists
+	update := client.UpdateDeploymentRequest{Spec: &mds.DeploymentSpec{Domains: []string{"moved.example.com"}}}
+	_, err = apiClient.UpdateDeployment(deployment.ID, update)
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+	update.Spec = &mds.DeploymentSpec{MongoMode: mds.MongoModeManaged}
+	_, err = apiClient.UpdateDeployment(deployment.ID, update)
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+	update.Spec = &mds.DeploymentSpec{Domains: []string{"app.example.com", "other.example.com"}}
+	_, err = apiClient.UpdateDeployment(deployment.ID, update)
+	expectAPIError(t, err, http.StatusConflict, mds.ErrorCodeConflict)
+	update.Spec = &mds.DeploymentSpec{HealthCheck: &mds.HealthCheck{Interval: 5, Timeout: 10}}
+	_, err = apiClient.UpdateDeployment(deployment.ID, update)
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+	_, err = apiClient.UpdateDeployment(deployment.ID, client.UpdateDeploymentRequest{Unset: []string{"not a name"}})
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+	update.Spec = &mds.DeploymentSpec{Network: "-shared"}
+	_, err = apiClient.UpdateDeployment(deployment.ID, update)
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+}
+
+func TestImageDeployments(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+	login(t, apiClient, "admin")
+	dir, err := ioutil.TempDir("", "mds-images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set("ApplicationDirectory", dir+"/")
+	defer viper.Set("ApplicationDirectory", "")
+	tarball := filepath.Join(dir, "image.tar")
+	if err := ioutil.WriteFile(tarball, []byte("not written by docker save"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	//A deployment runs a bundle or an image, never both
+	rejected := []client.CreateDeploymentRequest{
+		{ProjectName: "image", Type: "vm", BundlePath: tarball},
+		{ProjectName: "image", BundlePath: tarball, Spec: &mds.DeploymentSpec{Image: "nginx:1.13"}},
+		{ProjectName: "image", Type: mds.DeploymentTypeImage},
+		{ProjectName: "image", Type: mds.DeploymentTypeImage, BundlePath: tarball, Spec: &mds.DeploymentSpec{Image: "nginx:1.13"}},
+		{ProjectName: "image", Type: mds.DeploymentTypeImage, Spec: &mds.DeploymentSpec{Image: "nginx:1.13", BaseImage: "node:8"}},
+		{ProjectName: "image", Type: mds.DeploymentTypeImage, Spec: &mds.DeploymentSpec{Image: "nginx 1.13"}},
+		{ProjectName: "image", Type: mds.DeploymentTypeImage, Spec: &mds.DeploymentSpec{Image: "nginx:1.13", ContainerPort: 70000}},
+	}
+	for _, request := range rejected {
+		_, err = apiClient.CreateDeployment(request)
+		expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+	}
+	//Tarballs are checked before anything is deployed and nothing is kept if they are rejected
+	_, err = apiClient.CreateDeployment(client.CreateDeploymentRequest{ProjectName: "image", Type: mds.DeploymentTypeImage, BundlePath: tarball})
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeInvalidImage)
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("Rejected image tarball was kept: %d entries", len(entries))
+	}
+
+	bundleDeployment := mds.Deployment{ProjectName: "bundle", Type: mds.DeploymentTypeBundle, Port: "30006", Status: "running"}
+	database.Create(&bundleDeployment)
+	_, err = apiClient.UpdateDeployment(bundleDeployment.ID, client.UpdateDeploymentRequest{Spec: &mds.DeploymentSpec{Image: "nginx:1.13"}})
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+	imageDeployment := mds.Deployment{ProjectName: "image", Type: mds.DeploymentTypeImage, Port: "30007", Status: "running", Spec: mds.DeploymentSpec{Image: "nginx:1.13"}}
+	database.Create(&imageDeployment)
+	_, err = apiClient.UpdateDeployment(imageDeployment.ID, client.UpdateDeploymentRequest{BundlePath: tarball, Spec: &mds.DeploymentSpec{Image: "nginx:1.14"}})
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+	_, err = apiClient.UpdateDeployment(imageDeployment.ID, client.UpdateDeploymentRequest{BundlePath: tarball})
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeInvalidImage)
+}
+
+func TestUploads(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+	login(t, apiClient, "admin")
+	dir, err := ioutil.TempDir("", "mds-uploads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	viper.Set("DataDirectory", dir)
+	viper.Set("ApplicationDirectory", dir+"/")
+	defer viper.Set("DataDirectory", "")
+	defer viper.Set("ApplicationDirectory", "")
+
+	data := []byte(strings.Repeat("meteor bundle ", 10))
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+	_, err = apiClient.CreateUpload(mds.UploadRequest{Size: int64(len(data)), SHA256: "abc"})
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+	upload, err := apiClient.CreateUpload(mds.UploadRequest{Size: int64(len(data)), SHA256: checksum})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Chunks have to continue where the last one stopped
+	_, err = apiClient.UploadChunk(upload.ID, 5, bytes.NewReader(data[5:10]), 5)
+	expectAPIError(t, err, http.StatusConflict, mds.ErrorCodeConflict)
+	if _, err = apiClient.UploadChunk(upload.ID, 0, bytes.NewReader(data[:40]), 40); err != nil {
+		t.Fatal(err)
+	}
+	upload, err = apiClient.GetUpload(upload.ID)
+	if err != nil || upload.Offset != 40 || upload.Complete {
+		t.Fatalf("Unexpected upload after the first chunk: %+v %v", upload, err)
+	}
+	_, err = apiClient.UploadChunk(upload.ID, 40, bytes.NewReader(append(data[40:], 'x')), int64(len(data)-39))
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+
+	//Incomplete uploads cannot become a bundle
+	deployment := mds.Deployment{ProjectName: "uploaded", Port: "30005", Status: "updating"}
+	database.Create(&deployment)
+	_, err = apiClient.UpdateDeployment(deployment.ID, client.UpdateDeploymentRequest{UploadID: upload.ID})
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+
+	upload, err = apiClient.ResumeUpload(upload, bytes.NewReader(data), 25, nil)
+	if err != nil || !upload.Complete || upload.Offset != upload.Size {
+		t.Fatalf("Upload did not complete: %+v %v", upload, err)
+	}
+	_, err = apiClient.UpdateDeployment(deployment.ID, client.UpdateDeploymentRequest{UploadID: upload.ID})
+	expectAPIError(t, err, http.StatusConflict, mds.ErrorCodeConflict)
+
+	//Uploads belong to the user that started them
+	login(t, apiClient, "viewer")
+	_, err = apiClient.GetUpload(upload.ID)
+	expectAPIError(t, err, http.StatusForbidden, mds.ErrorCodeForbidden)
+	login(t, apiClient, "admin")
+
+	destination, err := moveUpload(upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved, err := ioutil.ReadFile(filepath.Join(destination, "application.tar.gz"))
+	if err != nil || !bytes.Equal(moved, data) {
+		t.Fatalf("Bundle was not moved: %q %v", moved, err)
+	}
+	_, err = apiClient.GetUpload(upload.ID)
+	expectAPIError(t, err, http.StatusNotFound, mds.ErrorCodeNotFound)
+
+	//A bundle that does not match its checksum is thrown away
+	upload, err = apiClient.CreateUpload(mds.UploadRequest{Size: int64(len(data)), SHA256: strings.Repeat("0", 64)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = apiClient.UploadChunk(upload.ID, 0, bytes.NewReader(data), int64(len(data)))
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+	_, err = apiClient.GetUpload(upload.ID)
+	expectAPIError(t, err, http.StatusNotFound, mds.ErrorCodeNotFound)
+
+	bundle := filepath.Join(dir, "bundle.tar.gz")
+	if err := ioutil.WriteFile(bundle, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	upload, err = apiClient.UploadBundle(bundle, 32, nil)
+	if err != nil || !upload.Complete || upload.SHA256 != checksum {
+		t.Fatalf("Bundle was not uploaded: %+v %v", upload, err)
+	}
+
+	//Bundles are checked before anything is deployed and nothing is kept if they are rejected
+	entries, _ := ioutil.ReadDir(dir)
+	_, err = apiClient.CreateDeployment(client.CreateDeploymentRequest{ProjectName: "corrupt", BundlePath: bundle})
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeInvalidBundle)
+	if after, _ := ioutil.ReadDir(dir); len(after) != len(entries) {
+		t.Fatalf("Rejected bundle was kept: %d entries before, %d after", len(entries), len(after))
+	}
+
+	//Abandoned uploads are removed once they expire
+	database.Model(&upload).Update("expires_at", time.Now().Add(-time.Minute))
+	removeExpiredUploads(database)
+	_, err = apiClient.GetUpload(upload.ID)
+	expectAPIError(t, err, http.StatusNotFound, mds.ErrorCodeNotFound)
+	if _, err := os.Stat(uploadPath(upload.ID)); !os.IsNotExist(err) {
+		t.Fatalf("Data of expired upload was kept: %v", err)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	deployment := mds.Deployment{Port: server.URL[strings.LastIndex(server.URL, ":")+1:]}
+	deployment.Spec.HealthCheck = &mds.HealthCheck{Path: "/health", Timeout: 1}
+	if err := probeDeployment(deployment); err != nil {
+		t.Fatalf("Expected the probe to pass: %s", err)
+	}
+	status = http.StatusServiceUnavailable
+	if err := probeDeployment(deployment); err == nil {
+		t.Fatal("Expected the probe to fail on a 503")
+	}
+
+	//Unhealthy only after retries failures in a row
+	for _, c := range []struct {
+		current  string
+		failures int
+		expected string
+	}{
+		{"", 0, healthHealthy},
+		{"", 1, healthStarting},
+		{healthHealthy, 2, healthHealthy},
+		{healthHealthy, 3, healthUnhealthy},
+		{healthUnhealthy, 0, healthHealthy},
+	} {
+		if health := nextHealth(c.current, c.failures, 3); health != c.expected {
+			t.Errorf("nextHealth(%q, %d, 3) = %q, expected %q", c.current, c.failures, health, c.expected)
+		}
+	}
+}
+
+func TestMergeEnvironment(t *testing.T) {
+	merged := mergeEnvironment([]string{"A=1", "B=2"}, []string{"B=3", "C=4"})
+	expected := []string{"A=1", "B=3", "C=4"}
+	if strings.Join(merged, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected %v, got %v", expected, merged)
+	}
+	if remaining := removeEnvironment(merged, []string{"A", "C"}); len(remaining) != 1 || remaining[0] != "B=3" {
+		t.Fatalf("Expected only B=3 to remain, got %v", remaining)
+	}
+}
+
+func TestDeploymentExports(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+	root, reset := testBackupHost(t)
+	defer reset()
+	createUser(database, "Export", "Only", "exporter", "exporter@example.com", testPassword, []string{ExportDeploymentPermission})
+	deployment := createTestExportDeployment(t, root)
+	login(t, apiClient, "admin")
+
+	var archive bytes.Buffer
+	if err := apiClient.ExportDeployment(deployment.ID, false, &archive); err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(root, "export.tar.gz")
+	if err := ioutil.WriteFile(archivePath, archive.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if manifest, err := readExportManifest(archivePath); err != nil || manifest.ProjectName != "exported" {
+		t.Fatalf("Unexpected export: %+v %v", manifest, err)
+	}
+	err := apiClient.ExportDeployment(999, false, ioutil.Discard)
+	expectAPIError(t, err, http.StatusNotFound, mds.ErrorCodeNotFound)
+	//Downloading never stops the deployment, that takes a POST
+	r, _ := http.NewRequest("GET", apiClient.BaseURL+client.APIPrefix+"/deployment/"+strconv.Itoa(int(deployment.ID))+"/export?stop=true", nil)
+	r.Header.Set("X-Auth-Token", apiClient.Token)
+	resp, err := apiClient.HTTPClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected GET with stop to be refused, got %s", resp.Status)
+	}
+
+	//The deployment still has its domain names on this daemon
+	_, err = apiClient.ImportDeployment(archivePath, nil)
+	expectAPIError(t, err, http.StatusConflict, mds.ErrorCodeConflict)
+	notAnArchive := filepath.Join(root, "not-an-archive")
+	writeTestFile(t, notAnArchive, "not gzip")
+	_, err = apiClient.ImportDeployment(notAnArchive, nil)
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeInvalidExport)
+
+	//Stopping the deployment is a control action
+	login(t, apiClient, "exporter")
+	err = apiClient.ExportDeployment(deployment.ID, true, ioutil.Discard)
+	expectAPIError(t, err, http.StatusForbidden, mds.ErrorCodeForbidden)
+	_, err = apiClient.ImportDeployment(archivePath, nil)
+	expectAPIError(t, err, http.StatusForbidden, mds.ErrorCodeForbidden)
+	login(t, apiClient, "viewer")
+	err = apiClient.ExportDeployment(deployment.ID, false, ioutil.Discard)
+	expectAPIError(t, err, http.StatusForbidden, mds.ErrorCodeForbidden)
+}
+
+func TestJobs(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+	login(t, apiClient, "admin")
+
+	finishedAt := time.Now()
+	job := mds.Job{Type: CreateDeploymentJob, Status: mds.JobStatusFailed, Error: "Step 'mongo' failed", FailedStep: "mongo", FinishedAt: &finishedAt}
+	database.Create(&job)
+	database.Create(&mds.JobStep{JobID: job.ID, Name: "record", Message: "Created deployment record"})
+	database.Create(&mds.JobStep{JobID: job.ID, Name: "domain", Message: "Reserved domain"})
+
+	jobList, err := apiClient.ListJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobList) != 1 || jobList[0].ID != job.ID {
+		t.Fatalf("Expected job %d in the list, got %v", job.ID, jobList)
+	}
+
+	fetched, err := apiClient.GetJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fetched.FailedStep != "mongo" || len(fetched.Steps) != 2 || fetched.Steps[0].Name != "record" {
+		t.Fatalf("Job did not round trip: %+v", fetched)
+	}
+
+	err = apiClient.CancelJob(job.ID)
+	expectAPIError(t, err, http.StatusConflict, mds.ErrorCodeConflict)
+	_, err = apiClient.GetJob(999)
+	expectAPIError(t, err, http.StatusNotFound, mds.ErrorCodeNotFound)
+}
+
+func TestInterruptedJobs(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+	login(t, apiClient, "admin")
+	engine := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"Id":"app1","State":{"Status":"running","Running":true}}`))
+	}))
+	defer engine.Close()
+	startEngine, _ := docker.NewClient(engine.URL)
+
+	//The daemon stopped part way through an update
+	deployment := mds.Deployment{ProjectName: "interrupted", ContainerID: "app1", Port: "30010", Status: "updating"}
+	database.Create(&deployment)
+	database.Create(&NginxProxyConfiguration{DomainName: "interrupted.example.com", DeploymentID: deployment.ID})
+	job := mds.Job{Type: UpdateDeploymentJob, Status: mds.JobStatusRunning, DeploymentID: deployment.ID}
+	database.Create(&job)
+	_, err := apiClient.PushSettings(deployment.ID, "{}")
+	expectAPIError(t, err, http.StatusConflict, mds.ErrorCodeConflict)
+
+	//Starting up again fails the job and gives the deployment the status of its container
+	failInterruptedJobs(startEngine, database)
+	database.First(&job, job.ID)
+	database.First(&deployment, deployment.ID)
+	if job.Status != mds.JobStatusFailed || deployment.Status != "running" {
+		t.Fatalf("Unexpected state after starting up: job %s, deployment %s", job.Status, deployment.Status)
+	}
+	update, err := apiClient.PushSettings(deployment.ID, "{}")
+	if err != nil {
+		t.Fatalf("Deployment could not be updated after starting up: %v", err)
+	}
+
+	//Without a docker client the update crashes, which must not leave the deployment updating either
+	if finished := waitForJob(t, apiClient, update.ID); finished.Status != mds.JobStatusFailed || !strings.Contains(finished.Error, "crashed") {
+		t.Fatalf("Expected the update to crash, got %+v", finished)
+	}
+	database.First(&deployment, deployment.ID)
+	if deployment.Status != "exited" {
+		t.Fatalf("Crashed update left the deployment %s", deployment.Status)
+	}
+	if _, err := apiClient.PushSettings(deployment.ID, "{}"); err != nil {
+		t.Fatalf("Deployment could not be updated after the crash: %v", err)
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+	login(t, apiClient, "admin")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	received := make(chan mds.DeploymentEvent, 16)
+	done := make(chan error, 1)
+	go func() {
+		done <- apiClient.WatchEvents(ctx, 7, func(event mds.DeploymentEvent) {
+			received <- event
+		})
+	}()
+
+	//The subscription starts some time after the request is sent so keep publishing until an event arrives
+	deployment := mds.Deployment{ProjectName: "watched", Status: "running"}
+	deployment.ID = 7
+	other := mds.Deployment{ProjectName: "ignored", Status: "running"}
+	other.ID = 8
+	timeout := time.After(5 * time.Second)
+	for {
+		publishProgress(&other, "container", "Not for this watcher")
+		publishProgress(&deployment, "container", "Started container")
+		select {
+		case event := <-received:
+			if event.DeploymentID != 7 || event.Type != mds.EventTypeProgress || event.Step != "container" {
+				t.Fatalf("Unexpected event: %+v", event)
+			}
+			cancel()
+			<-done
+			return
+		case err := <-done:
+			t.Fatalf("Event stream ended early: %v", err)
+		case <-timeout:
+			t.Fatal("No event received")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+
+	resp, err := apiClient.HTTPClient.Get(apiClient.BaseURL + "/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var document struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+		t.Fatalf("Document is not valid JSON: %s", err)
+	}
+	if !strings.HasPrefix(document.OpenAPI, "3.") {
+		t.Fatalf("Expected an OpenAPI 3 document, got %q", document.OpenAPI)
+	}
+
+	//Every route in registerV1Routes, in OpenAPI notation
+	routes := map[string][]string{
+		"/ping":                     {"get"},
+		"/login":                    {"post"},
+		"/deployments":              {"get"},
+		"/deployment":               {"post"},
+		"/deployment/{id}":          {"get", "put", "delete"},
+		"/deployment/{id}/start":    {"post"},
+		"/deployment/{id}/stop":     {"post"},
+		"/deployment/{id}/restart":  {"post"},
+		"/deployment/{id}/env":      {"get", "patch"},
+		"/deployment/{id}/settings": {"put"},
+		"/deployment/{id}/export":   {"get", "post"},
+		"/deployment/import":        {"post"},
+		"/jobs":                     {"get"},
+		"/jobs/{id}":                {"get", "delete"},
+		"/events":                   {"get"},
+		"/uploads":                  {"post"},
+		"/uploads/{id}":             {"get", "patch", "delete"},
+		"/registries":               {"get"},
+		"/registries/{registry}":    {"put", "delete"},
+		"/images":                   {"get"},
+		"/images/refresh":           {"post"},
+	}
+	for path, methods := range routes {
+		for _, method := range methods {
+			if _, ok := document.Paths[path][method]; !ok {
+				t.Errorf("%s %s is not documented", strings.ToUpper(method), path)
+			}
+		}
+	}
+	for path := range document.Paths {
+		if _, ok := routes[path]; !ok {
+			t.Errorf("%s is documented but not tested", path)
+		}
+	}
+}
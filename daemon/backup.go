@@ -0,0 +1,893 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//Version of the layout of backup archives. Restore refuses archives of other versions.
+const backupFormatVersion = 1
+
+//Entries of a backup archive
+const (
+	backupManifestEntry      = "manifest.json"
+	backupMasterKeyEntry     = "master.key"
+	backupDatabasePrefix     = "database/"     //A gob encoded slice of the rows of each table
+	backupApplicationsPrefix = "applications/" //ApplicationDirectory
+	backupCertificatesPrefix = "certificates/" //CertDestination
+	backupNginxPrefix        = "nginx/"        //Configuration files MDS wrote to NginxSitesDestination
+	backupMongoPrefix        = "mongo/"        //A mongodump archive for each deployment with a managed MongoDB
+)
+
+//Start of an encrypted backup, followed by the ID of its key and a newline
+const encryptedBackupHeader = "MDS-BACKUP-ENCRYPTED-1 "
+
+//Bytes of the archive sealed at a time when it is encrypted
+const backupChunkSize = 64 * 1024
+
+//backupManifest Describes a backup. It is the first entry of the archive so restore can check it before changing anything.
+type backupManifest struct {
+	Version           int
+	CreatedAt         time.Time
+	Hostname          string
+	SchemaVersion     uint   //Schema of the rows, they can only be restored by an mds-daemon at the same version
+	MasterKeyID       string //Key the stored secrets are encrypted with
+	IncludesMasterKey bool   //Only encrypted backups carry the master key
+	//Absolute directories of the host the backup was made on. Stored paths under them are moved on restore.
+	ApplicationDirectory string
+	CertDestination      string
+	NginxSitesDirectory  string
+	Rows                 map[string]int //Rows stored of every table
+	MongoDumps           []uint         //Deployments whose MongoDB was dumped
+}
+
+//backupOptions What writeBackup includes and how it is protected
+type backupOptions struct {
+	Key       *secretBox //Encrypts the archive so it can carry the master key, nil to write it in the clear
+	SkipMongo bool       //Leave out the MongoDB dumps, for hosts whose databases are backed up some other way
+}
+
+//backupDirectories The directories of this host that are backed up, by the prefix of their entries
+func backupDirectories() map[string]string {
+	return map[string]string{
+		backupApplicationsPrefix: absolutePath(viper.GetString("ApplicationDirectory")),
+		backupCertificatesPrefix: absolutePath(viper.GetString("CertDestination")),
+		backupNginxPrefix:        absolutePath(viper.GetString("NginxSitesDestination")),
+	}
+}
+
+//absolutePath Expands a relative path, leaving it as it is if that fails
+func absolutePath(path string) string {
+	if path == "" {
+		return ""
+	}
+	if absolute, err := filepath.Abs(path); err == nil {
+		return absolute
+	}
+	return path
+}
+
+//movedPath Gets where a path under oldDirectory ends up once the directory is restored to newDirectory.
+//Paths outside of oldDirectory are returned unchanged.
+func movedPath(path string, oldDirectory string, newDirectory string) string {
+	if path == "" || oldDirectory == "" || newDirectory == "" {
+		return path
+	}
+	relative, err := filepath.Rel(oldDirectory, path)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return path
+	}
+	moved := filepath.Join(newDirectory, relative)
+	//The nginx sites directory is configured with a trailing separator and joined to file names without one
+	if relative == "." && strings.HasSuffix(path, string(filepath.Separator)) {
+		moved += string(filepath.Separator)
+	}
+	return moved
+}
+
+//writeBackup Writes the database, the files of the deployments and their MongoDB databases to out.
+//The rows are read in one transaction so they are consistent with each other.
+func writeBackup(db *gorm.DB, client *docker.Client, out io.Writer, options backupOptions) (backupManifest, error) {
+	directories := backupDirectories()
+	manifest := backupManifest{
+		Version:              backupFormatVersion,
+		CreatedAt:            time.Now().UTC(),
+		MasterKeyID:          secrets.keyID,
+		IncludesMasterKey:    options.Key != nil,
+		ApplicationDirectory: directories[backupApplicationsPrefix],
+		CertDestination:      directories[backupCertificatesPrefix],
+		NginxSitesDirectory:  directories[backupNginxPrefix],
+		Rows:                 map[string]int{},
+	}
+	manifest.Hostname, _ = os.Hostname()
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return manifest, err
+	}
+	manifest.SchemaVersion = schemaVersion(applied)
+	if manifest.SchemaVersion != latestSchemaVersion(migrations) {
+		return manifest, fmt.Errorf("The database is at schema version %d, run 'mds-daemon migrate up' first", manifest.SchemaVersion)
+	}
+	masterKey := ""
+	if options.Key != nil {
+		if masterKey, err = encodedMasterKey(); err != nil {
+			return manifest, err
+		}
+	}
+
+	//Everything that could fail is read before the archive is started
+	tables, err := readBackupTables(db, manifest.Rows)
+	if err != nil {
+		return manifest, err
+	}
+	dumps := map[uint]string{}
+	defer func() {
+		for _, dump := range dumps {
+			os.Remove(dump)
+		}
+	}()
+	if !options.SkipMongo {
+		var deployments []mds.Deployment
+		if err := db.Where("mongo_container_id <> ''").Order("id").Find(&deployments).Error; err != nil {
+			return manifest, err
+		}
+		for _, deployment := range deployments {
+			if client == nil {
+				return manifest, errors.New("Docker is needed to dump MongoDB")
+			}
+			dump, err := writeMongoDump(client, deployment)
+			if err != nil {
+				return manifest, errors.Wrap(err, "Failed to dump MongoDB of "+deployment.ProjectName)
+			}
+			dumps[deployment.ID] = dump
+			manifest.MongoDumps = append(manifest.MongoDumps, deployment.ID)
+		}
+	}
+
+	var sealed *sealingWriter
+	if options.Key != nil {
+		if sealed, err = newSealingWriter(options.Key, out); err != nil {
+			return manifest, err
+		}
+		out = sealed
+	}
+	gz := gzip.NewWriter(out)
+	archive := tar.NewWriter(gz)
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	if err := writeBackupEntry(archive, backupManifestEntry, encoded); err != nil {
+		return manifest, err
+	}
+	if masterKey != "" {
+		if err := writeBackupEntry(archive, backupMasterKeyEntry, []byte(masterKey+"\n")); err != nil {
+			return manifest, err
+		}
+	}
+	for _, model := range databaseModels {
+		table := db.NewScope(model).TableName()
+		if err := writeBackupEntry(archive, backupDatabasePrefix+table+".gob", tables[table]); err != nil {
+			return manifest, err
+		}
+	}
+	for _, prefix := range []string{backupApplicationsPrefix, backupCertificatesPrefix, backupNginxPrefix} {
+		if err := writeBackupDirectory(archive, prefix, directories[prefix]); err != nil {
+			return manifest, err
+		}
+	}
+	for _, id := range manifest.MongoDumps {
+		if err := writeBackupFile(archive, backupMongoPrefix+strconv.FormatUint(uint64(id), 10)+".archive", dumps[id]); err != nil {
+			return manifest, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return manifest, err
+	}
+	if err := gz.Close(); err != nil {
+		return manifest, err
+	}
+	if sealed != nil {
+		return manifest, sealed.Close()
+	}
+	return manifest, nil
+}
+
+//readBackupTables Reads every row of every table in one transaction, gob encoded by table name.
+//The number of rows of each table is stored in rows.
+func readBackupTables(db *gorm.DB, rows map[string]int) (map[string][]byte, error) {
+	tx := db.Begin()
+	defer tx.Rollback()
+	tables := map[string][]byte{}
+	for _, model := range databaseModels {
+		table := tx.NewScope(model).TableName()
+		stored := reflect.New(reflect.SliceOf(reflect.TypeOf(model).Elem()))
+		if err := tx.Unscoped().Find(stored.Interface()).Error; err != nil {
+			return nil, errors.Wrap(err, "Failed to read "+table)
+		}
+		var encoded bytes.Buffer
+		if err := gob.NewEncoder(&encoded).Encode(stored.Interface()); err != nil {
+			return nil, errors.Wrap(err, "Failed to encode "+table)
+		}
+		tables[table] = encoded.Bytes()
+		rows[table] = stored.Elem().Len()
+	}
+	return tables, nil
+}
+
+//writeMongoDump Dumps the MongoDB of a deployment to a temporary file and returns its path
+func writeMongoDump(client *docker.Client, deployment mds.Deployment) (string, error) {
+	dump, err := ioutil.TempFile("", "mds-mongo-dump")
+	if err != nil {
+		return "", err
+	}
+	defer dump.Close()
+	if err := dumpMongoDB(client, deployment.MongoContainerID, dump); err != nil {
+		os.Remove(dump.Name())
+		return "", err
+	}
+	log.Infof("Dumped MongoDB of %s", deployment.ProjectName)
+	return dump.Name(), nil
+}
+
+//writeBackupEntry Adds a file with the given content to the archive
+func writeBackupEntry(archive *tar.Writer, name string, content []byte) error {
+	header := &tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := archive.Write(content)
+	return err
+}
+
+//writeBackupFile Adds a file of the host to the archive
+func writeBackupFile(archive *tar.Writer, name string, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(archive, file)
+	return err
+}
+
+//writeBackupDirectory Adds the files, directories and links under a directory to the archive with a prefix.
+//Only the configuration files MDS wrote are taken from the nginx sites directory. Missing directories are skipped.
+func writeBackupDirectory(archive *tar.Writer, prefix string, directory string) error {
+	if exists, _ := pathExists(directory); !exists {
+		return nil
+	}
+	return filepath.Walk(directory, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(directory, filePath)
+		if err != nil || relative == "." {
+			return err
+		}
+		if prefix == backupNginxPrefix {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			if !strings.HasPrefix(info.Name(), "MDS-") {
+				return nil
+			}
+		}
+		name := prefix + filepath.ToSlash(relative)
+		switch {
+		case info.Mode().IsRegular():
+			return writeBackupFile(archive, name, filePath)
+		case info.IsDir(), info.Mode()&os.ModeSymlink != 0:
+			link := ""
+			if !info.IsDir() {
+				if link, err = os.Readlink(filePath); err != nil {
+					return err
+				}
+			}
+			header, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			header.Name = name
+			return archive.WriteHeader(header)
+		}
+		log.Warningf("Left %s out of the backup, it is not a file, directory or link", filePath)
+		return nil
+	})
+}
+
+//restoredBackup What restoreBackup unpacked
+type restoredBackup struct {
+	Manifest   backupManifest
+	MongoDumps map[uint]string //Files holding the MongoDB dump of each deployment, removed by Close
+	directory  string
+}
+
+//Close Removes the MongoDB dumps
+func (r *restoredBackup) Close() {
+	if r.directory != "" {
+		os.RemoveAll(r.directory)
+	}
+}
+
+//restoreBackup Stores the rows of a backup in an empty database and unpacks its files into the directories of this
+//host, moving the stored paths along. Files that already exist are kept. The master key is written to SecretKeyFile
+//when there is none. Nothing is committed to the database unless the whole archive was read.
+//key decrypts an encrypted backup. db should not be used for anything else afterwards, see prepareDatabaseRestore.
+func restoreBackup(db *gorm.DB, in io.Reader, key *secretBox) (*restoredBackup, error) {
+	restored := &restoredBackup{MongoDumps: map[uint]string{}}
+	archiveReader, err := openBackup(in, key)
+	if err != nil {
+		return restored, err
+	}
+	gz, err := gzip.NewReader(archiveReader)
+	if err != nil {
+		return restored, errors.Wrap(err, "The backup is not a backup archive")
+	}
+	archive := tar.NewReader(gz)
+
+	header, err := archive.Next()
+	if err != nil || header.Name != backupManifestEntry {
+		return restored, errors.New("The backup does not start with a manifest")
+	}
+	if err := json.NewDecoder(archive).Decode(&restored.Manifest); err != nil {
+		return restored, errors.Wrap(err, "Failed to read the manifest")
+	}
+	manifest := restored.Manifest
+	if manifest.Version != backupFormatVersion {
+		return restored, fmt.Errorf("The backup is in format %d, this mds-daemon restores format %d", manifest.Version, backupFormatVersion)
+	}
+	if manifest.SchemaVersion != latestSchemaVersion(migrations) {
+		return restored, fmt.Errorf("The backup is at schema version %d but this mds-daemon is at %d, restore it with the version of mds-daemon that made it", manifest.SchemaVersion, latestSchemaVersion(migrations))
+	}
+	writeMasterKey, err := checkBackupMasterKey(manifest)
+	if err != nil {
+		return restored, err
+	}
+	if err := prepareDatabaseRestore(db); err != nil {
+		return restored, err
+	}
+	if restored.directory, err = ioutil.TempDir("", "mds-restore"); err != nil {
+		return restored, err
+	}
+
+	directories := backupDirectories()
+	tx := db.Begin()
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = restoreBackupEntry(tx, restored, header, archive, directories, writeMasterKey)
+		}
+		if err != nil {
+			tx.Rollback()
+			return restored, err
+		}
+	}
+	//The end of the tar archive comes before the end of the stream that proves nothing was cut off
+	if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+		tx.Rollback()
+		return restored, err
+	}
+	return restored, tx.Commit().Error
+}
+
+//openBackup Decrypts a backup if it is encrypted
+func openBackup(in io.Reader, key *secretBox) (io.Reader, error) {
+	buffered := bufio.NewReader(in)
+	start, _ := buffered.Peek(len(encryptedBackupHeader))
+	if string(start) != encryptedBackupHeader {
+		if key != nil {
+			log.Warning("The backup is not encrypted, the key is not needed")
+		}
+		return buffered, nil
+	}
+	line, err := buffered.ReadString('\n')
+	if err != nil {
+		return nil, errors.New("The backup is cut off")
+	}
+	keyID := strings.TrimSpace(strings.TrimPrefix(line, encryptedBackupHeader))
+	if key == nil {
+		return nil, fmt.Errorf("The backup is encrypted with key %s, pass its key file with -key", keyID)
+	}
+	if keyID != key.keyID {
+		return nil, fmt.Errorf("The backup is encrypted with key %s, not with %s", keyID, key.keyID)
+	}
+	return &openingReader{box: key, in: buffered}, nil
+}
+
+//checkBackupMasterKey Makes sure the secrets of a backup can be read once it is restored.
+//Returns whether the master key of the backup has to be written to SecretKeyFile.
+func checkBackupMasterKey(manifest backupManifest) (bool, error) {
+	encoded, err := encodedMasterKey()
+	if err != nil {
+		return false, err
+	}
+	if encoded == "" {
+		if !manifest.IncludesMasterKey {
+			return false, fmt.Errorf("The backup was not encrypted so it does not hold the master key, put key %s in SecretKeyFile or %s first", manifest.MasterKeyID, masterKeyEnvironmentVariable)
+		}
+		return true, nil
+	}
+	box, err := readEncodedKey(encoded)
+	if err != nil {
+		return false, err
+	}
+	if box.keyID != manifest.MasterKeyID {
+		return false, fmt.Errorf("The master key of this host is %s but the secrets of the backup are encrypted with %s", box.keyID, manifest.MasterKeyID)
+	}
+	return false, nil
+}
+
+//restoreBackupEntry Restores one entry of a backup archive after the manifest
+func restoreBackupEntry(tx *gorm.DB, restored *restoredBackup, header *tar.Header, content io.Reader, directories map[string]string, writeMasterKey bool) error {
+	name := header.Name
+	switch {
+	case name == backupMasterKeyEntry:
+		if !writeMasterKey {
+			return nil
+		}
+		keyFile := viper.GetString("SecretKeyFile")
+		if err := os.MkdirAll(filepath.Dir(keyFile), 0700); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(file, content)
+		log.Infof("Restored master key %s to %s", restored.Manifest.MasterKeyID, keyFile)
+		return err
+	case strings.HasPrefix(name, backupDatabasePrefix):
+		return restoreBackupTable(tx, restored.Manifest, strings.TrimSuffix(strings.TrimPrefix(name, backupDatabasePrefix), ".gob"), content)
+	case strings.HasPrefix(name, backupMongoPrefix):
+		id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, backupMongoPrefix), ".archive"), 10, 32)
+		if err != nil {
+			return fmt.Errorf("%s is not the dump of a deployment", name)
+		}
+		dumpPath := filepath.Join(restored.directory, strconv.FormatUint(id, 10)+".archive")
+		dump, err := os.Create(dumpPath)
+		if err != nil {
+			return err
+		}
+		defer dump.Close()
+		restored.MongoDumps[uint(id)] = dumpPath
+		_, err = io.Copy(dump, content)
+		return err
+	}
+	for _, prefix := range []string{backupApplicationsPrefix, backupCertificatesPrefix, backupNginxPrefix} {
+		if strings.HasPrefix(name, prefix) {
+			return restoreBackupFile(header, strings.TrimPrefix(name, prefix), directories[prefix], content)
+		}
+	}
+	log.Warningf("Skipped %s, it is not part of a backup", name)
+	return nil
+}
+
+//restoreBackupTable Stores the rows of a table, with the paths in them moved to the directories of this host
+func restoreBackupTable(tx *gorm.DB, manifest backupManifest, table string, content io.Reader) error {
+	for _, model := range databaseModels {
+		if tx.NewScope(model).TableName() != table {
+			continue
+		}
+		rows := reflect.New(reflect.SliceOf(reflect.TypeOf(model).Elem()))
+		if err := gob.NewDecoder(content).Decode(rows.Interface()); err != nil {
+			return errors.Wrap(err, "Failed to read the rows of "+table)
+		}
+		directories := backupDirectories()
+		for i := 0; i < rows.Elem().Len(); i++ {
+			switch row := rows.Elem().Index(i).Addr().Interface().(type) {
+			case *mds.Deployment:
+				row.VolumePath = movedPath(row.VolumePath, manifest.ApplicationDirectory, directories[backupApplicationsPrefix])
+			case *NginxProxyConfiguration:
+				row.CertificatePath = movedPath(row.CertificatePath, manifest.CertDestination, directories[backupCertificatesPrefix])
+				row.PrivateKeyPath = movedPath(row.PrivateKeyPath, manifest.CertDestination, directories[backupCertificatesPrefix])
+				row.ConfigurationFilePath = movedPath(row.ConfigurationFilePath, manifest.NginxSitesDirectory, directories[backupNginxPrefix])
+			}
+		}
+		if err := insertRows(tx, model, rows.Elem()); err != nil {
+			return err
+		}
+		log.Infof("Restored %d rows into %s", rows.Elem().Len(), table)
+		return nil
+	}
+	return fmt.Errorf("The backup has rows of %s, which this mds-daemon does not know", table)
+}
+
+//restoreBackupFile Unpacks a file, directory or link of the archive below directory. Existing files are kept.
+func restoreBackupFile(header *tar.Header, name string, directory string, content io.Reader) error {
+	relative, ok := bundleEntryName(name)
+	if !ok || relative == "." || directory == "" {
+		return fmt.Errorf("%s is outside of the directory it is restored to", header.Name)
+	}
+	target := filepath.Join(directory, filepath.FromSlash(relative))
+	mode := os.FileMode(header.Mode) & os.ModePerm
+	if header.Typeflag == tar.TypeDir {
+		return os.MkdirAll(target, mode|0700)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	switch header.Typeflag {
+	case tar.TypeReg:
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if os.IsExist(err) {
+			log.Warningf("Kept %s, it already exists", target)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(file, content)
+		return err
+	case tar.TypeSymlink:
+		if _, inside := bundleEntryName(path.Join(path.Dir(relative), header.Linkname)); !inside || path.IsAbs(header.Linkname) {
+			log.Warningf("Skipped link %s to %s, it points outside of %s", target, header.Linkname, directory)
+			return nil
+		}
+		if err := os.Symlink(header.Linkname, target); err != nil && !os.IsExist(err) {
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("%s is not a file, directory or link", header.Name)
+}
+
+//rebuildDeployments Recreates the networks and containers of restored deployments: MongoDB with its dump loaded,
+//then the application and its proxy the way an update does. Deployments that were stopped are stopped again.
+//Deployments that fail are skipped and counted in the error.
+func rebuildDeployments(client *docker.Client, db *gorm.DB, dumps map[uint]string) error {
+	var deployments []mds.Deployment
+	if err := db.Order("id").Find(&deployments).Error; err != nil {
+		return err
+	}
+	failed := 0
+	for _, deployment := range deployments {
+		if err := rebuildDeployment(client, db, deployment, dumps[deployment.ID]); err != nil {
+			log.Errorf("Failed to rebuild %s: %s", deployment.ProjectName, err.Error())
+			failed++
+			continue
+		}
+		log.Infof("Rebuilt %s", deployment.ProjectName)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d deployments could not be rebuilt, update them once the cause is fixed", failed, len(deployments))
+	}
+	return nil
+}
+
+//rebuildDeployment Recreates the containers of a restored deployment. dump is the MongoDB dump to load, if any.
+func rebuildDeployment(client *docker.Client, db *gorm.DB, deployment mds.Deployment, dump string) error {
+	//Deployments that were still linked to MongoDB get the network an update would have given them
+	if deployment.Network == "" {
+		deployment.Network = deploymentNetworkName(deployment.ID)
+	}
+	if _, err := ensureNetwork(client, deployment.Network); err != nil {
+		return err
+	}
+	if deployment.MongoContainerID != "" {
+		if _, err := ensureImage(client, db, viper.GetString("MongoImage")); err != nil {
+			return err
+		}
+		mongo, err := CreateMongoDBDockerContainer(client, deployment.Network)
+		if err != nil {
+			return err
+		}
+		deployment.MongoContainerID = mongo.ID
+		if err := client.StartContainer(mongo.ID, nil); err != nil {
+			return err
+		}
+	}
+	if err := db.Save(&deployment).Error; err != nil {
+		return err
+	}
+	if dump != "" {
+		if err := restoreMongoDB(client, deployment.MongoContainerID, dump); err != nil {
+			return errors.Wrap(err, "Failed to restore MongoDB")
+		}
+	}
+	rebuilt, err := updateDeployment(client, db, deployment.ID, deploymentUpdate{}, publishOnlyProgress)
+	if err != nil {
+		return err
+	}
+	if !deployment.AutoStart {
+		return stopDeployment(client, db, rebuilt)
+	}
+	return nil
+}
+
+//backupCommand Runs 'mds-daemon backup [-key <key file>] [-skip-mongo] <archive>'. The archive is written to stdout
+//if it is -. With -key it is encrypted and holds the master key, the key file is generated if it does not exist.
+func backupCommand(args []string) error {
+	usage := errors.New("Usage: mds-daemon backup [-key <key file>] [-skip-mongo] <archive>")
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	keyFile := flags.String("key", "", "Encrypt the archive with this key, generated if it does not exist")
+	skipMongo := flags.Bool("skip-mongo", false, "Leave out the MongoDB dumps")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return usage
+	}
+	var err error
+	if secrets, err = loadSecretBox(); err != nil {
+		return err
+	}
+	options := backupOptions{SkipMongo: *skipMongo}
+	if *keyFile != "" {
+		if exists, _ := pathExists(*keyFile); exists {
+			options.Key, err = readKeyFile(*keyFile)
+		} else {
+			log.Warningf("Generating backup key at %s. Keep it apart from the backups, they cannot be restored without it.", *keyFile)
+			options.Key, err = generateKeyFile(*keyFile)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var client *docker.Client
+	if !options.SkipMongo {
+		if client, err = startDockerClient(); err != nil {
+			return errors.Wrap(err, "Failed to connect to docker, pass -skip-mongo to back up without MongoDB")
+		}
+	}
+
+	destination := flags.Arg(0)
+	out := os.Stdout
+	if destination != "-" {
+		//O_EXCL so an earlier backup is never overwritten
+		if out, err = os.OpenFile(destination, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	manifest, err := writeBackup(db, client, out, options)
+	if err != nil {
+		if destination != "-" {
+			os.Remove(destination)
+		}
+		return err
+	}
+	rows := 0
+	for _, count := range manifest.Rows {
+		rows += count
+	}
+	log.Infof("Backed up %d rows and %d MongoDB databases to %s", rows, len(manifest.MongoDumps), destination)
+	if options.Key == nil {
+		log.Warningf("The backup is not encrypted and does not hold the master key %s, keep a copy of the key to restore it", manifest.MasterKeyID)
+	}
+	return nil
+}
+
+//restoreCommand Runs 'mds-daemon restore [-key <key file>] [-skip-rebuild] <archive>' on a host whose database is
+//empty, with the daemon stopped. The archive is read from stdin if it is -. Unless -skip-rebuild is given the
+//containers of the deployments are created again afterwards.
+func restoreCommand(args []string) error {
+	usage := errors.New("Usage: mds-daemon restore [-key <key file>] [-skip-rebuild] <archive>")
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	keyFile := flags.String("key", "", "Key file the archive was encrypted with")
+	skipRebuild := flags.Bool("skip-rebuild", false, "Only restore the database and the files, not the containers")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return usage
+	}
+	var key *secretBox
+	var err error
+	if *keyFile != "" {
+		if key, err = readKeyFile(*keyFile); err != nil {
+			return err
+		}
+	}
+	in := os.Stdin
+	if flags.Arg(0) != "-" {
+		if in, err = os.Open(flags.Arg(0)); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+
+	//The restore changes how its connection creates rows, the rebuild gets a connection of its own
+	restoreDB, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	restored, err := restoreBackup(restoreDB, in, key)
+	restoreDB.Close()
+	defer restored.Close()
+	if err != nil {
+		return err
+	}
+	log.Infof("Restored the backup of %s made at %s", restored.Manifest.Hostname, restored.Manifest.CreatedAt.Format(time.RFC3339))
+	if secrets, err = loadSecretBox(); err != nil {
+		return err
+	}
+	if *skipRebuild {
+		log.Info("Update each deployment to create its containers")
+		return nil
+	}
+
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	client, err := startDockerClient()
+	if err != nil {
+		return err
+	}
+	nginx = NginxInstance{ReloadCommand: viper.GetString("NginxReloadCommand"), SitesDirectory: viper.GetString("NginxSitesDestination")}
+	return rebuildDeployments(client, db, restored.MongoDumps)
+}
+
+//sealingWriter Encrypts what is written to it with AES-256-GCM in chunks of backupChunkSize. Each chunk is bound to
+//its position and the last one is marked, so chunks cannot be reordered, dropped or cut off unnoticed.
+type sealingWriter struct {
+	box    *secretBox
+	out    io.Writer
+	buffer []byte
+	chunk  uint64
+}
+
+//newSealingWriter Writes the header of an encrypted backup and returns a writer for its content. Close writes the
+//last chunk.
+func newSealingWriter(box *secretBox, out io.Writer) (*sealingWriter, error) {
+	if _, err := io.WriteString(out, encryptedBackupHeader+box.keyID+"\n"); err != nil {
+		return nil, err
+	}
+	return &sealingWriter{box: box, out: out}, nil
+}
+
+func (w *sealingWriter) Write(p []byte) (int, error) {
+	w.buffer = append(w.buffer, p...)
+	for len(w.buffer) > backupChunkSize {
+		if err := w.seal(w.buffer[:backupChunkSize], false); err != nil {
+			return 0, err
+		}
+		w.buffer = w.buffer[backupChunkSize:]
+	}
+	return len(p), nil
+}
+
+//Close Seals what is left as the last chunk
+func (w *sealingWriter) Close() error {
+	return w.seal(w.buffer, true)
+}
+
+func (w *sealingWriter) seal(plaintext []byte, last bool) error {
+	nonce := make([]byte, w.box.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	sealed := w.box.aead.Seal(nonce, nonce, plaintext, backupChunkData(w.box.keyID, w.chunk, last))
+	w.chunk++
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := w.out.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := w.out.Write(sealed)
+	return err
+}
+
+//backupChunkData Data a chunk is authenticated with besides its content
+func backupChunkData(keyID string, chunk uint64, last bool) []byte {
+	data := make([]byte, len(keyID)+9)
+	copy(data, keyID)
+	binary.BigEndian.PutUint64(data[len(keyID):], chunk)
+	if last {
+		data[len(data)-1] = 1
+	}
+	return data
+}
+
+//openingReader Decrypts what a sealingWriter wrote, after the header
+type openingReader struct {
+	box       *secretBox
+	in        io.Reader
+	plaintext []byte
+	chunk     uint64
+	last      bool
+}
+
+func (r *openingReader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		if r.last {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
+
+//open Decrypts the next chunk
+func (r *openingReader) open() error {
+	var length [4]byte
+	if _, err := io.ReadFull(r.in, length[:]); err != nil {
+		return errors.New("The backup is cut off")
+	}
+	overhead := r.box.aead.NonceSize() + r.box.aead.Overhead()
+	size := int(binary.BigEndian.Uint32(length[:]))
+	if size < overhead || size > backupChunkSize+overhead {
+		return errors.New("The backup is damaged")
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(r.in, sealed); err != nil {
+		return errors.New("The backup is cut off")
+	}
+	nonce, ciphertext := sealed[:r.box.aead.NonceSize()], sealed[r.box.aead.NonceSize():]
+	for _, last := range []bool{false, true} {
+		plaintext, err := r.box.aead.Open(nil, nonce, ciphertext, backupChunkData(r.box.keyID, r.chunk, last))
+		if err != nil {
+			continue
+		}
+		r.plaintext, r.last = plaintext, last
+		r.chunk++
+		if last {
+			if n, _ := r.in.Read(make([]byte, 1)); n > 0 {
+				return errors.New("The backup has data after its end")
+			}
+		}
+		return nil
+	}
+	return errors.New("The backup is damaged")
+}
@@ -0,0 +1,248 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//testBackupHost Points the directories of the daemon at a new temporary host. Returns its root and a function that
+//puts the previous configuration back and removes the host.
+func testBackupHost(t *testing.T) (string, func()) {
+	root, err := ioutil.TempDir("", "mds-backup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := map[string]interface{}{}
+	for _, key := range []string{"ApplicationDirectory", "CertDestination", "NginxSitesDestination", "SecretKeyFile"} {
+		previous[key] = viper.Get(key)
+	}
+	viper.Set("ApplicationDirectory", filepath.Join(root, "apps")+"/")
+	viper.Set("CertDestination", filepath.Join(root, "ssl"))
+	viper.Set("NginxSitesDestination", filepath.Join(root, "sites")+"/")
+	viper.Set("SecretKeyFile", filepath.Join(root, "data", "master.key"))
+	return root, func() {
+		for key, value := range previous {
+			viper.Set(key, value)
+		}
+		os.RemoveAll(root)
+	}
+}
+
+//writeTestFile Writes a file and the directories above it
+func writeTestFile(t *testing.T, path string, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	oldRoot, resetOld := testBackupHost(t)
+	defer resetOld()
+	previousSecrets := secrets
+	defer func() { secrets = previousSecrets }()
+	var err error
+	if secrets, err = generateKeyFile(viper.GetString("SecretKeyFile")); err != nil {
+		t.Fatal(err)
+	}
+	backupKey, err := generateKeyFile(filepath.Join(oldRoot, "backup.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source, cleanupSource := openTestDatabase(t, databaseDriverSQLite)
+	defer cleanupSource()
+	stored := fillTestDatabase(t, source)
+	bundleDirectory := filepath.Join(oldRoot, "apps", "bundle-1")
+	source.Model(&mds.Deployment{}).Where("id = ?", 1).UpdateColumn("volume_path", bundleDirectory)
+	source.Model(&NginxProxyConfiguration{}).Where("id = ?", 1).UpdateColumns(map[string]interface{}{
+		"certificate_path":        filepath.Join(oldRoot, "ssl", "app.example.com.cer"),
+		"configuration_file_path": viper.GetString("NginxSitesDestination") + "MDS-app.example.com.conf",
+	})
+	writeTestFile(t, filepath.Join(bundleDirectory, "bundle.tar.gz"), "bundle")
+	if err := os.Symlink("bundle.tar.gz", filepath.Join(bundleDirectory, "current")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(oldRoot, "ssl", "app.example.com.cer"), "certificate")
+	writeTestFile(t, filepath.Join(oldRoot, "sites", "MDS-app.example.com.conf"), "server {}")
+	writeTestFile(t, filepath.Join(oldRoot, "sites", "default"), "not ours")
+
+	for _, encrypted := range []bool{false, true} {
+		name := "plain"
+		options := backupOptions{}
+		if encrypted {
+			name = "encrypted"
+			options.Key = backupKey
+		}
+		t.Run(name, func(t *testing.T) {
+			var archive bytes.Buffer
+			manifest, err := writeBackup(source, nil, &archive, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if manifest.IncludesMasterKey != encrypted || manifest.MasterKeyID != secrets.keyID {
+				t.Fatalf("Unexpected manifest: %+v", manifest)
+			}
+
+			newRoot, resetNew := testBackupHost(t)
+			defer resetNew()
+			db, cleanup := openTestDatabase(t, databaseDriverSQLite)
+			defer cleanup()
+			if encrypted {
+				if _, err := restoreBackup(db, bytes.NewReader(archive.Bytes()), nil); err == nil {
+					t.Fatal("Restored an encrypted backup without its key")
+				}
+			} else {
+				//The master key has to be brought over by hand
+				if _, err := restoreBackup(db, bytes.NewReader(archive.Bytes()), nil); err == nil {
+					t.Fatal("Restored secrets without their master key")
+				}
+				writeTestFile(t, viper.GetString("SecretKeyFile"), mustReadFile(t, filepath.Join(oldRoot, "data", "master.key")))
+			}
+			restored, err := restoreBackup(db, bytes.NewReader(archive.Bytes()), options.Key)
+			defer restored.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if box, err := readKeyFile(viper.GetString("SecretKeyFile")); err != nil || box.keyID != secrets.keyID {
+				t.Fatalf("Master key was not restored: %v", err)
+			}
+
+			rows := 0
+			for _, model := range databaseModels {
+				count := 0
+				db.Unscoped().Model(model).Count(&count)
+				rows += count
+			}
+			if rows != stored {
+				t.Fatalf("Restored %d of %d rows", rows, stored)
+			}
+			var deployment mds.Deployment
+			db.First(&deployment, 1)
+			if deployment.VolumePath != filepath.Join(newRoot, "apps", "bundle-1") {
+				t.Fatalf("Application directory was not moved: %s", deployment.VolumePath)
+			}
+			if content := mustReadFile(t, filepath.Join(deployment.VolumePath, "bundle.tar.gz")); content != "bundle" {
+				t.Fatalf("Bundle was not restored: %s", content)
+			}
+			if link, err := os.Readlink(filepath.Join(deployment.VolumePath, "current")); err != nil || link != "bundle.tar.gz" {
+				t.Fatalf("Link was not restored: %s %v", link, err)
+			}
+			var proxy NginxProxyConfiguration
+			db.First(&proxy, 1)
+			if proxy.CertificatePath != filepath.Join(newRoot, "ssl", "app.example.com.cer") || proxy.ConfigurationFilePath != filepath.Join(newRoot, "sites", "MDS-app.example.com.conf") {
+				t.Fatalf("Proxy paths were not moved: %+v", proxy)
+			}
+			if content := mustReadFile(t, proxy.CertificatePath); content != "certificate" {
+				t.Fatalf("Certificate was not restored: %s", content)
+			}
+			if content := mustReadFile(t, proxy.ConfigurationFilePath); content != "server {}" {
+				t.Fatalf("Nginx configuration was not restored: %s", content)
+			}
+			if exists, _ := pathExists(filepath.Join(newRoot, "sites", "default")); exists {
+				t.Fatal("Nginx configuration MDS did not write was backed up")
+			}
+
+			if _, err := restoreBackup(db, bytes.NewReader(archive.Bytes()), options.Key); err == nil {
+				t.Fatal("Restored into a database that is not empty")
+			}
+		})
+	}
+}
+
+//mustReadFile Reads a whole file, failing the test if it cannot be read
+func mustReadFile(t *testing.T, path string) string {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestBackupEncryption(t *testing.T) {
+	key, err := newSecretBox(make([]byte, masterKeyLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := make([]byte, backupChunkSize*3+100)
+	rand.Read(plaintext)
+	var sealed bytes.Buffer
+	writer, err := newSealingWriter(key, &sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(plaintext[:100])
+	writer.Write(plaintext[100:])
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	open := func(archive []byte, key *secretBox) ([]byte, error) {
+		reader, err := openBackup(bytes.NewReader(archive), key)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(reader)
+	}
+	if opened, err := open(sealed.Bytes(), key); err != nil || !bytes.Equal(opened, plaintext) {
+		t.Fatalf("Backup did not decrypt to what was written: %v", err)
+	}
+	otherKey, _ := newSecretBox(bytes.Repeat([]byte{1}, masterKeyLength))
+	if _, err := open(sealed.Bytes(), otherKey); err == nil {
+		t.Fatal("Opened with the wrong key")
+	}
+	damaged := append([]byte{}, sealed.Bytes()...)
+	damaged[len(damaged)/2] ^= 1
+	if _, err := open(damaged, key); err == nil {
+		t.Fatal("Opened a damaged backup")
+	}
+	//Cut off at the end of a chunk, so every chunk that is left is intact
+	chunk := 4 + key.aead.NonceSize() + backupChunkSize + key.aead.Overhead()
+	header := len(encryptedBackupHeader) + len(key.keyID) + 1
+	if _, err := open(sealed.Bytes()[:header+2*chunk], key); err == nil || err == io.EOF {
+		t.Fatal("Opened a backup that was cut off")
+	}
+}
+
+func TestMovedPath(t *testing.T) {
+	expected := []struct {
+		path, oldDirectory, newDirectory, moved string
+	}{
+		{"/var/mds/apps/1234", "/var/mds/apps", "/srv/apps", "/srv/apps/1234"},
+		{"/etc/nginx/sites-enabled/MDS-app.conf", "/etc/nginx/sites-enabled", "/srv/sites", "/srv/sites/MDS-app.conf"},
+		{"/var/mds/ssl/app.key", "/var/mds/apps", "/srv/apps", "/var/mds/ssl/app.key"},
+		{"/var/mds/apps-old/1234", "/var/mds/apps", "/srv/apps", "/var/mds/apps-old/1234"},
+		{"", "/var/mds/apps", "/srv/apps", ""},
+	}
+	for _, e := range expected {
+		if moved := movedPath(e.path, e.oldDirectory, e.newDirectory); moved != e.moved {
+			t.Errorf("%s: expected %s, got %s", e.path, e.moved, moved)
+		}
+	}
+}
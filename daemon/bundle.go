@@ -0,0 +1,317 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//Entries of a bundle built with meteor build
+const (
+	bundleMainFile        = "bundle/main.js"
+	bundleServerDirectory = "bundle/programs/server"
+	bundleStarFile        = "bundle/star.json"
+	bundleNodeVersionFile = "bundle/.node_version.txt" //Written by every release, older ones leave nodeVersion out of star.json
+)
+
+//Largest star.json or .node_version.txt that is read
+const bundleMetadataLimit = 1 << 20
+
+//bundleInfo What was learned about a bundle while it was checked
+type bundleInfo struct {
+	Checksum      string //Hex SHA-256 of the tarball
+	MeteorRelease string //Release the bundle was built with, e.g. METEOR@1.6.1
+	NodeVersion   string //Version of Node the bundle needs without a leading v, empty if the bundle does not say
+}
+
+//bundleLimits Bounds on what a bundle can unpack to, so an archive cannot fill the disk of the container
+type bundleLimits struct {
+	MaxSize  int64 //Bytes all entries can add up to
+	MaxFiles int   //Number of entries
+	MaxRatio int64 //Times the unpacked size can be larger than the tarball
+}
+
+//bundleLimitsFromConfig Gets the limits set in the configuration
+func bundleLimitsFromConfig() bundleLimits {
+	return bundleLimits{
+		MaxSize:  viper.GetInt64("MaxBundleSizeMB") << 20,
+		MaxFiles: viper.GetInt("MaxBundleFiles"),
+		MaxRatio: viper.GetInt64("MaxBundleCompressionRatio"),
+	}
+}
+
+//invalidBundleError Explains why a bundle was rejected
+type invalidBundleError struct {
+	Entry   string //Name of the entry that was rejected, empty if the problem is not with one entry
+	Message string
+}
+
+func (e *invalidBundleError) Error() string {
+	if e.Entry == "" {
+		return e.Message
+	}
+	return e.Entry + ": " + e.Message
+}
+
+//invalidBundle Builds an invalidBundleError
+func invalidBundle(entry string, format string, args ...interface{}) error {
+	return &invalidBundleError{Entry: entry, Message: fmt.Sprintf(format, args...)}
+}
+
+//receiveArchive Puts the archive of a deployment form into a new application directory. The archive is either
+//a complete upload or the uploadfile field, whose checksum is verified if one was sent with it.
+//Returns the directory and the hex SHA-256 of the archive, or writes an error response and returns false.
+func receiveArchive(w http.ResponseWriter, r *http.Request, upload *mds.Upload) (string, string, bool) {
+	if upload != nil {
+		destination, err := moveUpload(*upload)
+		if err != nil {
+			writeInternalError(w, "Failed to use upload", err)
+			return "", "", false
+		}
+		return destination, upload.SHA256, true
+	}
+	destination, checksum, err := saveUploadedApplication(r)
+	if err != nil {
+		writeInternalError(w, "Failed to save uploaded application", err)
+		return "", "", false
+	}
+	if expected := strings.ToLower(r.FormValue(checksumField)); expected != "" && expected != checksum {
+		os.RemoveAll(destination)
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Checksum of the bundle does not match", map[string]string{"expected": expected, "actual": checksum})
+		return "", "", false
+	}
+	return destination, checksum, true
+}
+
+//receiveBundle Puts the bundle of a deployment form into a new application directory and validates it.
+//Returns the directory and what is known about the bundle, or writes an error response and returns false.
+func receiveBundle(w http.ResponseWriter, r *http.Request, upload *mds.Upload) (string, bundleInfo, bool) {
+	destination, checksum, ok := receiveArchive(w, r, upload)
+	if !ok {
+		return "", bundleInfo{}, false
+	}
+	info, err := validateBundle(filepath.Join(destination, "application.tar.gz"), bundleLimitsFromConfig())
+	if err != nil {
+		os.RemoveAll(destination)
+		writeInvalidArchive(w, mds.ErrorCodeInvalidBundle, "bundle", err)
+		return "", info, false
+	}
+	info.Checksum = checksum
+	return destination, info, true
+}
+
+//writeInvalidArchive Writes the response for an archive that failed validation with err. kind names the archive in messages.
+func writeInvalidArchive(w http.ResponseWriter, code string, kind string, err error) {
+	invalid, ok := err.(*invalidBundleError)
+	if !ok {
+		writeInternalError(w, "Failed to validate "+kind, err)
+		return
+	}
+	var details map[string]string
+	if invalid.Entry != "" {
+		details = map[string]string{"entry": invalid.Entry}
+	}
+	writeError(w, http.StatusBadRequest, code, "Invalid "+kind+": "+invalid.Error(), details)
+}
+
+//validateBundle Reads a whole bundle to check that it is an intact gzipped tarball built by meteor build
+//and that unpacking it cannot write outside of its directory or grow past the limits.
+//Returns an *invalidBundleError if the bundle is rejected. Nothing is written to disk.
+func validateBundle(bundlePath string, limits bundleLimits) (bundleInfo, error) {
+	var info bundleInfo
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return info, err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return info, invalidBundle("", "Bundle is not a gzipped tarball: %s", err.Error())
+	}
+	defer gz.Close()
+
+	var size int64
+	var star, nodeVersion []byte
+	foundMain, foundServer := false, false
+	files := 0
+	//Entries written through a link could land anywhere the link points
+	links := make(map[string]bool)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return info, invalidBundle("", "Bundle is not a valid tarball: %s", err.Error())
+		}
+		files++
+		if limits.MaxFiles > 0 && files > limits.MaxFiles {
+			return info, invalidBundle("", "Bundle has more than %d entries", limits.MaxFiles)
+		}
+		name, err := checkBundleEntry(header)
+		if err != nil {
+			return info, err
+		}
+		for dir := path.Dir(name); dir != "." && dir != "/"; dir = path.Dir(dir) {
+			if links[dir] {
+				return info, invalidBundle(header.Name, "Path goes through a link")
+			}
+		}
+		if header.Typeflag == tar.TypeSymlink {
+			links[name] = true
+		}
+
+		//Sizes in headers can lie, so what is actually read is counted
+		var content io.Reader = tr
+		var keep *[]byte
+		switch name {
+		case bundleStarFile:
+			keep = &star
+		case bundleNodeVersionFile:
+			keep = &nodeVersion
+		}
+		var buffer bytes.Buffer
+		if keep != nil {
+			content = io.TeeReader(tr, &limitedBuffer{buffer: &buffer, limit: bundleMetadataLimit})
+		}
+		n, err := io.Copy(ioutil.Discard, content)
+		if err != nil {
+			return info, invalidBundle(name, "Entry is damaged: %s", err.Error())
+		}
+		if keep != nil {
+			*keep = buffer.Bytes()
+		}
+		size += n
+		if limits.MaxSize > 0 && size > limits.MaxSize {
+			return info, invalidBundle("", "Bundle unpacks to more than %d MB", limits.MaxSize>>20)
+		}
+		if limits.MaxRatio > 0 && stat.Size() > 0 && size/stat.Size() > limits.MaxRatio {
+			return info, invalidBundle("", "Bundle unpacks to more than %d times its size", limits.MaxRatio)
+		}
+
+		switch {
+		case name == bundleMainFile && header.Typeflag == tar.TypeReg:
+			foundMain = true
+		case name == bundleServerDirectory || strings.HasPrefix(name, bundleServerDirectory+"/"):
+			foundServer = true
+		}
+	}
+	//Reading to the end makes gzip verify its checksum
+	if _, err := io.Copy(ioutil.Discard, gz); err != nil {
+		return info, invalidBundle("", "Bundle is damaged: %s", err.Error())
+	}
+
+	if !foundMain {
+		return info, invalidBundle("", "Bundle has no %s, build it with meteor build", bundleMainFile)
+	}
+	if !foundServer {
+		return info, invalidBundle("", "Bundle has no %s, build it with meteor build", bundleServerDirectory)
+	}
+	if star == nil {
+		return info, invalidBundle("", "Bundle has no %s, build it with meteor build", bundleStarFile)
+	}
+	var manifest struct {
+		MeteorRelease string `json:"meteorRelease"`
+		NodeVersion   string `json:"nodeVersion"`
+	}
+	if err := json.Unmarshal(star, &manifest); err != nil {
+		return info, invalidBundle(bundleStarFile, "Not valid JSON: %s", err.Error())
+	}
+	info.MeteorRelease = manifest.MeteorRelease
+	info.NodeVersion = manifest.NodeVersion
+	if info.NodeVersion == "" {
+		info.NodeVersion = strings.TrimSpace(string(nodeVersion))
+	}
+	info.NodeVersion = strings.TrimPrefix(info.NodeVersion, "v")
+	return info, nil
+}
+
+//checkBundleEntry Makes sure unpacking an entry stays inside the directory it is unpacked in.
+//Returns the name of the entry without a leading ./
+func checkBundleEntry(header *tar.Header) (string, error) {
+	name, ok := bundleEntryName(header.Name)
+	if !ok {
+		return "", invalidBundle(header.Name, "Path leaves the bundle")
+	}
+	switch header.Typeflag {
+	case tar.TypeReg, tar.TypeDir, tar.TypeXGlobalHeader:
+	case tar.TypeSymlink:
+		//Relative to the directory of the link
+		if path.IsAbs(header.Linkname) {
+			return "", invalidBundle(header.Name, "Link to an absolute path")
+		}
+		if _, ok := bundleEntryName(path.Join(path.Dir(name), header.Linkname)); !ok {
+			return "", invalidBundle(header.Name, "Link leaves the bundle")
+		}
+	case tar.TypeLink:
+		//Relative to the top of the archive
+		if _, ok := bundleEntryName(header.Linkname); !ok {
+			return "", invalidBundle(header.Name, "Link leaves the bundle")
+		}
+	default:
+		return "", invalidBundle(header.Name, "Devices and pipes are not allowed")
+	}
+	return name, nil
+}
+
+//bundleEntryName Cleans a path in a bundle. Returns false if it is absolute or climbs out with ..
+func bundleEntryName(name string) (string, bool) {
+	if path.IsAbs(name) {
+		return "", false
+	}
+	cleaned := path.Clean(name)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", false
+	}
+	return strings.TrimSuffix(cleaned, "/"), true
+}
+
+//limitedBuffer Keeps the first limit bytes written to it and drops the rest
+type limitedBuffer struct {
+	buffer *bytes.Buffer
+	limit  int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buffer.Len(); room > 0 {
+		if len(p) > room {
+			b.buffer.Write(p[:room])
+		} else {
+			b.buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//testBundleEntry An entry of a tarball built by writeTestBundle
+type testBundleEntry struct {
+	Name     string
+	Body     string
+	Type     byte   //tar.TypeReg if 0
+	Linkname string //Target of links
+}
+
+//meteorBundleEntries The entries every bundle built by meteor build has
+func meteorBundleEntries(star string) []testBundleEntry {
+	return []testBundleEntry{
+		{Name: "bundle/", Type: tar.TypeDir},
+		{Name: "bundle/main.js", Body: "require('./programs/server/boot.js');"},
+		{Name: "bundle/star.json", Body: star},
+		{Name: "bundle/.node_version.txt", Body: "v8.9.4\n"},
+		{Name: "bundle/programs/server/boot.js", Body: "//boot"},
+	}
+}
+
+//writeTestBundle Writes entries as a gzipped tarball in dir and returns its path
+func writeTestBundle(t *testing.T, dir string, entries []testBundleEntry) string {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.Name, Typeflag: entry.Type, Linkname: entry.Linkname, Mode: 0644, Size: int64(len(entry.Body))}
+		if header.Typeflag == 0 {
+			header.Typeflag = tar.TypeReg
+		}
+		if header.Typeflag != tar.TypeReg {
+			header.Size = 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(entry.Body))
+	}
+	tw.Close()
+	gz.Close()
+	f, err := ioutil.TempFile(dir, "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.Write(b.Bytes())
+	return f.Name()
+}
+
+func TestValidateBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mds-bundle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	limits := bundleLimits{MaxSize: 1 << 20, MaxFiles: 20, MaxRatio: 100}
+
+	info, err := validateBundle(writeTestBundle(t, dir, meteorBundleEntries(`{"meteorRelease": "METEOR@1.6.1", "nodeVersion": "8.9.4"}`)), limits)
+	if err != nil || info.MeteorRelease != "METEOR@1.6.1" || info.NodeVersion != "8.9.4" {
+		t.Fatalf("Valid bundle was not read: %+v %v", info, err)
+	}
+	//Older releases only have .node_version.txt
+	info, err = validateBundle(writeTestBundle(t, dir, meteorBundleEntries(`{"meteorRelease": "METEOR@1.4"}`)), limits)
+	if err != nil || info.NodeVersion != "8.9.4" {
+		t.Fatalf("Node version was not read from .node_version.txt: %+v %v", info, err)
+	}
+
+	star := `{"meteorRelease": "METEOR@1.6.1"}`
+	many := meteorBundleEntries(star)
+	for i := 0; i < limits.MaxFiles; i++ {
+		many = append(many, testBundleEntry{Name: fmt.Sprintf("bundle/file%d", i), Body: "x"})
+	}
+	rejected := map[string][]testBundleEntry{
+		"missing main.js":    meteorBundleEntries(star)[2:],
+		"missing star.json":  append(meteorBundleEntries(star)[:2], meteorBundleEntries(star)[3:]...),
+		"invalid star.json":  meteorBundleEntries("{"),
+		"parent directory":   append(meteorBundleEntries(star), testBundleEntry{Name: "bundle/../../etc/passwd", Body: "x"}),
+		"absolute path":      append(meteorBundleEntries(star), testBundleEntry{Name: "/etc/passwd", Body: "x"}),
+		"symlink out":        append(meteorBundleEntries(star), testBundleEntry{Name: "bundle/out", Type: tar.TypeSymlink, Linkname: "../../.."}),
+		"absolute symlink":   append(meteorBundleEntries(star), testBundleEntry{Name: "bundle/out", Type: tar.TypeSymlink, Linkname: "/etc"}),
+		"write through link": append(meteorBundleEntries(star), testBundleEntry{Name: "bundle/in", Type: tar.TypeSymlink, Linkname: "programs"}, testBundleEntry{Name: "bundle/in/x", Body: "x"}),
+		"hard link out":      append(meteorBundleEntries(star), testBundleEntry{Name: "bundle/passwd", Type: tar.TypeLink, Linkname: "../etc/passwd"}),
+		"device":             append(meteorBundleEntries(star), testBundleEntry{Name: "bundle/null", Type: tar.TypeChar}),
+		"too large":          append(meteorBundleEntries(star), testBundleEntry{Name: "bundle/big", Body: strings.Repeat("0", 2<<20)}),
+		"compression ratio":  append(meteorBundleEntries(star), testBundleEntry{Name: "bundle/bomb", Body: strings.Repeat("0", 900<<10)}),
+		"too many files":     many,
+	}
+	for name, entries := range rejected {
+		_, err := validateBundle(writeTestBundle(t, dir, entries), limits)
+		if _, ok := err.(*invalidBundleError); !ok {
+			t.Errorf("%s: expected the bundle to be rejected, got %v", name, err)
+		}
+	}
+
+	//Archives that are not intact
+	valid, _ := ioutil.ReadFile(writeTestBundle(t, dir, meteorBundleEntries(star)))
+	broken := map[string][]byte{
+		"not gzip":  []byte("PK\x03\x04 not a tarball"),
+		"truncated": valid[:len(valid)/2],
+		"corrupted": append(append([]byte{}, valid[:len(valid)-8]...), 0, 0, 0, 0, 0, 0, 0, 0),
+	}
+	for name, content := range broken {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, content, 0600)
+		if _, err := validateBundle(path, limits); err == nil {
+			t.Errorf("%s: expected the bundle to be rejected", name)
+		} else if _, ok := err.(*invalidBundleError); !ok {
+			t.Errorf("%s: expected an invalid bundle error, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//Overrides DatabaseDSN, so the password of the database does not have to be in the configuration file
+const databaseDSNEnvironmentVariable = "MDS_DATABASE_DSN"
+
+//Drivers the daemon can store its data with
+const (
+	databaseDriverSQLite   = "sqlite3"
+	databaseDriverPostgres = "postgres"
+	databaseDriverMySQL    = "mysql"
+)
+
+//databaseModels Every model stored in the database, in the order their rows are copied. Their tables are made by migrations.
+var databaseModels = []interface{}{
+	&mds.Deployment{},
+	&mds.UserPermission{},
+	&mds.User{},
+	&mds.AuthenticationToken{},
+	&NginxProxyConfiguration{},
+	&mds.Job{},
+	&mds.JobStep{},
+	&mds.EnvironmentVariable{},
+	&mds.Upload{},
+	&mds.RegistryCredential{},
+	&PortReservation{},
+}
+
+//databaseConfig Gets the driver and data source name of the database from the configuration
+func databaseConfig() (string, string) {
+	dsn := viper.GetString("DatabaseDSN")
+	if fromEnvironment := os.Getenv(databaseDSNEnvironmentVariable); fromEnvironment != "" {
+		dsn = fromEnvironment
+	}
+	return viper.GetString("DatabaseDriver"), dsn
+}
+
+//openDatabase Connects to the database of the daemon
+func openDatabase() (*gorm.DB, error) {
+	return openDatabaseWith(databaseConfig())
+}
+
+//openDatabaseWith Connects to a database. MySQL connections are made to read times, store any text and count the
+//rows an update matched rather than changed, as the other databases do.
+func openDatabaseWith(driver string, dsn string) (*gorm.DB, error) {
+	switch driver {
+	case databaseDriverSQLite, databaseDriverPostgres:
+	case databaseDriverMySQL:
+		dsn = withDSNParameter(dsn, "parseTime", "true")
+		dsn = withDSNParameter(dsn, "charset", "utf8mb4")
+		dsn = withDSNParameter(dsn, "clientFoundRows", "true")
+	default:
+		return nil, fmt.Errorf("DatabaseDriver must be %s, %s or %s, not '%s'", databaseDriverSQLite, databaseDriverPostgres, databaseDriverMySQL, driver)
+	}
+	if dsn == "" {
+		return nil, errors.New("DatabaseDSN is empty")
+	}
+	db, err := gorm.Open(driver, dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to connect to the "+driver+" database")
+	}
+	return db, nil
+}
+
+//withDSNParameter Adds a parameter to a MySQL data source name unless it already sets it
+func withDSNParameter(dsn string, name string, value string) string {
+	query := ""
+	if i := strings.Index(dsn, "?"); i >= 0 {
+		query = dsn[i+1:]
+	}
+	for _, parameter := range strings.Split(query, "&") {
+		if strings.HasPrefix(parameter, name+"=") {
+			return dsn
+		}
+	}
+	switch {
+	case !strings.Contains(dsn, "?"):
+		return dsn + "?" + name + "=" + value
+	case query == "":
+		return dsn + name + "=" + value
+	}
+	return dsn + "&" + name + "=" + value
+}
+
+//migrateDatabaseCommand Runs 'mds-daemon migrate-db'. Copies every row of a SQLite database into the database in the
+//configuration, which has to be empty. IDs and timestamps are kept so the daemon picks up where it left off.
+func migrateDatabaseCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: mds-daemon migrate-db <sqlite file>")
+	}
+	if exists, _ := pathExists(args[0]); !exists {
+		return fmt.Errorf("%s does not exist", args[0])
+	}
+	driver, dsn := databaseConfig()
+	if driver == databaseDriverSQLite {
+		return errors.New("Set DatabaseDriver and DatabaseDSN to the database to copy into first")
+	}
+	source, err := openDatabaseWith(databaseDriverSQLite, args[0])
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	destination, err := openDatabaseWith(driver, dsn)
+	if err != nil {
+		return err
+	}
+	defer destination.Close()
+	copied, err := copyDatabase(source, destination)
+	if err != nil {
+		return err
+	}
+	log.Infof("Copied %d rows from %s into the %s database", copied, args[0], driver)
+	log.Infof("The daemon uses the %s database from its next start, keep %s as a backup", driver, args[0])
+	return nil
+}
+
+//copyDatabase Copies every row of source into destination in one transaction and returns how many were copied.
+//Both databases are migrated to the latest schema first. Rows are copied as they are, including soft deleted ones.
+func copyDatabase(source *gorm.DB, destination *gorm.DB) (int, error) {
+	if err := migrateDatabase(source); err != nil {
+		return 0, errors.Wrap(err, "Failed to migrate the source")
+	}
+	if err := prepareDatabaseRestore(destination); err != nil {
+		return 0, err
+	}
+
+	tx := destination.Begin()
+	copied := 0
+	for _, model := range databaseModels {
+		table := destination.NewScope(model).TableName()
+		rows := reflect.New(reflect.SliceOf(reflect.TypeOf(model).Elem()))
+		if err := source.Unscoped().Find(rows.Interface()).Error; err != nil {
+			tx.Rollback()
+			return 0, errors.Wrap(err, "Failed to read "+table)
+		}
+		if err := insertRows(tx, model, rows.Elem()); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		copied += rows.Elem().Len()
+		log.Infof("Copied %d rows into %s", rows.Elem().Len(), table)
+	}
+	if err := tx.Commit().Error; err != nil {
+		return 0, err
+	}
+	return copied, nil
+}
+
+//prepareDatabaseRestore Migrates a database rows are going to be copied into, makes sure it is empty and makes it
+//store the timestamps of the rows as they are. The connection should not be used for anything else afterwards.
+func prepareDatabaseRestore(db *gorm.DB) error {
+	if err := migrateDatabase(db); err != nil {
+		return errors.Wrap(err, "Failed to migrate the destination")
+	}
+	for _, model := range databaseModels {
+		count := 0
+		if err := db.Unscoped().Model(model).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("The database already has rows in %s, it has to be empty", db.NewScope(model).TableName())
+		}
+	}
+	//Keep the stored timestamps and leave related rows to their own tables
+	for _, callback := range []string{"gorm:update_time_stamp", "gorm:save_before_associations", "gorm:save_after_associations"} {
+		db.Callback().Create().Remove(callback)
+	}
+	return nil
+}
+
+//insertRows Stores a slice of rows of a model with their IDs, into a database set up by prepareDatabaseRestore
+func insertRows(tx *gorm.DB, model interface{}, rows reflect.Value) error {
+	table := tx.NewScope(model).TableName()
+	for i := 0; i < rows.Len(); i++ {
+		if err := tx.Create(rows.Index(i).Addr().Interface()).Error; err != nil {
+			return errors.Wrap(err, "Failed to copy into "+table)
+		}
+	}
+	if err := resetSequence(tx, model); err != nil {
+		return errors.Wrap(err, "Failed to reset the IDs of "+table)
+	}
+	return nil
+}
+
+//resetSequence Makes PostgreSQL give IDs after the ones copied into a table. MySQL and SQLite do it on their own.
+func resetSequence(db *gorm.DB, model interface{}) error {
+	scope := db.NewScope(model)
+	if db.Dialect().GetName() != databaseDriverPostgres || scope.PrimaryField() == nil || scope.PrimaryField().Field.Kind() == reflect.String {
+		return nil
+	}
+	table := scope.TableName()
+	return db.Exec(fmt.Sprintf("SELECT setval(pg_get_serial_sequence('%s', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM %s", table, scope.QuotedTableName())).Error
+}
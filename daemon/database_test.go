@@ -0,0 +1,243 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/jinzhu/gorm"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//testDatabaseServer How to start a throwaway server of a dialect in a docker container
+type testDatabaseServer struct {
+	Image string
+	Port  docker.Port
+	Env   []string
+	DSN   string //Format of the data source name, given the host port
+}
+
+var testDatabaseServers = map[string]testDatabaseServer{
+	databaseDriverPostgres: {
+		Image: "postgres:16-alpine",
+		Port:  "5432/tcp",
+		Env:   []string{"POSTGRES_PASSWORD=mds", "POSTGRES_DB=mds"},
+		DSN:   "host=127.0.0.1 port=%s user=postgres password=mds dbname=mds sslmode=disable",
+	},
+	databaseDriverMySQL: {
+		Image: "mysql:8.0",
+		Port:  "3306/tcp",
+		Env:   []string{"MYSQL_ROOT_PASSWORD=mds", "MYSQL_DATABASE=mds"},
+		DSN:   "root:mds@tcp(127.0.0.1:%s)/mds",
+	},
+}
+
+//openTestDatabase Opens an empty database of a dialect. SQLite gets a temporary file. The others use the DSN in
+//MDS_TEST_POSTGRES_DSN or MDS_TEST_MYSQL_DSN, whose tables are dropped, or a server started in a docker container.
+//The test is skipped if there is neither.
+func openTestDatabase(t *testing.T, driver string) (*gorm.DB, func()) {
+	if driver == databaseDriverSQLite {
+		dir, err := ioutil.TempDir("", "mds-database-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		db, err := openDatabaseWith(driver, filepath.Join(dir, "mds.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db, func() {
+			db.Close()
+			os.RemoveAll(dir)
+		}
+	}
+	if dsn := os.Getenv("MDS_TEST_" + strings.ToUpper(driver) + "_DSN"); dsn != "" {
+		db, err := openDatabaseWith(driver, dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, model := range databaseModels {
+			db.DropTableIfExists(model)
+		}
+		db.DropTableIfExists(&SchemaMigration{})
+		return db, func() { db.Close() }
+	}
+	engine, err := docker.NewClientFromEnv()
+	if err == nil {
+		err = engine.Ping()
+	}
+	if err != nil {
+		t.Skipf("Set MDS_TEST_%s_DSN or make docker reachable to test %s: %v", strings.ToUpper(driver), driver, err)
+	}
+	server := testDatabaseServers[driver]
+	if _, err := engine.InspectImage(server.Image); err != nil {
+		repository, tag := splitImageReference(server.Image)
+		if err := engine.PullImage(docker.PullImageOptions{Repository: repository, Tag: tag}, docker.AuthConfiguration{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	container, err := engine.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{Image: server.Image, Env: server.Env, ExposedPorts: map[docker.Port]struct{}{server.Port: {}}},
+		HostConfig: &docker.HostConfig{
+			PortBindings: map[docker.Port][]docker.PortBinding{server.Port: {{HostIP: "127.0.0.1"}}},
+		},
+		Context: context.Background(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := func() { removeContainer(engine, container.ID) }
+	if err := engine.StartContainer(container.ID, nil); err != nil {
+		stop()
+		t.Fatal(err)
+	}
+	container, err = engine.InspectContainer(container.ID)
+	if err != nil || len(container.NetworkSettings.Ports[server.Port]) == 0 {
+		stop()
+		t.Fatalf("Port of the %s container is unknown: %v", driver, err)
+	}
+	dsn := fmt.Sprintf(server.DSN, container.NetworkSettings.Ports[server.Port][0].HostPort)
+	//The server takes a while to accept connections
+	deadline := time.Now().Add(2 * time.Minute)
+	for {
+		db, err := openDatabaseWith(driver, dsn)
+		if err == nil {
+			if err = db.DB().Ping(); err == nil {
+				return db, func() {
+					db.Close()
+					stop()
+				}
+			}
+			db.Close()
+		}
+		if time.Now().After(deadline) {
+			stop()
+			t.Fatalf("%s did not start: %v", driver, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+//fillTestDatabase Stores a row of every model the way the daemon does. Returns how many rows were stored.
+func fillTestDatabase(t *testing.T, db *gorm.DB) int {
+	if err := migrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	createUser(db, "Admin", "User", "admin", "admin@example.com", testPassword, []string{"*.*"})
+	spec := mds.DeploymentSpec{Domains: []string{"app.example.com", "www.example.com"}, Network: "shop"}
+	deployment := mds.Deployment{ProjectName: "app", Port: "30001", Spec: spec, Settings: strings.Repeat("s", 5000)}
+	deleted := mds.Deployment{ProjectName: "deleted", Port: "30002"}
+	job := mds.Job{Type: CreateDeploymentJob, Status: mds.JobStatusFailed, Error: strings.Repeat("e", 1000)}
+	rows := []interface{}{
+		&deployment,
+		&deleted,
+		&job,
+		&NginxProxyConfiguration{DomainName: "app.example.com", DeploymentID: 1},
+		&mds.AuthenticationToken{AuthenticationToken: "token", UserID: 1, Persistent: true},
+		&mds.EnvironmentVariable{DeploymentID: 1, Name: "KEY", Value: strings.Repeat("v", 1000), Secret: true},
+		&mds.Upload{ID: "upload", Size: 10, SHA256: strings.Repeat("0", 64), ExpiresAt: time.Now()},
+		&mds.RegistryCredential{Registry: "registry.example.com", Username: "ci", Password: "enc"},
+		&PortReservation{Port: 30001, DeploymentID: 1},
+	}
+	for _, row := range rows {
+		if err := db.Create(row).Error; err != nil {
+			t.Fatalf("Failed to store %T: %v", row, err)
+		}
+	}
+	if err := db.Create(&mds.JobStep{JobID: job.ID, Name: "record", Message: "Created deployment record"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	db.Delete(&deleted)
+	//Dates from before the copy have to survive it
+	db.Model(&job).UpdateColumn("created_at", time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC))
+	//The admin comes with a permission and the job with a step
+	return len(rows) + 3
+}
+
+func TestDatabaseDialects(t *testing.T) {
+	_, resetRange := setPortRange(t, 3)
+	defer resetRange()
+	for _, driver := range []string{databaseDriverSQLite, databaseDriverPostgres, databaseDriverMySQL} {
+		t.Run(driver, func(t *testing.T) {
+			db, cleanup := openTestDatabase(t, driver)
+			defer cleanup()
+			source, cleanupSource := openTestDatabase(t, databaseDriverSQLite)
+			defer cleanupSource()
+			stored := fillTestDatabase(t, source)
+
+			copied, err := copyDatabase(source, db)
+			if err != nil || copied != stored {
+				t.Fatalf("Copied %d of %d rows: %v", copied, stored, err)
+			}
+			if _, err := copyDatabase(source, db); err == nil {
+				t.Fatal("Copied into a database that is not empty")
+			}
+
+			var deployment mds.Deployment
+			if err := db.Where("project_name = ?", "app").First(&deployment).Error; err != nil {
+				t.Fatal(err)
+			}
+			if deployment.ID != 1 || deployment.Spec.PrimaryDomain() != "app.example.com" || deployment.Spec.Network != "shop" || len(deployment.Settings) != 5000 {
+				t.Fatalf("Deployment did not survive the copy: %+v", deployment)
+			}
+			if !db.Where("project_name = ?", "deleted").First(&mds.Deployment{}).RecordNotFound() {
+				t.Fatal("Deleted deployment came back")
+			}
+			var job mds.Job
+			db.Preload("Steps").First(&job)
+			if job.CreatedAt.UTC().Year() != 2017 || len(job.Steps) != 1 || len(job.Error) != 1000 {
+				t.Fatalf("Job did not survive the copy: %+v", job)
+			}
+			if status := checkAuthentication(db, "token", ListDeploymentPermission); status != AuthOK {
+				t.Fatalf("Token of the admin was not accepted after the copy: %d", status)
+			}
+
+			//New rows get IDs after the copied ones and unique indexes hold
+			next := mds.Deployment{ProjectName: "next"}
+			if err := db.Create(&next).Error; err != nil || next.ID != 3 {
+				t.Fatalf("New deployment got ID %d: %v", next.ID, err)
+			}
+			if err := db.Create(&PortReservation{Port: 30001, DeploymentID: next.ID}).Error; err == nil {
+				t.Fatal("Port was reserved twice")
+			}
+			if port, err := reservePort(db, next.ID); err != nil || port == 30001 {
+				t.Fatalf("Unexpected port %d: %v", port, err)
+			}
+		})
+	}
+}
+
+func TestWithDSNParameter(t *testing.T) {
+	expected := map[string]string{
+		"root:pw@tcp(db:3306)/mds":                      "root:pw@tcp(db:3306)/mds?parseTime=true",
+		"root:pw@tcp(db:3306)/mds?":                     "root:pw@tcp(db:3306)/mds?parseTime=true",
+		"root:pw@tcp(db:3306)/mds?tls=true":             "root:pw@tcp(db:3306)/mds?tls=true&parseTime=true",
+		"root:pw@tcp(db:3306)/mds?parseTime=false&tls=1": "root:pw@tcp(db:3306)/mds?parseTime=false&tls=1",
+	}
+	for dsn, withParameter := range expected {
+		if found := withDSNParameter(dsn, "parseTime", "true"); found != withParameter {
+			t.Errorf("%s: expected %s, got %s", dsn, withParameter, found)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//Variables the daemon sets on every application container. They cannot be set as custom variables.
+var reservedEnvironmentVariables = map[string]bool{
+	"ROOT_URL":        true,
+	"MONGO_URL":       true,
+	"MONGO_OPLOG_URL": true,
+	"METEOR_SETTINGS": true,
+}
+
+//applicationConfiguration The settings and custom environment variables an application container is created with
+type applicationConfiguration struct {
+	Settings    string          //Contents of settings.json, passed as METEOR_SETTINGS
+	Environment []string        //Custom variables as KEY=VALUE
+	Secrets     map[string]bool //Names of variables whose values are never shown
+}
+
+//apply Adds or replaces the variables in set and secrets, marking only the latter secret, then removes the names in unset
+func (c *applicationConfiguration) apply(set []string, secrets []string, unset []string) {
+	c.Environment = removeEnvironment(mergeEnvironment(mergeEnvironment(c.Environment, set), secrets), unset)
+	if c.Secrets == nil {
+		c.Secrets = make(map[string]bool)
+	}
+	for _, variable := range set {
+		name, _ := splitEnvironmentVariable(variable)
+		delete(c.Secrets, name)
+	}
+	for _, variable := range secrets {
+		name, _ := splitEnvironmentVariable(variable)
+		c.Secrets[name] = true
+	}
+	for _, name := range unset {
+		delete(c.Secrets, name)
+	}
+}
+
+//variables Gets the custom variables with the values of secrets replaced by mds.RedactedValue
+func (c *applicationConfiguration) variables() []mds.EnvironmentVariable {
+	variables := []mds.EnvironmentVariable{}
+	for _, variable := range c.Environment {
+		name, value := splitEnvironmentVariable(variable)
+		if c.Secrets[name] {
+			value = mds.RedactedValue
+		}
+		variables = append(variables, mds.EnvironmentVariable{Name: name, Value: value, Secret: c.Secrets[name]})
+	}
+	return variables
+}
+
+//redacted Gets the custom variables as KEY=VALUE with the values of secrets hidden so they can be logged
+func (c *applicationConfiguration) redacted() []string {
+	var redacted []string
+	for _, variable := range c.variables() {
+		redacted = append(redacted, variable.Name+"="+variable.Value)
+	}
+	return redacted
+}
+
+//loadApplicationConfiguration Gets the settings and custom environment variables of a deployment.
+//Deployments that were created before the configuration was stored have it read back from their container.
+func loadApplicationConfiguration(dClient *docker.Client, db *gorm.DB, deployment *mds.Deployment) (applicationConfiguration, error) {
+	configuration := applicationConfiguration{Secrets: make(map[string]bool)}
+	if !deployment.ConfigurationSaved {
+		container, err := dClient.InspectContainer(deployment.ContainerID)
+		if err != nil {
+			return configuration, err
+		}
+		return readApplicationConfiguration(dClient, container)
+	}
+	settings, err := secrets.Decrypt(deployment.Settings)
+	if err != nil {
+		return configuration, errors.Wrap(err, "Settings")
+	}
+	configuration.Settings = settings
+	var variables []mds.EnvironmentVariable
+	if err := db.Where("deployment_id = ?", deployment.ID).Order("id").Find(&variables).Error; err != nil {
+		return configuration, err
+	}
+	for _, variable := range variables {
+		value, err := secrets.Decrypt(variable.Value)
+		if err != nil {
+			return configuration, errors.Wrap(err, "Environment variable "+variable.Name)
+		}
+		configuration.Environment = append(configuration.Environment, variable.Name+"="+value)
+		if variable.Secret {
+			configuration.Secrets[variable.Name] = true
+		}
+	}
+	return configuration, nil
+}
+
+//saveApplicationConfiguration Encrypts and replaces the stored settings and custom environment variables of a deployment
+func saveApplicationConfiguration(db *gorm.DB, deployment *mds.Deployment, configuration applicationConfiguration) error {
+	settings, err := secrets.Encrypt(configuration.Settings)
+	if err != nil {
+		return err
+	}
+	tx := db.Begin()
+	if err := tx.Where("deployment_id = ?", deployment.ID).Delete(&mds.EnvironmentVariable{}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, variable := range configuration.Environment {
+		name, value := splitEnvironmentVariable(variable)
+		encrypted, err := secrets.Encrypt(value)
+		if err == nil {
+			err = tx.Create(&mds.EnvironmentVariable{DeploymentID: deployment.ID, Name: name, Value: encrypted, Secret: configuration.Secrets[name]}).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	settingsChecksum := checksumSettings(configuration.Settings)
+	changes := map[string]interface{}{"settings": settings, "settings_checksum": settingsChecksum, "configuration_saved": true}
+	if err := tx.Model(&mds.Deployment{}).Where("id = ?", deployment.ID).Updates(changes).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+	//The record keeps the encrypted form so saving it again does not store the plaintext
+	deployment.Settings = settings
+	deployment.SettingsChecksum = settingsChecksum
+	deployment.ConfigurationSaved = true
+	return nil
+}
+
+//checksumSettings Returns the hex SHA-256 of settings, or an empty string if there are no settings
+func checksumSettings(settings string) string {
+	if settings == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(settings))
+	return hex.EncodeToString(sum[:])
+}
+
+//deleteApplicationConfiguration Removes the stored environment variables of a deployment
+func deleteApplicationConfiguration(db *gorm.DB, deploymentID uint) error {
+	return db.Where("deployment_id = ?", deploymentID).Delete(&mds.EnvironmentVariable{}).Error
+}
+
+//readApplicationConfiguration Recovers the configuration an application container was created with.
+//Variables that come from the image or are set by the daemon are left out.
+func readApplicationConfiguration(dClient *docker.Client, container *docker.Container) (applicationConfiguration, error) {
+	var configuration applicationConfiguration
+	image, err := dClient.InspectImage(container.Image)
+	if err != nil {
+		return configuration, err
+	}
+	fromImage := make(map[string]bool)
+	for _, variable := range image.Config.Env {
+		fromImage[variable] = true
+	}
+	for _, variable := range container.Config.Env {
+		name, value := splitEnvironmentVariable(variable)
+		switch {
+		case name == "METEOR_SETTINGS":
+			configuration.Settings = value
+		case name == "" || reservedEnvironmentVariables[name] || fromImage[variable]:
+			continue
+		default:
+			configuration.Environment = append(configuration.Environment, variable)
+		}
+	}
+	return configuration, nil
+}
+
+//splitEnvironmentVariable Splits KEY=VALUE into its name and value
+func splitEnvironmentVariable(variable string) (string, string) {
+	parts := strings.SplitN(variable, "=", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+//validateVariableNames Checks that names can be removed from the custom variables
+func validateVariableNames(names []string) error {
+	for _, name := range names {
+		if name == "" || strings.ContainsAny(name, "= \t\n") {
+			return fmt.Errorf("'%s' is not a variable name", name)
+		}
+		if reservedEnvironmentVariables[name] {
+			return fmt.Errorf("%s is set by the daemon and cannot be changed", name)
+		}
+	}
+	return nil
+}
+
+//validateEnvironment Checks that custom variables are KEY=VALUE pairs that do not replace a reserved variable
+func validateEnvironment(environment []string) error {
+	for _, variable := range environment {
+		name, _ := splitEnvironmentVariable(variable)
+		if name == "" || !strings.Contains(variable, "=") || strings.ContainsAny(name, " \t\n") {
+			return fmt.Errorf("'%s' is not a KEY=VALUE pair", variable)
+		}
+		if reservedEnvironmentVariables[name] {
+			return fmt.Errorf("%s is set by the daemon and cannot be changed", name)
+		}
+	}
+	return nil
+}
+
+//mergeEnvironment Returns base with each variable in overrides replacing the one with the same name, or appended if it is new
+func mergeEnvironment(base []string, overrides []string) []string {
+	merged := append([]string{}, base...)
+	for _, override := range overrides {
+		name, _ := splitEnvironmentVariable(override)
+		replaced := false
+		for i, variable := range merged {
+			if existing, _ := splitEnvironmentVariable(variable); existing == name {
+				merged[i] = override
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, override)
+		}
+	}
+	return merged
+}
+
+//removeEnvironment Returns environment without the variables with the given names
+func removeEnvironment(environment []string, names []string) []string {
+	remove := make(map[string]bool)
+	for _, name := range names {
+		remove[name] = true
+	}
+	kept := []string{}
+	for _, variable := range environment {
+		if name, _ := splitEnvironmentVariable(variable); !remove[name] {
+			kept = append(kept, variable)
+		}
+	}
+	return kept
+}
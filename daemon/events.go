@@ -0,0 +1,189 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//How many events can queue up for a subscriber before new events are dropped for it
+const eventSubscriberBuffer = 64
+
+//How often a comment is sent on idle event streams so proxies do not close them
+const eventKeepAliveInterval = 15 * time.Second
+
+//EventBroker Fans deployment events out to every subscriber of the event stream
+type EventBroker struct {
+	lock        sync.Mutex
+	subscribers map[chan mds.DeploymentEvent]struct{}
+}
+
+var events = NewEventBroker()
+
+//NewEventBroker Creates an EventBroker with no subscribers
+func NewEventBroker() *EventBroker {
+	return &EventBroker{subscribers: make(map[chan mds.DeploymentEvent]struct{})}
+}
+
+//Subscribe Registers a new subscriber and returns the channel its events are delivered on
+func (b *EventBroker) Subscribe() chan mds.DeploymentEvent {
+	ch := make(chan mds.DeploymentEvent, eventSubscriberBuffer)
+	b.lock.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.lock.Unlock()
+	return ch
+}
+
+//Unsubscribe Removes a subscriber and closes its channel
+func (b *EventBroker) Unsubscribe(ch chan mds.DeploymentEvent) {
+	b.lock.Lock()
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+	b.lock.Unlock()
+}
+
+//Publish Sends an event to every subscriber. Slow subscribers miss events rather than block the publisher.
+func (b *EventBroker) Publish(event mds.DeploymentEvent) {
+	if event.Timestamp == 0 {
+		event.Timestamp = time.Now().Unix()
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+			log.Warningf("Dropped %s event for deployment %d, subscriber is not keeping up", event.Type, event.DeploymentID)
+		}
+	}
+}
+
+//publishStatusChange Announces that a deployment moved from one status to another
+func publishStatusChange(deployment *mds.Deployment, previousStatus string) {
+	events.Publish(mds.DeploymentEvent{
+		Type:           mds.EventTypeStatus,
+		DeploymentID:   deployment.ID,
+		ProjectName:    deployment.ProjectName,
+		Status:         deployment.Status,
+		PreviousStatus: previousStatus,
+		Health:         deployment.Health,
+		Message:        fmt.Sprintf("Status changed from '%s' to '%s'", previousStatus, deployment.Status),
+	})
+}
+
+//publishHealthChange Announces that the health reported by docker for a deployment changed
+func publishHealthChange(deployment *mds.Deployment, previousHealth string) {
+	events.Publish(mds.DeploymentEvent{
+		Type:           mds.EventTypeHealth,
+		DeploymentID:   deployment.ID,
+		ProjectName:    deployment.ProjectName,
+		Status:         deployment.Status,
+		Health:         deployment.Health,
+		PreviousHealth: previousHealth,
+		Message:        fmt.Sprintf("Health changed from '%s' to '%s'", previousHealth, deployment.Health),
+	})
+}
+
+//publishProgress Announces that a step of a create, update or delete completed
+func publishProgress(deployment *mds.Deployment, step string, message string) {
+	events.Publish(mds.DeploymentEvent{
+		Type:         mds.EventTypeProgress,
+		DeploymentID: deployment.ID,
+		ProjectName:  deployment.ProjectName,
+		Status:       deployment.Status,
+		Health:       deployment.Health,
+		Step:         step,
+		Message:      message,
+	})
+}
+
+//Statuses of deployments whose containers a job is creating or replacing
+var busyDeploymentStatuses = []string{"deploying", "updating"}
+
+//setDeploymentStatus Updates the status of a deployment, stores it and announces the change.
+//Only the status column is written so a stale copy cannot put back what a job changed since it was read.
+func setDeploymentStatus(db *gorm.DB, deployment *mds.Deployment, status string) {
+	previousStatus := deployment.Status
+	deployment.Status = status
+	db.Model(&mds.Deployment{}).Where("id = ?", deployment.ID).Update("status", status)
+	if previousStatus != status {
+		publishStatusChange(deployment, previousStatus)
+	}
+}
+
+//Called when GET /events is called. Streams events as server-sent events until the client disconnects.
+//An optional deployment query parameter limits the stream to a single deployment.
+func eventsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	//Check if they only want a single deployment
+	var deploymentFilter uint
+	if filter := r.URL.Query().Get("deployment"); filter != "" {
+		id, err := strconv.Atoi(filter)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Invalid Deployment ID", nil)
+			return
+		}
+		deploymentFilter = uint(id)
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, mds.ErrorCodeInternal, "Streaming Not Supported", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	subscription := events.Subscribe()
+	defer events.Unsubscribe(subscription)
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case event := <-subscription:
+			if deploymentFilter != 0 && event.DeploymentID != deploymentFilter {
+				continue
+			}
+			jsonBytes, err := json.Marshal(event)
+			if err != nil {
+				log.Warning(err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, jsonBytes)
+			flusher.Flush()
+		}
+	}
+}
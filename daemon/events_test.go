@@ -0,0 +1,80 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+func TestDeploymentStatusWrites(t *testing.T) {
+	_, cleanup := newTestAPI(t)
+	defer cleanup()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"Id":"app1","State":{"Status":"running","Running":true}}`))
+	}))
+	defer server.Close()
+	engine, _ := docker.NewClient(server.URL)
+
+	//A stale copy only writes its status and leaves what a job changed since it was read
+	deployment := mds.Deployment{ProjectName: "app", ContainerID: "app1", Port: "3000", Status: "exited"}
+	database.Create(&deployment)
+	stale := deployment
+	database.Model(&mds.Deployment{}).Where("id = ?", deployment.ID).Updates(map[string]interface{}{"container_id": "app2", "port": "3001"})
+	setDeploymentStatus(database, &stale, "stopped")
+	var stored mds.Deployment
+	database.First(&stored, deployment.ID)
+	if stored.Status != "stopped" || stored.ContainerID != "app2" || stored.Port != "3001" {
+		t.Fatalf("Stale status write changed other columns: %+v", stored)
+	}
+
+	//Inspecting picks up the status of the container
+	if _, err := inspectDeployment(engine, database, deployment.ID); err != nil {
+		t.Fatal(err)
+	}
+	database.First(&stored, deployment.ID)
+	if stored.Status != "running" || stored.Port != "3001" {
+		t.Fatalf("Unexpected deployment after inspecting: %+v", stored)
+	}
+
+	//Deployments a job is updating keep that status until the job sets the next one
+	database.Model(&mds.Deployment{}).Where("id = ?", deployment.ID).Update("status", "updating")
+	jobs.LockDeployments(deployment.ID)
+	inspected, err := inspectDeployment(engine, database, deployment.ID)
+	jobs.UnlockDeployments(deployment.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	database.First(&stored, deployment.ID)
+	if stored.Status != "updating" || inspected.Status != "updating" {
+		t.Fatalf("Inspecting overwrote the status of a busy deployment: %s %s", stored.Status, inspected.Status)
+	}
+
+	//Without a job holding it the status was left behind and the container decides
+	if _, err := inspectDeployment(engine, database, deployment.ID); err != nil {
+		t.Fatal(err)
+	}
+	database.First(&stored, deployment.ID)
+	if stored.Status != "running" {
+		t.Fatalf("Inspecting kept a status no job is behind: %s", stored.Status)
+	}
+}
@@ -0,0 +1,563 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//Version of the layout of export archives. Import refuses archives of other versions.
+const exportFormatVersion = 1
+
+//Entries of an export archive
+const (
+	exportManifestEntry    = "manifest.json"
+	exportBundleEntry      = "application.tar.gz" //The bundle or image tarball the deployment runs
+	exportCertificateEntry = "certificate.cer"
+	exportPrivateKeyEntry  = "certificate.key"
+	exportMongoEntry       = "mongo.archive" //A mongodump archive of the MongoDB managed for the deployment
+)
+
+//exportManifest Describes the deployment in an export archive. It is the first entry so an import can be checked
+//before the rest of the archive is read.
+type exportManifest struct {
+	Version        int
+	CreatedAt      time.Time
+	Hostname       string
+	ProjectName    string
+	Type           string
+	Spec           mds.DeploymentSpec       //Domains lists every domain the deployment was served under, the primary one first
+	Running        bool                     //Whether the deployment was meant to be running before it was exported
+	Bundle         bundleInfo               //What was known about the bundle or image tarball
+	Configuration  applicationConfiguration //Settings and custom environment variables with the values of secrets in the clear
+	HasBundle      bool
+	HasCertificate bool
+	HasMongoDump   bool
+}
+
+//deploymentExport The files of a deployment gathered by prepareExport, ready to be written as an export archive
+type deploymentExport struct {
+	Manifest        exportManifest
+	bundlePath      string
+	certificatePath string
+	privateKeyPath  string
+	mongoDump       string //Temporary file removed by Close
+}
+
+//Close Removes the MongoDB dump
+func (e *deploymentExport) Close() {
+	if e.mongoDump != "" {
+		os.Remove(e.mongoDump)
+	}
+}
+
+//prepareExport Gathers what an export of a deployment holds and dumps its MongoDB, so nothing is left to fail
+//but writing. With stop the application container is stopped before the dump so nothing written to MongoDB
+//afterwards is lost, and the deployment is left stopped. It is started again if the export cannot be prepared.
+func prepareExport(client *docker.Client, db *gorm.DB, deployment mds.Deployment, stop bool) (*deploymentExport, error) {
+	configuration, err := loadApplicationConfiguration(client, db, &deployment)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read the configuration")
+	}
+	export := &deploymentExport{Manifest: exportManifest{
+		Version:       exportFormatVersion,
+		CreatedAt:     time.Now().UTC(),
+		ProjectName:   deployment.ProjectName,
+		Type:          deployment.Type,
+		Spec:          deployment.Spec,
+		Running:       deployment.AutoStart,
+		Bundle:        bundleInfo{Checksum: deployment.BundleChecksum, MeteorRelease: deployment.MeteorRelease, NodeVersion: deployment.NodeVersion},
+		Configuration: configuration,
+	}}
+	export.Manifest.Hostname, _ = os.Hostname()
+	if export.Manifest.Type == "" {
+		export.Manifest.Type = mds.DeploymentTypeBundle
+	}
+	var proxy NginxProxyConfiguration
+	if !db.Where("deployment_id = ?", deployment.ID).First(&proxy).RecordNotFound() {
+		//Deployments made before the spec listed every domain
+		if len(export.Manifest.Spec.Domains) == 0 {
+			export.Manifest.Spec.Domains = append([]string{proxy.DomainName}, strings.Fields(proxy.Aliases)...)
+		}
+		certificateExists, _ := pathExists(proxy.CertificatePath)
+		privateKeyExists, _ := pathExists(proxy.PrivateKeyPath)
+		if proxy.IsHTTPS && certificateExists && privateKeyExists {
+			export.certificatePath = proxy.CertificatePath
+			export.privateKeyPath = proxy.PrivateKeyPath
+			export.Manifest.HasCertificate = true
+		}
+	}
+	if len(export.Manifest.Spec.Domains) == 0 && deployment.URL != "" {
+		export.Manifest.Spec.Domains = []string{deployment.URL}
+	}
+	if deployment.VolumePath != "" {
+		bundlePath := filepath.Join(deployment.VolumePath, "application.tar.gz")
+		if exists, _ := pathExists(bundlePath); exists {
+			export.bundlePath = bundlePath
+			export.Manifest.HasBundle = true
+		}
+	}
+
+	stopped := false
+	if stop && deployment.AutoStart && deployment.ContainerID != "" {
+		if err := stopContainer(client, deployment.ContainerID); err != nil {
+			return nil, errors.Wrap(err, "Failed to stop the application container")
+		}
+		stopped = true
+		publishProgress(&deployment, "export", "Stopped application container "+deployment.ContainerID+" to export it")
+	}
+	//Undoes the stop, the deployment keeps running where it is
+	fail := func(err error) (*deploymentExport, error) {
+		export.Close()
+		if stopped {
+			if startErr := startContainer(client, deployment.ContainerID); startErr != nil {
+				log.Errorf("Failed to start %s again after a failed export: %s", deployment.ProjectName, startErr.Error())
+			}
+		}
+		return nil, err
+	}
+	if deployment.MongoContainerID != "" {
+		if export.mongoDump, err = dumpDeploymentMongoDB(client, deployment); err != nil {
+			return fail(errors.Wrap(err, "Failed to dump MongoDB"))
+		}
+		export.Manifest.HasMongoDump = true
+	}
+	if stopped {
+		if err := stopDeployment(client, db, &deployment); err != nil {
+			return fail(err)
+		}
+	}
+	return export, nil
+}
+
+//dumpDeploymentMongoDB Dumps the MongoDB of a deployment to a temporary file and returns its path. The MongoDB
+//container of a deployment that was stopped is started for the dump and then stopped again.
+func dumpDeploymentMongoDB(client *docker.Client, deployment mds.Deployment) (string, error) {
+	if deployment.AutoStart {
+		return writeMongoDump(client, deployment)
+	}
+	if err := startContainer(client, deployment.MongoContainerID); err != nil {
+		return "", err
+	}
+	defer stopContainer(client, deployment.MongoContainerID)
+	deadline := time.Now().Add(mongoStartTimeout)
+	for {
+		dump, err := writeMongoDump(client, deployment)
+		//Fails while MongoDB is still starting up
+		if err == nil || time.Now().After(deadline) {
+			return dump, err
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+//writeTo Writes the export archive, a gzipped tarball whose first entry is the manifest
+func (e *deploymentExport) writeTo(out io.Writer) error {
+	gz := gzip.NewWriter(out)
+	archive := tar.NewWriter(gz)
+	encoded, err := json.MarshalIndent(e.Manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeBackupEntry(archive, exportManifestEntry, encoded); err != nil {
+		return err
+	}
+	files := []struct{ entry, path string }{
+		{exportBundleEntry, e.bundlePath},
+		{exportCertificateEntry, e.certificatePath},
+		{exportPrivateKeyEntry, e.privateKeyPath},
+		{exportMongoEntry, e.mongoDump},
+	}
+	for _, file := range files {
+		if file.path == "" {
+			continue
+		}
+		if err := writeBackupFile(archive, file.entry, file.path); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+//readExportManifest Reads the manifest of an export archive and checks that the deployment it describes can be created.
+//Returns an *invalidBundleError if the archive is damaged or was not written by a compatible mds-daemon.
+func readExportManifest(archivePath string) (exportManifest, error) {
+	var manifest exportManifest
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return manifest, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return manifest, invalidBundle("", "Export archive is damaged: %s", err.Error())
+	}
+	defer gz.Close()
+	entries := tar.NewReader(gz)
+	header, err := entries.Next()
+	if err != nil {
+		return manifest, invalidBundle("", "Export archive is damaged: %s", err.Error())
+	}
+	if header.Name != exportManifestEntry {
+		return manifest, invalidBundle(header.Name, "Expected %s as the first entry of the export archive", exportManifestEntry)
+	}
+	if err := json.NewDecoder(io.LimitReader(entries, bundleMetadataLimit)).Decode(&manifest); err != nil {
+		return manifest, invalidBundle(exportManifestEntry, "Invalid manifest: %s", err.Error())
+	}
+	return manifest, checkExportManifest(&manifest)
+}
+
+//checkExportManifest Checks the version of an export and that the deployment it describes can be created
+func checkExportManifest(manifest *exportManifest) error {
+	if manifest.Version != exportFormatVersion {
+		return invalidBundle(exportManifestEntry, "Export archives of version %d cannot be imported, this mds-daemon imports version %d", manifest.Version, exportFormatVersion)
+	}
+	if manifest.ProjectName == "" {
+		return invalidBundle(exportManifestEntry, "The export does not name its project")
+	}
+	manifest.Spec.Normalize()
+	if err := manifest.Spec.Validate(); err != nil {
+		return invalidBundle(exportManifestEntry, "%s", err.Error())
+	}
+	//The deployment keeps its domain, a new one would break every link to it
+	if manifest.Spec.PrimaryDomain() == "" {
+		return invalidBundle(exportManifestEntry, "The export does not say which domain the deployment was served under")
+	}
+	if err := checkDeploymentSource(manifest.Type, &manifest.Spec, manifest.HasBundle, false); err != nil {
+		return invalidBundle(exportManifestEntry, "%s", err.Error())
+	}
+	if err := validateEnvironment(manifest.Configuration.Environment); err != nil {
+		return invalidBundle(exportManifestEntry, "%s", err.Error())
+	}
+	return nil
+}
+
+//unpackedExport What unpackExport took out of an export archive
+type unpackedExport struct {
+	Manifest    exportManifest
+	Bundle      bundleInfo //What was learned about the bundle while it was checked again
+	Certificate []byte
+	PrivateKey  []byte
+	MongoDump   string //Path of the MongoDB dump, empty if there is none
+}
+
+//unpackExport Puts the bundle of an export archive into applicationDirectory and its MongoDB dump into workDirectory.
+//The bundle is checked against the checksum in the manifest and validated like an uploaded one.
+func unpackExport(archivePath string, applicationDirectory string, workDirectory string) (unpackedExport, error) {
+	var unpacked unpackedExport
+	manifest, err := readExportManifest(archivePath)
+	if err != nil {
+		return unpacked, err
+	}
+	unpacked.Manifest = manifest
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return unpacked, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return unpacked, err
+	}
+	defer gz.Close()
+	bundlePath := filepath.Join(applicationDirectory, "application.tar.gz")
+	checksum := ""
+	entries := tar.NewReader(gz)
+	for {
+		header, err := entries.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return unpacked, invalidBundle("", "Export archive is damaged: %s", err.Error())
+		}
+		switch header.Name {
+		case exportManifestEntry:
+			continue
+		case exportBundleEntry:
+			if !manifest.HasBundle {
+				return unpacked, invalidBundle(header.Name, "The manifest does not list a bundle")
+			}
+			if checksum, err = writeExportEntry(bundlePath, entries, 0644); err != nil {
+				return unpacked, err
+			}
+		case exportCertificateEntry:
+			unpacked.Certificate, err = ioutil.ReadAll(io.LimitReader(entries, bundleMetadataLimit))
+		case exportPrivateKeyEntry:
+			unpacked.PrivateKey, err = ioutil.ReadAll(io.LimitReader(entries, bundleMetadataLimit))
+		case exportMongoEntry:
+			unpacked.MongoDump = filepath.Join(workDirectory, exportMongoEntry)
+			_, err = writeExportEntry(unpacked.MongoDump, entries, 0600)
+		default:
+			return unpacked, invalidBundle(header.Name, "Unknown entry in the export archive")
+		}
+		if err != nil {
+			return unpacked, err
+		}
+	}
+	if manifest.HasBundle && checksum == "" {
+		return unpacked, invalidBundle(exportBundleEntry, "The bundle listed by the manifest is missing")
+	}
+	if manifest.HasMongoDump && unpacked.MongoDump == "" {
+		return unpacked, invalidBundle(exportMongoEntry, "The MongoDB dump listed by the manifest is missing")
+	}
+	if !manifest.HasBundle {
+		return unpacked, nil
+	}
+	if manifest.Bundle.Checksum != "" && manifest.Bundle.Checksum != checksum {
+		return unpacked, invalidBundle(exportBundleEntry, "Checksum of the bundle does not match, expected %s but got %s", manifest.Bundle.Checksum, checksum)
+	}
+	if manifest.Type == mds.DeploymentTypeImage {
+		if _, err := readImageArchive(bundlePath); err != nil {
+			return unpacked, err
+		}
+		unpacked.Bundle = bundleInfo{Checksum: checksum}
+		return unpacked, nil
+	}
+	unpacked.Bundle, err = validateBundle(bundlePath, bundleLimitsFromConfig())
+	unpacked.Bundle.Checksum = checksum
+	return unpacked, err
+}
+
+//writeExportEntry Copies an entry of an export archive to a new file. Returns the hex SHA-256 of its content.
+func writeExportEntry(filePath string, content io.Reader, mode os.FileMode) (string, error) {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), content); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), file.Sync()
+}
+
+//importDeployment Creates a deployment from an export archive under the domain names it was served under.
+//Its MongoDB is loaded from the dump before the application container starts, and a deployment that
+//was stopped when it was exported is stopped again once it has been created.
+func importDeployment(client *docker.Client, db *gorm.DB, archivePath string, progress deploymentProgress) (*mds.Deployment, error) {
+	workDirectory, err := ioutil.TempDir("", "mds-import")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workDirectory)
+	applicationDirectory, err := GetNewApplicationDirectory()
+	if err != nil {
+		return nil, err
+	}
+	unpacked, err := unpackExport(archivePath, applicationDirectory, workDirectory)
+	if err != nil {
+		os.RemoveAll(applicationDirectory)
+		return nil, err
+	}
+	manifest := unpacked.Manifest
+	if !manifest.HasBundle {
+		os.RemoveAll(applicationDirectory)
+		applicationDirectory = ""
+	}
+	var certificate *NginxProxyConfiguration
+	//Nothing refers to the unpacked files if the deployment is not created
+	fail := func(err error) (*mds.Deployment, error) {
+		if applicationDirectory != "" {
+			os.RemoveAll(applicationDirectory)
+		}
+		if certificate != nil {
+			os.Remove(certificate.CertificatePath)
+			os.Remove(certificate.PrivateKeyPath)
+		}
+		return nil, err
+	}
+	if err := progress(nil, "unpack", "Unpacked the export of "+manifest.ProjectName+" from "+manifest.Hostname); err != nil {
+		return fail(err)
+	}
+
+	//The certificate is installed once the domain names are reserved so it cannot replace the one of another deployment.
+	//The dump is loaded as soon as MongoDB has started, before the application can write to it.
+	importProgress := func(deployment *mds.Deployment, step string, message string) error {
+		if err := progress(deployment, step, message); err != nil {
+			return err
+		}
+		switch {
+		case step == "domain":
+			installed, err := installExportedCertificate(unpacked, deployment.URL)
+			if err != nil {
+				return errors.Wrap(err, "Failed to install the certificate")
+			}
+			if installed == nil {
+				return nil
+			}
+			certificate = installed
+			return progress(deployment, "domain", "Installed the certificate of "+deployment.URL+" from "+manifest.Hostname)
+		case step == "mongo" && unpacked.MongoDump != "":
+			if err := restoreMongoDB(client, deployment.MongoContainerID, unpacked.MongoDump); err != nil {
+				return errors.Wrap(err, "Failed to restore MongoDB")
+			}
+			return progress(deployment, "mongo", "Restored MongoDB from the dump of "+manifest.Hostname)
+		}
+		return nil
+	}
+	deployment, err := createDeployment(client, db, manifest.ProjectName, manifest.Type, applicationDirectory, unpacked.Bundle, manifest.Configuration, manifest.Spec, importProgress)
+	if err != nil {
+		return fail(err)
+	}
+	if unpacked.MongoDump != "" && deployment.MongoContainerID == "" {
+		progress(deployment, "mongo", "Left the MongoDB dump out, the deployment uses the MongoDB of the configuration")
+	}
+	if !manifest.Running {
+		if err := stopDeployment(client, db, deployment); err != nil {
+			log.Warningf("Failed to stop imported deployment %s: %s", deployment.ProjectName, err.Error())
+		} else {
+			progress(deployment, "stop", "Stopped the deployment, it was stopped on "+manifest.Hostname)
+		}
+	}
+	return deployment, nil
+}
+
+//installExportedCertificate Puts the certificate of an export where the proxy for domainName reads it from.
+//Nothing is installed if the export has no certificate or the proxy generates its own with the selfsigned provider.
+//Returns the proxy configuration holding the paths of the installed files, nil if nothing was installed.
+func installExportedCertificate(unpacked unpackedExport, domainName string) (*NginxProxyConfiguration, error) {
+	if len(unpacked.Certificate) == 0 || len(unpacked.PrivateKey) == 0 || viper.GetString("CertProvider") == "selfsigned" {
+		return nil, nil
+	}
+	config := nginx.GenerateHTTPSSettings(NginxProxyConfiguration{DomainName: domainName})
+	if err := os.MkdirAll(filepath.Dir(config.CertificatePath), 0755); err != nil {
+		return nil, err
+	}
+	//Files already there were left behind by a deployment that was deleted, the domain name has been reserved
+	os.Remove(config.CertificatePath)
+	os.Remove(config.PrivateKeyPath)
+	if err := ioutil.WriteFile(config.CertificatePath, unpacked.Certificate, 0644); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(config.PrivateKeyPath, unpacked.PrivateKey, 0600); err != nil {
+		os.Remove(config.CertificatePath)
+		return nil, err
+	}
+	return &config, nil
+}
+
+//Called when GET or POST /deployment/:id/export is called. Streams the export archive of the deployment.
+//POST stops the deployment first and leaves it stopped, which also needs the deployment.control permission.
+//GET never changes the deployment so a retried or prefetched download cannot take it down.
+func exportDeploymentAPIHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := requestDeploymentID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, err.Error(), nil)
+		return
+	}
+	stop := r.Method == "POST"
+	if !stop && r.URL.Query().Get("stop") != "" {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Use POST to stop the deployment while exporting it", nil)
+		return
+	}
+	if stop {
+		if authCode := checkAuthentication(database, r.Header.Get("X-Auth-Token"), ControlDeploymentPermission); authCode != AuthOK {
+			writeAuthError(w, authCode)
+			return
+		}
+	}
+	deployment, ok := updatableDeployment(w, id)
+	if !ok {
+		return
+	}
+	//Held while the archive is sent so no job changes what is being exported
+	if !jobs.LockDeployments(deployment.ID) {
+		writeBusyError(w, nil)
+		return
+	}
+	defer jobs.UnlockDeployments(deployment.ID)
+	export, err := prepareExport(dClient, database, deployment, stop)
+	if err != nil {
+		writeInternalError(w, "Failed to export "+deployment.ProjectName, err)
+		return
+	}
+	defer export.Close()
+	log.Infof("Exporting deployment %d (%s)", deployment.ID, deployment.ProjectName)
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": deployment.ProjectName + ".tar.gz"}))
+	w.WriteHeader(http.StatusOK)
+	if err := export.writeTo(w); err != nil {
+		log.Errorf("Failed to send export of %s: %s", deployment.ProjectName, err.Error())
+		//Drops the connection so the client sees the archive is incomplete
+		panic(http.ErrAbortHandler)
+	}
+}
+
+//Called when POST /deployment/import is called with an export archive. The deployment is created by a background job.
+func importDeploymentAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Expected a multipart form", err.Error())
+		return
+	}
+	upload, ok := readUploadField(w, r)
+	if !ok {
+		return
+	}
+	if !hasUploadedFile(r) && upload == nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Please provide an export archive", missingFields("uploadfile", uploadField))
+		return
+	}
+	destination, _, ok := receiveArchive(w, r, upload)
+	if !ok {
+		return
+	}
+	archivePath := filepath.Join(destination, "application.tar.gz")
+	manifest, err := readExportManifest(archivePath)
+	if err != nil {
+		os.RemoveAll(destination)
+		writeInvalidArchive(w, mds.ErrorCodeInvalidExport, "export archive", err)
+		return
+	}
+	//Checked again when the job reserves them, this just gives a quicker answer
+	if taken := UnavailableDomainNames(database, manifest.Spec.Domains, 0); len(taken) > 0 {
+		os.RemoveAll(destination)
+		writeError(w, http.StatusConflict, mds.ErrorCodeConflict, "Domain names already in use", map[string][]string{"domains": taken})
+		return
+	}
+	log.Infof("Importing %s exported from %s", manifest.ProjectName, manifest.Hostname)
+	job, _ := jobs.Submit(database, ImportDeploymentJob, requestUserID(r), nil, func(ctx context.Context, progress deploymentProgress) error {
+		//The archive was unpacked into a directory of its own
+		defer os.RemoveAll(destination)
+		_, err := importDeployment(dClient, database, archivePath, progress)
+		return err
+	})
+	writeJSON(w, http.StatusAccepted, job)
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//createTestExportDeployment Stores a deployment with a bundle, a saved configuration and a certificate under root
+func createTestExportDeployment(t *testing.T, root string) mds.Deployment {
+	bundleDirectory := filepath.Join(root, "apps", "exported")
+	if err := os.MkdirAll(bundleDirectory, 0755); err != nil {
+		t.Fatal(err)
+	}
+	bundle := writeTestBundle(t, bundleDirectory, meteorBundleEntries(`{"meteorRelease":"METEOR@1.6.1"}`))
+	bundlePath := filepath.Join(bundleDirectory, "application.tar.gz")
+	if err := os.Rename(bundle, bundlePath); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(mustReadFile(t, bundlePath)))
+	checksum := hex.EncodeToString(sum[:])
+	deployment := mds.Deployment{
+		ProjectName:    "exported",
+		Type:           mds.DeploymentTypeBundle,
+		VolumePath:     bundleDirectory,
+		AutoStart:      true,
+		Status:         "running",
+		URL:            "exported.example.com",
+		BundleChecksum: checksum,
+		Spec:           mds.DeploymentSpec{Domains: []string{"exported.example.com", "www.example.com"}},
+	}
+	database.Create(&deployment)
+	configuration := applicationConfiguration{Settings: `{"public":{}}`}
+	configuration.apply([]string{"PLAIN=1"}, []string{"TOKEN=secret"}, nil)
+	if err := saveApplicationConfiguration(database, &deployment, configuration); err != nil {
+		t.Fatal(err)
+	}
+	proxy := NginxProxyConfiguration{
+		DomainName:      "exported.example.com",
+		Aliases:         "www.example.com",
+		IsHTTPS:         true,
+		CertificatePath: filepath.Join(root, "ssl", "exported.example.com.cer"),
+		PrivateKeyPath:  filepath.Join(root, "ssl", "exported.example.com.key"),
+		DeploymentID:    deployment.ID,
+	}
+	database.Create(&proxy)
+	writeTestFile(t, proxy.CertificatePath, "certificate")
+	writeTestFile(t, proxy.PrivateKeyPath, "private key")
+	return deployment
+}
+
+//writeTestExport Writes an export archive with the manifest and entries to path
+func writeTestExport(t *testing.T, path string, manifest exportManifest, entries map[string]string) {
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	archive := tar.NewWriter(gz)
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeBackupEntry(archive, exportManifestEntry, encoded); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range entries {
+		if err := writeBackupEntry(archive, name, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive.Close()
+	gz.Close()
+	if err := ioutil.WriteFile(path, b.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportAndImport(t *testing.T) {
+	root, reset := testBackupHost(t)
+	defer reset()
+	previousSecrets, previousDatabase, previousProvider := secrets, database, viper.Get("CertProvider")
+	defer func() {
+		secrets, database = previousSecrets, previousDatabase
+		viper.Set("CertProvider", previousProvider)
+	}()
+	var err error
+	if secrets, err = newSecretBox(make([]byte, masterKeyLength)); err != nil {
+		t.Fatal(err)
+	}
+	db, cleanup := openTestDatabase(t, databaseDriverSQLite)
+	defer cleanup()
+	if err := migrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	database = db
+	deployment := createTestExportDeployment(t, root)
+
+	export, err := prepareExport(nil, db, deployment, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(root, "export.tar.gz")
+	archive, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = export.writeTo(archive)
+	archive.Close()
+	export.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := readExportManifest(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.ProjectName != "exported" || !manifest.Running || !manifest.HasBundle || !manifest.HasCertificate || manifest.HasMongoDump {
+		t.Fatalf("Unexpected manifest: %+v", manifest)
+	}
+	if manifest.Spec.PrimaryDomain() != "exported.example.com" || len(manifest.Spec.Aliases()) != 1 {
+		t.Fatalf("Domains were not exported: %v", manifest.Spec.Domains)
+	}
+	if manifest.Configuration.Settings != `{"public":{}}` || !manifest.Configuration.Secrets["TOKEN"] || len(manifest.Configuration.Environment) != 2 {
+		t.Fatalf("Configuration was not exported: %+v", manifest.Configuration)
+	}
+
+	applicationDirectory := filepath.Join(root, "apps", "imported")
+	workDirectory := filepath.Join(root, "work")
+	for _, directory := range []string{applicationDirectory, workDirectory} {
+		if err := os.MkdirAll(directory, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	unpacked, err := unpackExport(archivePath, applicationDirectory, workDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unpacked.Bundle.Checksum != deployment.BundleChecksum || unpacked.Bundle.MeteorRelease != "METEOR@1.6.1" || unpacked.Bundle.NodeVersion != "8.9.4" {
+		t.Fatalf("Unexpected bundle: %+v", unpacked.Bundle)
+	}
+	if string(unpacked.Certificate) != "certificate" || string(unpacked.PrivateKey) != "private key" || unpacked.MongoDump != "" {
+		t.Fatalf("Unexpected files: %+v", unpacked)
+	}
+
+	//The selfsigned provider generates a certificate of its own
+	viper.Set("CertProvider", "selfsigned")
+	if installed, err := installExportedCertificate(unpacked, "imported.example.com"); err != nil || installed != nil {
+		t.Fatalf("Installed a certificate the proxy replaces: %v %v", installed, err)
+	}
+	viper.Set("CertProvider", "")
+	installed, err := installExportedCertificate(unpacked, "imported.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mustReadFile(t, filepath.Join(root, "ssl", "imported.example.com.cer")) != "certificate" || installed.PrivateKeyPath != filepath.Join(root, "ssl", "imported.example.com.key") {
+		t.Fatalf("Certificate was not installed: %+v", installed)
+	}
+	if info, err := os.Stat(installed.PrivateKeyPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("Private key is not private: %v %v", info, err)
+	}
+}
+
+func TestInvalidExports(t *testing.T) {
+	root, reset := testBackupHost(t)
+	defer reset()
+	valid := exportManifest{
+		Version:     exportFormatVersion,
+		ProjectName: "broken",
+		Type:        mds.DeploymentTypeBundle,
+		Spec:        mds.DeploymentSpec{Domains: []string{"broken.example.com"}},
+		Bundle:      bundleInfo{Checksum: "0000"},
+		HasBundle:   true,
+	}
+	tests := []struct {
+		name    string
+		change  func(manifest *exportManifest)
+		entries map[string]string
+	}{
+		{"newer version", func(manifest *exportManifest) { manifest.Version++ }, nil},
+		{"no domain", func(manifest *exportManifest) { manifest.Spec.Domains = nil }, nil},
+		{"no project", func(manifest *exportManifest) { manifest.ProjectName = "" }, nil},
+		{"reserved variable", func(manifest *exportManifest) { manifest.Configuration.Environment = []string{"MONGO_URL=mongodb://elsewhere"} }, nil},
+		{"missing bundle", func(manifest *exportManifest) {}, nil},
+		{"wrong checksum", func(manifest *exportManifest) {}, map[string]string{exportBundleEntry: "bundle"}},
+		{"unknown entry", func(manifest *exportManifest) {}, map[string]string{"../escape": "x"}},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			manifest := valid
+			manifest.Spec.Domains = append([]string(nil), valid.Spec.Domains...)
+			test.change(&manifest)
+			archivePath := filepath.Join(root, "export.tar.gz")
+			writeTestExport(t, archivePath, manifest, test.entries)
+			directory := filepath.Join(root, "unpacked", string(rune('a'+i)))
+			if err := os.MkdirAll(directory, 0755); err != nil {
+				t.Fatal(err)
+			}
+			_, err := unpackExport(archivePath, directory, directory)
+			if _, ok := err.(*invalidBundleError); !ok {
+				t.Fatalf("Expected the export to be rejected, got %v", err)
+			}
+		})
+	}
+
+	notAnArchive := filepath.Join(root, "not-an-archive")
+	writeTestFile(t, notAnArchive, "not gzip")
+	if _, err := readExportManifest(notAnArchive); err == nil {
+		t.Fatal("Read the manifest of a file that is not an archive")
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//Health values set by the daemon. They match the ones docker reports for its own health checks.
+const (
+	healthStarting  = "starting"  //No probe has passed yet
+	healthHealthy   = "healthy"   //The last probe passed
+	healthUnhealthy = "unhealthy" //Retries probes in a row failed
+)
+
+//healthProbe State of the HTTP health check of a single deployment
+type healthProbe struct {
+	lastRun  time.Time //When the last probe started
+	running  bool      //Whether a probe is waiting for a response
+	failures int       //Probes that failed in a row
+}
+
+//healthMonitor Runs the HTTP health checks set in deployment specs
+type healthMonitor struct {
+	sync.Mutex
+	probes map[uint]*healthProbe
+}
+
+//healthChecks Health checks of every deployment, driven by the deployment monitor
+var healthChecks = &healthMonitor{probes: make(map[uint]*healthProbe)}
+
+//Check Starts a probe of a running deployment if its interval has passed and no probe is in progress.
+//The probe runs in the background so a slow application does not hold up the monitor.
+func (m *healthMonitor) Check(db *gorm.DB, deployment mds.Deployment) {
+	check := deployment.Spec.HealthCheck
+	if check == nil || deployment.Status != "running" {
+		return
+	}
+	m.Lock()
+	defer m.Unlock()
+	probe, ok := m.probes[deployment.ID]
+	if !ok {
+		probe = &healthProbe{}
+		m.probes[deployment.ID] = probe
+	}
+	if probe.running || time.Since(probe.lastRun) < time.Duration(check.Interval)*time.Second {
+		return
+	}
+	probe.running = true
+	probe.lastRun = time.Now()
+	go m.run(db, deployment, probe)
+}
+
+//Forget Drops the state of a deployment so the next probe starts over
+func (m *healthMonitor) Forget(deploymentID uint) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.probes, deploymentID)
+}
+
+//run Probes a deployment and stores the resulting health
+func (m *healthMonitor) run(db *gorm.DB, deployment mds.Deployment, probe *healthProbe) {
+	err := probeDeployment(deployment)
+	m.Lock()
+	probe.running = false
+	if err == nil {
+		probe.failures = 0
+	} else {
+		probe.failures++
+		log.Debugf("Health check of %s failed (%d in a row): %s", deployment.ProjectName, probe.failures, err.Error())
+	}
+	health := nextHealth(deployment.Health, probe.failures, deployment.Spec.HealthCheck.Retries)
+	m.Unlock()
+	setDeploymentHealth(db, deployment.ID, health)
+}
+
+//probeDeployment Requests the health check path of a deployment. Returns an error unless it answers with a 2xx or 3xx status.
+func probeDeployment(deployment mds.Deployment) error {
+	check := deployment.Spec.HealthCheck
+	client := &http.Client{
+		Timeout: time.Duration(check.Timeout) * time.Second,
+		//A redirect still means the application is answering
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Get("http://127.0.0.1:" + deployment.Port + check.Path)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("%s returned %s", check.Path, resp.Status)
+	}
+	return nil
+}
+
+//nextHealth Works out the health of a deployment after a probe.
+//A deployment is unhealthy after retries failures in a row. Fewer failures keep the current health.
+func nextHealth(current string, failures int, retries int) string {
+	switch {
+	case failures == 0:
+		return healthHealthy
+	case failures >= retries:
+		return healthUnhealthy
+	case current == "":
+		return healthStarting
+	}
+	return current
+}
+
+//setDeploymentHealth Stores the health of a deployment if it is still running and lets event stream subscribers know
+func setDeploymentHealth(db *gorm.DB, deploymentID uint, health string) {
+	var deployment mds.Deployment
+	if db.First(&deployment, deploymentID).RecordNotFound() || deployment.Status != "running" || deployment.Health == health {
+		return
+	}
+	previousHealth := deployment.Health
+	//Only the health column so a concurrent status change is not overwritten
+	db.Model(&deployment).Update("health", health)
+	deployment.Health = health
+	publishHealthChange(&deployment, previousHealth)
+}
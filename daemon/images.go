@@ -0,0 +1,321 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//Form field holding the type of a new deployment, mds.DeploymentTypeBundle if it is not sent
+const typeField = "type"
+
+//Written by docker save, lists the images in the tarball
+const imageManifestFile = "manifest.json"
+
+//nodeImage An entry of the NodeImages table in the configuration
+type nodeImage struct {
+	Node  string //Node version the entry is for. 8 matches every 8.x.x and 8.9 every 8.9.x.
+	Image string //Image that runs bundles needing that version, pinned to a tag
+}
+
+//defaultNodeImages Used when the configuration has no NodeImages table
+var defaultNodeImages = []nodeImage{
+	{Node: "4", Image: "abernix/meteord:node-4.8.4-base"},
+	{Node: "8", Image: "abernix/meteord:node-8.9.4-base"},
+	{Node: "12", Image: "abernix/meteord:node-12.16.1-base"},
+	{Node: "14", Image: "abernix/meteord:node-14.17.6-base"},
+}
+
+//nodeImageTable Gets the NodeImages table from the configuration
+func nodeImageTable() []nodeImage {
+	var table []nodeImage
+	if err := viper.UnmarshalKey("NodeImages", &table); err != nil {
+		log.Warningf("Ignoring NodeImages, it is not a list of node and image pairs: %s", err.Error())
+		return defaultNodeImages
+	}
+	if len(table) == 0 {
+		return defaultNodeImages
+	}
+	return table
+}
+
+//selectBaseImage Picks the image a bundle runs in. The spec can name one, otherwise the most specific entry of
+//the table matching the Node version of the bundle is used. Bundles that match nothing get DefaultBaseImage.
+func selectBaseImage(spec mds.DeploymentSpec, nodeVersion string, table []nodeImage) string {
+	if spec.BaseImage != "" {
+		return spec.BaseImage
+	}
+	best := ""
+	bestLength := 0
+	for _, entry := range table {
+		length := len(strings.Split(entry.Node, "."))
+		if matchesNodeVersion(entry.Node, nodeVersion) && length > bestLength {
+			best = entry.Image
+			bestLength = length
+		}
+	}
+	if best == "" {
+		return viper.GetString("DefaultBaseImage")
+	}
+	return best
+}
+
+//matchesNodeVersion Checks that every part of a version prefix is the same in version, so 8.9 matches 8.9.4 but not 8.10.0
+func matchesNodeVersion(prefix string, version string) bool {
+	if prefix == "" || version == "" {
+		return false
+	}
+	prefixParts := strings.Split(strings.TrimPrefix(prefix, "v"), ".")
+	versionParts := strings.Split(strings.TrimPrefix(version, "v"), ".")
+	if len(prefixParts) > len(versionParts) {
+		return false
+	}
+	for i, part := range prefixParts {
+		if part != versionParts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//imageMessage Describes the image chosen for a bundle in progress events
+func imageMessage(baseImage string, nodeVersion string) string {
+	if nodeVersion == "" {
+		return "Using image " + baseImage
+	}
+	return "Using image " + baseImage + " for Node " + nodeVersion
+}
+
+//splitImageReference Splits an image reference into its repository and tag. The tag is latest if there is none.
+//A colon before the last slash belongs to the port of a registry, not to the tag. References pinned to a digest
+//are returned whole with an empty tag, docker pulls them as they are.
+func splitImageReference(reference string) (string, string) {
+	if strings.Contains(reference, "@") {
+		return reference, ""
+	}
+	lastColon := strings.LastIndex(reference, ":")
+	if lastColon > strings.LastIndex(reference, "/") {
+		return reference[:lastColon], reference[lastColon+1:]
+	}
+	return reference, "latest"
+}
+
+//ensureImage Gets an image, pulling it first if docker does not have it. The pull goes through the image manager
+//so it is not repeated if the manager is already pulling the image.
+func ensureImage(client *docker.Client, db *gorm.DB, reference string) (*docker.Image, error) {
+	image, err := client.InspectImage(reference)
+	if err != docker.ErrNoSuchImage {
+		return image, err
+	}
+	if err := imagePulls.Pull(client, db, reference); err != nil {
+		return nil, err
+	}
+	return client.InspectImage(reference)
+}
+
+//imageDigest Gets the digest that identifies the content of an image. Images that were never pushed to a registry
+//have no repository digest, their ID is used instead.
+func imageDigest(image *docker.Image) string {
+	if len(image.RepoDigests) > 0 {
+		return image.RepoDigests[0]
+	}
+	return image.ID
+}
+
+//imageArchive What was read from the manifest of a tarball written by docker save
+type imageArchive struct {
+	ID   string   //ID of the image, sha256: followed by the digest of its configuration
+	Tags []string //Tags the image was saved with, may be empty
+}
+
+//Reference Gets the name the image is shown with, its first tag or its ID
+func (a imageArchive) Reference() string {
+	if len(a.Tags) > 0 {
+		return a.Tags[0]
+	}
+	return a.ID
+}
+
+//checkDeploymentSource Makes sure a deployment form sends what its type runs. Bundle deployments need a bundle and
+//image deployments an image reference in the spec or a tarball written by docker save, not both.
+//An update can send neither to keep what the deployment runs.
+func checkDeploymentSource(deploymentType string, spec *mds.DeploymentSpec, hasArchive bool, update bool) error {
+	image := spec != nil && spec.Image != ""
+	switch deploymentType {
+	case mds.DeploymentTypeBundle:
+		if image {
+			return errors.New("Only deployments of type image can run an image")
+		}
+		if !hasArchive && !update {
+			return errors.New("Please upload the application archive")
+		}
+	case mds.DeploymentTypeImage:
+		if spec != nil && spec.BaseImage != "" {
+			return errors.New("Deployments of type image do not have a base image")
+		}
+		if image && hasArchive {
+			return errors.New("Send either an image reference or an image tarball, not both")
+		}
+		if !image && !hasArchive && !update {
+			return errors.New("Please send an image reference in the spec or upload an image tarball")
+		}
+	default:
+		return fmt.Errorf("Deployment type must be %s or %s", mds.DeploymentTypeBundle, mds.DeploymentTypeImage)
+	}
+	return nil
+}
+
+//receiveImageArchive Puts the image tarball of a deployment form into a new application directory and checks
+//that docker save wrote it. The image is loaded by the job that deploys it.
+//Returns the directory and the checksum of the tarball, or writes an error response and returns false.
+func receiveImageArchive(w http.ResponseWriter, r *http.Request, upload *mds.Upload) (string, bundleInfo, bool) {
+	destination, checksum, ok := receiveArchive(w, r, upload)
+	if !ok {
+		return "", bundleInfo{}, false
+	}
+	if _, err := readImageArchive(filepath.Join(destination, "application.tar.gz")); err != nil {
+		os.RemoveAll(destination)
+		writeInvalidArchive(w, mds.ErrorCodeInvalidImage, "image tarball", err)
+		return "", bundleInfo{}, false
+	}
+	return destination, bundleInfo{Checksum: checksum}, true
+}
+
+//readImageArchive Finds the image in a tarball written by docker save, which may be gzipped.
+//Returns an *invalidBundleError if the tarball does not hold exactly one image.
+func readImageArchive(archivePath string) (imageArchive, error) {
+	var archive imageArchive
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return archive, err
+	}
+	defer f.Close()
+	var content io.Reader = bufio.NewReader(f)
+	if magic, _ := content.(*bufio.Reader).Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(content)
+		if err != nil {
+			return archive, invalidBundle("", "Image tarball is damaged: %s", err.Error())
+		}
+		defer gz.Close()
+		content = gz
+	}
+
+	var manifest []byte
+	tr := tar.NewReader(content)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return archive, invalidBundle("", "Image tarball is not a valid tarball: %s", err.Error())
+		}
+		if path.Clean(header.Name) != imageManifestFile || header.Typeflag != tar.TypeReg {
+			continue
+		}
+		var buffer bytes.Buffer
+		if _, err := io.Copy(&limitedBuffer{buffer: &buffer, limit: bundleMetadataLimit}, tr); err != nil {
+			return archive, invalidBundle(imageManifestFile, "Entry is damaged: %s", err.Error())
+		}
+		manifest = buffer.Bytes()
+	}
+	if manifest == nil {
+		return archive, invalidBundle("", "Image tarball has no %s, write it with docker save", imageManifestFile)
+	}
+	var images []struct {
+		Config   string
+		RepoTags []string
+	}
+	if err := json.Unmarshal(manifest, &images); err != nil {
+		return archive, invalidBundle(imageManifestFile, "Not valid JSON: %s", err.Error())
+	}
+	if len(images) != 1 {
+		return archive, invalidBundle(imageManifestFile, "Image tarball holds %d images, save exactly one", len(images))
+	}
+	//blobs/sha256/<digest> in the OCI layout of newer releases, <digest>.json before that
+	digest := strings.TrimSuffix(path.Base(images[0].Config), ".json")
+	if !isSHA256(digest) {
+		return archive, invalidBundle(imageManifestFile, "Image has no configuration")
+	}
+	archive.ID = "sha256:" + digest
+	archive.Tags = images[0].RepoTags
+	return archive, nil
+}
+
+//loadImageArchive Loads the image in a tarball written by docker save
+func loadImageArchive(client *docker.Client, archivePath string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return client.LoadImage(docker.LoadImageOptions{InputStream: f})
+}
+
+//prepareImage Gets the image the container of a deployment runs and the name it is shown with.
+//Bundles run in the base image picked by selectBaseImage. Image deployments run the image of their spec,
+//or the image in the tarball in their application directory, which is loaded again if docker lost it.
+func prepareImage(client *docker.Client, db *gorm.DB, deploymentType string, spec mds.DeploymentSpec, nodeVersion string, applicationDirectory string) (string, *docker.Image, error) {
+	if deploymentType != mds.DeploymentTypeImage {
+		reference := selectBaseImage(spec, nodeVersion, nodeImageTable())
+		image, err := ensureImage(client, db, reference)
+		return reference, image, err
+	}
+	if spec.Image != "" {
+		image, err := ensureImage(client, db, spec.Image)
+		return spec.Image, image, err
+	}
+	archivePath := filepath.Join(applicationDirectory, "application.tar.gz")
+	archive, err := readImageArchive(archivePath)
+	if err != nil {
+		return "", nil, err
+	}
+	image, err := client.InspectImage(archive.ID)
+	if err == docker.ErrNoSuchImage {
+		log.Infof("Loading image %s", archive.Reference())
+		if err = loadImageArchive(client, archivePath); err != nil {
+			return "", nil, err
+		}
+		image, err = client.InspectImage(archive.ID)
+	}
+	return archive.Reference(), image, err
+}
+
+//bundleVolume Gets the directory mounted as /bundle, empty for image deployments which bring their application along
+func bundleVolume(deploymentType string, applicationDirectory string) string {
+	if deploymentType == mds.DeploymentTypeImage {
+		return ""
+	}
+	return applicationDirectory
+}
@@ -0,0 +1,118 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+func TestSelectBaseImage(t *testing.T) {
+	viper.Set("DefaultBaseImage", "meteord:default")
+	defer viper.Set("DefaultBaseImage", nil)
+	table := []nodeImage{
+		{Node: "8", Image: "meteord:8"},
+		{Node: "8.9", Image: "meteord:8.9"},
+		{Node: "12.16.1", Image: "meteord:12.16.1"},
+	}
+	expected := map[string]string{
+		"8.9.4":   "meteord:8.9",
+		"8.11.1":  "meteord:8",
+		"8.1":     "meteord:8",
+		"12.16.1": "meteord:12.16.1",
+		"12.16.2": "meteord:default",
+		"80.0.0":  "meteord:default",
+		"":        "meteord:default",
+	}
+	for version, image := range expected {
+		if selected := selectBaseImage(mds.DeploymentSpec{}, version, table); selected != image {
+			t.Errorf("Node %s: expected %s, got %s", version, image, selected)
+		}
+	}
+	if selected := selectBaseImage(mds.DeploymentSpec{BaseImage: "node:custom"}, "8.9.4", table); selected != "node:custom" {
+		t.Errorf("Base image of the spec was not used, got %s", selected)
+	}
+}
+
+func TestSplitImageReference(t *testing.T) {
+	expected := map[string][2]string{
+		"mongo":                           {"mongo", "latest"},
+		"abernix/meteord:node-8.9.4-base": {"abernix/meteord", "node-8.9.4-base"},
+		"registry:5000/team/app":          {"registry:5000/team/app", "latest"},
+		"registry:5000/team/app:2":        {"registry:5000/team/app", "2"},
+		"node@sha256:0123456789abcdef":    {"node@sha256:0123456789abcdef", ""},
+	}
+	for reference, parts := range expected {
+		if repository, tag := splitImageReference(reference); repository != parts[0] || tag != parts[1] {
+			t.Errorf("%s: expected %v, got %s %s", reference, parts, repository, tag)
+		}
+	}
+}
+
+func TestReadImageArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mds-image-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	digest := strings.Repeat("ab", 32)
+	layers := []testBundleEntry{
+		{Name: digest + ".json", Body: "{}"},
+		{Name: "0123/", Type: tar.TypeDir},
+		{Name: "0123/layer.tar", Body: "layer"},
+	}
+
+	manifests := map[string]string{
+		"tagged":     `[{"Config": "` + digest + `.json", "RepoTags": ["shop:2"], "Layers": ["0123/layer.tar"]}]`,
+		"untagged":   `[{"Config": "` + digest + `.json", "RepoTags": null, "Layers": ["0123/layer.tar"]}]`,
+		"oci layout": `[{"Config": "blobs/sha256/` + digest + `", "RepoTags": ["shop:2"], "Layers": []}]`,
+	}
+	for name, manifest := range manifests {
+		archive, err := readImageArchive(writeTestBundle(t, dir, append(layers, testBundleEntry{Name: "manifest.json", Body: manifest})))
+		if err != nil || archive.ID != "sha256:"+digest {
+			t.Errorf("%s: image was not found: %+v %v", name, archive, err)
+		}
+	}
+	archive, _ := readImageArchive(writeTestBundle(t, dir, append(layers, testBundleEntry{Name: "manifest.json", Body: manifests["tagged"]})))
+	if archive.Reference() != "shop:2" {
+		t.Errorf("Expected the image to be shown by its tag, got %s", archive.Reference())
+	}
+	archive, _ = readImageArchive(writeTestBundle(t, dir, append(layers, testBundleEntry{Name: "manifest.json", Body: manifests["untagged"]})))
+	if archive.Reference() != "sha256:"+digest {
+		t.Errorf("Expected an untagged image to be shown by its ID, got %s", archive.Reference())
+	}
+
+	rejected := map[string][]testBundleEntry{
+		"meteor bundle": meteorBundleEntries(`{"meteorRelease": "METEOR@1.6.1"}`),
+		"two images":    append(layers, testBundleEntry{Name: "manifest.json", Body: `[{"Config": "` + digest + `.json"}, {"Config": "` + digest + `.json"}]`}),
+		"no config":     append(layers, testBundleEntry{Name: "manifest.json", Body: `[{"RepoTags": ["shop:2"]}]`}),
+		"invalid json":  append(layers, testBundleEntry{Name: "manifest.json", Body: `[`}),
+	}
+	for name, entries := range rejected {
+		if _, err := readImageArchive(writeTestBundle(t, dir, entries)); err == nil {
+			t.Errorf("%s: expected the tarball to be rejected", name)
+		} else if _, ok := err.(*invalidBundleError); !ok {
+			t.Errorf("%s: expected an invalid bundle error, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//Types of jobs
+const (
+	CreateDeploymentJob = "deployment.create"
+	UpdateDeploymentJob = "deployment.update"
+	ImportDeploymentJob = "deployment.import"
+	RefreshImagesJob    = "image.refresh"
+)
+
+//Permission needed to cancel each type of job. This is the same permission needed to submit it.
+var jobPermissions = map[string]string{
+	CreateDeploymentJob: CreateDeploymentPermission,
+	UpdateDeploymentJob: UpdateDeploymentPermission,
+	ImportDeploymentJob: CreateDeploymentPermission,
+	RefreshImagesJob:    UpdateDeploymentPermission,
+}
+
+//Returned by a progress function once the job it belongs to has been cancelled
+var errJobCancelled = errors.New("Job was cancelled")
+
+//deploymentProgress Receives the steps of a deployment operation as they complete.
+//Returning an error tells the operation to stop, which is how cancellation is signalled.
+type deploymentProgress func(deployment *mds.Deployment, step string, message string) error
+
+//publishOnlyProgress A deploymentProgress that only sends the step to event stream subscribers
+func publishOnlyProgress(deployment *mds.Deployment, step string, message string) error {
+	publishProgress(deployment, step, message)
+	return nil
+}
+
+//jobWork The body of a job. It should report each step to progress and stop if progress returns an error.
+type jobWork func(ctx context.Context, progress deploymentProgress) error
+
+//JobManager Runs jobs in the background and keeps track of how to cancel them and which deployments they hold
+type JobManager struct {
+	lock        sync.Mutex
+	cancels     map[uint]context.CancelFunc
+	deployments map[uint]bool //Deployments held by a job or an export, only one may change a deployment at a time
+}
+
+var jobs = NewJobManager()
+
+//NewJobManager Creates a JobManager with no running jobs
+func NewJobManager() *JobManager {
+	return &JobManager{cancels: make(map[uint]context.CancelFunc), deployments: make(map[uint]bool)}
+}
+
+//Submit Records a new job and starts running it in the background. The job holds deploymentIDs until it ends.
+//Returns false without recording the job if one of them is already held.
+func (m *JobManager) Submit(db *gorm.DB, jobType string, userID uint, deploymentIDs []uint, work jobWork) (mds.Job, bool) {
+	if !m.LockDeployments(deploymentIDs...) {
+		return mds.Job{}, false
+	}
+	job := mds.Job{Type: jobType, Status: mds.JobStatusQueued, UserID: userID}
+	db.Create(&job)
+	log.Infof("Submitted job %d (%s)", job.ID, jobType)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.lock.Lock()
+	m.cancels[job.ID] = cancel
+	m.lock.Unlock()
+
+	go m.run(ctx, db, job, deploymentIDs, work)
+	return job, true
+}
+
+//LockDeployments Holds deployments so no other job can change them. Returns false and holds none of them
+//if one is already held.
+func (m *JobManager) LockDeployments(deploymentIDs ...uint) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, id := range deploymentIDs {
+		if m.deployments[id] {
+			return false
+		}
+	}
+	for _, id := range deploymentIDs {
+		m.deployments[id] = true
+	}
+	return true
+}
+
+//HoldsDeployment Checks whether a job or an export is holding a deployment
+func (m *JobManager) HoldsDeployment(deploymentID uint) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.deployments[deploymentID]
+}
+
+//UnlockDeployments Releases deployments held with LockDeployments
+func (m *JobManager) UnlockDeployments(deploymentIDs ...uint) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, id := range deploymentIDs {
+		delete(m.deployments, id)
+	}
+}
+
+//Cancel Asks a running job to stop. Returns false if the job is not running.
+func (m *JobManager) Cancel(jobID uint) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	cancel, ok := m.cancels[jobID]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+//run Runs the work of a job and records its progress and result
+func (m *JobManager) run(ctx context.Context, db *gorm.DB, job mds.Job, deploymentIDs []uint, work jobWork) {
+	defer func() {
+		m.lock.Lock()
+		if cancel, ok := m.cancels[job.ID]; ok {
+			cancel()
+			delete(m.cancels, job.ID)
+		}
+		m.lock.Unlock()
+	}()
+
+	db.Model(&job).Update("status", mds.JobStatusRunning)
+
+	progress := func(deployment *mds.Deployment, step string, message string) error {
+		//The first step that knows about a deployment ties it to the job
+		if deployment != nil && job.DeploymentID == 0 && deployment.ID != 0 {
+			job.DeploymentID = deployment.ID
+			db.Model(&job).Update("deployment_id", deployment.ID)
+		}
+		db.Create(&mds.JobStep{JobID: job.ID, Name: step, Message: message})
+		if deployment != nil {
+			publishProgress(deployment, step, message)
+		}
+		if ctx.Err() != nil {
+			return errJobCancelled
+		}
+		return nil
+	}
+
+	err := runJobWork(ctx, work, progress, func() {
+		//The work never got to put back the status of what it was changing
+		resetBusyDeployments(dClient, db, append([]uint{job.DeploymentID}, deploymentIDs...)...)
+	})
+
+	finishedAt := time.Now()
+	updates := map[string]interface{}{"finished_at": &finishedAt}
+	if ctx.Err() != nil && (err == nil || errors.Cause(err) == errJobCancelled) {
+		updates["status"] = mds.JobStatusCancelled
+		updates["error"] = errJobCancelled.Error()
+		if stepErr, ok := err.(*DeploymentStepError); ok {
+			updates["failed_step"] = stepErr.Step
+		}
+		log.Warningf("Job %d (%s) was cancelled", job.ID, job.Type)
+	} else if err != nil {
+		updates["status"] = mds.JobStatusFailed
+		updates["error"] = err.Error()
+		if stepErr, ok := err.(*DeploymentStepError); ok {
+			updates["failed_step"] = stepErr.Step
+		}
+		log.Criticalf("Job %d (%s) failed: %s", job.ID, job.Type, err.Error())
+	} else {
+		updates["status"] = mds.JobStatusSucceeded
+		log.Infof("Job %d (%s) finished", job.ID, job.Type)
+	}
+	//Released first so the deployments can be changed again by the time the job is seen to have ended
+	m.UnlockDeployments(deploymentIDs...)
+	db.Model(&job).Updates(updates)
+}
+
+//runJobWork Runs the work of a job, turning a panic into an error so it cannot take the daemon down with it.
+//crashed is called after a panic to clean up what the work could not.
+func runJobWork(ctx context.Context, work jobWork, progress deploymentProgress, crashed func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Criticalf("Job panicked: %v\n%s", r, debug.Stack())
+			err = fmt.Errorf("Job crashed: %v", r)
+			crashed()
+		}
+	}()
+	return work(ctx, progress)
+}
+
+//failInterruptedJobs Marks jobs that were still active when the daemon stopped as failed and gives the deployments
+//they were creating or updating the status of their container back
+func failInterruptedJobs(client *docker.Client, db *gorm.DB) {
+	finishedAt := time.Now()
+	result := db.Model(&mds.Job{}).Where("status IN (?)", []string{mds.JobStatusQueued, mds.JobStatusRunning}).
+		Updates(map[string]interface{}{"status": mds.JobStatusFailed, "error": "Interrupted by daemon restart", "finished_at": &finishedAt})
+	if result.RowsAffected > 0 {
+		log.Warningf("Marked %d interrupted jobs as failed", result.RowsAffected)
+	}
+	var busy []uint
+	db.Model(&mds.Deployment{}).Where("status IN (?)", busyDeploymentStatuses).Pluck("id", &busy)
+	resetBusyDeployments(client, db, busy...)
+}
+
+//resetBusyDeployments Sets deployments still deploying or updating after their job ended to the status of their
+//container, exited if they have none or it is gone, so they can be changed again
+func resetBusyDeployments(client *docker.Client, db *gorm.DB, deploymentIDs ...uint) {
+	if len(deploymentIDs) == 0 {
+		return
+	}
+	var deployments []mds.Deployment
+	db.Where("id IN (?) AND status IN (?)", deploymentIDs, busyDeploymentStatuses).Find(&deployments)
+	for _, deployment := range deployments {
+		status := "exited"
+		if deployment.ContainerID != "" && client != nil {
+			if container, err := client.InspectContainer(deployment.ContainerID); err == nil {
+				status = container.State.Status
+			}
+		}
+		log.Warningf("%s was left %s, setting it to %s", deployment.ProjectName, deployment.Status, status)
+		setDeploymentStatus(db, &deployment, status)
+	}
+}
+
+//getJob Gets a job and its steps from the DB
+func getJob(db *gorm.DB, jobID string) (mds.Job, error) {
+	var job mds.Job
+	if db.First(&job, jobID).RecordNotFound() {
+		return job, errors.New("Job not found")
+	}
+	db.Where("job_id = ?", job.ID).Order("id asc").Find(&job.Steps)
+	return job, nil
+}
+
+//Called when GET /jobs is called. Returns the most recent jobs without their steps.
+func getJobsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	jobList := []mds.Job{}
+	database.Order("id desc").Limit(50).Find(&jobList)
+	writeJSON(w, http.StatusOK, jobList)
+}
+
+//requestJob Loads the job named in the path of the request, sending an error response if that fails
+func requestJob(w http.ResponseWriter, r *http.Request) (mds.Job, bool) {
+	idString, _ := pathParam(r, "id")
+	if _, err := strconv.Atoi(idString); err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Invalid Job ID", nil)
+		return mds.Job{}, false
+	}
+	job, err := getJob(database, idString)
+	if err != nil {
+		writeError(w, http.StatusNotFound, mds.ErrorCodeNotFound, err.Error(), nil)
+		return job, false
+	}
+	return job, true
+}
+
+//Called when GET /jobs/:id is called
+func getJobAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if job, ok := requestJob(w, r); ok {
+		writeJSON(w, http.StatusOK, job)
+	}
+}
+
+//Called when DELETE /jobs/:id is called. Cancels the job if it is still running.
+func cancelJobAPIHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := requestJob(w, r)
+	if !ok {
+		return
+	}
+	authCode := checkAuthentication(database, r.Header.Get("X-Auth-Token"), jobPermissions[job.Type])
+	if authCode != AuthOK {
+		writeAuthError(w, authCode)
+		return
+	}
+	if job.IsFinished() || !jobs.Cancel(job.ID) {
+		writeError(w, http.StatusConflict, mds.ErrorCodeConflict, "Job already "+job.Status, map[string]string{"status": job.Status})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job)
+}
@@ -0,0 +1,183 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/x509/pkix"
+	"errors"
+	"strings"
+
+	"github.com/fsouza/go-dockerclient"
+	"github.com/jinzhu/gorm"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//Seconds docker waits for a container to stop before killing it
+const containerStopTimeout = 10
+
+//Returned when a lifecycle action is asked of a deployment that has no application container yet
+var errNoContainer = errors.New("Deployment has no container")
+
+//Actions that can be taken on a running deployment
+const (
+	StartDeploymentAction   = "start"
+	StopDeploymentAction    = "stop"
+	RestartDeploymentAction = "restart"
+)
+
+//getDeploymentDetail Gets a deployment with its proxy, MongoDB and container configuration
+func getDeploymentDetail(dClient *docker.Client, db *gorm.DB, deploymentID uint) (*mds.DeploymentDetail, error) {
+	var deployment mds.Deployment
+	if db.First(&deployment, deploymentID).RecordNotFound() {
+		return nil, gorm.ErrRecordNotFound
+	}
+	//Refresh the status, falling back to what was last saved if docker cannot be reached
+	if inspected, err := inspectDeployment(dClient, db, deploymentID); err == nil {
+		deployment = *inspected
+	} else {
+		log.Warning(err)
+	}
+	detail := &mds.DeploymentDetail{Deployment: deployment, MongoMode: deploymentMongoMode(deployment)}
+
+	if detail.MongoMode == mds.MongoModeManaged {
+		if mongoContainer, err := dClient.InspectContainer(deployment.MongoContainerID); err == nil {
+			detail.MongoStatus = mongoContainer.State.Status
+		} else {
+			log.Warning(err)
+		}
+	}
+
+	if deployment.ConfigurationSaved || deployment.ContainerID != "" {
+		if configuration, err := loadApplicationConfiguration(dClient, db, &deployment); err == nil {
+			detail.EnvironmentVariables = environmentVariableNames(configuration.Environment)
+		} else {
+			log.Warning(err)
+		}
+	}
+
+	var nginxConfig NginxProxyConfiguration
+	if !db.Where("deployment_id = ?", deployment.ID).First(&nginxConfig).RecordNotFound() {
+		detail.Proxy = &mds.ProxyDetail{
+			DomainName:  nginxConfig.DomainName,
+			IsHTTPS:     nginxConfig.IsHTTPS,
+			Destination: nginxConfig.Destination,
+		}
+		if nginxConfig.IsHTTPS {
+			detail.Proxy.CertificatePath = nginxConfig.CertificatePath
+			if certificate, err := ReadCertificateFromFile(nginxConfig.CertificatePath); err == nil {
+				detail.Proxy.CertificateSubject = certificateName(certificate.Subject, certificate.DNSNames)
+				detail.Proxy.CertificateIssuer = certificateName(certificate.Issuer, nil)
+				detail.Proxy.CertificateExpires = &certificate.NotAfter
+			} else {
+				log.Warningf("Could not read certificate of %s: %s", nginxConfig.DomainName, err.Error())
+			}
+		}
+	}
+	return detail, nil
+}
+
+//certificateName Gets a readable name for the subject or issuer of a certificate.
+//Certificates made by CreateSelfSignedCertificate only have an organization and DNS names.
+func certificateName(name pkix.Name, dnsNames []string) string {
+	if name.CommonName != "" {
+		return name.CommonName
+	}
+	if len(dnsNames) > 0 {
+		return dnsNames[0]
+	}
+	return strings.Join(name.Organization, ", ")
+}
+
+//environmentVariableNames Gets the names from a list of KEY=VALUE pairs so values are never exposed
+func environmentVariableNames(environment []string) []string {
+	names := []string{}
+	for _, variable := range environment {
+		name := strings.SplitN(variable, "=", 2)[0]
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+//startDeployment Starts the MongoDB container of a deployment, if it has one, followed by the application container
+func startDeployment(dClient *docker.Client, db *gorm.DB, deployment *mds.Deployment) error {
+	if deployment.ContainerID == "" {
+		return errNoContainer
+	}
+	if deployment.MongoContainerID != "" {
+		if err := startContainer(dClient, deployment.MongoContainerID); err != nil {
+			return err
+		}
+		publishProgress(deployment, "mongo", "Started MongoDB container "+deployment.MongoContainerID)
+	}
+	if err := startContainer(dClient, deployment.ContainerID); err != nil {
+		return err
+	}
+	publishProgress(deployment, "container", "Started application container "+deployment.ContainerID)
+	//Remember that it should be running
+	deployment.AutoStart = true
+	db.Model(deployment).Update("auto_start", true)
+	return nil
+}
+
+//stopDeployment Stops the application container of a deployment followed by its MongoDB container. Nothing is removed.
+func stopDeployment(dClient *docker.Client, db *gorm.DB, deployment *mds.Deployment) error {
+	if deployment.ContainerID == "" {
+		return errNoContainer
+	}
+	if err := stopContainer(dClient, deployment.ContainerID); err != nil {
+		return err
+	}
+	publishProgress(deployment, "container", "Stopped application container "+deployment.ContainerID)
+	if deployment.MongoContainerID != "" {
+		if err := stopContainer(dClient, deployment.MongoContainerID); err != nil {
+			return err
+		}
+		publishProgress(deployment, "mongo", "Stopped MongoDB container "+deployment.MongoContainerID)
+	}
+	//Remember that it was stopped on purpose
+	deployment.AutoStart = false
+	db.Model(deployment).Update("auto_start", false)
+	return nil
+}
+
+//restartDeployment Stops and then starts a deployment so MongoDB is up before the application starts again
+func restartDeployment(dClient *docker.Client, db *gorm.DB, deployment *mds.Deployment) error {
+	if err := stopDeployment(dClient, db, deployment); err != nil {
+		return err
+	}
+	return startDeployment(dClient, db, deployment)
+}
+
+//startContainer Starts a container, doing nothing if it is already running
+func startContainer(dClient *docker.Client, containerID string) error {
+	err := dClient.StartContainer(containerID, nil)
+	if _, ok := err.(*docker.ContainerAlreadyRunning); ok {
+		return nil
+	}
+	return err
+}
+
+//stopContainer Stops a container, doing nothing if it is not running
+func stopContainer(dClient *docker.Client, containerID string) error {
+	err := dClient.StopContainer(containerID, containerStopTimeout)
+	if _, ok := err.(*docker.ContainerNotRunning); ok {
+		return nil
+	}
+	return err
+}
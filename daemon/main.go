@@ -20,14 +20,15 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"fmt"
 	math "math/rand"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/fsouza/go-dockerclient"
 	"github.com/jinzhu/gorm"
-	_ "github.com/jinzhu/gorm/dialects/sqlite"
 	"github.com/op/go-logging"
 	"github.com/spf13/viper"
 	"github.com/twa16/meteor-deploy-system/common"
@@ -38,6 +39,16 @@ import (
 var log = logging.MustGetLogger("mds-daemon")
 var nginx NginxInstance
 
+//Maintenance commands that run instead of the daemon, as in 'mds-daemon <command> [args]'
+var commands = map[string]func(args []string) error{
+	"rotate-key":     rotateKeyCommand,
+	"encrypt-secret": encryptSecretCommand,
+	"migrate-db":     migrateDatabaseCommand,
+	"migrate":        migrateCommand,
+	"backup":         backupCommand,
+	"restore":        restoreCommand,
+}
+
 func main() {
 	log.Info("Meteor Deploy System - Manuel Gauto (mgauto@mgenterprises.org)")
 	log.Info("Starting...")
@@ -52,23 +63,39 @@ func main() {
 	//Load configuration
 	loadConfig()
 
+	if len(os.Args) > 1 {
+		command, ok := commands[os.Args[1]]
+		if !ok {
+			log.Fatalf("Unknown command: %s", os.Args[1])
+		}
+		if err := command(os.Args[2:]); err != nil {
+			log.Fatalf("%s failed: %s", os.Args[1], err.Error())
+		}
+		return
+	}
+
+	//Secrets: Loading the master key
+	var err error
+	secrets, err = loadSecretBox()
+	if err != nil {
+		log.Fatalf("Failed to load master key: %s", err.Error())
+	}
+	log.Infof("Using master key %s", secrets.keyID)
+
 	//Database: Starting Connection
 	log.Info("Starting ORM...")
-	db, err := gorm.Open("sqlite3", "mds.db")
+	db, err := openDatabase()
 	if err != nil {
-		panic("failed to connect database")
+		log.Fatalf("Failed to open database: %s", err.Error())
 	}
 	defer db.Close()
 	log.Info("ORM Started.")
 
 	//Database: Migrating Schemas
 	log.Info("Migrating Schemas")
-	db.AutoMigrate(&mds.Deployment{})
-	db.AutoMigrate(&mds.UserPermission{})
-	//db.Model(&mds.User{}).Related(&mds.UserPermission{})
-	db.AutoMigrate(&mds.User{})
-	db.AutoMigrate(&mds.AuthenticationToken{})
-	db.AutoMigrate(&NginxProxyConfiguration{})
+	if err := migrateDatabase(db); err != nil {
+		log.Fatalf("Failed to migrate the database: %s", err.Error())
+	}
 	log.Info("Migration Complete")
 
 	log.Info("Creating Neccessary Directories.")
@@ -89,6 +116,9 @@ func main() {
 	//Ensure admin user exists
 	ensureAdminUser(db)
 
+	//Deployments created before ports were reserved keep theirs
+	reserveDeploymentPorts(db)
+
 	//Setup Nginx
 	nginx = NginxInstance{}
 	nginx.ReloadCommand = viper.GetString("NginxReloadCommand")
@@ -102,10 +132,12 @@ func main() {
 	}
 	log.Info("Connected to Docker")
 
-	log.Info("Pulling needed images (This can take a while the first time)...")
-	PullDockerImage(cli, "abernix/meteord")
-	PullDockerImage(cli, "mongo")
-	log.Info("Images Pulled")
+	//Jobs that were running when the daemon stopped will never finish
+	failInterruptedJobs(cli, db)
+
+	//Pull the images in the background so a slow or unreachable registry does not hold up the start
+	log.Info("Started Image Manager")
+	go imagePulls.Run(cli, db)
 
 	log.Info("Seeding random number generator...")
 	math.Seed(time.Now().UTC().UnixNano())
@@ -150,6 +182,14 @@ func main() {
 		}
 	}(cli, db)
 
+	//Remove uploads that were abandoned or never used
+	go func(db *gorm.DB) {
+		for true {
+			removeExpiredUploads(db)
+			time.Sleep(time.Minute * 10)
+		}
+	}(db)
+
 	//createDeployment(cli, db, "First-Project", "/tmp/test")
 	log.Info("Start Complete! Starting API.")
 	startAPI(cli, db)
@@ -210,6 +250,9 @@ func startDockerClient() (*docker.Client, error) {
 	return cli, err
 }
 
+//Configuration keys, as viper lowercases them, whose values can hold passwords and are not logged
+var secretConfigKeys = map[string]bool{"databasedsn": true, "mongodburl": true, "mongodbopslog": true}
+
 //loadConfig I bet you can guess what this function does
 func loadConfig() {
 	viper.SetConfigName("config")                         // name of config file (without extension)
@@ -221,6 +264,18 @@ func loadConfig() {
 	viper.SetDefault("ApplicationDirectory", "./apps")
 	viper.SetDefault("ApiHttpsKey", "./ssl/api.key")
 	viper.SetDefault("ApiHttpsCertificate", "./ssl/api.cert")
+	viper.SetDefault("SecretKeyFile", "./data/master.key")
+	viper.SetDefault("UploadExpiryHours", 24)
+	viper.SetDefault("MaxBundleSizeMB", 2048)
+	viper.SetDefault("MaxBundleFiles", 200000)
+	viper.SetDefault("MaxBundleCompressionRatio", 100)
+	viper.SetDefault("DefaultBaseImage", "abernix/meteord:node-8.9.4-base")
+	viper.SetDefault("MongoImage", "mongo")
+	viper.SetDefault("ImageCheckIntervalHours", 24)
+	viper.SetDefault("PortRangeStart", 30000)
+	viper.SetDefault("PortRangeEnd", 39999)
+	viper.SetDefault("DatabaseDriver", "sqlite3")
+	viper.SetDefault("DatabaseDSN", "mds.db")
 
 	err := viper.ReadInConfig() // Find and read the config file
 	if err != nil {
@@ -230,7 +285,11 @@ func loadConfig() {
 
 	log.Infof("Using config file: %s", viper.ConfigFileUsed())
 	for _, key := range viper.AllKeys() {
-		log.Infof("Loaded: %s as %s", key, viper.GetString(key))
+		value := viper.GetString(key)
+		if secretConfigKeys[key] && value != "" {
+			value = mds.RedactedValue
+		}
+		log.Infof("Loaded: %s as %s", key, value)
 	}
 	//viper.SetDefault("k", "v")
 }
@@ -239,19 +298,22 @@ func loadConfig() {
 // hostname = Name of the container
 // volumePath = Directory that contains the meteor application
 // externalPort = external port to assign to the container, will be proxied
-func createDockerContainer(client *docker.Client, volumePath string, externalPort string, rootURL string, mongoURL string, mongoOplogURL string, meteorSettings string, environment []string, mongoContainer *docker.Container) (*docker.Container, error) {
+// network = Network of the deployment, where a MongoDB managed by the daemon is reachable as mongo
+func createDockerContainer(client *docker.Client, image string, volumePath string, containerPort int, externalPort string, rootURL string, mongoURL string, mongoOplogURL string, meteorSettings string, environment []string, resources mds.ResourceLimits, network string) (*docker.Container, error) {
 	//======Container Config=====
 	var containerConfig docker.Config
 	//Set the image
-	containerConfig.Image = "abernix/meteord"
-	//Create the volume that will contain the app code
+	containerConfig.Image = image
+	//Create the volume that will contain the app code, images bring their own
 	containerConfig.Volumes = make(map[string]struct{})
 	var v struct{}
-	containerConfig.Volumes["/bundle"] = v
+	if volumePath != "" {
+		containerConfig.Volumes["/bundle"] = v
+	}
 	//Ports
-	//port80, _ := nat.NewPort("tcp", "80")
+	applicationPort := docker.Port(strconv.Itoa(containerPort) + "/tcp")
 	containerConfig.ExposedPorts = make(map[docker.Port]struct{})
-	containerConfig.ExposedPorts["80/tcp"] = v
+	containerConfig.ExposedPorts[applicationPort] = v
 	//Environmental Variables
 	//Format is a slice of strings FOO=BAR
 	env := make([]string, 3)
@@ -273,18 +335,22 @@ func createDockerContainer(client *docker.Client, volumePath string, externalPor
 	//=====Host Config======
 	//Setup Volume Bindings
 	var hostConfig docker.HostConfig
-	hostConfig.Binds = []string{volumePath + ":/bundle"}
+	if volumePath != "" {
+		hostConfig.Binds = []string{volumePath + ":/bundle"}
+	}
+	//Limits, zero leaves them to docker
+	hostConfig.Memory = resources.MemoryMB * 1024 * 1024
+	hostConfig.CPUShares = resources.CPUShares
 	//Setup Port Maps
 	//Forward a dynamic host port to container. Listen on localhost so that nginx can proxy.
 	hostConfig.PortBindings = make(map[docker.Port][]docker.PortBinding)
-	hostConfig.PortBindings["80/tcp"] = append(hostConfig.PortBindings["80/tcp"], docker.PortBinding{HostIP: "127.0.0.1", HostPort: externalPort})
-	//Link mongo container if necessary. The proper URLs will already be set if this is provided.
-	if mongoContainer != nil {
-		hostConfig.Links = []string{mongoContainer.ID + ":mongo"}
-	}
+	hostConfig.PortBindings[applicationPort] = append(hostConfig.PortBindings[applicationPort], docker.PortBinding{HostIP: "127.0.0.1", HostPort: externalPort})
+	//Join the network of the deployment instead of the default bridge
+	hostConfig.NetworkMode = network
 
 	//======Network Config=====
 	var networkConfig docker.NetworkingConfig
+	networkConfig.EndpointsConfig = map[string]*docker.EndpointConfig{network: {}}
 
 	//======Container Creation=====
 	//Wrapup config
@@ -309,93 +375,192 @@ func removeContainer(client *docker.Client, id string) error {
 	return client.RemoveContainer(options)
 }
 
+//deploymentUpdate What to change about a deployment. Anything left empty keeps its current value.
+type deploymentUpdate struct {
+	ApplicationDirectory string              //Directory holding the new bundle or image tarball, empty to keep the current one
+	Settings             *string             //New contents of settings.json, nil to keep the current settings
+	Environment          []string            //Custom variables to add or replace, other variables are kept
+	Secrets              []string            //Custom variables to add or replace whose values are never shown
+	Unset                []string            //Names of custom variables to remove
+	Spec                 *mds.DeploymentSpec //New aliases, resource limits and health check, nil to keep the current spec
+	Bundle               bundleInfo          //Checksum and requirements of the bundle or checksum of the tarball in ApplicationDirectory
+}
+
 //Updates and restarts a deployment
-// projectName cannot contain spaces
-func updateDeployment(dClient *docker.Client, db *gorm.DB, deploymentID int, applicationDirectory string, meteorSettings string, environment []string) (*mds.Deployment, error) {
+// progress is told about each step as it completes and stops the update if it returns an error
+// The new container is created before the old one is stopped. If any step fails the new container is removed,
+// the old one is started again and a *DeploymentStepError is returned.
+func updateDeployment(dClient *docker.Client, db *gorm.DB, deploymentID uint, update deploymentUpdate, progress deploymentProgress) (*mds.Deployment, error) {
 	/*
 	 * Step 1: Get the original deployment
 	 */
-	log.Info("Deployment Update requested for Deployment ID: %d\n", deploymentID)
+	log.Infof("Deployment Update requested for Deployment ID: %d\n", deploymentID)
 	var deployment mds.Deployment
 	var nginxConfig NginxProxyConfiguration
 
 	//Get deployment object
-	err := db.Where("id = ?", deploymentID).First(&deployment).Error
-	if err != nil {
-		log.Critical(err)
+	if db.First(&deployment, deploymentID).RecordNotFound() {
 		return nil, errors.New("Deployment with that ID does not exist")
 	}
 	//Get nginx config
-	err = db.Where("deployment_id = ?", deployment.ID).First(&nginxConfig).Error
-	if err != nil {
-		log.Critical(err)
+	if db.Where("deployment_id = ?", deployment.ID).First(&nginxConfig).RecordNotFound() {
 		return nil, errors.New("Could not find NginxConfig for that deployment")
 	}
 	log.Debugf("Deployment Update Started for %s\n", deployment.ProjectName)
-
-	//Get Mongo Container
-	mongoContainer, err := dClient.InspectContainer(deployment.MongoContainerID)
-	if err != nil {
-		log.Warning("Error getting Mongo container for update of "+deployment.ProjectName)
-		return nil, err
+	tx := &deploymentTransaction{}
+	previousStatus := deployment.Status
+	//Undoes every completed step and puts the status back
+	fail := func(err error) (*mds.Deployment, error) {
+		stepErr := tx.Rollback(err)
+		setDeploymentStatus(db, &deployment, previousStatus)
+		return nil, stepErr
 	}
+	setDeploymentStatus(db, &deployment, "updating")
 
 	/*
-	 * Step 2: Cleanup old container
+	 * Step 2: Work out the new configuration, keeping whatever was not changed
 	 */
-	//Stop the container
-	err = dClient.StopContainer(deployment.ContainerID, 10)
+	tx.Begin("configuration")
+	configuration, err := loadApplicationConfiguration(dClient, db, &deployment)
 	if err != nil {
-		log.Warning(err)
+		return fail(err)
 	}
-
-	//Remove the container
-	//This method sets the volume remove flag as well
-	err = removeContainer(dClient, deployment.ContainerID)
-	if err != nil {
-		log.Warning(err)
+	if update.Settings != nil {
+		configuration.Settings = *update.Settings
 	}
-
-	/*
-	 * Step 3: Update deployment object
-	 */
-	//Update Deployment with new values
-	deployment.VolumePath = applicationDirectory
-	db.Save(&deployment)
-
-	//He set the URLs
+	configuration.apply(update.Environment, update.Secrets, update.Unset)
+	log.Debugf("Environment for %s: %s", deployment.ProjectName, strings.Join(configuration.redacted(), " "))
+	applicationDirectory := deployment.VolumePath
+	bundle := bundleInfo{Checksum: deployment.BundleChecksum, MeteorRelease: deployment.MeteorRelease, NodeVersion: deployment.NodeVersion}
+	if update.ApplicationDirectory != "" {
+		applicationDirectory = update.ApplicationDirectory
+		bundle = update.Bundle
+	}
+	spec := deployment.Spec
+	if update.Spec != nil {
+		spec = *update.Spec
+	}
+	//An image deployment runs either the image of its spec or the tarball in its application directory
+	if deployment.Type == mds.DeploymentTypeImage {
+		if update.ApplicationDirectory != "" {
+			spec.Image = ""
+		} else if spec.Image != "" {
+			applicationDirectory = ""
+			bundle = bundleInfo{}
+		}
+	}
+	//Keep using the same MongoDB
 	mongoURL := "mongodb://mongo"
 	mongoOpsLogURL := ""
+	if deployment.MongoContainerID != "" {
+		if _, err := dClient.InspectContainer(deployment.MongoContainerID); err != nil {
+			log.Warning("Error getting Mongo container for update of " + deployment.ProjectName)
+			return fail(err)
+		}
+	} else {
+		mongoURL = viper.GetString("MongoDBURL")
+		mongoOpsLogURL = viper.GetString("MongoDBOpsLog")
+	}
+	if err := progress(&deployment, "configuration", fmt.Sprintf("Using %d custom environment variables", len(configuration.Environment))); err != nil {
+		return fail(err)
+	}
+	//Deployments made before networks reached MongoDB through a link and get a network of their own now
+	network := deployment.Network
+	if network == "" {
+		tx.Begin("network")
+		network, err = migrateToNetwork(dClient, tx, &deployment)
+		if err != nil {
+			log.Criticalf("Failed to create network for %s: %s", deployment.ProjectName, err.Error())
+			return fail(err)
+		}
+		if err := progress(&deployment, "network", "Moved deployment to network "+network); err != nil {
+			return fail(err)
+		}
+	}
 
 	/*
-	 * Step 4: Create new docker container
+	 * Step 3: Swap the old container for a new one
 	 */
-	//Create a docker container for the application
-	log.Debugf("Starting Docker Container\n")
-	container, err := createDockerContainer(dClient, deployment.VolumePath, deployment.Port, "http://"+nginxConfig.DomainName, mongoURL, mongoOpsLogURL, meteorSettings, environment, mongoContainer)
+	tx.Begin("container")
+	oldContainerID := deployment.ContainerID
+	//Registered first so it runs last, once the new container is out of the way
+	tx.OnRollback("start previous application container "+oldContainerID, func() error {
+		return startContainer(dClient, oldContainerID)
+	})
+	baseImage, image, err := prepareImage(dClient, db, deployment.Type, spec, bundle.NodeVersion, applicationDirectory)
+	if err != nil {
+		log.Criticalf("Failed to get image for %s: %s", deployment.ProjectName, err.Error())
+		return fail(err)
+	}
+	if err := progress(&deployment, "container", imageMessage(baseImage, bundle.NodeVersion)); err != nil {
+		return fail(err)
+	}
+	//Registered before the container so it runs once the container is off the shared network
+	if spec.Network != "" && spec.Network != deployment.Spec.Network {
+		tx.OnRollback("remove shared network "+sharedNetworkName(spec.Network)+" if unused", func() error {
+			return releaseSharedNetwork(dClient, db, spec.Network, deployment.ID)
+		})
+	}
+	log.Debugf("Creating Docker Container\n")
+	//Creates the container on the port of the deployment, which changes if the port turns out to be taken
+	create := func() (*docker.Container, error) {
+		container, err := createDockerContainer(dClient, image.ID, bundleVolume(deployment.Type, applicationDirectory), spec.ApplicationPort(), deployment.Port, "http://"+nginxConfig.DomainName, mongoURL, mongoOpsLogURL, configuration.Settings, configuration.Environment, spec.Resources, network)
+		if err != nil {
+			return nil, err
+		}
+		if err := joinSharedNetwork(dClient, spec, deployment.ProjectName, container.ID); err != nil {
+			removeContainer(dClient, container.ID)
+			return nil, err
+		}
+		return container, nil
+	}
+	container, err := create()
 	if err != nil {
 		log.Critical("Failed to create container: " + err.Error())
-		return nil, err
+		return fail(err)
 	}
-	//Start the new docker container
-	err = dClient.StartContainer(container.ID, nil)
+	tx.OnRollback("remove new application container", func() error {
+		return removeContainer(dClient, container.ID)
+	})
+	//The old container holds the port until it stops. It may already be gone if it was removed by hand.
+	if err := stopContainer(dClient, oldContainerID); err != nil {
+		if _, missing := err.(*docker.NoSuchContainer); !missing {
+			return fail(err)
+		}
+	}
+	container, abandonedPorts, err := startOnFreePort(dClient, db, tx, &deployment, container, create)
 	log.Debugf("Container created: %s\n", container.ID)
 	if err != nil {
 		log.Critical("Failed to start container: " + err.Error())
-		return nil, err
+		return fail(err)
+	}
+	if err := progress(&deployment, "container", "Started application container "+container.ID); err != nil {
+		return fail(err)
 	}
 
 	/*
-	 * Step 5: Save new container information
-	 */
-	//Set the Container ID
-	deployment.ContainerID = container.ID
-	//Save deployment Info
-	db.Save(&deployment)
-
-	/*
-	 * Step 6: Recreate proxy
+	 * Step 4: Recreate proxy
 	 */
+	tx.Begin("proxy")
+	previousProxy := nginxConfig
+	//Aliases are the only part of the proxy the spec can change, the destination changes if the port was taken
+	destination := "http://127.0.0.1:" + deployment.Port
+	if (update.Spec != nil && strings.Join(spec.Aliases(), " ") != nginxConfig.Aliases) || destination != nginxConfig.Destination {
+		if update.Spec != nil {
+			nginxConfig.Aliases = strings.Join(spec.Aliases(), " ")
+		}
+		nginxConfig.Destination = destination
+		if err := db.Save(&nginxConfig).Error; err != nil {
+			return fail(err)
+		}
+		tx.OnRollback("restore previous proxy for "+previousProxy.DomainName, func() error {
+			if err := db.Save(&previousProxy).Error; err != nil {
+				return err
+			}
+			_, err := nginx.CreateProxy(db, &previousProxy)
+			return err
+		})
+	}
 	//Generate HTTPS settings if needed
 	if nginxConfig.IsHTTPS {
 		log.Infof("Generating HTTPS configuration for update of %s\n", deployment.ProjectName)
@@ -405,54 +570,207 @@ func updateDeployment(dClient *docker.Client, db *gorm.DB, deploymentID int, app
 	_, err = nginx.CreateProxy(db, &nginxConfig)
 	if err != nil {
 		log.Critical("Error Creating Proxy: " + err.Error())
-		return nil, err
+		return fail(err)
+	}
+	if err := progress(&deployment, "proxy", "Recreated proxy for "+nginxConfig.DomainName); err != nil {
+		return fail(err)
 	}
 
 	/*
-	 * Step 7: Save New Deployment Information
+	 * Step 5: Store the configuration the new container was created with
 	 */
-	//If there was no error then the container is running
-	deployment.Status = "running"
-	//Save deployment Info
+	tx.Begin("record")
+	if err := saveApplicationConfiguration(db, &deployment, configuration); err != nil {
+		return fail(err)
+	}
+
+	/*
+	 * Step 6: Save the new deployment information and clean up the old container.
+	 * Nothing is rolled back from here on.
+	 */
+	oldApplicationDirectory := deployment.VolumePath
+	oldSharedNetwork := deployment.Spec.Network
+	migrated := deployment.Network == ""
+	deployment.ContainerID = container.ID
+	deployment.Network = network
+	deployment.VolumePath = applicationDirectory
+	deployment.BundleChecksum = bundle.Checksum
+	deployment.MeteorRelease = bundle.MeteorRelease
+	deployment.NodeVersion = bundle.NodeVersion
+	deployment.BaseImage = baseImage
+	deployment.ImageDigest = imageDigest(image)
+	deployment.ImageOutdated = false
+	deployment.Spec = spec
+	//The new container has not been probed yet
+	deployment.Health = ""
+	healthChecks.Forget(deployment.ID)
 	db.Save(&deployment)
+	setDeploymentStatus(db, &deployment, "running")
+	if err := removeContainer(dClient, oldContainerID); err != nil {
+		log.Warningf("Failed to remove old container %s: %s", oldContainerID, err.Error())
+	}
+	if oldApplicationDirectory != applicationDirectory {
+		if err := os.RemoveAll(oldApplicationDirectory); err != nil {
+			log.Warningf("Failed to remove old application directory %s: %s", oldApplicationDirectory, err.Error())
+		}
+	}
+	//The link of the old container was the last reason for MongoDB to be on the default bridge
+	releaseAbandonedPorts(db, deployment.ID, abandonedPorts)
+	if migrated && deployment.MongoContainerID != "" {
+		if err := disconnectNetwork(dClient, defaultBridgeNetwork, deployment.MongoContainerID); err != nil {
+			log.Warningf("Failed to take MongoDB container off %s: %s", defaultBridgeNetwork, err.Error())
+		}
+	}
+	if oldSharedNetwork != spec.Network {
+		if err := releaseSharedNetwork(dClient, db, oldSharedNetwork, deployment.ID); err != nil {
+			log.Warningf("Failed to remove shared network %s: %s", sharedNetworkName(oldSharedNetwork), err.Error())
+		}
+	}
+	progress(&deployment, "cleanup", "Removed old application container "+oldContainerID)
 	return &deployment, nil
 }
 
 //Creates and starts a deployment
 // projectName cannot contain spaces
-func createDeployment(dClient *docker.Client, db *gorm.DB, projectName string, applicationDirectory string, meteorSettings string, environment []string) (*mds.Deployment, error) {
-	log.Info("Deployment Creation Started for %s\n", projectName)
-	//Get a new port
-	var port = strconv.Itoa(GetNextOpenPort(db))
-	log.Debugf("Using port: %s\n", port)
+// deploymentType is mds.DeploymentTypeBundle or mds.DeploymentTypeImage. applicationDirectory holds the bundle or
+// the image tarball, it is empty for an image deployment that runs the image of its spec.
+// progress is told about each step as it completes and stops the creation if it returns an error
+// If any step fails everything done by the earlier steps is undone and a *DeploymentStepError is returned
+func createDeployment(dClient *docker.Client, db *gorm.DB, projectName string, deploymentType string, applicationDirectory string, bundle bundleInfo, configuration applicationConfiguration, spec mds.DeploymentSpec, progress deploymentProgress) (*mds.Deployment, error) {
+	log.Infof("Deployment Creation Started for %s\n", projectName)
+	log.Debugf("Environment for %s: %s", projectName, strings.Join(configuration.redacted(), " "))
+	var deployment mds.Deployment
+	tx := &deploymentTransaction{}
+	//Undoes every completed step and lets subscribers know the deployment failed
+	fail := func(err error) (*mds.Deployment, error) {
+		stepErr := tx.Rollback(err)
+		if deployment.ID != 0 {
+			previousStatus := deployment.Status
+			deployment.Status = "failed"
+			publishStatusChange(&deployment, previousStatus)
+		}
+		return nil, stepErr
+	}
+
+	/*
+	 * Step 1: Create the deployment record
+	 */
+	tx.Begin("record")
 	//Create a deployment record
-	var deployment = mds.Deployment{VolumePath: applicationDirectory, AutoStart: true, Port: port, ProjectName: projectName}
+	//It is deploying from the start so no update can be submitted for it before its containers exist
+	deployment = mds.Deployment{Type: deploymentType, Status: "deploying", VolumePath: applicationDirectory, AutoStart: true, ProjectName: projectName, Spec: spec, BundleChecksum: bundle.Checksum, MeteorRelease: bundle.MeteorRelease, NodeVersion: bundle.NodeVersion}
 	//Save the record so it gets an ID
-	db.Create(&deployment)
+	if err := db.Create(&deployment).Error; err != nil {
+		return fail(err)
+	}
+	tx.OnRollback("delete deployment record", func() error {
+		return db.Unscoped().Delete(&deployment).Error
+	})
+	//Held until it is created so nothing else changes it in the meantime, a new ID cannot be held already
+	jobs.LockDeployments(deployment.ID)
+	defer jobs.UnlockDeployments(deployment.ID)
+	//Reserve a port for the deployment
+	reservedPort, err := reservePort(db, deployment.ID)
+	if err != nil {
+		return fail(err)
+	}
+	tx.OnRollback("release ports", func() error {
+		return releaseDeploymentPorts(db, deployment.ID)
+	})
+	port := strconv.Itoa(reservedPort)
+	log.Debugf("Using port: %s\n", port)
+	deployment.Port = port
+	db.Save(&deployment)
+	//Stored so later redeploys can recreate the container without the settings and variables being sent again
+	if err := saveApplicationConfiguration(db, &deployment, configuration); err != nil {
+		return fail(err)
+	}
+	tx.OnRollback("delete stored configuration", func() error {
+		return deleteApplicationConfiguration(db, deployment.ID)
+	})
 	log.Debugf("Deployment Created and Saved\n")
-	//This reserves a domainName and initializes an NginxProxyConfiguration
-	nginxConfig := ReserveDomainName(db)
+	publishStatusChange(&deployment, "")
+	if err := progress(&deployment, "record", "Created deployment record using port "+port); err != nil {
+		return fail(err)
+	}
+
+	/*
+	 * Step 2: Reserve a domain name
+	 */
+	tx.Begin("domain")
+	//This reserves the domain names and initializes an NginxProxyConfiguration
+	nginxConfig, err := ReserveDomainNames(db, spec.PrimaryDomain(), spec.Aliases())
+	if err != nil {
+		return fail(err)
+	}
+	tx.OnRollback("release domain name "+nginxConfig.DomainName, func() error {
+		return db.Unscoped().Delete(&nginxConfig).Error
+	})
 	log.Debugf("Domain Name Reserved: %s", nginxConfig.DomainName)
 	//set URL on deployment
 	deployment.URL = nginxConfig.DomainName
+	//Record the generated name so the spec lists every domain served
+	if len(deployment.Spec.Domains) == 0 {
+		deployment.Spec.Domains = []string{nginxConfig.DomainName}
+	}
 	//Save deployment Info
 	db.Save(&deployment)
+	if err := progress(&deployment, "domain", "Reserved domain name "+nginxConfig.DomainName); err != nil {
+		return fail(err)
+	}
 	//TODO: Actually allow https
 	nginxConfig.IsHTTPS = true
 	//Set the deploymentID
 	nginxConfig.DeploymentID = deployment.ID
-	//Set the destination
-	nginxConfig.Destination = "http://127.0.0.1:" + port
+
+	/*
+	 * Step 3: Create the network of the deployment
+	 */
+	tx.Begin("network")
+	network := deploymentNetworkName(deployment.ID)
+	created, err := ensureNetwork(dClient, network)
+	if err != nil {
+		log.Criticalf("Failed to create network: %s\n", err.Error())
+		return fail(err)
+	}
+	if created {
+		tx.OnRollback("remove network "+network, func() error {
+			return removeNetwork(dClient, network)
+		})
+	}
+	deployment.Network = network
+	db.Save(&deployment)
+	if err := progress(&deployment, "network", "Created network "+network); err != nil {
+		return fail(err)
+	}
+
+	/*
+	 * Step 4: Start MongoDB if it is managed by the daemon
+	 */
+	tx.Begin("mongo")
 	//Prepare MongoDB Stuff
 	mongoURL := "mongodb://mongo"
 	mongoOpsLogURL := ""
 	var mongoContainer *docker.Container
-	//Check to see if the daemon is set manage mongo
-	if viper.GetBool("AutoManageMongoDB") {
+	//Check to see if the daemon is set manage mongo, unless the spec decides
+	deployment.Spec.MongoMode = mds.MongoModeExternal
+	if managesMongoDB(spec) {
+		deployment.Spec.MongoMode = mds.MongoModeManaged
 		//Create a new mongo instance
-		mongoContainerInstance, err := CreateMongoDBDockerContainer(dClient)
+		if _, err := ensureImage(dClient, db, viper.GetString("MongoImage")); err != nil {
+			log.Criticalf("Failed to get MongoDB image: %s\n", err.Error())
+			return fail(err)
+		}
+		mongoContainerInstance, err := CreateMongoDBDockerContainer(dClient, network)
+		if err != nil {
+			log.Criticalf("Failed to create MongoDB container: %s\n", err.Error())
+			return fail(err)
+		}
 		//This tells the compilier that we intentionally are shadowing the variable's intitial value.
 		mongoContainer = mongoContainerInstance
+		tx.OnRollback("remove MongoDB container "+mongoContainer.ID, func() error {
+			return removeContainer(dClient, mongoContainer.ID)
+		})
 		//Set the ID of the mongo container
 		deployment.MongoContainerID = mongoContainer.ID
 		//Save deployment Info
@@ -462,12 +780,10 @@ func createDeployment(dClient *docker.Client, db *gorm.DB, projectName string, a
 		log.Debugf("MognoDB Container created: %s\n", mongoContainer.ID)
 		if err != nil {
 			log.Critical("Failed to start MongoDB container: " + err.Error())
-			return nil, err
+			return fail(err)
 		}
-
-		if err != nil {
-			log.Criticalf("Failed to create MongoDB container: %s\n", err.Error())
-			return nil, err
+		if err := progress(&deployment, "mongo", "Started MongoDB container "+mongoContainer.ID); err != nil {
+			return fail(err)
 		}
 	} else {
 		//If the application isn't set to manage mongo then set the urls to what is in the config
@@ -475,62 +791,125 @@ func createDeployment(dClient *docker.Client, db *gorm.DB, projectName string, a
 		mongoOpsLogURL = viper.GetString("MongoDBOpsLog")
 	}
 
+	/*
+	 * Step 5: Create and start the application container
+	 */
+	tx.Begin("container")
 	//Create a docker container for the application
+	baseImage, image, err := prepareImage(dClient, db, deployment.Type, spec, bundle.NodeVersion, applicationDirectory)
+	if err != nil {
+		log.Criticalf("Failed to get image for %s: %s", deployment.ProjectName, err.Error())
+		return fail(err)
+	}
+	deployment.BaseImage = baseImage
+	deployment.ImageDigest = imageDigest(image)
+	if err := progress(&deployment, "container", imageMessage(baseImage, bundle.NodeVersion)); err != nil {
+		return fail(err)
+	}
 	log.Debugf("Starting Docker Container\n")
-	container, err := createDockerContainer(dClient, deployment.VolumePath, deployment.Port, "http://"+nginxConfig.DomainName, mongoURL, mongoOpsLogURL, meteorSettings, environment, mongoContainer)
+	//Registered first so it runs once the container is off the shared network
+	if spec.Network != "" {
+		tx.OnRollback("remove shared network "+sharedNetworkName(spec.Network)+" if unused", func() error {
+			return releaseSharedNetwork(dClient, db, spec.Network, deployment.ID)
+		})
+	}
+	//Creates the container on the port of the deployment, which changes if the port turns out to be taken
+	create := func() (*docker.Container, error) {
+		container, err := createDockerContainer(dClient, image.ID, bundleVolume(deployment.Type, applicationDirectory), spec.ApplicationPort(), deployment.Port, "http://"+nginxConfig.DomainName, mongoURL, mongoOpsLogURL, configuration.Settings, configuration.Environment, spec.Resources, network)
+		if err != nil {
+			return nil, err
+		}
+		if err := joinSharedNetwork(dClient, spec, deployment.ProjectName, container.ID); err != nil {
+			removeContainer(dClient, container.ID)
+			return nil, err
+		}
+		return container, nil
+	}
+	container, err := create()
 	if err != nil {
 		log.Critical("Failed to create container: " + err.Error())
-		return nil, err
+		return fail(err)
 	}
+	tx.OnRollback("remove application container", func() error {
+		return removeContainer(dClient, container.ID)
+	})
+	container, abandonedPorts, err := startOnFreePort(dClient, db, tx, &deployment, container, create)
 	//Set the Container ID
 	deployment.ContainerID = container.ID
 	//Save deployment Info
 	db.Save(&deployment)
-	err = dClient.StartContainer(container.ID, nil)
 	log.Debugf("Container created: %s\n", container.ID)
 	if err != nil {
 		log.Critical("Failed to start container: " + err.Error())
-		return nil, err
+		return fail(err)
 	}
+	releaseAbandonedPorts(db, deployment.ID, abandonedPorts)
+	//Set the destination
+	nginxConfig.Destination = "http://127.0.0.1:" + deployment.Port
+	if err := progress(&deployment, "container", "Started application container "+container.ID); err != nil {
+		return fail(err)
+	}
+
+	/*
+	 * Step 6: Generate key material and create the proxy
+	 */
+	tx.Begin("proxy")
 	//Generate HTTPS settings if needed
 	if nginxConfig.IsHTTPS {
 		log.Infof("Generating HTTPS configuration for %s\n", projectName)
 		nginxConfig = nginx.GenerateHTTPSSettings(nginxConfig)
 	}
+	//Registered before the proxy is created because a failure part way through can leave files behind
+	tx.OnRollback("remove proxy configuration and key material for "+nginxConfig.DomainName, func() error {
+		return nginx.RemoveProxyFiles(&nginxConfig)
+	})
 	log.Debugf("Creating nginx proxy for %s", projectName)
 	_, err = nginx.CreateProxy(db, &nginxConfig)
 	if err != nil {
 		log.Critical("Error Creating Proxy: " + err.Error())
-		return nil, err
+		return fail(err)
 	}
+	db.Save(&nginxConfig)
+	if err := progress(&deployment, "proxy", "Created proxy for "+nginxConfig.DomainName); err != nil {
+		return fail(err)
+	}
+
 	//If there was no error then the container is running
-	deployment.Status = "running"
-	//Save deployment Info
-	db.Save(&deployment)
+	setDeploymentStatus(db, &deployment, "running")
 	return &deployment, nil
 }
 
-//PullDockerImage Pulls a docker image from the hub
-func PullDockerImage(dClient *docker.Client, image string) error {
-	pullOptions := docker.PullImageOptions{Repository: image, Tag: "latest"}
-	authOptions := docker.AuthConfiguration{}
-	err := dClient.PullImage(pullOptions, authOptions)
-	return err
+//PullDockerImage Pulls a docker image, the latest tag unless the reference has a tag or digest.
+//The credentials stored for its registry are used if there are any.
+//progress, if not nil, is told what was downloaded so far while the pull goes on.
+func PullDockerImage(dClient *docker.Client, db *gorm.DB, image string, progress func(string)) error {
+	authOptions, err := registryAuth(db, image)
+	if err != nil {
+		return err
+	}
+	repository, tag := splitImageReference(image)
+	output := newPullOutput(progress)
+	pullOptions := docker.PullImageOptions{Repository: repository, Tag: tag, OutputStream: output, RawJSONStream: true}
+	if err := dClient.PullImage(pullOptions, authOptions); err != nil {
+		return err
+	}
+	return output.Err()
 }
 
 //InspectDeployments Inspects all deployments and stores updated status in database.
 func InspectDeployments(dClient *docker.Client, db *gorm.DB) {
 	var deployments []mds.Deployment
-	database.Find(&deployments)
+	db.Find(&deployments)
 	for _, deployment := range deployments {
-		inspectResult, err := inspectDeployment(dClient, database, deployment.ID)
+		inspectResult, err := inspectDeployment(dClient, db, deployment.ID)
 		if err != nil {
 			log.Warning(err)
+			continue
 		}
 		if inspectResult.Status != deployment.Status {
 			log.Infof("Update Deployment %d to status %s from %s\n", deployment.ID, inspectResult.Status, deployment.Status)
 		}
-		db.Save(&inspectResult)
+		healthChecks.Check(db, *inspectResult)
 	}
 }
 
@@ -546,9 +925,32 @@ func inspectDeployment(dClient *docker.Client, db *gorm.DB, deploymentID uint) (
 		if err != nil {
 			return nil, err
 		}
-		//Save the status
-		deployment.Status = container.State.Status
-		db.Save(&deployment)
+		//Save the status and health, letting event stream subscribers know if either changed
+		previousHealth := deployment.Health
+		if deployment.Spec.HealthCheck == nil {
+			deployment.Health = container.State.Health.Status
+		} else if container.State.Status != "running" {
+			//The daemon probes the deployment itself and starts over once it runs again
+			deployment.Health = ""
+			healthChecks.Forget(deployment.ID)
+		}
+		//Only the columns that changed are written, a job may have changed the rest of the row since it was read.
+		//A deployment held by a job that is creating or updating it keeps that status until the job sets the next one.
+		if previousStatus := deployment.Status; previousStatus != container.State.Status {
+			query := db.Model(&mds.Deployment{}).Where("id = ?", deployment.ID)
+			if jobs.HoldsDeployment(deployment.ID) {
+				query = query.Where("status NOT IN (?)", busyDeploymentStatuses)
+			}
+			result := query.Update("status", container.State.Status)
+			if result.Error == nil && result.RowsAffected > 0 {
+				deployment.Status = container.State.Status
+				publishStatusChange(&deployment, previousStatus)
+			}
+		}
+		if previousHealth != deployment.Health {
+			db.Model(&mds.Deployment{}).Where("id = ?", deployment.ID).Update("health", deployment.Health)
+			publishHealthChange(&deployment, previousHealth)
+		}
 	}
 	return &deployment, nil
 }
@@ -576,24 +978,25 @@ func DeleteDeployment(dClient *docker.Client, db *gorm.DB, deploymentID uint) er
 	if err != nil {
 		log.Warning(err)
 	}
+	//Once the container is gone nothing is left on the networks of the deployment but its MongoDB
+	removeDeploymentNetworks(dClient, db, deployment)
+	//Its port can be given to the next deployment
+	if err := releaseDeploymentPorts(db, deployment.ID); err != nil {
+		log.Warning(err)
+	}
 
 	//Delete Record
 	db.Delete(&deployment)
-	return nil
-}
-
-//GetNextOpenPort Generates an available port. This checks against the DB but does not reserve it
-// so technically, conflicts are possible.
-func GetNextOpenPort(db *gorm.DB) int {
-	for true {
-		var portTry = 30000 + math.Intn(10000)
-		var deployment mds.Deployment
-		if db.Where(&mds.Deployment{Port: strconv.Itoa(portTry)}).First(&deployment).RecordNotFound() {
-			return portTry
-		}
+	healthChecks.Forget(deployment.ID)
+	//The variables can hold credentials so they do not outlive the deployment
+	if err := deleteApplicationConfiguration(db, deployment.ID); err != nil {
+		log.Warning(err)
 	}
-	//This will never be reached but it makes the compilier happy
-	return -1
+	//The record is gone so the final status is only announced, not saved
+	previousStatus := deployment.Status
+	deployment.Status = "deleted"
+	publishStatusChange(&deployment, previousStatus)
+	return nil
 }
 
 // GenerateRandomBytes returns securely generated random bytes.
@@ -0,0 +1,392 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+//SchemaMigration A migration that was applied to the database, stored in schema_migrations
+type SchemaMigration struct {
+	Version   uint `gorm:"primary_key"`
+	Name      string
+	AppliedAt time.Time
+}
+
+//migration A numbered change to the schema or the data in it.
+//Migrations are not run in a transaction because gorm looks at the schema outside of it, so Up and Down have to
+//be safe to run again after failing halfway. Down is nil for migrations that cannot be rolled back.
+type migration struct {
+	Version uint
+	Name    string
+	Up      func(db *gorm.DB) error
+	Down    func(db *gorm.DB) error
+}
+
+//migrations Every migration, in order. Append new ones with the next version and never change one that was released,
+//a database only runs each version once. Migrations use their own copies of the models for the same reason.
+var migrations = []migration{
+	{Version: 1, Name: "create tables", Up: createTablesV1},
+	{Version: 2, Name: "index lookup columns", Up: addLookupIndexes, Down: removeLookupIndexes},
+}
+
+//latestSchemaVersion Gets the version the migrations of this binary bring the database to
+func latestSchemaVersion(list []migration) uint {
+	if len(list) == 0 {
+		return 0
+	}
+	return list[len(list)-1].Version
+}
+
+//appliedMigrations Gets the migrations recorded in the database by version, including ones this binary does not know
+func appliedMigrations(db *gorm.DB) (map[uint]SchemaMigration, error) {
+	if err := db.AutoMigrate(&SchemaMigration{}).Error; err != nil {
+		return nil, errors.Wrap(err, "Failed to create schema_migrations")
+	}
+	var rows []SchemaMigration
+	if err := db.Order("version").Find(&rows).Error; err != nil {
+		return nil, errors.Wrap(err, "Failed to read schema_migrations")
+	}
+	applied := map[uint]SchemaMigration{}
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+//schemaVersion Gets the highest version applied to the database, 0 for a database that was never migrated
+func schemaVersion(applied map[uint]SchemaMigration) uint {
+	version := uint(0)
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version
+}
+
+//migrateDatabase Applies every migration the database does not have yet. Fails without changing anything if the
+//database was migrated by a newer mds-daemon, which this one could corrupt.
+func migrateDatabase(db *gorm.DB) error {
+	return migrateTo(db, migrations, latestSchemaVersion(migrations))
+}
+
+//migrateTo Runs the migrations of list up or down until the database is at version target
+func migrateTo(db *gorm.DB, list []migration, target uint) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	current := schemaVersion(applied)
+	if latest := latestSchemaVersion(list); current > latest {
+		return fmt.Errorf("The database is at schema version %d but this mds-daemon only knows up to version %d, run a newer mds-daemon", current, latest)
+	}
+	if target > latestSchemaVersion(list) {
+		return fmt.Errorf("There is no schema version %d, the latest is %d", target, latestSchemaVersion(list))
+	}
+
+	if target >= current {
+		for _, m := range list {
+			if _, done := applied[m.Version]; done || m.Version > target {
+				continue
+			}
+			log.Infof("Applying migration %d: %s", m.Version, m.Name)
+			if err := m.Up(db); err != nil {
+				return errors.Wrapf(err, "Migration %d (%s) failed", m.Version, m.Name)
+			}
+			if err := db.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error; err != nil {
+				return errors.Wrapf(err, "Failed to record migration %d", m.Version)
+			}
+		}
+		return nil
+	}
+
+	//Check every step can be undone before undoing any of them
+	for _, m := range list {
+		if _, done := applied[m.Version]; done && m.Version > target && m.Down == nil {
+			return fmt.Errorf("Migration %d (%s) cannot be rolled back", m.Version, m.Name)
+		}
+	}
+	for i := len(list) - 1; i >= 0; i-- {
+		m := list[i]
+		if _, done := applied[m.Version]; !done || m.Version <= target {
+			continue
+		}
+		log.Infof("Rolling back migration %d: %s", m.Version, m.Name)
+		if err := m.Down(db); err != nil {
+			return errors.Wrapf(err, "Rolling back migration %d (%s) failed", m.Version, m.Name)
+		}
+		if err := db.Delete(&SchemaMigration{Version: m.Version}).Error; err != nil {
+			return errors.Wrapf(err, "Failed to remove migration %d from schema_migrations", m.Version)
+		}
+	}
+	return nil
+}
+
+//migrateCommand Runs 'mds-daemon migrate status|up [version]|down [version]'. Up goes to the latest version and
+//down rolls back the last migration unless a version is given. The daemon should be stopped while it runs.
+func migrateCommand(args []string) error {
+	usage := errors.New("Usage: mds-daemon migrate status|up [version]|down [version]")
+	if len(args) < 1 || len(args) > 2 || (args[0] == "status" && len(args) != 1) {
+		return usage
+	}
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	current := schemaVersion(applied)
+
+	var target uint
+	switch args[0] {
+	case "status":
+		printMigrationStatus(migrations, applied)
+		return nil
+	case "up":
+		target = latestSchemaVersion(migrations)
+	case "down":
+		if current == 0 {
+			return errors.New("No migrations have been applied")
+		}
+		target = current - 1
+	default:
+		return usage
+	}
+	if len(args) == 2 {
+		version, err := strconv.ParseUint(args[1], 10, 32)
+		if err != nil {
+			return usage
+		}
+		target = uint(version)
+		if (args[0] == "up" && target < current) || (args[0] == "down" && target > current) {
+			return fmt.Errorf("The database is at version %d, it cannot go %s to version %d", current, args[0], target)
+		}
+	}
+	if err := migrateTo(db, migrations, target); err != nil {
+		return err
+	}
+	log.Infof("The database is at schema version %d", target)
+	return nil
+}
+
+//printMigrationStatus Prints every migration with when it was applied
+func printMigrationStatus(list []migration, applied map[uint]SchemaMigration) {
+	fmt.Printf("%-8s %-30s %s\n", "VERSION", "NAME", "APPLIED")
+	known := map[uint]bool{}
+	for _, m := range list {
+		known[m.Version] = true
+		state := "pending"
+		if row, ok := applied[m.Version]; ok {
+			state = row.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Printf("%-8d %-30s %s\n", m.Version, m.Name, state)
+	}
+	var unknown []int
+	for version := range applied {
+		if !known[version] {
+			unknown = append(unknown, int(version))
+		}
+	}
+	sort.Ints(unknown)
+	for _, version := range unknown {
+		row := applied[uint(version)]
+		fmt.Printf("%-8d %-30s %s (unknown to this mds-daemon)\n", version, row.Name, row.AppliedAt.Format(time.RFC3339))
+	}
+}
+
+//Tables as version 1 created them. Existing databases made by AutoMigrate before versioned migrations already
+//have them, so the migration only records that they are there.
+type deploymentV1 struct {
+	gorm.Model
+	ProjectName        string
+	Type               string
+	VolumePath         string
+	AutoStart          bool
+	ContainerID        string
+	Port               string
+	Status             string
+	URL                string
+	MongoContainerID   string
+	Health             string
+	Settings           string `sql:"type:text"`
+	ConfigurationSaved bool
+	Spec               string `sql:"type:text"`
+	BundleChecksum     string
+	MeteorRelease      string
+	NodeVersion        string
+	BaseImage          string
+	ImageDigest        string
+	ImageOutdated      bool
+	Network            string
+	SettingsChecksum   string
+}
+
+type userPermissionV1 struct {
+	gorm.Model
+	UserID     uint
+	Permission string
+}
+
+type userV1 struct {
+	gorm.Model
+	FirstName    string
+	LastName     string
+	Username     string `gorm:"unique"`
+	Email        string
+	PasswordHash []byte
+}
+
+type authenticationTokenV1 struct {
+	gorm.Model
+	AuthenticationToken string
+	UserID              uint
+	LastSeen            int64
+	Persistent          bool
+}
+
+type nginxProxyConfigurationV1 struct {
+	gorm.Model
+	DomainName            string
+	Aliases               string
+	IsHTTPS               bool
+	CertificatePath       string
+	PrivateKeyPath        string
+	Destination           string
+	DeploymentID          uint
+	ConfigurationFilePath string
+}
+
+type jobV1 struct {
+	gorm.Model
+	Type         string
+	Status       string
+	UserID       uint
+	DeploymentID uint
+	Error        string `sql:"type:text"`
+	FailedStep   string
+	FinishedAt   *time.Time
+}
+
+type jobStepV1 struct {
+	gorm.Model
+	JobID   uint
+	Name    string
+	Message string `sql:"type:text"`
+}
+
+type environmentVariableV1 struct {
+	ID           uint
+	DeploymentID uint `gorm:"index"`
+	Name         string
+	Value        string `sql:"type:text"`
+	Secret       bool
+}
+
+type uploadV1 struct {
+	ID        string `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	UserID    uint
+	Size      int64
+	Offset    int64
+	SHA256    string
+	Complete  bool
+	ExpiresAt time.Time
+}
+
+type registryCredentialV1 struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Registry  string `gorm:"unique_index"`
+	Username  string
+	Password  string
+}
+
+type portReservationV1 struct {
+	ID           uint `gorm:"primary_key"`
+	Port         int  `gorm:"unique_index"`
+	DeploymentID uint `gorm:"index"`
+}
+
+func (deploymentV1) TableName() string              { return "deployments" }
+func (userPermissionV1) TableName() string          { return "user_permissions" }
+func (userV1) TableName() string                    { return "users" }
+func (authenticationTokenV1) TableName() string     { return "authentication_tokens" }
+func (nginxProxyConfigurationV1) TableName() string { return "nginx_proxy_configurations" }
+func (jobV1) TableName() string                     { return "jobs" }
+func (jobStepV1) TableName() string                 { return "job_steps" }
+func (environmentVariableV1) TableName() string     { return "environment_variables" }
+func (uploadV1) TableName() string                  { return "uploads" }
+func (registryCredentialV1) TableName() string      { return "registry_credentials" }
+func (portReservationV1) TableName() string         { return "port_reservations" }
+
+//createTablesV1 Migration 1. Creates the tables that are missing and the columns older databases do not have yet.
+func createTablesV1(db *gorm.DB) error {
+	return db.AutoMigrate(&deploymentV1{}, &userPermissionV1{}, &userV1{}, &authenticationTokenV1{},
+		&nginxProxyConfigurationV1{}, &jobV1{}, &jobStepV1{}, &environmentVariableV1{}, &uploadV1{},
+		&registryCredentialV1{}, &portReservationV1{}).Error
+}
+
+//lookupIndexes Columns rows are looked up by on every request or job, by table and index name
+var lookupIndexes = []struct {
+	Table  string
+	Name   string
+	Column string
+}{
+	{"authentication_tokens", "idx_authentication_tokens_authentication_token", "authentication_token"},
+	{"user_permissions", "idx_user_permissions_user_id", "user_id"},
+	{"job_steps", "idx_job_steps_job_id", "job_id"},
+	{"jobs", "idx_jobs_status", "status"},
+	{"nginx_proxy_configurations", "idx_nginx_proxy_configurations_deployment_id", "deployment_id"},
+}
+
+//addLookupIndexes Migration 2. Indexes the columns in lookupIndexes.
+func addLookupIndexes(db *gorm.DB) error {
+	for _, index := range lookupIndexes {
+		if db.Dialect().HasIndex(index.Table, index.Name) {
+			continue
+		}
+		if err := db.Table(index.Table).AddIndex(index.Name, index.Column).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//removeLookupIndexes Rolls back migration 2
+func removeLookupIndexes(db *gorm.DB) error {
+	for _, index := range lookupIndexes {
+		if !db.Dialect().HasIndex(index.Table, index.Name) {
+			continue
+		}
+		if err := db.Dialect().RemoveIndex(index.Table, index.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//testSchemaVersion Gets the version the database is at, failing the test if it cannot be read
+func testSchemaVersion(t *testing.T, db *gorm.DB) uint {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return schemaVersion(applied)
+}
+
+func TestMigrations(t *testing.T) {
+	latest := latestSchemaVersion(migrations)
+	for _, driver := range []string{databaseDriverSQLite, databaseDriverPostgres, databaseDriverMySQL} {
+		t.Run(driver, func(t *testing.T) {
+			db, cleanup := openTestDatabase(t, driver)
+			defer cleanup()
+
+			//Databases made before versioned migrations have their tables created by AutoMigrate
+			for _, model := range databaseModels {
+				if err := db.AutoMigrate(model).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Create(&mds.Deployment{ProjectName: "app"}).Error; err != nil {
+				t.Fatal(err)
+			}
+			if err := migrateDatabase(db); err != nil {
+				t.Fatal(err)
+			}
+			if version := testSchemaVersion(t, db); version != latest {
+				t.Fatalf("Database is at version %d instead of %d", version, latest)
+			}
+			if db.Where("project_name = ?", "app").First(&mds.Deployment{}).RecordNotFound() {
+				t.Fatal("Deployment was lost in the migration")
+			}
+
+			//Every field of every model needs a column, so changing a model needs a migration
+			for _, model := range databaseModels {
+				scope := db.NewScope(model)
+				for _, field := range scope.Fields() {
+					if field.IsNormal && !field.IsIgnored && !db.Dialect().HasColumn(scope.TableName(), field.DBName) {
+						t.Errorf("%s has no column %s, add a migration for it", scope.TableName(), field.DBName)
+					}
+				}
+			}
+
+			//Down and up again
+			if err := migrateTo(db, migrations, 1); err != nil {
+				t.Fatal(err)
+			}
+			if version := testSchemaVersion(t, db); version != 1 {
+				t.Fatalf("Database is at version %d after rolling back to 1", version)
+			}
+			for _, index := range lookupIndexes {
+				if db.Dialect().HasIndex(index.Table, index.Name) {
+					t.Errorf("%s was not removed", index.Name)
+				}
+			}
+			if err := migrateTo(db, migrations, 0); err == nil {
+				t.Fatal("Rolled back the creation of the tables")
+			}
+			if err := migrateDatabase(db); err != nil {
+				t.Fatal(err)
+			}
+			for _, index := range lookupIndexes {
+				if !db.Dialect().HasIndex(index.Table, index.Name) {
+					t.Errorf("%s was not created", index.Name)
+				}
+			}
+
+			//A schema from a newer binary is left alone
+			if err := db.Create(&SchemaMigration{Version: latest + 1, Name: "from the future"}).Error; err != nil {
+				t.Fatal(err)
+			}
+			if err := migrateDatabase(db); err == nil {
+				t.Fatal("Migrated a database with a newer schema")
+			}
+			if err := migrateTo(db, migrations, 1); err == nil {
+				t.Fatal("Rolled back a database with a newer schema")
+			}
+		})
+	}
+}
+
+func TestFailedMigration(t *testing.T) {
+	db, cleanup := openTestDatabase(t, databaseDriverSQLite)
+	defer cleanup()
+
+	fail := true
+	list := []migration{
+		{Version: 1, Name: "create tables", Up: createTablesV1},
+		{Version: 2, Name: "flaky", Up: func(db *gorm.DB) error {
+			if fail {
+				return errors.New("disk full")
+			}
+			return nil
+		}},
+	}
+	if err := migrateTo(db, list, 2); err == nil {
+		t.Fatal("Failed migration was not reported")
+	}
+	if version := testSchemaVersion(t, db); version != 1 {
+		t.Fatalf("Database is at version %d after migration 2 failed", version)
+	}
+	fail = false
+	if err := migrateTo(db, list, 2); err != nil {
+		t.Fatal(err)
+	}
+	if version := testSchemaVersion(t, db); version != 2 {
+		t.Fatalf("Database is at version %d after migration 2 was retried", version)
+	}
+}
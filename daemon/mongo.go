@@ -17,25 +17,65 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
 )
 
-//CreateMongoDBDockerContainer Creates a MongoDB instance in Docker
-func CreateMongoDBDockerContainer(client *docker.Client) (*docker.Container, error) {
+//How long restoring a dump waits for a MongoDB container that was just started to accept connections
+const mongoStartTimeout = time.Minute
+
+//Commands that copy every database of a MongoDB container in and out as a single gzipped archive
+var (
+	mongoDumpCommand    = []string{"mongodump", "--archive", "--gzip", "--quiet"}
+	mongoRestoreCommand = []string{"mongorestore", "--archive", "--gzip", "--drop", "--quiet"}
+)
+
+//managesMongoDB Whether the daemon runs a MongoDB container for a deployment. The spec overrides AutoManageMongoDB.
+func managesMongoDB(spec mds.DeploymentSpec) bool {
+	switch spec.MongoMode {
+	case mds.MongoModeManaged:
+		return true
+	case mds.MongoModeExternal:
+		return false
+	}
+	return viper.GetBool("AutoManageMongoDB")
+}
+
+//deploymentMongoMode Gets the MongoMode constant describing how a deployment gets its database
+func deploymentMongoMode(deployment mds.Deployment) string {
+	if deployment.MongoContainerID != "" {
+		return mds.MongoModeManaged
+	}
+	return mds.MongoModeExternal
+}
+
+//CreateMongoDBDockerContainer Creates a MongoDB instance in Docker on the network of a deployment, where the
+//application reaches it as mongo
+func CreateMongoDBDockerContainer(client *docker.Client, network string) (*docker.Container, error) {
 	//======Container Config=====
 	var containerConfig docker.Config
 	//Set the image
-	containerConfig.Image = "mongo"
+	containerConfig.Image = viper.GetString("MongoImage")
 	containerConfig.Env = []string{}
 
 	//=====Host Config======
 	//Setup Volume Bindings
 	var hostConfig docker.HostConfig
+	hostConfig.NetworkMode = network
 
 	//======Network Config=====
 	var networkConfig docker.NetworkingConfig
+	networkConfig.EndpointsConfig = map[string]*docker.EndpointConfig{network: {Aliases: []string{mongoAlias}}}
 
 	//======Container Creation=====
 	//Wrapup config
@@ -48,3 +88,54 @@ func CreateMongoDBDockerContainer(client *docker.Client) (*docker.Container, err
 	c, err := client.CreateContainer(config)
 	return c, err
 }
+
+//execInContainer Runs a command in a running container with in as its stdin, nil for none, and its stdout written
+//to out. Fails with what the command wrote to stderr if it exits with an error.
+func execInContainer(client *docker.Client, containerID string, command []string, in io.Reader, out io.Writer) error {
+	exec, err := client.CreateExec(docker.CreateExecOptions{
+		Container:    containerID,
+		Cmd:          command,
+		AttachStdin:  in != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+		Context:      context.Background(),
+	})
+	if err != nil {
+		return err
+	}
+	stderr := &limitedBuffer{buffer: &bytes.Buffer{}, limit: 4096}
+	if err := client.StartExec(exec.ID, docker.StartExecOptions{InputStream: in, OutputStream: out, ErrorStream: stderr}); err != nil {
+		return err
+	}
+	inspect, err := client.InspectExec(exec.ID)
+	if err != nil {
+		return err
+	}
+	if inspect.ExitCode != 0 {
+		return fmt.Errorf("%s exited with %d: %s", command[0], inspect.ExitCode, strings.TrimSpace(stderr.buffer.String()))
+	}
+	return nil
+}
+
+//dumpMongoDB Writes every database of a MongoDB container to out
+func dumpMongoDB(client *docker.Client, containerID string, out io.Writer) error {
+	return execInContainer(client, containerID, mongoDumpCommand, nil, out)
+}
+
+//restoreMongoDB Loads a file written by dumpMongoDB into a MongoDB container, replacing the collections it has
+func restoreMongoDB(client *docker.Client, containerID string, dumpPath string) error {
+	deadline := time.Now().Add(mongoStartTimeout)
+	for {
+		dump, err := os.Open(dumpPath)
+		if err != nil {
+			return err
+		}
+		err = execInContainer(client, containerID, mongoRestoreCommand, dump, ioutil.Discard)
+		dump.Close()
+		//Fails while MongoDB is still starting up
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
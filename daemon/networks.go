@@ -0,0 +1,174 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/jinzhu/gorm"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//Prefixes of the networks made by the daemon, so they cannot clash with networks made by hand
+const (
+	deploymentNetworkPrefix = "mds-deployment-"
+	sharedNetworkPrefix     = "mds-shared-"
+)
+
+//Label put on networks made by the daemon, holding the deployment or shared network they are for
+const networkLabel = "mds.network"
+
+//Name the application reaches its MongoDB container by on the network of its deployment
+const mongoAlias = "mongo"
+
+//Network containers are on when docker is not told otherwise
+const defaultBridgeNetwork = "bridge"
+
+//deploymentNetworkName Gets the name of the network of a deployment
+func deploymentNetworkName(deploymentID uint) string {
+	return fmt.Sprintf("%s%d", deploymentNetworkPrefix, deploymentID)
+}
+
+//sharedNetworkName Gets the docker name of the shared network a spec names
+func sharedNetworkName(name string) string {
+	return sharedNetworkPrefix + name
+}
+
+//ensureNetwork Creates a bridge network unless it exists. Returns whether it was created.
+func ensureNetwork(client *docker.Client, name string) (bool, error) {
+	_, err := client.NetworkInfo(name)
+	if err == nil {
+		return false, nil
+	}
+	if _, missing := err.(*docker.NoSuchNetwork); !missing {
+		return false, err
+	}
+	options := docker.CreateNetworkOptions{
+		Name:           name,
+		Driver:         "bridge",
+		CheckDuplicate: true,
+		Labels:         map[string]string{networkLabel: name},
+		Context:        context.Background(),
+	}
+	_, err = client.CreateNetwork(options)
+	if err == docker.ErrNetworkAlreadyExists {
+		//Created by a job running at the same time
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//removeNetwork Removes a network, doing nothing if it is already gone
+func removeNetwork(client *docker.Client, name string) error {
+	err := client.RemoveNetwork(name)
+	if _, missing := err.(*docker.NoSuchNetwork); missing {
+		return nil
+	}
+	return err
+}
+
+//connectNetwork Joins a container to a network, where other containers can reach it by its aliases
+func connectNetwork(client *docker.Client, network string, containerID string, aliases ...string) error {
+	return client.ConnectNetwork(network, docker.NetworkConnectionOptions{
+		Container:      containerID,
+		EndpointConfig: &docker.EndpointConfig{Aliases: aliases},
+		Context:        context.Background(),
+	})
+}
+
+//disconnectNetwork Takes a container off a network, doing nothing if either is already gone
+func disconnectNetwork(client *docker.Client, network string, containerID string) error {
+	err := client.DisconnectNetwork(network, docker.NetworkConnectionOptions{Container: containerID, Force: true})
+	if _, missing := err.(*docker.NoSuchNetworkOrContainer); missing {
+		return nil
+	}
+	return err
+}
+
+//joinSharedNetwork Joins the application container of a deployment to the shared network its spec names, creating
+//the network if it is the first deployment to use it. The other deployments reach it by its project name.
+func joinSharedNetwork(client *docker.Client, spec mds.DeploymentSpec, projectName string, containerID string) error {
+	if spec.Network == "" {
+		return nil
+	}
+	network := sharedNetworkName(spec.Network)
+	if _, err := ensureNetwork(client, network); err != nil {
+		return err
+	}
+	return connectNetwork(client, network, containerID, projectName)
+}
+
+//releaseSharedNetwork Removes a shared network once no deployment but deploymentID names it in its spec
+func releaseSharedNetwork(client *docker.Client, db *gorm.DB, name string, deploymentID uint) error {
+	if name == "" {
+		return nil
+	}
+	var deployments []mds.Deployment
+	db.Where("id <> ?", deploymentID).Find(&deployments)
+	for _, deployment := range deployments {
+		if deployment.Spec.Network == name {
+			return nil
+		}
+	}
+	return removeNetwork(client, sharedNetworkName(name))
+}
+
+//migrateToNetwork Gives a deployment made before networks one of its own. Its MongoDB container joins the network
+//under the alias the application expects and stays on the default bridge until the old application container,
+//which reaches it through a link, is gone. Undo actions are registered with tx.
+func migrateToNetwork(client *docker.Client, tx *deploymentTransaction, deployment *mds.Deployment) (string, error) {
+	network := deploymentNetworkName(deployment.ID)
+	created, err := ensureNetwork(client, network)
+	if err != nil {
+		return "", err
+	}
+	if created {
+		tx.OnRollback("remove network "+network, func() error {
+			return removeNetwork(client, network)
+		})
+	}
+	mongoContainerID := deployment.MongoContainerID
+	if mongoContainerID != "" {
+		if err := connectNetwork(client, network, mongoContainerID, mongoAlias); err != nil {
+			return "", err
+		}
+		tx.OnRollback("take MongoDB container "+mongoContainerID+" off "+network, func() error {
+			return disconnectNetwork(client, network, mongoContainerID)
+		})
+	}
+	return network, nil
+}
+
+//removeDeploymentNetworks Takes the MongoDB container of a deleted deployment off its network, then removes that
+//network and the shared network if no other deployment uses it. The application container has to be removed first.
+func removeDeploymentNetworks(client *docker.Client, db *gorm.DB, deployment mds.Deployment) {
+	if deployment.Network != "" {
+		if deployment.MongoContainerID != "" {
+			if err := disconnectNetwork(client, deployment.Network, deployment.MongoContainerID); err != nil {
+				log.Warningf("Failed to take MongoDB container off %s: %s", deployment.Network, err.Error())
+			}
+		}
+		if err := removeNetwork(client, deployment.Network); err != nil {
+			log.Warningf("Failed to remove network %s: %s", deployment.Network, err.Error())
+		}
+	}
+	if err := releaseSharedNetwork(client, db, deployment.Spec.Network, deployment.ID); err != nil {
+		log.Warningf("Failed to remove shared network %s: %s", sharedNetworkName(deployment.Spec.Network), err.Error())
+	}
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//fakeNetworkEngine Stands in for the network API of a docker engine. Networks are kept by name with the aliases
+//each container joined them with.
+type fakeNetworkEngine struct {
+	sync.Mutex
+	networks map[string]docker.Network
+	created  int
+}
+
+func (e *fakeNetworkEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.Lock()
+	defer e.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/networks/"), "/")
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/networks/create":
+		var options docker.CreateNetworkOptions
+		json.NewDecoder(r.Body).Decode(&options)
+		if _, exists := e.networks[options.Name]; exists {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		e.created++
+		e.networks[options.Name] = docker.Network{Name: options.Name, ID: options.Name, Driver: options.Driver, Labels: options.Labels, Containers: map[string]docker.Endpoint{}}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"Id": options.Name})
+	case len(parts) == 1 && r.Method == "GET":
+		network, exists := e.networks[parts[0]]
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(network)
+	case len(parts) == 1 && r.Method == "DELETE":
+		network, exists := e.networks[parts[0]]
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		if len(network.Containers) > 0 {
+			http.Error(w, `{"message":"network has active endpoints"}`, http.StatusForbidden)
+			return
+		}
+		delete(e.networks, parts[0])
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && r.Method == "POST":
+		network, exists := e.networks[parts[0]]
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		var options docker.NetworkConnectionOptions
+		json.NewDecoder(r.Body).Decode(&options)
+		if parts[1] == "connect" {
+			endpoint := docker.Endpoint{Name: strings.Join(options.EndpointConfig.Aliases, ",")}
+			network.Containers[options.Container] = endpoint
+		} else if _, joined := network.Containers[options.Container]; joined {
+			delete(network.Containers, options.Container)
+		} else {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestDeploymentNetworks(t *testing.T) {
+	_, cleanup := newTestAPI(t)
+	defer cleanup()
+	fake := &fakeNetworkEngine{networks: map[string]docker.Network{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	engine, _ := docker.NewClient(server.URL)
+
+	//Networks are made once and labeled
+	for i := 0; i < 2; i++ {
+		created, err := ensureNetwork(engine, deploymentNetworkName(7))
+		if err != nil || created != (i == 0) {
+			t.Fatalf("Unexpected result of ensureNetwork: %v %v", created, err)
+		}
+	}
+	if network := fake.networks["mds-deployment-7"]; fake.created != 1 || network.Driver != "bridge" || network.Labels[networkLabel] != "mds-deployment-7" {
+		t.Fatalf("Unexpected network: %+v", network)
+	}
+
+	//Deployments made before networks move their MongoDB onto one, which is undone if the update fails
+	legacy := mds.Deployment{ProjectName: "legacy", MongoContainerID: "mongo1"}
+	database.Create(&legacy)
+	tx := &deploymentTransaction{}
+	tx.Begin("network")
+	network, err := migrateToNetwork(engine, tx, &legacy)
+	if err != nil || network != deploymentNetworkName(legacy.ID) {
+		t.Fatalf("Migration failed: %s %v", network, err)
+	}
+	if endpoint := fake.networks[network].Containers["mongo1"]; endpoint.Name != mongoAlias {
+		t.Fatalf("MongoDB did not join with its alias: %+v", fake.networks[network])
+	}
+	tx.Rollback(errors.New("update failed"))
+	if _, exists := fake.networks[network]; exists {
+		t.Fatal("Network of the failed migration was not removed")
+	}
+
+	//A shared network is removed with the last deployment naming it
+	first := mds.Deployment{ProjectName: "first", Spec: mds.DeploymentSpec{Network: "team"}}
+	second := mds.Deployment{ProjectName: "second", Spec: mds.DeploymentSpec{Network: "team"}}
+	database.Create(&first)
+	database.Create(&second)
+	for _, deployment := range []mds.Deployment{first, second} {
+		if err := joinSharedNetwork(engine, deployment.Spec, deployment.ProjectName, deployment.ProjectName+"-container"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if endpoint := fake.networks["mds-shared-team"].Containers["second-container"]; fake.created != 3 || endpoint.Name != "second" {
+		t.Fatalf("Unexpected shared network: %+v", fake.networks["mds-shared-team"])
+	}
+	disconnectNetwork(engine, "mds-shared-team", "first-container")
+	if err := releaseSharedNetwork(engine, database, "team", first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := fake.networks["mds-shared-team"]; !exists {
+		t.Fatal("Shared network was removed while still in use")
+	}
+	database.Delete(&first)
+
+	//Deleting the last one takes its MongoDB off its network and removes both networks
+	second.Network = deploymentNetworkName(second.ID)
+	second.MongoContainerID = "mongo2"
+	ensureNetwork(engine, second.Network)
+	connectNetwork(engine, second.Network, "mongo2", mongoAlias)
+	disconnectNetwork(engine, "mds-shared-team", "second-container")
+	removeDeploymentNetworks(engine, database, second)
+	if len(fake.networks) != 1 {
+		t.Fatalf("Networks were left behind: %+v", fake.networks)
+	}
+	if err := removeNetwork(engine, "mds-shared-team"); err != nil {
+		t.Fatalf("Removing a missing network failed: %v", err)
+	}
+}
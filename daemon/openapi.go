@@ -0,0 +1,825 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+)
+
+//Called when GET /openapi.json is called. Returns the OpenAPI document that describes the API.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(openAPISpec))
+}
+
+//openAPISpec OpenAPI 3 description of version 1 of the API. Keep it in step with registerV1Routes and the client package.
+const openAPISpec = `{
+  "openapi": "3.0.0",
+  "info": {
+    "title": "Meteor Deploy System",
+    "description": "API of the MDS daemon, which deploys meteor applications as docker containers behind nginx.",
+    "version": "1"
+  },
+  "servers": [
+    {"url": "/api/v1"}
+  ],
+  "security": [
+    {"token": []}
+  ],
+  "paths": {
+    "/ping": {
+      "get": {
+        "operationId": "ping",
+        "summary": "Check that the daemon is reachable",
+        "security": [],
+        "responses": {
+          "200": {"description": "The daemon is up", "content": {"application/json": {"schema": {"type": "object", "properties": {"Message": {"type": "string"}}}}}}
+        }
+      }
+    },
+    "/login": {
+      "post": {
+        "operationId": "login",
+        "summary": "Exchange a username and password for an authentication token",
+        "security": [],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {"schema": {"$ref": "#/components/schemas/LoginRequest"}},
+            "application/x-www-form-urlencoded": {"schema": {"type": "object", "properties": {"username": {"type": "string"}, "password": {"type": "string"}, "persistent": {"type": "string", "enum": ["true", "false"]}}}}
+          }
+        },
+        "responses": {
+          "200": {"description": "Logged in", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/AuthenticationToken"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"}
+        }
+      }
+    },
+    "/deployments": {
+      "get": {
+        "operationId": "listDeployments",
+        "summary": "List every deployment",
+        "description": "Needs the deployment.list permission.",
+        "responses": {
+          "200": {"description": "The deployments", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Deployment"}}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      }
+    },
+    "/deployment": {
+      "post": {
+        "operationId": "createDeployment",
+        "summary": "Upload an application and create a deployment for it",
+        "description": "Needs the deployment.create permission. The bundle is checked before anything is deployed and rejected with invalid_bundle if it is damaged, is not built by meteor build or could unpack outside of its directory. Deployments of type image run the Image of the spec, or the image in a tarball written by docker save sent like a bundle and rejected with invalid_image if it does not hold exactly one image. The deployment is created by a background job.",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "multipart/form-data": {
+              "schema": {
+                "type": "object",
+                "required": ["projectname"],
+                "properties": {
+                  "projectname": {"type": "string"},
+                  "type": {"type": "string", "enum": ["bundle", "image"], "description": "What the deployment runs, bundle if not sent"},
+                  "uploadfile": {"type": "string", "format": "binary", "description": "Tarball of the application built with meteor build, or of the image for deployments of type image. Required unless upload is sent or the spec has an Image."},
+                  "sha256": {"type": "string", "description": "Hex SHA-256 of uploadfile, the bundle is rejected if it does not match"},
+                  "upload": {"type": "string", "description": "ID of a complete upload to use instead of uploadfile"},
+                  "settings": {"type": "string", "description": "Contents of settings.json"},
+                  "Env-Var": {"type": "array", "items": {"type": "string"}, "description": "Custom environment variables as KEY=VALUE"},
+                  "Secret-Env-Var": {"type": "array", "items": {"type": "string"}, "description": "Custom environment variables as KEY=VALUE whose values are never returned"},
+                  "spec": {"type": "string", "description": "DeploymentSpec as JSON"}
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "202": {"description": "The job creating the deployment", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "409": {"$ref": "#/components/responses/Conflict"}
+        }
+      }
+    },
+    "/deployment/{id}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/ID"}
+      ],
+      "get": {
+        "operationId": "getDeployment",
+        "summary": "Get a deployment with its proxy, MongoDB and container configuration",
+        "description": "Needs the deployment.list permission. Only the names of environment variables are returned.",
+        "responses": {
+          "200": {"description": "The deployment", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DeploymentDetail"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      },
+      "put": {
+        "operationId": "updateDeployment",
+        "summary": "Replace the containers of a deployment with a new bundle, settings or environment variables",
+        "description": "Needs the deployment.update permission. At least one field has to be sent, anything not sent is kept. Environment variables are merged by name with the current ones. A spec replaces the aliases, resource limits and health check but cannot change the primary domain or the MongoDB mode. The deployment is updated by a background job that puts the previous container back if a step fails.",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "multipart/form-data": {
+              "schema": {
+                "type": "object",
+                "properties": {
+                  "uploadfile": {"type": "string", "format": "binary", "description": "Tarball of the new version, or of the new image for deployments of type image"},
+                  "sha256": {"type": "string", "description": "Hex SHA-256 of uploadfile, the bundle is rejected if it does not match"},
+                  "upload": {"type": "string", "description": "ID of a complete upload to use instead of uploadfile"},
+                  "settings": {"type": "string", "description": "Contents of settings.json, an empty value clears the settings"},
+                  "Env-Var": {"type": "array", "items": {"type": "string"}, "description": "Custom environment variables to add or replace as KEY=VALUE"},
+                  "Secret-Env-Var": {"type": "array", "items": {"type": "string"}, "description": "Custom environment variables to add or replace whose values are never returned"},
+                  "Unset-Env-Var": {"type": "array", "items": {"type": "string"}, "description": "Names of custom environment variables to remove"},
+                  "spec": {"type": "string", "description": "DeploymentSpec as JSON"}
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "202": {"description": "The job updating the deployment", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Conflict"}
+        }
+      },
+      "delete": {
+        "operationId": "deleteDeployment",
+        "summary": "Delete a deployment with its containers and proxy configuration",
+        "description": "Needs the deployment.delete permission. Refused while a job is changing the deployment.",
+        "responses": {
+          "204": {"description": "Deleted"},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Conflict"}
+        }
+      }
+    },
+    "/deployment/{id}/start": {
+      "parameters": [
+        {"$ref": "#/components/parameters/ID"}
+      ],
+      "post": {
+        "operationId": "startDeployment",
+        "summary": "Start the MongoDB and application containers of a deployment",
+        "description": "Needs the deployment.control permission. Responds once the containers have changed state.",
+        "responses": {
+          "200": {"description": "The deployment after the action", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DeploymentDetail"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Conflict"}
+        }
+      }
+    },
+    "/deployment/{id}/stop": {
+      "parameters": [
+        {"$ref": "#/components/parameters/ID"}
+      ],
+      "post": {
+        "operationId": "stopDeployment",
+        "summary": "Stop the application and MongoDB containers of a deployment without removing anything",
+        "description": "Needs the deployment.control permission. Responds once the containers have changed state.",
+        "responses": {
+          "200": {"description": "The deployment after the action", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DeploymentDetail"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Conflict"}
+        }
+      }
+    },
+    "/deployment/{id}/restart": {
+      "parameters": [
+        {"$ref": "#/components/parameters/ID"}
+      ],
+      "post": {
+        "operationId": "restartDeployment",
+        "summary": "Stop and then start the containers of a deployment",
+        "description": "Needs the deployment.control permission. Responds once the containers have changed state.",
+        "responses": {
+          "200": {"description": "The deployment after the action", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DeploymentDetail"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Conflict"}
+        }
+      }
+    },
+    "/deployment/{id}/env": {
+      "parameters": [
+        {"$ref": "#/components/parameters/ID"}
+      ],
+      "get": {
+        "operationId": "listEnvironment",
+        "summary": "List the custom environment variables of a deployment with their values",
+        "description": "Needs the deployment.update permission because values are returned. The values of secrets are replaced by ********.",
+        "responses": {
+          "200": {"description": "The variables", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/EnvironmentVariable"}}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      },
+      "patch": {
+        "operationId": "changeEnvironment",
+        "summary": "Set and remove custom environment variables",
+        "description": "Needs the deployment.update permission. The container is recreated from the bundle already on the server by a background job. Variables that are not named are kept.",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/EnvironmentChange"}}}
+        },
+        "responses": {
+          "202": {"description": "The job recreating the container", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Conflict"}
+        }
+      }
+    },
+    "/deployment/{id}/settings": {
+      "parameters": [
+        {"$ref": "#/components/parameters/ID"}
+      ],
+      "put": {
+        "operationId": "pushSettings",
+        "summary": "Replace the settings of a deployment",
+        "description": "Needs the deployment.update permission. Settings must be valid JSON or empty. The container is recreated from the bundle already on the server by a background job.",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/SettingsChange"}}}
+        },
+        "responses": {
+          "202": {"description": "The job recreating the container", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Conflict"}
+        }
+      }
+    },
+    "/deployment/{id}/export": {
+      "parameters": [
+        {"$ref": "#/components/parameters/ID"}
+      ],
+      "get": {
+        "operationId": "exportDeployment",
+        "summary": "Download everything needed to recreate a deployment on another daemon",
+        "description": "Needs the deployment.export permission. The archive holds the bundle or image tarball, the settings and environment variables with the values of secrets in the clear, the certificate and private key of the proxy and a dump of the MongoDB managed for the deployment. It can only be imported by POST /deployment/import. The deployment is left running, use POST to stop it first.",
+        "responses": {
+          "200": {"description": "The export archive, a gzipped tarball", "content": {"application/gzip": {"schema": {"type": "string", "format": "binary"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Conflict"}
+        }
+      },
+      "post": {
+        "operationId": "stopAndExportDeployment",
+        "summary": "Stop a deployment and download everything needed to recreate it on another daemon",
+        "description": "Needs the deployment.export and deployment.control permissions. The application is stopped before MongoDB is dumped so nothing written afterwards is lost, and the deployment is left stopped. The archive is the same as the one of GET.",
+        "responses": {
+          "200": {"description": "The export archive, a gzipped tarball", "content": {"application/gzip": {"schema": {"type": "string", "format": "binary"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Conflict"}
+        }
+      }
+    },
+    "/deployment/import": {
+      "post": {
+        "operationId": "importDeployment",
+        "summary": "Recreate a deployment from an export archive of another daemon",
+        "description": "Needs the deployment.create permission. The archive is rejected with invalid_export if it is damaged or was written by an incompatible daemon. The deployment keeps its project name and domain names and is created by a background job that loads the MongoDB dump before the application starts. A certificate in the archive is installed unless the daemon uses the selfsigned provider. A deployment that was stopped when it was exported is stopped again.",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "multipart/form-data": {
+              "schema": {
+                "type": "object",
+                "properties": {
+                  "uploadfile": {"type": "string", "format": "binary", "description": "Export archive written by GET /deployment/{id}/export. Required unless upload is sent."},
+                  "sha256": {"type": "string", "description": "Hex SHA-256 of uploadfile, the archive is rejected if it does not match"},
+                  "upload": {"type": "string", "description": "ID of a complete upload to use instead of uploadfile"}
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "202": {"description": "The job creating the deployment", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "409": {"$ref": "#/components/responses/Conflict"}
+        }
+      }
+    },
+    "/jobs": {
+      "get": {
+        "operationId": "listJobs",
+        "summary": "List the 50 most recent jobs without their steps",
+        "description": "Needs the deployment.list permission.",
+        "responses": {
+          "200": {"description": "The jobs", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Job"}}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      }
+    },
+    "/jobs/{id}": {
+      "parameters": [
+        {"$ref": "#/components/parameters/ID"}
+      ],
+      "get": {
+        "operationId": "getJob",
+        "summary": "Get a job and the steps it has completed",
+        "description": "Needs the deployment.list permission.",
+        "responses": {
+          "200": {"description": "The job", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      },
+      "delete": {
+        "operationId": "cancelJob",
+        "summary": "Cancel a running job",
+        "description": "Needs the permission that was needed to submit the job. The job stops after its current step.",
+        "responses": {
+          "202": {"description": "The job is being cancelled", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Conflict"}
+        }
+      }
+    },
+    "/uploads": {
+      "post": {
+        "operationId": "createUpload",
+        "summary": "Start a resumable upload of a bundle",
+        "description": "Needs the deployment.create or deployment.update permission. The bundle is then sent in chunks with PATCH. Uploads are removed after UploadExpiryHours without a chunk or once used.",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {"schema": {"$ref": "#/components/schemas/UploadRequest"}}
+          }
+        },
+        "responses": {
+          "201": {"description": "The upload", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Upload"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      }
+    },
+    "/uploads/{id}": {
+      "parameters": [
+        {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}
+      ],
+      "get": {
+        "operationId": "getUpload",
+        "summary": "Get an upload, its Offset is where an interrupted upload resumes",
+        "description": "Needs the deployment.create or deployment.update permission. Only the user that started the upload can see it.",
+        "responses": {
+          "200": {"description": "The upload", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Upload"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      },
+      "patch": {
+        "operationId": "uploadChunk",
+        "summary": "Append a chunk to an upload",
+        "description": "Needs the deployment.create or deployment.update permission. The chunk has to start at the Offset of the upload. If the connection drops what arrived is kept. When the last byte arrives the SHA-256 is checked and an upload that does not match is removed.",
+        "parameters": [
+          {"name": "Upload-Offset", "in": "header", "required": true, "description": "Where in the bundle the chunk starts", "schema": {"type": "integer", "minimum": 0}}
+        ],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/octet-stream": {"schema": {"type": "string", "format": "binary"}}
+          }
+        },
+        "responses": {
+          "200": {"description": "The upload with its new offset", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Upload"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Conflict"}
+        }
+      },
+      "delete": {
+        "operationId": "cancelUpload",
+        "summary": "Remove an upload and everything sent for it",
+        "description": "Needs the deployment.create or deployment.update permission.",
+        "responses": {
+          "204": {"description": "Removed"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Conflict"}
+        }
+      }
+    },
+    "/registries": {
+      "get": {
+        "operationId": "listRegistries",
+        "summary": "List the registries images are pulled from with stored credentials",
+        "description": "Needs the registry.manage permission. Passwords are never returned. Registries in the Registries list of the configuration are not included.",
+        "responses": {
+          "200": {"description": "The registries", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/RegistryCredential"}}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      }
+    },
+    "/registries/{registry}": {
+      "parameters": [
+        {"name": "registry", "in": "path", "required": true, "description": "Host of the registry with its port if it has one, docker.io for Docker Hub", "schema": {"type": "string"}}
+      ],
+      "put": {
+        "operationId": "putRegistryCredential",
+        "summary": "Store the credentials images from a registry are pulled with",
+        "description": "Needs the registry.manage permission. The password is encrypted with the master key. Replaces the credentials the registry had and takes precedence over the Registries list of the configuration.",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {"schema": {"$ref": "#/components/schemas/RegistryCredentialRequest"}}
+          }
+        },
+        "responses": {
+          "200": {"description": "The stored credentials without the password", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/RegistryCredential"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      },
+      "delete": {
+        "operationId": "deleteRegistryCredential",
+        "summary": "Remove the credentials of a registry",
+        "description": "Needs the registry.manage permission.",
+        "responses": {
+          "204": {"description": "Removed"},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"}
+        }
+      }
+    },
+    "/images": {
+      "get": {
+        "operationId": "listImages",
+        "summary": "List the images the daemon keeps pulled",
+        "description": "Needs the deployment.list permission. DefaultBaseImage, MongoImage and the images deployments run are pulled in the background. Failed pulls are retried with a growing delay and images with a tag are pulled again every ImageCheckIntervalHours, which flags deployments running an older digest with ImageOutdated.",
+        "responses": {
+          "200": {"description": "The images", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ImageStatus"}}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      }
+    },
+    "/images/refresh": {
+      "post": {
+        "operationId": "refreshImages",
+        "summary": "Recreate deployments with the newest version of their image, one at a time",
+        "description": "Needs the deployment.update permission. The images are pulled first. Without Deployments every deployment that then runs an outdated image is recreated. The next deployment is only recreated once the previous one is running, and healthy if it has a health check. The first failure stops the refresh. Images loaded from a tarball cannot be refreshed. The refresh is done by a background job.",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {"schema": {"$ref": "#/components/schemas/ImageRefreshRequest"}}
+          }
+        },
+        "responses": {
+          "202": {"description": "The refresh job was started", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"},
+          "404": {"$ref": "#/components/responses/NotFound"},
+          "409": {"$ref": "#/components/responses/Conflict"}
+        }
+      }
+    },
+    "/events": {
+      "get": {
+        "operationId": "watchEvents",
+        "summary": "Stream deployment events as server-sent events",
+        "description": "Needs the deployment.list permission. Each event has its type as the event field and a DeploymentEvent as JSON in the data field.",
+        "parameters": [
+          {"name": "deployment", "in": "query", "required": false, "description": "Only send events about this deployment", "schema": {"type": "integer"}}
+        ],
+        "responses": {
+          "200": {"description": "The event stream", "content": {"text/event-stream": {"schema": {"$ref": "#/components/schemas/DeploymentEvent"}}}},
+          "400": {"$ref": "#/components/responses/BadRequest"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "403": {"$ref": "#/components/responses/Forbidden"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "token": {"type": "apiKey", "in": "header", "name": "X-Auth-Token"}
+    },
+    "parameters": {
+      "ID": {"name": "id", "in": "path", "required": true, "schema": {"type": "integer", "minimum": 1}}
+    },
+    "responses": {
+      "BadRequest": {"description": "The request was missing something or was malformed", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorResponse"}}}},
+      "Unauthorized": {"description": "No valid token was sent, the token expired or the credentials were wrong", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorResponse"}}}},
+      "Forbidden": {"description": "The user does not have the permission needed", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorResponse"}}}},
+      "NotFound": {"description": "The object does not exist", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorResponse"}}}},
+      "Conflict": {"description": "The object is not in a state that allows the request", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ErrorResponse"}}}}
+    },
+    "schemas": {
+      "ErrorResponse": {
+        "type": "object",
+        "required": ["error"],
+        "properties": {
+          "error": {
+            "type": "object",
+            "required": ["code", "message"],
+            "properties": {
+              "code": {"type": "string", "enum": ["bad_request", "invalid_credentials", "unauthorized", "token_expired", "forbidden", "not_found", "conflict", "invalid_bundle", "invalid_image", "invalid_export", "internal_error"]},
+              "message": {"type": "string"},
+              "details": {"description": "Extra information that depends on the code"}
+            }
+          }
+        }
+      },
+      "LoginRequest": {
+        "type": "object",
+        "required": ["Username", "Password"],
+        "properties": {
+          "Username": {"type": "string"},
+          "Password": {"type": "string", "format": "password"},
+          "Persistent": {"type": "boolean", "description": "If true the token never expires"}
+        }
+      },
+      "AuthenticationToken": {
+        "type": "object",
+        "properties": {
+          "ID": {"type": "integer"},
+          "CreatedAt": {"type": "string", "format": "date-time"},
+          "UpdatedAt": {"type": "string", "format": "date-time"},
+          "DeletedAt": {"type": "string", "format": "date-time", "nullable": true},
+          "AuthenticationToken": {"type": "string", "description": "Send as the X-Auth-Token header"},
+          "UserID": {"type": "integer"},
+          "LastSeen": {"type": "integer", "description": "Unix time of the last request made with the token"},
+          "Persistent": {"type": "boolean"}
+        }
+      },
+      "Deployment": {
+        "type": "object",
+        "properties": {
+          "ID": {"type": "integer"},
+          "CreatedAt": {"type": "string", "format": "date-time"},
+          "UpdatedAt": {"type": "string", "format": "date-time"},
+          "DeletedAt": {"type": "string", "format": "date-time", "nullable": true},
+          "ProjectName": {"type": "string"},
+          "Type": {"type": "string", "enum": ["bundle", "image"], "description": "Empty for deployments created before images could be deployed, which run bundles"},
+          "VolumePath": {"type": "string"},
+          "AutoStart": {"type": "boolean"},
+          "ContainerID": {"type": "string"},
+          "Port": {"type": "string"},
+          "Status": {"type": "string"},
+          "URL": {"type": "string"},
+          "MongoContainerID": {"type": "string"},
+          "Network": {"type": "string", "description": "Docker network of the deployment, where its MongoDB is reachable as mongo. Empty for deployments created before networks, which move to one on their next update."},
+          "Health": {"type": "string", "description": "Set by the health check of the spec if it has one, otherwise by the image"},
+          "Spec": {"$ref": "#/components/schemas/DeploymentSpec"},
+          "BundleChecksum": {"type": "string", "description": "Hex SHA-256 of the bundle the container runs"},
+          "MeteorRelease": {"type": "string", "description": "Release the bundle was built with, read from its star.json"},
+          "NodeVersion": {"type": "string", "description": "Version of Node the bundle needs, empty if the bundle does not say"},
+          "BaseImage": {"type": "string", "description": "Image the application container runs"},
+          "ImageDigest": {"type": "string", "description": "Digest of the image when the container was created, its ID if it has none"},
+          "ImageOutdated": {"type": "boolean", "description": "Whether a newer version of BaseImage was pulled since the container was created"},
+          "SettingsChecksum": {"type": "string", "description": "Hex SHA-256 of the settings, empty if there are none"}
+        }
+      },
+      "DeploymentSpec": {
+        "type": "object",
+        "properties": {
+          "Domains": {"type": "array", "items": {"type": "string"}, "description": "The first is the primary domain, the rest are aliases. One is generated if empty."},
+          "MongoMode": {"type": "string", "enum": ["managed", "external"], "description": "The daemon configuration decides if empty"},
+          "Resources": {
+            "type": "object",
+            "properties": {
+              "MemoryMB": {"type": "integer", "description": "Memory limit in megabytes, at least 6"},
+              "CPUShares": {"type": "integer", "description": "Relative CPU weight"}
+            }
+          },
+          "HealthCheck": {"$ref": "#/components/schemas/HealthCheck"},
+          "BaseImage": {"type": "string", "description": "Image to run the bundle in. Picked from the NodeImages table of the daemon by the Node version of the bundle if empty."},
+          "Image": {"type": "string", "description": "Image run by a deployment of type image, pulled with the credentials stored for its registry if docker does not have it. Empty if its tarball was uploaded."},
+          "ContainerPort": {"type": "integer", "description": "Port the application listens on inside its container, 80 if not set"},
+          "Network": {"type": "string", "description": "Shared network to join besides the network of the deployment, mds-shared- followed by this name in docker. Lowercase letters, digits, - and _."}
+        }
+      },
+      "HealthCheck": {
+        "type": "object",
+        "description": "HTTP request made by the daemon. A 2xx or 3xx response passes.",
+        "properties": {
+          "Path": {"type": "string", "default": "/"},
+          "Interval": {"type": "integer", "default": 30, "description": "Seconds between checks"},
+          "Timeout": {"type": "integer", "default": 5, "description": "Seconds to wait for a response"},
+          "Retries": {"type": "integer", "default": 3, "description": "Failed checks in a row before the deployment is unhealthy"}
+        }
+      },
+      "DeploymentDetail": {
+        "allOf": [
+          {"$ref": "#/components/schemas/Deployment"},
+          {
+            "type": "object",
+            "properties": {
+              "MongoMode": {"type": "string", "enum": ["managed", "external"]},
+              "MongoStatus": {"type": "string", "description": "Status of the MongoDB container, empty unless MongoMode is managed"},
+              "EnvironmentVariables": {"type": "array", "items": {"type": "string"}, "nullable": true, "description": "Names of the variables set in the application container"},
+              "Proxy": {"allOf": [{"$ref": "#/components/schemas/ProxyDetail"}], "nullable": true}
+            }
+          }
+        ]
+      },
+      "ProxyDetail": {
+        "type": "object",
+        "properties": {
+          "DomainName": {"type": "string"},
+          "IsHTTPS": {"type": "boolean"},
+          "Destination": {"type": "string"},
+          "CertificatePath": {"type": "string"},
+          "CertificateSubject": {"type": "string"},
+          "CertificateIssuer": {"type": "string"},
+          "CertificateExpires": {"type": "string", "format": "date-time", "nullable": true}
+        }
+      },
+      "EnvironmentVariable": {
+        "type": "object",
+        "properties": {
+          "Name": {"type": "string"},
+          "Value": {"type": "string", "description": "******** for secrets"},
+          "Secret": {"type": "boolean"}
+        }
+      },
+      "EnvironmentChange": {
+        "type": "object",
+        "properties": {
+          "Set": {"type": "array", "items": {"type": "string"}, "nullable": true, "description": "Variables to add or replace as KEY=VALUE"},
+          "SetSecret": {"type": "array", "items": {"type": "string"}, "nullable": true, "description": "Variables to add or replace as KEY=VALUE whose values are never returned"},
+          "Unset": {"type": "array", "items": {"type": "string"}, "nullable": true, "description": "Names of variables to remove"}
+        }
+      },
+      "SettingsChange": {
+        "type": "object",
+        "properties": {
+          "Settings": {"type": "string", "description": "Contents of settings.json, empty to remove the settings"}
+        }
+      },
+      "UploadRequest": {
+        "type": "object",
+        "required": ["Size", "SHA256"],
+        "properties": {
+          "Size": {"type": "integer", "minimum": 1, "description": "Size of the whole bundle in bytes"},
+          "SHA256": {"type": "string", "description": "Hex SHA-256 of the whole bundle"}
+        }
+      },
+      "Upload": {
+        "type": "object",
+        "properties": {
+          "ID": {"type": "string", "description": "Sent as the upload field of a deployment form once complete"},
+          "CreatedAt": {"type": "string", "format": "date-time"},
+          "UpdatedAt": {"type": "string", "format": "date-time"},
+          "Size": {"type": "integer"},
+          "Offset": {"type": "integer", "description": "Bytes received so far, the next chunk has to start here"},
+          "SHA256": {"type": "string"},
+          "Complete": {"type": "boolean", "description": "True once every byte arrived and the checksum matched"},
+          "ExpiresAt": {"type": "string", "format": "date-time"}
+        }
+      },
+      "RegistryCredentialRequest": {
+        "type": "object",
+        "required": ["Username", "Password"],
+        "properties": {
+          "Username": {"type": "string"},
+          "Password": {"type": "string", "format": "password"}
+        }
+      },
+      "RegistryCredential": {
+        "type": "object",
+        "properties": {
+          "ID": {"type": "integer"},
+          "CreatedAt": {"type": "string", "format": "date-time"},
+          "UpdatedAt": {"type": "string", "format": "date-time"},
+          "Registry": {"type": "string"},
+          "Username": {"type": "string"}
+        }
+      },
+      "ImageStatus": {
+        "type": "object",
+        "properties": {
+          "Reference": {"type": "string"},
+          "State": {"type": "string", "enum": ["queued", "pulling", "ready", "failed"]},
+          "Progress": {"type": "string", "description": "What the running pull has downloaded so far"},
+          "Digest": {"type": "string"},
+          "Attempts": {"type": "integer", "description": "Pulls that failed in a row"},
+          "Error": {"type": "string", "description": "Why the last pull failed"},
+          "CheckedAt": {"type": "string", "format": "date-time", "nullable": true},
+          "NextCheckAt": {"type": "string", "format": "date-time", "nullable": true, "description": "Null for images pinned to a digest once they are pulled"},
+          "Deployments": {"type": "array", "items": {"type": "integer"}, "nullable": true}
+        }
+      },
+      "ImageRefreshRequest": {
+        "type": "object",
+        "properties": {
+          "Deployments": {"type": "array", "items": {"type": "integer"}, "nullable": true, "description": "Deployments to recreate whether or not they are outdated"}
+        }
+      },
+      "Job": {
+        "type": "object",
+        "properties": {
+          "ID": {"type": "integer"},
+          "CreatedAt": {"type": "string", "format": "date-time"},
+          "UpdatedAt": {"type": "string", "format": "date-time"},
+          "DeletedAt": {"type": "string", "format": "date-time", "nullable": true},
+          "Type": {"type": "string", "enum": ["deployment.create", "deployment.update", "deployment.import", "image.refresh"]},
+          "Status": {"type": "string", "enum": ["queued", "running", "succeeded", "failed", "cancelled"]},
+          "UserID": {"type": "integer"},
+          "DeploymentID": {"type": "integer"},
+          "Error": {"type": "string"},
+          "FailedStep": {"type": "string"},
+          "FinishedAt": {"type": "string", "format": "date-time", "nullable": true},
+          "Steps": {"type": "array", "items": {"$ref": "#/components/schemas/JobStep"}, "nullable": true}
+        }
+      },
+      "JobStep": {
+        "type": "object",
+        "properties": {
+          "ID": {"type": "integer"},
+          "CreatedAt": {"type": "string", "format": "date-time"},
+          "UpdatedAt": {"type": "string", "format": "date-time"},
+          "DeletedAt": {"type": "string", "format": "date-time", "nullable": true},
+          "JobID": {"type": "integer"},
+          "Name": {"type": "string"},
+          "Message": {"type": "string"}
+        }
+      },
+      "DeploymentEvent": {
+        "type": "object",
+        "properties": {
+          "Type": {"type": "string", "enum": ["status", "progress", "health", "image"], "description": "Image events about a pull have no DeploymentID"},
+          "DeploymentID": {"type": "integer"},
+          "ProjectName": {"type": "string"},
+          "Status": {"type": "string"},
+          "PreviousStatus": {"type": "string"},
+          "Health": {"type": "string"},
+          "PreviousHealth": {"type": "string"},
+          "Step": {"type": "string"},
+          "Image": {"type": "string", "description": "Reference of the image, only set for image events"},
+          "Message": {"type": "string"},
+          "Timestamp": {"type": "integer"}
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,168 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	math "math/rand"
+	"net"
+	"strconv"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//Times a container is moved to another port when the one it got turns out to be taken
+const portCollisionRetries = 3
+
+//PortReservation A host port held by a deployment. The unique index makes reserving a port atomic,
+//so two deployments created at the same time cannot get the same port.
+type PortReservation struct {
+	ID           uint `gorm:"primary_key"`
+	Port         int  `gorm:"unique_index"`
+	DeploymentID uint `gorm:"index"`
+}
+
+//portRange Gets the ports deployments are given from the configuration, both ends included
+func portRange() (int, int, error) {
+	first := viper.GetInt("PortRangeStart")
+	last := viper.GetInt("PortRangeEnd")
+	if first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("PortRangeStart %d and PortRangeEnd %d are not a range of ports", first, last)
+	}
+	return first, last, nil
+}
+
+//reservePort Reserves a free port in the configured range for a deployment. Ports are tried from a random one on
+//and skipped if they are reserved or something on the host is listening on them.
+func reservePort(db *gorm.DB, deploymentID uint) (int, error) {
+	first, last, err := portRange()
+	if err != nil {
+		return 0, err
+	}
+	size := last - first + 1
+	start := math.Intn(size)
+	for i := 0; i < size; i++ {
+		port := first + (start+i)%size
+		if !db.Where("port = ?", port).First(&PortReservation{}).RecordNotFound() || !portIsFree(port) {
+			continue
+		}
+		reservation := PortReservation{Port: port, DeploymentID: deploymentID}
+		//Fails if another deployment reserved the port since it was checked
+		if err := db.Create(&reservation).Error; err != nil {
+			log.Debugf("Port %d was reserved by someone else: %s", port, err.Error())
+			continue
+		}
+		return port, nil
+	}
+	return 0, fmt.Errorf("No free port between %d and %d", first, last)
+}
+
+//releasePort Gives a port of a deployment back so other deployments can have it
+func releasePort(db *gorm.DB, deploymentID uint, port int) error {
+	return db.Where("port = ? AND deployment_id = ?", port, deploymentID).Delete(&PortReservation{}).Error
+}
+
+//releaseDeploymentPorts Gives every port of a deployment back
+func releaseDeploymentPorts(db *gorm.DB, deploymentID uint) error {
+	return db.Where("deployment_id = ?", deploymentID).Delete(&PortReservation{}).Error
+}
+
+//portIsFree Checks that nothing on the host listens on a port of 127.0.0.1, where containers are published
+func portIsFree(port int) bool {
+	listener, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+//reserveDeploymentPorts Reserves the ports of deployments created before ports were reserved
+func reserveDeploymentPorts(db *gorm.DB) {
+	var deployments []mds.Deployment
+	db.Find(&deployments)
+	for _, deployment := range deployments {
+		port, err := strconv.Atoi(deployment.Port)
+		if err != nil {
+			continue
+		}
+		var reservation PortReservation
+		if db.Where("port = ?", port).First(&reservation).RecordNotFound() {
+			reservation = PortReservation{Port: port, DeploymentID: deployment.ID}
+			if err := db.Create(&reservation).Error; err != nil {
+				log.Warningf("Failed to reserve port %d of %s: %s", port, deployment.ProjectName, err.Error())
+			}
+		} else if reservation.DeploymentID != deployment.ID {
+			log.Warningf("Port %d of %s is reserved by deployment %d, update it to move it to another port", port, deployment.ProjectName, reservation.DeploymentID)
+		}
+	}
+}
+
+//isPortCollision Checks whether a container failed to start because its host port is taken
+func isPortCollision(err error) bool {
+	message := err.Error()
+	return strings.Contains(message, "port is already allocated") || strings.Contains(message, "address already in use")
+}
+
+//startOnFreePort Starts the new application container of a deployment. If its port turns out to be taken a port is
+//reserved in its place and create makes another container for it, up to portCollisionRetries times. Moves are
+//registered with tx, which puts the port back. Returns the container that was started, or the one that could not be
+//started, and the ports that were given up, to be released once the operation succeeds.
+func startOnFreePort(client *docker.Client, db *gorm.DB, tx *deploymentTransaction, deployment *mds.Deployment, container *docker.Container, create func() (*docker.Container, error)) (*docker.Container, []int, error) {
+	var abandoned []int
+	for attempt := 0; ; attempt++ {
+		err := client.StartContainer(container.ID, nil)
+		if err == nil || !isPortCollision(err) || attempt == portCollisionRetries {
+			return container, abandoned, err
+		}
+		oldPort, _ := strconv.Atoi(deployment.Port)
+		port, reserveErr := reservePort(db, deployment.ID)
+		if reserveErr != nil {
+			return container, abandoned, errors.New(err.Error() + ", and no other port is free: " + reserveErr.Error())
+		}
+		log.Warningf("Port %d of %s is taken, moving it to port %d", oldPort, deployment.ProjectName, port)
+		previousPort := deployment.Port
+		tx.OnRollback(fmt.Sprintf("move back from port %d to %s", port, previousPort), func() error {
+			deployment.Port = previousPort
+			return releasePort(db, deployment.ID, port)
+		})
+		deployment.Port = strconv.Itoa(port)
+		replacement, err := create()
+		if err != nil {
+			return container, abandoned, err
+		}
+		if err := removeContainer(client, container.ID); err != nil {
+			log.Warningf("Failed to remove container %s: %s", container.ID, err.Error())
+		}
+		abandoned = append(abandoned, oldPort)
+		container = replacement
+	}
+}
+
+//releaseAbandonedPorts Releases the ports a deployment was moved away from
+func releaseAbandonedPorts(db *gorm.DB, deploymentID uint, ports []int) {
+	for _, port := range ports {
+		if err := releasePort(db, deploymentID, port); err != nil {
+			log.Warningf("Failed to release port %d: %s", port, err.Error())
+		}
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//setPortRange Makes deployments get ports from a range of free ports, which is returned. The range is reset by the returned function.
+func setPortRange(t *testing.T, size int) (int, func()) {
+	//Ports above the ephemeral range handed out by the kernel are unlikely to be taken while the test runs
+	first := 0
+	for candidate := 20000; candidate < 29000 && first == 0; candidate += size {
+		free := true
+		for port := candidate; port < candidate+size; port++ {
+			free = free && portIsFree(port)
+		}
+		if free {
+			first = candidate
+		}
+	}
+	if first == 0 {
+		t.Fatal("No free range of ports")
+	}
+	viper.Set("PortRangeStart", first)
+	viper.Set("PortRangeEnd", first+size-1)
+	return first, func() {
+		viper.Set("PortRangeStart", nil)
+		viper.Set("PortRangeEnd", nil)
+	}
+}
+
+func TestReservePort(t *testing.T) {
+	_, cleanup := newTestAPI(t)
+	defer cleanup()
+	first, resetRange := setPortRange(t, 3)
+	defer resetRange()
+
+	//Ports another process listens on are skipped
+	listener, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(first+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	reserved := map[int]bool{}
+	for id := uint(1); id <= 2; id++ {
+		port, err := reservePort(database, id)
+		if err != nil || reserved[port] || port == first+1 || port < first || port > first+2 {
+			t.Fatalf("Unexpected port %d: %v", port, err)
+		}
+		reserved[port] = true
+	}
+	if port, err := reservePort(database, 3); err == nil {
+		t.Fatalf("Port %d was reserved twice", port)
+	}
+
+	//Released ports can be reserved again
+	if err := releaseDeploymentPorts(database, 1); err != nil {
+		t.Fatal(err)
+	}
+	if port, err := reservePort(database, 3); err != nil || !reserved[port] {
+		t.Fatalf("Released port was not reserved: %d %v", port, err)
+	}
+
+	//Only the first deployment on a port keeps it
+	database.Where("1 = 1").Delete(&PortReservation{})
+	database.Create(&mds.Deployment{ProjectName: "old", Port: "31000"})
+	database.Create(&mds.Deployment{ProjectName: "copy", Port: "31000"})
+	reserveDeploymentPorts(database)
+	var reservations []PortReservation
+	database.Find(&reservations)
+	if len(reservations) != 1 || reservations[0].Port != 31000 {
+		t.Fatalf("Unexpected reservations: %+v", reservations)
+	}
+
+	viper.Set("PortRangeStart", 40000)
+	viper.Set("PortRangeEnd", 39999)
+	if _, err := reservePort(database, 4); err == nil {
+		t.Fatal("Range ending before it starts was accepted")
+	}
+}
+
+func TestStartOnFreePort(t *testing.T) {
+	_, cleanup := newTestAPI(t)
+	defer cleanup()
+	_, resetRange := setPortRange(t, 10)
+	defer resetRange()
+	//Containers named after their port fail to start while it is listed as taken
+	taken := map[string]bool{}
+	var removed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Split(strings.TrimPrefix(r.URL.Path, "/containers/"), "/")[0]
+		switch {
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/start"):
+			if taken[id] {
+				http.Error(w, `{"message":"driver failed programming external connectivity: Bind for 127.0.0.1:`+id+` failed: port is already allocated"}`, http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "DELETE":
+			removed = append(removed, id)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	engine, _ := docker.NewClient(server.URL)
+
+	deployment := mds.Deployment{ProjectName: "app"}
+	database.Create(&deployment)
+	port, _ := reservePort(database, deployment.ID)
+	deployment.Port = strconv.Itoa(port)
+	taken[deployment.Port] = true
+	create := func() (*docker.Container, error) {
+		return &docker.Container{ID: deployment.Port}, nil
+	}
+	tx := &deploymentTransaction{}
+	tx.Begin("container")
+	container, abandoned, err := startOnFreePort(engine, database, tx, &deployment, &docker.Container{ID: deployment.Port}, create)
+	if err != nil || container.ID == strconv.Itoa(port) || container.ID != deployment.Port {
+		t.Fatalf("Container was not moved to another port: %+v %v", container, err)
+	}
+	if len(abandoned) != 1 || abandoned[0] != port || len(removed) != 1 || removed[0] != strconv.Itoa(port) {
+		t.Fatalf("Unexpected abandoned ports %v and removed containers %v", abandoned, removed)
+	}
+
+	//Rolling back puts the deployment on its first port
+	moved := deployment.Port
+	tx.Rollback(errors.New("proxy failed"))
+	if deployment.Port != strconv.Itoa(port) {
+		t.Fatalf("Port was not put back: %s", deployment.Port)
+	}
+	if !database.Where("port = ?", moved).First(&PortReservation{}).RecordNotFound() {
+		t.Fatal("Port the deployment was moved to is still reserved")
+	}
+
+	//Other failures are not retried
+	if isPortCollision(errors.New("no such image")) {
+		t.Fatal("Unrelated error taken for a collision")
+	}
+}
@@ -44,6 +44,7 @@ type NginxInstance struct {
 type NginxProxyConfiguration struct {
 	gorm.Model
 	DomainName      string //Optional. Generated if not provided. Regenerated if not unique.
+	Aliases         string //Other domain names served by the proxy, separated by spaces
 	IsHTTPS         bool   //Required
 	CertificatePath string
 	PrivateKeyPath  string
@@ -82,8 +83,9 @@ func (n *NginxInstance) CreateProxy(db *gorm.DB, config *NginxProxyConfiguration
 	//domainName := config.domainName
 	var domainName = config.DomainName
 
-	//Set the values in the configuration
-	configString := strings.Replace(templateString, "{{domainName}}", domainName, -1)
+	//Set the values in the configuration. The template only uses the domain name as the server name so the aliases go with it.
+	serverNames := strings.TrimSpace(domainName + " " + config.Aliases)
+	configString := strings.Replace(templateString, "{{domainName}}", serverNames, -1)
 	configString = strings.Replace(configString, "{{destination}}", config.Destination, -1)
 
 	//Set HTTPS options if necessary
@@ -134,24 +136,48 @@ func (n *NginxInstance) CreateProxy(db *gorm.DB, config *NginxProxyConfiguration
 	return domainName, nil
 }
 
+//DeleteProxyConfiguration Removes the proxy for a domain name, its key material and its record
 func (n *NginxInstance) DeleteProxyConfiguration(db *gorm.DB, domainName string) error {
 	//Let's get the details about this proxy
 	nginxConfig := NginxProxyConfiguration{}
-	resp := db.Where("DomainName = ?", domainName).First(nginxConfig)
+	resp := db.Where("domain_name = ?", domainName).First(&nginxConfig)
 	//Throw an error if the configuration was not found
 	if resp.RecordNotFound() {
 		return errors.New("No proxy with that domain name was found")
 	}
-	//Remove the config file
-	os.Remove(nginxConfig.ConfigurationFilePath)
-	//Remove the key material if the site is https
-	if nginxConfig.IsHTTPS {
-		os.Remove(nginxConfig.CertificatePath)
-		os.Remove(nginxConfig.PrivateKeyPath)
-	}
+	//Remove the config file and key material
+	err := n.RemoveProxyFiles(&nginxConfig)
 	//Finally, remove the config itself
 	db.Delete(&nginxConfig)
-	return nil
+	return err
+}
+
+//RemoveProxyFiles Removes the nginx configuration file and key material of a proxy and reloads nginx if needed.
+//Files that do not exist are ignored so this is safe to call on a proxy that was only partially created.
+func (n *NginxInstance) RemoveProxyFiles(config *NginxProxyConfiguration) error {
+	configurationFilePath := config.ConfigurationFilePath
+	if configurationFilePath == "" {
+		configurationFilePath = n.SitesDirectory + "MDS-" + config.DomainName + ".conf"
+	}
+	//Remove the key material if the site is https
+	if config.IsHTTPS {
+		for _, path := range []string{config.CertificatePath, config.PrivateKeyPath} {
+			if path == "" {
+				continue
+			}
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	//Remove the config file, nginx only needs to be reloaded if it existed
+	err := os.Remove(configurationFilePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return n.ApplyChanges()
 }
 
 func (n *NginxInstance) GenerateHTTPSSettings(config NginxProxyConfiguration) NginxProxyConfiguration {
@@ -168,12 +194,39 @@ func (n *NginxInstance) GenerateHTTPSSettings(config NginxProxyConfiguration) Ng
 	return config
 }
 
-//ReserveDomainName Reserves a domain name in the DB by creating an unaffiliated NginxConfig
-func ReserveDomainName(db *gorm.DB) NginxProxyConfiguration {
-	nginxConfig := NginxProxyConfiguration{}
-	nginxConfig.DomainName = GenerateNewUniqueURL(db)
-	db.Create(&nginxConfig)
-	return nginxConfig
+//ReserveDomainNames Reserves domain names in the DB by creating an unaffiliated NginxConfig.
+//A primary domain name is generated if none is given.
+func ReserveDomainNames(db *gorm.DB, primary string, aliases []string) (NginxProxyConfiguration, error) {
+	nginxConfig := NginxProxyConfiguration{Aliases: strings.Join(aliases, " ")}
+	if taken := UnavailableDomainNames(db, append([]string{primary}, aliases...), 0); len(taken) > 0 {
+		return nginxConfig, errors.New("Domain names already in use: " + strings.Join(taken, ", "))
+	}
+	nginxConfig.DomainName = primary
+	if primary == "" {
+		nginxConfig.DomainName = GenerateNewUniqueURL(db)
+	}
+	err := db.Create(&nginxConfig).Error
+	return nginxConfig, err
+}
+
+//UnavailableDomainNames Gets the domain names that another proxy already serves, ignoring the proxy with the ID exclude
+func UnavailableDomainNames(db *gorm.DB, domainNames []string, exclude uint) []string {
+	var configs []NginxProxyConfiguration
+	db.Where("id <> ?", exclude).Find(&configs)
+	inUse := make(map[string]bool)
+	for _, config := range configs {
+		inUse[config.DomainName] = true
+		for _, alias := range strings.Fields(config.Aliases) {
+			inUse[alias] = true
+		}
+	}
+	var taken []string
+	for _, domainName := range domainNames {
+		if domainName != "" && inUse[domainName] {
+			taken = append(taken, domainName)
+		}
+	}
+	return taken
 }
 
 //GenerateNewUniqueURL Generates a new URL to be used by an application
@@ -192,8 +245,9 @@ func GenerateNewUniqueURL(db *gorm.DB) string {
 
 //IsDomainNameUnique checks the database to see if the domain name is unique
 func IsDomainNameUnique(db *gorm.DB, domainName string) bool {
-	log.Debugf("Result of unqiue check for %s is %b\n", domainName, db.Where(&NginxProxyConfiguration{DomainName: domainName}).RecordNotFound())
-	return db.Where(&NginxProxyConfiguration{DomainName: domainName}).First(&NginxProxyConfiguration{}).RecordNotFound()
+	unique := len(UnavailableDomainNames(db, []string{domainName}, 0)) == 0
+	log.Debugf("Result of unique check for %s is %t\n", domainName, unique)
+	return unique
 }
 
 //TODO: Finish Implementation of this
@@ -0,0 +1,429 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//Delay before a failed pull is tried again. It doubles with every failure in a row up to imagePullMaxRetryDelay.
+const (
+	imagePullRetryDelay    = 30 * time.Second
+	imagePullMaxRetryDelay = time.Hour
+)
+
+//How often the image manager looks for images that are due
+const imageManagerInterval = 10 * time.Second
+
+//How often the progress of a pull is announced
+const imagePullProgressInterval = time.Second
+
+//trackedImage An image kept pulled by the imageManager
+type trackedImage struct {
+	status  mds.ImageStatus
+	due     time.Time     //When the image is pulled next, zero if it is not pulled again
+	pulling chan struct{} //Closed once the pull in progress finishes, nil if none is running
+	err     error         //Result of the last pull
+}
+
+//imageManager Pulls the images of the configuration and of deployments in the background. Failed pulls are retried
+//and images pinned to a tag are pulled again every ImageCheckIntervalHours, so that deployments running an older
+//digest than the registry has can be flagged.
+type imageManager struct {
+	sync.Mutex
+	images map[string]*trackedImage
+	wake   chan struct{}
+}
+
+//imagePulls Keeps every image the daemon needs pulled
+var imagePulls = newImageManager()
+
+//newImageManager Creates an imageManager that tracks no images
+func newImageManager() *imageManager {
+	return &imageManager{images: make(map[string]*trackedImage), wake: make(chan struct{}, 1)}
+}
+
+//Run Pulls images as they become due. Never returns.
+func (m *imageManager) Run(client *docker.Client, db *gorm.DB) {
+	for {
+		m.Sync(db)
+		for _, reference := range m.due(time.Now()) {
+			m.Pull(client, db, reference)
+		}
+		select {
+		case <-m.wake:
+		case <-time.After(imageManagerInterval):
+		}
+	}
+}
+
+//Wake Makes Run look for due images now instead of at its next interval
+func (m *imageManager) Wake() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+//Sync Starts tracking the images in the configuration and those deployments run. Images nothing needs anymore are
+//dropped once they are due, so an image pulled for a deployment that was then deleted is not pulled again.
+func (m *imageManager) Sync(db *gorm.DB) {
+	wanted := wantedImages(db)
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	for reference, deployments := range wanted {
+		m.track(reference).status.Deployments = deployments
+	}
+	for reference, image := range m.images {
+		if _, ok := wanted[reference]; ok {
+			continue
+		}
+		image.status.Deployments = nil
+		if image.pulling == nil && !image.due.After(now) {
+			delete(m.images, reference)
+		}
+	}
+}
+
+//track Gets the state of an image, tracking it and making it due now if it was not tracked. The caller holds the lock.
+func (m *imageManager) track(reference string) *trackedImage {
+	image, ok := m.images[reference]
+	if !ok {
+		image = &trackedImage{status: mds.ImageStatus{Reference: reference, State: mds.ImageStateQueued}, due: time.Now()}
+		m.images[reference] = image
+	}
+	return image
+}
+
+//due Gets the images whose next pull is due at now and that are not being pulled, in alphabetical order
+func (m *imageManager) due(now time.Time) []string {
+	m.Lock()
+	defer m.Unlock()
+	var references []string
+	for reference, image := range m.images {
+		if image.pulling == nil && !image.due.IsZero() && !image.due.After(now) {
+			references = append(references, reference)
+		}
+	}
+	sort.Strings(references)
+	return references
+}
+
+//List Gets the state of every tracked image in alphabetical order
+func (m *imageManager) List() []mds.ImageStatus {
+	m.Lock()
+	defer m.Unlock()
+	statuses := []mds.ImageStatus{}
+	for _, image := range m.images {
+		status := image.status
+		if !image.due.IsZero() {
+			due := image.due
+			status.NextCheckAt = &due
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Reference < statuses[j].Reference })
+	return statuses
+}
+
+//Pull Pulls an image now and records the result. If the image is already being pulled the result of that pull
+//is waited for instead. Deployments that run an older digest of the image are flagged once it is pulled.
+func (m *imageManager) Pull(client *docker.Client, db *gorm.DB, reference string) error {
+	m.Lock()
+	image := m.track(reference)
+	if image.pulling != nil {
+		done := image.pulling
+		m.Unlock()
+		<-done
+		m.Lock()
+		defer m.Unlock()
+		return image.err
+	}
+	done := make(chan struct{})
+	image.pulling = done
+	image.status.State = mds.ImageStatePulling
+	image.status.Progress = ""
+	m.Unlock()
+	log.Infof("Pulling image %s", reference)
+	publishImageEvent(reference, "Pulling "+reference)
+
+	err := PullDockerImage(client, db, reference, func(progress string) {
+		m.Lock()
+		image.status.Progress = progress
+		m.Unlock()
+		publishImageEvent(reference, "Pulling "+reference+": "+progress)
+	})
+	var pulled *docker.Image
+	if err == nil {
+		pulled, err = client.InspectImage(reference)
+	}
+
+	m.Lock()
+	now := time.Now()
+	image.err = err
+	image.status.Progress = ""
+	if err != nil {
+		image.status.State = mds.ImageStateFailed
+		image.status.Attempts++
+		image.status.Error = err.Error()
+		image.due = now.Add(imagePullBackoff(image.status.Attempts))
+	} else {
+		image.status.State = mds.ImageStateReady
+		image.status.Attempts = 0
+		image.status.Error = ""
+		image.status.Digest = imageDigest(pulled)
+		image.status.CheckedAt = &now
+		image.due = nextImageCheck(reference, now)
+	}
+	image.pulling = nil
+	close(done)
+	retry := image.due.Sub(now)
+	m.Unlock()
+
+	if err != nil {
+		log.Warningf("Failed to pull %s, retrying in %s: %s", reference, retry, err.Error())
+		publishImageEvent(reference, fmt.Sprintf("Failed to pull %s, retrying in %s: %s", reference, retry, err.Error()))
+		return err
+	}
+	publishImageEvent(reference, "Pulled "+reference+" at "+imageDigest(pulled))
+	flagOutdatedDeployments(db, reference, pulled)
+	return nil
+}
+
+//imagePullBackoff Gets how long to wait before pulling again after attempts failures in a row
+func imagePullBackoff(attempts int) time.Duration {
+	delay := imagePullRetryDelay
+	for i := 1; i < attempts && delay < imagePullMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > imagePullMaxRetryDelay {
+		return imagePullMaxRetryDelay
+	}
+	return delay
+}
+
+//nextImageCheck Gets when an image pulled at now is pulled again to look for a newer version.
+//Zero for images pinned to a digest, which cannot change, and when ImageCheckIntervalHours is 0.
+func nextImageCheck(reference string, now time.Time) time.Time {
+	interval := viper.GetInt("ImageCheckIntervalHours")
+	if strings.Contains(reference, "@") || interval <= 0 {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(interval) * time.Hour)
+}
+
+//wantedImages Gets the images to keep pulled and the IDs of the deployments that run each
+func wantedImages(db *gorm.DB) map[string][]uint {
+	wanted := make(map[string][]uint)
+	for _, reference := range []string{viper.GetString("DefaultBaseImage"), viper.GetString("MongoImage")} {
+		if reference != "" {
+			wanted[reference] = []uint{}
+		}
+	}
+	var deployments []mds.Deployment
+	db.Where("base_image <> ''").Order("id").Find(&deployments)
+	for _, deployment := range deployments {
+		if pullableDeployment(deployment) {
+			wanted[deployment.BaseImage] = append(wanted[deployment.BaseImage], deployment.ID)
+		}
+	}
+	return wanted
+}
+
+//pullableDeployment Whether the image of a deployment comes from a registry. Images loaded from a tarball do not.
+func pullableDeployment(deployment mds.Deployment) bool {
+	return deployment.BaseImage != "" && (deployment.Type != mds.DeploymentTypeImage || deployment.Spec.Image != "")
+}
+
+//imageHasDigest Whether digest, as stored on a deployment by imageDigest, is one of the digests of an image
+func imageHasDigest(image *docker.Image, digest string) bool {
+	if digest == image.ID {
+		return true
+	}
+	for _, repoDigest := range image.RepoDigests {
+		if repoDigest == digest {
+			return true
+		}
+	}
+	return false
+}
+
+//flagOutdatedDeployments Sets ImageOutdated on the deployments running reference, depending on whether the digest
+//their container was created from is the one just pulled
+func flagOutdatedDeployments(db *gorm.DB, reference string, image *docker.Image) {
+	var deployments []mds.Deployment
+	db.Where("base_image = ?", reference).Find(&deployments)
+	for _, deployment := range deployments {
+		if !pullableDeployment(deployment) || deployment.ImageDigest == "" {
+			continue
+		}
+		outdated := !imageHasDigest(image, deployment.ImageDigest)
+		if outdated == deployment.ImageOutdated {
+			continue
+		}
+		//Only the flag so a concurrent update is not overwritten
+		db.Model(&deployment).Update("image_outdated", outdated)
+		if outdated {
+			log.Infof("%s runs an outdated version of %s", deployment.ProjectName, reference)
+			events.Publish(mds.DeploymentEvent{
+				Type:         mds.EventTypeImage,
+				DeploymentID: deployment.ID,
+				ProjectName:  deployment.ProjectName,
+				Status:       deployment.Status,
+				Health:       deployment.Health,
+				Image:        reference,
+				Message:      "A newer version of " + reference + " was pulled, refresh the deployment to run it",
+			})
+		}
+	}
+}
+
+//publishImageEvent Announces the progress or result of a pull
+func publishImageEvent(reference string, message string) {
+	events.Publish(mds.DeploymentEvent{Type: mds.EventTypeImage, Image: reference, Message: message})
+}
+
+//pullMessage A message of the JSON stream docker writes while pulling
+type pullMessage struct {
+	ID             string `json:"id"`
+	Status         string `json:"status"`
+	Error          string `json:"error"`
+	ProgressDetail struct {
+		Current int64 `json:"current"`
+		Total   int64 `json:"total"`
+	} `json:"progressDetail"`
+}
+
+//layerProgress What was downloaded of one layer of an image
+type layerProgress struct {
+	downloaded int64
+	size       int64
+	done       bool
+}
+
+//pullOutput Reads the JSON stream of a pull to summarize its progress and find the error docker reports in it,
+//which the docker client does not return when it is given the raw stream
+type pullOutput struct {
+	pending    []byte
+	layers     map[string]*layerProgress
+	err        error
+	progress   func(string) //Called with a summary at most every imagePullProgressInterval, may be nil
+	lastReport time.Time
+}
+
+//newPullOutput Creates a pullOutput that reports the progress of the pull to progress
+func newPullOutput(progress func(string)) *pullOutput {
+	return &pullOutput{layers: make(map[string]*layerProgress), progress: progress}
+}
+
+func (o *pullOutput) Write(p []byte) (int, error) {
+	o.pending = append(o.pending, p...)
+	for {
+		end := bytes.IndexByte(o.pending, '\n')
+		if end < 0 {
+			break
+		}
+		o.handle(o.pending[:end])
+		o.pending = o.pending[end+1:]
+	}
+	if o.progress != nil && len(o.layers) > 0 && time.Since(o.lastReport) >= imagePullProgressInterval {
+		o.lastReport = time.Now()
+		o.progress(o.Summary())
+	}
+	return len(p), nil
+}
+
+//handle Updates the progress with one message of the stream
+func (o *pullOutput) handle(line []byte) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+	var message pullMessage
+	if err := json.Unmarshal(line, &message); err != nil {
+		return
+	}
+	if message.Error != "" {
+		o.err = errors.New(message.Error)
+		return
+	}
+	layer := o.layers[message.ID]
+	switch message.Status {
+	case "Pulling fs layer", "Waiting":
+		if layer == nil {
+			o.layers[message.ID] = &layerProgress{}
+		}
+	case "Downloading":
+		if layer == nil {
+			layer = &layerProgress{}
+			o.layers[message.ID] = layer
+		}
+		layer.downloaded = message.ProgressDetail.Current
+		layer.size = message.ProgressDetail.Total
+	case "Verifying Checksum", "Download complete", "Extracting":
+		if layer != nil {
+			layer.downloaded = layer.size
+		}
+	case "Pull complete", "Already exists":
+		if layer == nil {
+			layer = &layerProgress{}
+			o.layers[message.ID] = layer
+		}
+		layer.downloaded = layer.size
+		layer.done = true
+	}
+}
+
+//Err Gets the error docker reported in the stream, nil if the pull succeeded
+func (o *pullOutput) Err() error {
+	o.handle(o.pending)
+	o.pending = nil
+	return o.err
+}
+
+//Summary Describes how many layers were pulled and how much was downloaded
+func (o *pullOutput) Summary() string {
+	done := 0
+	var downloaded, size int64
+	for _, layer := range o.layers {
+		if layer.done {
+			done++
+		}
+		downloaded += layer.downloaded
+		size += layer.size
+	}
+	return fmt.Sprintf("%d of %d layers done, %.1f of %.1f MB downloaded", done, len(o.layers), float64(downloaded)/(1<<20), float64(size)/(1<<20))
+}
+
+//Called when GET /images is called. Returns the images the daemon keeps pulled.
+func getImagesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, imagePulls.List())
+}
@@ -0,0 +1,233 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//fakeImageEngine Stands in for a docker engine whose registry holds one digest of every image.
+//Pulls fail while failing is set, and the pulled digest can be changed to publish a new version.
+type fakeImageEngine struct {
+	sync.Mutex
+	digest  string
+	failing bool
+	pulls   int
+}
+
+func (e *fakeImageEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.Lock()
+	defer e.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/images/create":
+		e.pulls++
+		if e.failing {
+			fmt.Fprint(w, `{"status":"Pulling fs layer","id":"a1"}`+"\r\n"+`{"error":"connection reset by peer"}`+"\r\n")
+			return
+		}
+		fmt.Fprint(w, `{"status":"Pulling fs layer","id":"a1"}`+"\r\n"+`{"status":"Pull complete","id":"a1"}`+"\r\n")
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/images/") && strings.HasSuffix(r.URL.Path, "/json"):
+		reference := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/images/"), "/json")
+		repository, _ := splitImageReference(reference)
+		json.NewEncoder(w).Encode(docker.Image{ID: "sha256:" + e.digest, RepoDigests: []string{repository + "@sha256:" + e.digest}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestPullOutput(t *testing.T) {
+	var reports []string
+	output := newPullOutput(func(summary string) { reports = append(reports, summary) })
+	stream := `{"status":"Pulling from library/mongo","id":"3.4"}` + "\r\n" +
+		`{"status":"Already exists","id":"a1"}` + "\r\n" +
+		`{"status":"Pulling fs layer","id":"b2"}` + "\r\n" +
+		`{"status":"Downloading","id":"b2","progressDetail":{"current":1048576,"total":4194304}}` + "\r\n"
+	//Docker does not write whole messages at a time
+	for len(stream) > 0 {
+		n := 7
+		if n > len(stream) {
+			n = len(stream)
+		}
+		output.Write([]byte(stream[:n]))
+		stream = stream[n:]
+	}
+	if summary := output.Summary(); summary != "1 of 2 layers done, 1.0 of 4.0 MB downloaded" {
+		t.Fatalf("Unexpected summary: %s", summary)
+	}
+	if len(reports) != 1 {
+		t.Fatalf("Expected progress to be reported once a second, got %v", reports)
+	}
+	output.Write([]byte(`{"status":"Pull complete","id":"b2"}` + "\r\n" + `{"status":"Digest: sha256:0"}`))
+	if err := output.Err(); err != nil || output.Summary() != "2 of 2 layers done, 4.0 of 4.0 MB downloaded" {
+		t.Fatalf("Unexpected result: %s %v", output.Summary(), err)
+	}
+
+	output = newPullOutput(nil)
+	output.Write([]byte(`{"errorDetail":{"message":"manifest unknown"},"error":"manifest for mongo:9 not found"}`))
+	if err := output.Err(); err == nil || err.Error() != "manifest for mongo:9 not found" {
+		t.Fatalf("Error in the stream was not returned: %v", err)
+	}
+}
+
+func TestImagePullBackoff(t *testing.T) {
+	expected := map[int]time.Duration{1: 30 * time.Second, 2: time.Minute, 3: 2 * time.Minute, 8: time.Hour, 100: time.Hour}
+	for attempts, delay := range expected {
+		if found := imagePullBackoff(attempts); found != delay {
+			t.Errorf("%d attempts: expected %s, got %s", attempts, delay, found)
+		}
+	}
+}
+
+func TestImageManager(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+	login(t, apiClient, "viewer")
+	fake := &fakeImageEngine{digest: strings.Repeat("1", 64)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	engine, _ := docker.NewClient(server.URL)
+	viper.Set("DefaultBaseImage", "abernix/meteord:node-8.9.4-base")
+	viper.Set("MongoImage", "mongo@sha256:"+strings.Repeat("0", 64))
+	viper.Set("ImageCheckIntervalHours", 24)
+	defer viper.Set("DefaultBaseImage", nil)
+	defer viper.Set("MongoImage", nil)
+	defer viper.Set("ImageCheckIntervalHours", nil)
+
+	current := mds.Deployment{ProjectName: "current", Port: "30010", BaseImage: "app:1", ImageDigest: "app@sha256:" + strings.Repeat("1", 64)}
+	old := mds.Deployment{ProjectName: "old", Port: "30011", BaseImage: "app:1", ImageDigest: "app@sha256:" + strings.Repeat("9", 64)}
+	loaded := mds.Deployment{ProjectName: "loaded", Port: "30012", Type: mds.DeploymentTypeImage, BaseImage: "app:1", ImageDigest: "sha256:" + strings.Repeat("9", 64)}
+	database.Create(&current)
+	database.Create(&old)
+	database.Create(&loaded)
+
+	manager := newImageManager()
+	manager.Sync(database)
+	due := manager.due(time.Now())
+	if strings.Join(due, " ") != "abernix/meteord:node-8.9.4-base app:1 mongo@sha256:"+strings.Repeat("0", 64) {
+		t.Fatalf("Unexpected images: %v", due)
+	}
+
+	//Failed pulls are retried later
+	fake.failing = true
+	if err := manager.Pull(engine, database, "app:1"); err == nil {
+		t.Fatal("Pull error was not returned")
+	}
+	status := manager.List()[1]
+	if status.State != mds.ImageStateFailed || status.Attempts != 1 || status.Error != "connection reset by peer" {
+		t.Fatalf("Unexpected status: %+v", status)
+	}
+	if status.NextCheckAt == nil || time.Until(*status.NextCheckAt) > imagePullRetryDelay {
+		t.Fatalf("Retry was not scheduled: %v", status.NextCheckAt)
+	}
+
+	fake.failing = false
+	if err := manager.Pull(engine, database, "app:1"); err != nil {
+		t.Fatal(err)
+	}
+	status = manager.List()[1]
+	if status.State != mds.ImageStateReady || status.Attempts != 0 || status.Digest != "app@sha256:"+strings.Repeat("1", 64) || len(status.Deployments) != 2 {
+		t.Fatalf("Unexpected status: %+v", status)
+	}
+	if status.NextCheckAt == nil || time.Until(*status.NextCheckAt) < 23*time.Hour {
+		t.Fatalf("Tag was not checked again a day later: %v", status.NextCheckAt)
+	}
+	database.First(&current, current.ID)
+	database.First(&old, old.ID)
+	database.First(&loaded, loaded.ID)
+	if current.ImageOutdated || !old.ImageOutdated || loaded.ImageOutdated {
+		t.Fatalf("Unexpected flags: current %t, old %t, loaded %t", current.ImageOutdated, old.ImageOutdated, loaded.ImageOutdated)
+	}
+
+	//Digests never change so they are not checked again
+	if err := manager.Pull(engine, database, "mongo@sha256:"+strings.Repeat("0", 64)); err != nil {
+		t.Fatal(err)
+	}
+	if status := manager.List()[2]; status.NextCheckAt != nil {
+		t.Fatalf("Image pinned to a digest is checked again at %v", status.NextCheckAt)
+	}
+
+	//Images nothing needs are dropped once they are due again
+	database.Delete(&current)
+	database.Delete(&old)
+	database.Delete(&loaded)
+	manager.Sync(database)
+	if len(manager.List()) != 3 {
+		t.Fatalf("Image was dropped before it was due: %+v", manager.List())
+	}
+	manager.images["app:1"].due = time.Now()
+	manager.Sync(database)
+	if len(manager.List()) != 2 {
+		t.Fatalf("Image nothing runs was kept: %+v", manager.List())
+	}
+
+	imagePulls = manager
+	defer func() { imagePulls = newImageManager() }()
+	images, err := apiClient.ListImages()
+	if err != nil || len(images) != 2 || images[0].Reference != "abernix/meteord:node-8.9.4-base" {
+		t.Fatalf("Unexpected images: %+v %v", images, err)
+	}
+}
+
+func TestRefreshImages(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+	login(t, apiClient, "admin")
+	fake := &fakeImageEngine{digest: strings.Repeat("1", 64)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	dClient, _ = docker.NewClient(server.URL)
+	imagePulls = newImageManager()
+
+	current := mds.Deployment{ProjectName: "current", Port: "30013", Status: "running", BaseImage: "app:1", ImageDigest: "app@sha256:" + strings.Repeat("1", 64)}
+	loaded := mds.Deployment{ProjectName: "loaded", Port: "30014", Status: "running", Type: mds.DeploymentTypeImage, BaseImage: "app:1", ImageDigest: "sha256:" + strings.Repeat("9", 64)}
+	database.Create(&current)
+	database.Create(&loaded)
+
+	_, err := apiClient.RefreshImages(mds.ImageRefreshRequest{Deployments: []uint{999}})
+	expectAPIError(t, err, http.StatusNotFound, mds.ErrorCodeNotFound)
+	_, err = apiClient.RefreshImages(mds.ImageRefreshRequest{Deployments: []uint{loaded.ID}})
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+
+	//Nothing is outdated once the image is pulled, so nothing is recreated
+	job, err := apiClient.RefreshImages(mds.ImageRefreshRequest{})
+	if err != nil || job.Type != RefreshImagesJob {
+		t.Fatalf("Refresh was not started: %+v %v", job, err)
+	}
+	for !job.IsFinished() {
+		time.Sleep(10 * time.Millisecond)
+		job, _ = apiClient.GetJob(job.ID)
+	}
+	if job.Status != mds.JobStatusSucceeded || len(job.Steps) != 2 || job.Steps[0].Message != "Pulled app:1" || fake.pulls != 1 {
+		t.Fatalf("Unexpected job: %+v", job)
+	}
+
+	login(t, apiClient, "viewer")
+	_, err = apiClient.RefreshImages(mds.ImageRefreshRequest{})
+	expectAPIError(t, err, http.StatusForbidden, mds.ErrorCodeForbidden)
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/jinzhu/gorm"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//How often the health of a refreshed deployment is looked at while waiting for it
+const refreshHealthPollInterval = time.Second
+
+//Called when POST /images/refresh is called. Starts a job that recreates deployments with the newest version of
+//their image one after another, every deployment running an outdated image unless the request names some.
+func refreshImagesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var request mds.ImageRefreshRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	for _, id := range request.Deployments {
+		deployment, ok := updatableDeployment(w, id)
+		if !ok {
+			return
+		}
+		if !pullableDeployment(deployment) {
+			writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, deployment.ProjectName+" runs an image loaded from a tarball, update it with a new tarball instead", nil)
+			return
+		}
+	}
+	job, ok := jobs.Submit(database, RefreshImagesJob, requestUserID(r), request.Deployments, func(ctx context.Context, progress deploymentProgress) error {
+		return refreshDeployments(ctx, dClient, database, request.Deployments, progress)
+	})
+	if !ok {
+		writeBusyError(w, nil)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+//refreshDeployments Pulls the images of deployments and recreates the deployments with them one at a time.
+//Without deploymentIDs every deployment whose image turns out to be outdated is recreated. The next deployment
+//is only started once the previous one is running, and healthy if it has a health check. The first deployment
+//that fails stops the refresh, the ones after it keep their current container. Named deployments are held by the
+//job for its whole run, the others only while they are being refreshed.
+func refreshDeployments(ctx context.Context, client *docker.Client, db *gorm.DB, deploymentIDs []uint, progress deploymentProgress) error {
+	var deployments []mds.Deployment
+	query := db.Where("base_image <> ''")
+	if len(deploymentIDs) > 0 {
+		query = query.Where("id IN (?)", deploymentIDs)
+	}
+	query.Order("id").Find(&deployments)
+
+	//Pull first so the deployments are recreated with what the registry has now
+	pulled := make(map[string]bool)
+	for _, deployment := range deployments {
+		if !pullableDeployment(deployment) || pulled[deployment.BaseImage] {
+			continue
+		}
+		pulled[deployment.BaseImage] = true
+		if err := imagePulls.Pull(client, db, deployment.BaseImage); err != nil {
+			return &DeploymentStepError{Step: "pull", Err: err}
+		}
+		if err := progress(nil, "pull", "Pulled "+deployment.BaseImage); err != nil {
+			return err
+		}
+	}
+
+	//Pulling flagged the deployments that run an older version
+	var outdated []mds.Deployment
+	if len(deploymentIDs) > 0 {
+		outdated = deployments
+	} else {
+		db.Where("image_outdated = ?", true).Order("id").Find(&outdated)
+	}
+	if len(outdated) == 0 {
+		return progress(nil, "refresh", "Every deployment runs the newest version of its image")
+	}
+	for i, deployment := range outdated {
+		if err := progress(&deployment, "refresh", fmt.Sprintf("Refreshing %s (%d of %d)", deployment.ProjectName, i+1, len(outdated))); err != nil {
+			return err
+		}
+		//Another job may have started changing it since the refresh began
+		if len(deploymentIDs) == 0 && !jobs.LockDeployments(deployment.ID) {
+			return &DeploymentStepError{Step: "refresh", Err: fmt.Errorf("%s is busy", deployment.ProjectName)}
+		}
+		refreshed, err := refreshDeployment(ctx, client, db, deployment, progress)
+		if len(deploymentIDs) == 0 {
+			jobs.UnlockDeployments(deployment.ID)
+		}
+		if err != nil {
+			return err
+		}
+		if err := progress(refreshed, "refresh", "Refreshed "+refreshed.ProjectName+" with "+refreshed.ImageDigest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//refreshDeployment Recreates a deployment with the newest version of its image and waits for it to become healthy
+func refreshDeployment(ctx context.Context, client *docker.Client, db *gorm.DB, deployment mds.Deployment, progress deploymentProgress) (*mds.Deployment, error) {
+	db.First(&deployment, deployment.ID)
+	if deployment.Status == "deploying" || deployment.Status == "updating" {
+		return nil, &DeploymentStepError{Step: "refresh", Err: fmt.Errorf("%s is busy", deployment.ProjectName)}
+	}
+	refreshed, err := updateDeployment(client, db, deployment.ID, deploymentUpdate{}, progress)
+	if err != nil {
+		return nil, err
+	}
+	if err := waitUntilHealthy(ctx, db, refreshed); err != nil {
+		return nil, &DeploymentStepError{Step: "health", Err: err}
+	}
+	return refreshed, nil
+}
+
+//waitUntilHealthy Waits for the health check of a recreated deployment to pass. Returns an error if the deployment
+//becomes unhealthy or takes longer than its check allows. Deployments without a health check return at once.
+func waitUntilHealthy(ctx context.Context, db *gorm.DB, deployment *mds.Deployment) error {
+	check := deployment.Spec.HealthCheck
+	if check == nil {
+		return nil
+	}
+	//Every probe allowed to fail and time out, plus a round of the deployment monitor to start the first
+	limit := time.Duration((check.Retries+1)*(check.Interval+check.Timeout))*time.Second + 10*time.Second
+	deadline := time.After(limit)
+	ticker := time.NewTicker(refreshHealthPollInterval)
+	defer ticker.Stop()
+	for {
+		var current mds.Deployment
+		if db.First(&current, deployment.ID).RecordNotFound() {
+			return fmt.Errorf("%s was deleted", deployment.ProjectName)
+		}
+		switch current.Health {
+		case healthHealthy:
+			return nil
+		case healthUnhealthy:
+			return fmt.Errorf("%s is unhealthy", deployment.ProjectName)
+		}
+		select {
+		case <-ctx.Done():
+			return errJobCancelled
+		case <-deadline:
+			return fmt.Errorf("%s was not healthy within %s", deployment.ProjectName, limit)
+		case <-ticker.C:
+		}
+	}
+}
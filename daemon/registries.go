@@ -0,0 +1,216 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//dockerHubServerAddress Address docker expects in the credentials of Docker Hub
+const dockerHubServerAddress = "https://index.docker.io/v1/"
+
+//dockerHubAliases Other names Docker Hub is known by
+var dockerHubAliases = map[string]bool{
+	"index.docker.io":         true,
+	"registry-1.docker.io":    true,
+	"registry.hub.docker.com": true,
+}
+
+//configuredRegistry An entry of the Registries list in the configuration
+type configuredRegistry struct {
+	Registry string
+	Username string
+	Password string //Either plaintext or a value printed by 'mds-daemon encrypt-secret'
+}
+
+//imageRegistry Gets the registry an image reference is pulled from. The first part of a reference is a registry
+//if it has a dot or a port or is localhost, otherwise the image is on Docker Hub.
+func imageRegistry(reference string) string {
+	slash := strings.Index(reference, "/")
+	if slash < 0 {
+		return mds.DockerHubRegistry
+	}
+	host := reference[:slash]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return mds.DockerHubRegistry
+	}
+	return normalizeRegistry(host)
+}
+
+//normalizeRegistry Gets the name credentials of a registry are stored under
+func normalizeRegistry(registry string) string {
+	registry = strings.ToLower(strings.TrimSpace(registry))
+	registry = strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")
+	registry = strings.TrimSuffix(registry, "/")
+	if dockerHubAliases[registry] {
+		return mds.DockerHubRegistry
+	}
+	return registry
+}
+
+//isRegistryName Checks that a name could be the host of a registry, with a port if it has one
+func isRegistryName(registry string) bool {
+	if registry == "" || len(registry) > 255 {
+		return false
+	}
+	for _, c := range registry {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == ':' || c == '[' || c == ']') {
+			return false
+		}
+	}
+	return true
+}
+
+//registryAuth Gets the credentials to pull an image with. Credentials stored through the API take precedence over
+//the Registries list of the configuration. Images from registries without credentials are pulled anonymously.
+func registryAuth(db *gorm.DB, reference string) (docker.AuthConfiguration, error) {
+	registry := imageRegistry(reference)
+	serverAddress := registry
+	if registry == mds.DockerHubRegistry {
+		serverAddress = dockerHubServerAddress
+	}
+	var stored mds.RegistryCredential
+	if db != nil && !db.Where("registry = ?", registry).First(&stored).RecordNotFound() {
+		password, err := secrets.Decrypt(stored.Password)
+		if err != nil {
+			return docker.AuthConfiguration{}, fmt.Errorf("Failed to decrypt the password of %s: %s", registry, err.Error())
+		}
+		return docker.AuthConfiguration{Username: stored.Username, Password: password, ServerAddress: serverAddress}, nil
+	}
+	var configured []configuredRegistry
+	if err := viper.UnmarshalKey("Registries", &configured); err != nil {
+		return docker.AuthConfiguration{}, fmt.Errorf("Registries is not a list of registries with credentials: %s", err.Error())
+	}
+	for _, entry := range configured {
+		if normalizeRegistry(entry.Registry) != registry {
+			continue
+		}
+		password, err := secrets.Decrypt(entry.Password)
+		if err != nil {
+			return docker.AuthConfiguration{}, fmt.Errorf("Failed to decrypt the password of %s in the configuration: %s", registry, err.Error())
+		}
+		return docker.AuthConfiguration{Username: entry.Username, Password: password, ServerAddress: serverAddress}, nil
+	}
+	return docker.AuthConfiguration{}, nil
+}
+
+//requestRegistry Gets the registry named in the path. Writes an error response and returns false if it is not valid.
+func requestRegistry(w http.ResponseWriter, r *http.Request) (string, bool) {
+	registry, _ := pathParam(r, "registry")
+	registry = normalizeRegistry(registry)
+	if !isRegistryName(registry) {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "'"+registry+"' is not the host of a registry", nil)
+		return "", false
+	}
+	return registry, true
+}
+
+//Called when GET /registries is called. Passwords are never returned.
+func getRegistriesAPIHandler(w http.ResponseWriter, r *http.Request) {
+	credentials := []mds.RegistryCredential{}
+	if err := database.Order("registry").Find(&credentials).Error; err != nil {
+		writeInternalError(w, "Failed to list registries", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, credentials)
+}
+
+//Called when PUT /registries/:registry is called. Stores the credentials of a registry, replacing any it had.
+func putRegistryAPIHandler(w http.ResponseWriter, r *http.Request) {
+	registry, ok := requestRegistry(w, r)
+	if !ok {
+		return
+	}
+	var request mds.RegistryCredentialRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	if request.Username == "" || request.Password == "" {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Please provide a username and password", missingFields("Username", "Password"))
+		return
+	}
+	password, err := secrets.Encrypt(request.Password)
+	if err != nil {
+		writeInternalError(w, "Failed to encrypt registry password", err)
+		return
+	}
+	var credential mds.RegistryCredential
+	database.Where("registry = ?", registry).First(&credential)
+	credential.Registry = registry
+	credential.Username = request.Username
+	credential.Password = password
+	if err := database.Save(&credential).Error; err != nil {
+		writeInternalError(w, "Failed to save registry credentials", err)
+		return
+	}
+	log.Infof("Stored credentials of %s for %s", registry, request.Username)
+	writeJSON(w, http.StatusOK, credential)
+}
+
+//Called when DELETE /registries/:registry is called
+func deleteRegistryAPIHandler(w http.ResponseWriter, r *http.Request) {
+	registry, ok := requestRegistry(w, r)
+	if !ok {
+		return
+	}
+	result := database.Where("registry = ?", registry).Delete(&mds.RegistryCredential{})
+	if result.Error != nil {
+		writeInternalError(w, "Failed to remove registry credentials", result.Error)
+		return
+	}
+	if result.RowsAffected == 0 {
+		writeError(w, http.StatusNotFound, mds.ErrorCodeNotFound, "No credentials are stored for "+registry, nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//encryptSecretCommand Runs 'mds-daemon encrypt-secret'. Reads a value from the first line of stdin and prints it
+//encrypted with the master key, for passwords in the configuration file.
+func encryptSecretCommand(args []string) error {
+	if len(args) != 0 {
+		return errors.New("Usage: echo <value> | mds-daemon encrypt-secret")
+	}
+	box, err := loadSecretBox()
+	if err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return errors.New("Expected the value on stdin")
+	}
+	value := strings.TrimRight(line, "\r\n")
+	if value == "" {
+		return errors.New("Expected the value on stdin")
+	}
+	encrypted, err := box.Encrypt(value)
+	if err != nil {
+		return err
+	}
+	fmt.Println(encrypted)
+	return nil
+}
@@ -0,0 +1,172 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//pullRequest A pull received by fakeRegistryEngine
+type pullRequest struct {
+	Image string
+	Tag   string
+	Auth  docker.AuthConfiguration
+}
+
+//fakeRegistryEngine Stands in for a docker engine in front of a private registry that only lets username and
+//password pull. Every pull it receives is recorded.
+func fakeRegistryEngine(t *testing.T, registry string, username string, password string) (*docker.Client, func() []pullRequest, func()) {
+	var lock sync.Mutex
+	var pulls []pullRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/images/create" {
+			http.NotFound(w, r)
+			return
+		}
+		pull := pullRequest{Image: r.URL.Query().Get("fromImage"), Tag: r.URL.Query().Get("tag")}
+		if header := r.Header.Get("X-Registry-Auth"); header != "" {
+			decoded, err := base64.URLEncoding.DecodeString(header)
+			if err == nil {
+				err = json.Unmarshal(decoded, &pull.Auth)
+			}
+			if err != nil {
+				t.Errorf("X-Registry-Auth is malformed: %v", err)
+			}
+		}
+		lock.Lock()
+		pulls = append(pulls, pull)
+		lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if imageRegistry(pull.Image) == registry && (pull.Auth.Username != username || pull.Auth.Password != password) {
+			fmt.Fprintf(w, `{"errorDetail": {"message": "unauthorized"}, "error": "unauthorized: authentication required"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"status": "Pull complete"}`)
+	}))
+	engine, err := docker.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := func() []pullRequest {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]pullRequest(nil), pulls...)
+	}
+	return engine, recorded, server.Close
+}
+
+func TestImageRegistry(t *testing.T) {
+	expected := map[string]string{
+		"mongo":                                   mds.DockerHubRegistry,
+		"abernix/meteord:node-8.9.4-base":         mds.DockerHubRegistry,
+		"index.docker.io/library/mongo":           mds.DockerHubRegistry,
+		"localhost/app":                           "localhost",
+		"registry.example.com/team/app:2":         "registry.example.com",
+		"Registry.Example.com:5000/app@sha256:ab": "registry.example.com:5000",
+	}
+	for reference, registry := range expected {
+		if found := imageRegistry(reference); found != registry {
+			t.Errorf("%s: expected %s, got %s", reference, registry, found)
+		}
+	}
+}
+
+func TestPullWithRegistryCredentials(t *testing.T) {
+	apiClient, cleanup := newTestAPI(t)
+	defer cleanup()
+	login(t, apiClient, "admin")
+	engine, pulls, closeEngine := fakeRegistryEngine(t, "registry.example.com:5000", "ci", "s3cret")
+	defer closeEngine()
+
+	//Images from other registries are pulled anonymously
+	if err := PullDockerImage(engine, database, "mongo", nil); err != nil {
+		t.Fatal(err)
+	}
+	if pull := pulls()[0]; pull.Image != "mongo" || pull.Tag != "latest" || pull.Auth.Username != "" {
+		t.Fatalf("Unexpected anonymous pull: %+v", pull)
+	}
+
+	mirror := "registry.example.com:5000/mirror/meteord:node-8.9.4-base"
+	if err := PullDockerImage(engine, database, mirror, nil); err == nil {
+		t.Fatal("Pull without credentials was not refused")
+	}
+
+	//Passwords in the configuration can be encrypted with the master key
+	encrypted, _ := secrets.Encrypt("s3cret")
+	viper.Set("Registries", []map[string]string{{"registry": "https://registry.example.com:5000/", "username": "ci", "password": encrypted}})
+	defer viper.Set("Registries", nil)
+	if err := PullDockerImage(engine, database, mirror, nil); err != nil {
+		t.Fatalf("Pull with configured credentials failed: %v", err)
+	}
+	pull := pulls()[2]
+	if pull.Image != "registry.example.com:5000/mirror/meteord" || pull.Tag != "node-8.9.4-base" || pull.Auth.ServerAddress != "registry.example.com:5000" {
+		t.Fatalf("Unexpected pull: %+v", pull)
+	}
+
+	//Credentials stored through the API take precedence and are encrypted
+	_, err := apiClient.PutRegistryCredential("registry.example.com:5000", mds.RegistryCredentialRequest{Username: "ci", Password: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := PullDockerImage(engine, database, mirror, nil); err == nil {
+		t.Fatal("Stored credentials were not used")
+	}
+	credential, err := apiClient.PutRegistryCredential("Registry.Example.com:5000", mds.RegistryCredentialRequest{Username: "ci", Password: "s3cret"})
+	if err != nil || credential.Registry != "registry.example.com:5000" {
+		t.Fatalf("Credentials were not replaced: %+v %v", credential, err)
+	}
+	var stored mds.RegistryCredential
+	database.First(&stored)
+	if stored.Password == "s3cret" || stored.Password == "" {
+		t.Fatalf("Password was not encrypted: %q", stored.Password)
+	}
+	digest := "registry.example.com:5000/mirror/mongo@sha256:" + fmt.Sprintf("%064d", 0)
+	if err := PullDockerImage(engine, database, digest, nil); err != nil {
+		t.Fatalf("Pull with stored credentials failed: %v", err)
+	}
+	if pull := pulls()[4]; pull.Image != digest || pull.Tag != "" {
+		t.Fatalf("Image pinned to a digest was not pulled as it is: %+v", pull)
+	}
+
+	credentials, err := apiClient.ListRegistryCredentials()
+	if err != nil || len(credentials) != 1 || credentials[0].Password != "" {
+		t.Fatalf("Unexpected credentials: %+v %v", credentials, err)
+	}
+	_, err = apiClient.PutRegistryCredential("registry.example.com", mds.RegistryCredentialRequest{Username: "ci"})
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+	_, err = apiClient.PutRegistryCredential("not a host", mds.RegistryCredentialRequest{Username: "ci", Password: "x"})
+	expectAPIError(t, err, http.StatusBadRequest, mds.ErrorCodeBadRequest)
+	if err := apiClient.DeleteRegistryCredential("registry.example.com:5000"); err != nil {
+		t.Fatal(err)
+	}
+	err = apiClient.DeleteRegistryCredential("registry.example.com:5000")
+	expectAPIError(t, err, http.StatusNotFound, mds.ErrorCodeNotFound)
+
+	login(t, apiClient, "viewer")
+	_, err = apiClient.ListRegistryCredentials()
+	expectAPIError(t, err, http.StatusForbidden, mds.ErrorCodeForbidden)
+}
@@ -0,0 +1,82 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+//DeploymentStepError Returned when a step of a deployment operation fails. The changes made by earlier steps have been rolled back.
+type DeploymentStepError struct {
+	Step           string   //Name of the step that failed
+	Err            error    //What went wrong in that step
+	RollbackErrors []string //Undo actions that failed, anything listed here may have been left behind
+}
+
+func (e *DeploymentStepError) Error() string {
+	message := fmt.Sprintf("Step '%s' failed: %s", e.Step, e.Err.Error())
+	if len(e.RollbackErrors) > 0 {
+		message += fmt.Sprintf(" (rollback incomplete: %s)", strings.Join(e.RollbackErrors, "; "))
+	}
+	return message
+}
+
+//Cause Returns the error that made the step fail so errors.Cause sees through the step error
+func (e *DeploymentStepError) Cause() error {
+	return e.Err
+}
+
+//undoAction Reverts the change made by one step
+type undoAction struct {
+	description string
+	undo        func() error
+}
+
+//deploymentTransaction Tracks the undo actions of a multi-step deployment operation so a failure can be rolled back.
+//Each step calls Begin before doing anything and OnRollback once it has made a change that would be left behind.
+type deploymentTransaction struct {
+	step  string
+	undos []undoAction
+}
+
+//Begin Marks the start of a step. A failure from now on is reported against this step.
+func (t *deploymentTransaction) Begin(step string) {
+	t.step = step
+}
+
+//OnRollback Registers an action that reverts a change made by the current step
+func (t *deploymentTransaction) OnRollback(description string, undo func() error) {
+	t.undos = append(t.undos, undoAction{description: description, undo: undo})
+}
+
+//Rollback Runs the undo actions in reverse order and returns a DeploymentStepError naming the step that failed.
+//Every undo action is attempted even if an earlier one fails.
+func (t *deploymentTransaction) Rollback(err error) error {
+	stepError := &DeploymentStepError{Step: t.step, Err: err}
+	log.Warningf("Step '%s' failed, rolling back %d changes: %s", t.step, len(t.undos), err.Error())
+	for i := len(t.undos) - 1; i >= 0; i-- {
+		action := t.undos[i]
+		log.Infof("Rollback: %s", action.description)
+		if undoErr := action.undo(); undoErr != nil {
+			log.Criticalf("Rollback of '%s' failed: %s", action.description, undoErr.Error())
+			stepError.RollbackErrors = append(stepError.RollbackErrors, action.description+": "+undoErr.Error())
+		}
+	}
+	t.undos = nil
+	return stepError
+}
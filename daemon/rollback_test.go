@@ -0,0 +1,182 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	docker "github.com/fsouza/go-dockerclient"
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+func TestRollback(t *testing.T) {
+	var undone []string
+	tx := &deploymentTransaction{}
+	tx.Begin("first")
+	tx.OnRollback("undo a", func() error {
+		undone = append(undone, "a")
+		return nil
+	})
+	tx.Begin("second")
+	tx.OnRollback("undo b", func() error {
+		undone = append(undone, "b")
+		return errors.New("b is stuck")
+	})
+	tx.OnRollback("undo c", func() error {
+		undone = append(undone, "c")
+		return nil
+	})
+
+	//Undo actions run last to first and a failing one does not stop the rest
+	err := tx.Rollback(errors.New("boom"))
+	if !reflect.DeepEqual(undone, []string{"c", "b", "a"}) {
+		t.Fatalf("Undo actions ran as %v", undone)
+	}
+	stepErr, ok := err.(*DeploymentStepError)
+	if !ok || stepErr.Step != "second" || stepErr.Err.Error() != "boom" {
+		t.Fatalf("Unexpected rollback error: %#v", err)
+	}
+	if !reflect.DeepEqual(stepErr.RollbackErrors, []string{"undo b: b is stuck"}) || !strings.Contains(stepErr.Error(), "rollback incomplete: undo b: b is stuck") {
+		t.Fatalf("Failed undo action was not reported: %v", stepErr)
+	}
+
+	//Nothing is undone twice
+	undone = nil
+	if err := tx.Rollback(errors.New("again")).(*DeploymentStepError); len(undone) != 0 || len(err.RollbackErrors) != 0 {
+		t.Fatalf("Rolled back again: %v %v", undone, err)
+	}
+}
+
+//fakeDeploymentEngine Stands in for the parts of a docker engine a deployment is created with. Images always exist
+//and containers are kept by ID until they are removed.
+type fakeDeploymentEngine struct {
+	fakeNetworkEngine
+	containers map[string]bool
+	created    int
+}
+
+func (e *fakeDeploymentEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/networks/") {
+		e.fakeNetworkEngine.ServeHTTP(w, r)
+		return
+	}
+	e.Lock()
+	defer e.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	id := strings.Split(strings.TrimPrefix(r.URL.Path, "/containers/"), "/")[0]
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/images/"):
+		json.NewEncoder(w).Encode(docker.Image{ID: "sha256:0123"})
+	case r.Method == "POST" && r.URL.Path == "/containers/create":
+		e.created++
+		id = "container" + strconv.Itoa(e.created)
+		e.containers[id] = true
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"Id": id})
+	case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/start") && e.containers[id]:
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "DELETE" && e.containers[id]:
+		delete(e.containers, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestCreateDeploymentRollback(t *testing.T) {
+	_, cleanup := newTestAPI(t)
+	defer cleanup()
+	_, resetRange := setPortRange(t, 10)
+	defer resetRange()
+	root, resetHost := testBackupHost(t)
+	defer resetHost()
+	previousNginx := nginx
+	defer func() {
+		nginx = previousNginx
+		viper.Set("DataDirectory", nil)
+		viper.Set("CertProvider", nil)
+		viper.Set("MongoImage", nil)
+	}()
+	viper.Set("DataDirectory", filepath.Join(root, "data"))
+	viper.Set("CertProvider", "selfsigned")
+	viper.Set("MongoImage", "mongo")
+	writeTestFile(t, filepath.Join(root, "data", "https-site-nginx.template"), "server_name {{domainName}};\n")
+	os.MkdirAll(viper.GetString("CertDestination"), 0755)
+	//The sites directory is never created so the proxy fails after its key material has been written
+	nginx = NginxInstance{SitesDirectory: viper.GetString("NginxSitesDestination")}
+
+	fake := &fakeDeploymentEngine{fakeNetworkEngine: fakeNetworkEngine{networks: map[string]docker.Network{}}, containers: map[string]bool{}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	engine, _ := docker.NewClient(server.URL)
+
+	spec := mds.DeploymentSpec{Image: "app:latest", MongoMode: mds.MongoModeManaged, Domains: []string{"app.example.com"}}
+	var steps []string
+	progress := func(deployment *mds.Deployment, step string, message string) error {
+		steps = append(steps, step)
+		return nil
+	}
+	_, err := createDeployment(engine, database, "app", mds.DeploymentTypeImage, "", bundleInfo{}, applicationConfiguration{}, spec, progress)
+	stepErr, ok := err.(*DeploymentStepError)
+	if !ok || stepErr.Step != "proxy" || len(stepErr.RollbackErrors) > 0 {
+		t.Fatalf("Expected the proxy step to fail and roll back cleanly, got %v", err)
+	}
+	if strings.Join(steps, ",") != "record,domain,network,mongo,container,container" {
+		t.Fatalf("Unexpected steps: %v", steps)
+	}
+
+	//Both containers and the network were removed
+	if fake.created != 2 || len(fake.containers) != 0 || len(fake.networks) != 0 {
+		t.Fatalf("Containers or networks left behind: %v %v", fake.containers, fake.networks)
+	}
+	//The row, its port, its configuration and the domain name were released
+	for _, model := range []interface{}{&mds.Deployment{}, &PortReservation{}, &mds.EnvironmentVariable{}, &NginxProxyConfiguration{}} {
+		var count int
+		database.Unscoped().Model(model).Count(&count)
+		if count != 0 {
+			t.Fatalf("%T left behind", model)
+		}
+	}
+	//The key material written by the proxy was removed
+	if entries, _ := filepath.Glob(filepath.Join(viper.GetString("CertDestination"), "*")); len(entries) != 0 {
+		t.Fatalf("Key material left behind: %v", entries)
+	}
+
+	//A domain name already in use fails before anything exists on the engine
+	database.Create(&NginxProxyConfiguration{DomainName: "app.example.com"})
+	steps = nil
+	_, err = createDeployment(engine, database, "app", mds.DeploymentTypeImage, "", bundleInfo{}, applicationConfiguration{}, spec, progress)
+	if stepErr, ok := err.(*DeploymentStepError); !ok || stepErr.Step != "domain" {
+		t.Fatalf("Expected the domain step to fail, got %v", err)
+	}
+	var deployments, ports int
+	database.Unscoped().Model(&mds.Deployment{}).Count(&deployments)
+	database.Model(&PortReservation{}).Count(&ports)
+	if deployments != 0 || ports != 0 || fake.created != 2 {
+		t.Fatalf("Deployment of the failed domain step was left behind")
+	}
+}
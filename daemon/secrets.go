@@ -0,0 +1,285 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//Environment variable holding the base64 encoded master key. It takes precedence over SecretKeyFile.
+const masterKeyEnvironmentVariable = "MDS_MASTER_KEY"
+
+//Prefix of values encrypted by a secretBox. Anything without it was stored before encryption was added.
+const encryptedValuePrefix = "enc:v1:"
+
+//Length of the AES-256 master key in bytes
+const masterKeyLength = 32
+
+//Encrypts environment variables and settings before they are stored
+var secrets *secretBox
+
+//secretBox Encrypts and decrypts stored values with AES-256-GCM
+type secretBox struct {
+	aead  cipher.AEAD
+	keyID string //Identifies the key a value was encrypted with so a wrong key gives a clear error
+}
+
+//newSecretBox Creates a secretBox from a 32 byte master key
+func newSecretBox(key []byte) (*secretBox, error) {
+	if len(key) != masterKeyLength {
+		return nil, fmt.Errorf("Master key must be %d bytes, got %d", masterKeyLength, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &secretBox{aead: aead, keyID: hex.EncodeToString(sum[:4])}, nil
+}
+
+//Encrypt Returns the stored form of a value. Empty values are stored as they are.
+func (b *secretBox) Encrypt(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), []byte(b.keyID))
+	return encryptedValuePrefix + b.keyID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+//Decrypt Returns the plaintext of a stored value. Values stored before encryption was added are returned unchanged.
+func (b *secretBox) Decrypt(stored string) (string, error) {
+	if !strings.HasPrefix(stored, encryptedValuePrefix) {
+		return stored, nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(stored, encryptedValuePrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("Encrypted value is malformed")
+	}
+	if parts[0] != b.keyID {
+		return "", fmt.Errorf("Value was encrypted with key %s but the master key is %s", parts[0], b.keyID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < b.aead.NonceSize() {
+		return "", errors.New("Encrypted value is malformed")
+	}
+	nonce, ciphertext := sealed[:b.aead.NonceSize()], sealed[b.aead.NonceSize():]
+	plaintext, err := b.aead.Open(nil, nonce, ciphertext, []byte(b.keyID))
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to decrypt value")
+	}
+	return string(plaintext), nil
+}
+
+//loadSecretBox Reads the master key from MDS_MASTER_KEY or SecretKeyFile.
+//A key file is generated the first time the daemon starts if neither is set.
+func loadSecretBox() (*secretBox, error) {
+	if encoded := os.Getenv(masterKeyEnvironmentVariable); encoded != "" {
+		box, err := readEncodedKey(encoded)
+		if err != nil {
+			return nil, errors.Wrap(err, masterKeyEnvironmentVariable)
+		}
+		return box, nil
+	}
+	keyFile := viper.GetString("SecretKeyFile")
+	if exists, _ := pathExists(keyFile); !exists {
+		log.Warningf("Generating master key at %s. Back it up, stored secrets cannot be read without it.", keyFile)
+		if _, err := generateKeyFile(keyFile); err != nil {
+			return nil, err
+		}
+	}
+	return readKeyFile(keyFile)
+}
+
+//encodedMasterKey Gets the base64 encoded master key from MDS_MASTER_KEY or SecretKeyFile, empty if there is none yet
+func encodedMasterKey() (string, error) {
+	if encoded := os.Getenv(masterKeyEnvironmentVariable); encoded != "" {
+		return strings.TrimSpace(encoded), nil
+	}
+	encoded, err := ioutil.ReadFile(viper.GetString("SecretKeyFile"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(encoded)), err
+}
+
+//readEncodedKey Creates a secretBox from a base64 encoded master key
+func readEncodedKey(encoded string) (*secretBox, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, errors.Wrap(err, "Master key is not base64")
+	}
+	return newSecretBox(key)
+}
+
+//readKeyFile Creates a secretBox from a file holding a base64 encoded master key
+func readKeyFile(path string) (*secretBox, error) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	box, err := readEncodedKey(string(encoded))
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	return box, nil
+}
+
+//generateKeyFile Writes a new random master key that only the daemon user can read
+func generateKeyFile(path string) (*secretBox, error) {
+	key := make([]byte, masterKeyLength)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	//O_EXCL so an existing key is never overwritten
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(base64.StdEncoding.EncodeToString(key) + "\n"); err != nil {
+		return nil, err
+	}
+	return newSecretBox(key)
+}
+
+//rotateSecrets Re-encrypts every stored environment variable and settings with a new key in a single transaction.
+//Returns the number of values that were re-encrypted.
+func rotateSecrets(db *gorm.DB, oldBox *secretBox, newBox *secretBox) (int, error) {
+	rotated := 0
+	reencrypt := func(stored string) (string, error) {
+		plaintext, err := oldBox.Decrypt(stored)
+		if err != nil {
+			return "", err
+		}
+		rotated++
+		return newBox.Encrypt(plaintext)
+	}
+	tx := db.Begin()
+	var variables []mds.EnvironmentVariable
+	if err := tx.Find(&variables).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for _, variable := range variables {
+		value, err := reencrypt(variable.Value)
+		if err == nil {
+			err = tx.Model(&variable).Update("value", value).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return 0, errors.Wrapf(err, "Environment variable %s of deployment %d", variable.Name, variable.DeploymentID)
+		}
+	}
+	//Deleted deployments keep their row so their settings are rotated too
+	var deployments []mds.Deployment
+	if err := tx.Unscoped().Where("settings <> ''").Find(&deployments).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for _, deployment := range deployments {
+		settings, err := reencrypt(deployment.Settings)
+		if err == nil {
+			err = tx.Unscoped().Model(&deployment).UpdateColumn("settings", settings).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return 0, errors.Wrapf(err, "Settings of deployment %d", deployment.ID)
+		}
+	}
+	var credentials []mds.RegistryCredential
+	if err := tx.Find(&credentials).Error; err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for _, credential := range credentials {
+		password, err := reencrypt(credential.Password)
+		if err == nil {
+			err = tx.Model(&credential).Update("password", password).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			return 0, errors.Wrapf(err, "Password of registry %s", credential.Registry)
+		}
+	}
+	return rotated, tx.Commit().Error
+}
+
+//rotateKeyCommand Runs 'mds-daemon rotate-key <new key file>'. The daemon should be stopped while it runs.
+//The new key file is generated if it does not exist.
+func rotateKeyCommand(args []string) error {
+	if len(args) != 1 {
+		return errors.New("Usage: mds-daemon rotate-key <new key file>")
+	}
+	oldBox, err := loadSecretBox()
+	if err != nil {
+		return err
+	}
+	var newBox *secretBox
+	if exists, _ := pathExists(args[0]); exists {
+		newBox, err = readKeyFile(args[0])
+	} else {
+		newBox, err = generateKeyFile(args[0])
+	}
+	if err != nil {
+		return err
+	}
+	if newBox.keyID == oldBox.keyID {
+		return errors.New("The new key is the same as the current key")
+	}
+	db, err := openDatabase()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err := migrateDatabase(db); err != nil {
+		return err
+	}
+	rotated, err := rotateSecrets(db, oldBox, newBox)
+	if err != nil {
+		return err
+	}
+	log.Infof("Re-encrypted %d values with key %s", rotated, newBox.keyID)
+	log.Infof("Point SecretKeyFile at %s, or set %s to its contents, before starting the daemon again", args[0], masterKeyEnvironmentVariable)
+	return nil
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+func TestSecretBox(t *testing.T) {
+	box, err := newSecretBox(make([]byte, masterKeyLength))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := box.Encrypt("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encrypted, encryptedValuePrefix+box.keyID+":") || strings.Contains(encrypted, "hunter2") {
+		t.Fatalf("Unexpected encrypted value: %s", encrypted)
+	}
+	if decrypted, err := box.Decrypt(encrypted); err != nil || decrypted != "hunter2" {
+		t.Fatalf("Expected hunter2, got %q (%v)", decrypted, err)
+	}
+	//Values stored before encryption was added are read as they are
+	if plain, err := box.Decrypt("plain"); err != nil || plain != "plain" {
+		t.Fatalf("Expected plain, got %q (%v)", plain, err)
+	}
+
+	otherKey := make([]byte, masterKeyLength)
+	otherKey[0] = 1
+	other, _ := newSecretBox(otherKey)
+	if _, err := other.Decrypt(encrypted); err == nil {
+		t.Fatal("A different key decrypted the value")
+	}
+	tampered := encrypted[:len(encrypted)-4] + "AAA="
+	if _, err := box.Decrypt(tampered); err == nil {
+		t.Fatal("A tampered value was decrypted")
+	}
+	if _, err := newSecretBox([]byte("short")); err == nil {
+		t.Fatal("A short key was accepted")
+	}
+}
+
+func TestRotateSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mds-secrets-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := gorm.Open("sqlite3", filepath.Join(dir, "mds.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := migrateDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+
+	oldBox, err := generateKeyFile(filepath.Join(dir, "old.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := generateKeyFile(filepath.Join(dir, "old.key")); err == nil {
+		t.Fatal("An existing key file was overwritten")
+	}
+	newBox, err := generateKeyFile(filepath.Join(dir, "new.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reread, err := readKeyFile(filepath.Join(dir, "new.key")); err != nil || reread.keyID != newBox.keyID {
+		t.Fatalf("Key file did not round trip: %v", err)
+	}
+
+	secrets = oldBox
+	deployment := mds.Deployment{ProjectName: "rotated"}
+	db.Create(&deployment)
+	var configuration applicationConfiguration
+	configuration.Settings = `{"key":"value"}`
+	configuration.apply([]string{"PLAIN=1"}, []string{"TOKEN=secret"}, nil)
+	if err := saveApplicationConfiguration(db, &deployment, configuration); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := rotateSecrets(db, oldBox, newBox)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated != 3 {
+		t.Fatalf("Expected 3 values to be rotated, got %d", rotated)
+	}
+	db.First(&deployment, deployment.ID)
+	if _, err := loadApplicationConfiguration(nil, db, &deployment); err == nil {
+		t.Fatal("The old key can still read the configuration")
+	}
+	secrets = newBox
+	loaded, err := loadApplicationConfiguration(nil, db, &deployment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Settings != configuration.Settings || strings.Join(loaded.Environment, ",") != "PLAIN=1,TOKEN=secret" || !loaded.Secrets["TOKEN"] {
+		t.Fatalf("Configuration did not survive rotation: %+v", loaded)
+	}
+}
@@ -22,6 +22,8 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"io/ioutil"
 	"math/big"
 	"os"
 	"time"
@@ -102,3 +104,16 @@ func WritePrivateKeyToFile(key *rsa.PrivateKey, filePath string) error {
 	keyOut.Close()
 	return nil
 }
+
+//ReadCertificateFromFile Parses the first PEM encoded certificate in a file
+func ReadCertificateFromFile(filePath string) (*x509.Certificate, error) {
+	pemBytes, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("No certificate found in " + filePath)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,367 @@
+/*
+ * Copyright 2017 Manuel Gauto (github.com/twa16)
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	uuid "github.com/satori/go.uuid"
+	"github.com/spf13/viper"
+	"github.com/twa16/meteor-deploy-system/common"
+)
+
+//Form fields that can be sent with a deployment form
+const (
+	uploadField   = "upload" //ID of a complete upload, sent instead of uploadfile
+	checksumField = "sha256" //Hex SHA-256 the file in uploadfile has to match
+)
+
+//uploadLocks IDs of the uploads a request is currently writing to or moving
+type uploadLocks struct {
+	sync.Mutex
+	busy map[string]bool
+}
+
+//activeUploads Keeps two requests from changing the same upload at once
+var activeUploads = &uploadLocks{busy: make(map[string]bool)}
+
+//Acquire Marks an upload as busy, returns false if it already is
+func (l *uploadLocks) Acquire(id string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.busy[id] {
+		return false
+	}
+	l.busy[id] = true
+	return true
+}
+
+//Release Marks an upload as no longer busy
+func (l *uploadLocks) Release(id string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.busy, id)
+}
+
+//uploadDirectory Gets the directory holding the data of uploads that have not been used yet
+func uploadDirectory() string {
+	return filepath.Join(viper.GetString("DataDirectory"), "uploads")
+}
+
+//uploadPath Gets the file the chunks of an upload are written to
+func uploadPath(id string) string {
+	return filepath.Join(uploadDirectory(), id+".part")
+}
+
+//uploadExpiry Gets how long an upload is kept after its last chunk
+func uploadExpiry() time.Duration {
+	return time.Duration(viper.GetInt("UploadExpiryHours")) * time.Hour
+}
+
+//isSHA256 Checks that a value is a hex SHA-256 as sent by clients
+func isSHA256(value string) bool {
+	if len(value) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
+
+//checksumFile Gets the hex SHA-256 of a file
+func checksumFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+//removeUpload Deletes an upload and its data
+func removeUpload(db *gorm.DB, upload mds.Upload) error {
+	if err := os.Remove(uploadPath(upload.ID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return db.Delete(&upload).Error
+}
+
+//removeExpiredUploads Deletes the uploads that were abandoned or never used
+func removeExpiredUploads(db *gorm.DB) {
+	var uploads []mds.Upload
+	db.Where("expires_at < ?", time.Now()).Find(&uploads)
+	for _, upload := range uploads {
+		if !activeUploads.Acquire(upload.ID) {
+			continue
+		}
+		if err := removeUpload(db, upload); err != nil {
+			log.Warningf("Failed to remove expired upload %s: %s", upload.ID, err.Error())
+		} else {
+			log.Infof("Removed expired upload %s", upload.ID)
+		}
+		activeUploads.Release(upload.ID)
+	}
+}
+
+//requestUpload Gets the upload named in the path of the request. Writes an error response and returns false if
+//it does not exist or belongs to someone else.
+func requestUpload(w http.ResponseWriter, r *http.Request) (mds.Upload, bool) {
+	id, _ := pathParam(r, "id")
+	var upload mds.Upload
+	if database.Where("id = ? AND user_id = ?", id, requestUserID(r)).First(&upload).RecordNotFound() {
+		writeError(w, http.StatusNotFound, mds.ErrorCodeNotFound, "Upload Not Found", nil)
+		return upload, false
+	}
+	return upload, true
+}
+
+//Called when POST /uploads is called. Starts an upload that is sent in chunks with PATCH /uploads/:id.
+func createUploadAPIHandler(w http.ResponseWriter, r *http.Request) {
+	var request mds.UploadRequest
+	if !readJSON(w, r, &request) {
+		return
+	}
+	request.SHA256 = strings.ToLower(request.SHA256)
+	if request.Size <= 0 {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Size must be positive", nil)
+		return
+	}
+	if !isSHA256(request.SHA256) {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "SHA256 must be a hex SHA-256", nil)
+		return
+	}
+	if err := os.MkdirAll(uploadDirectory(), 0700); err != nil {
+		writeInternalError(w, "Failed to create upload directory", err)
+		return
+	}
+	upload := mds.Upload{
+		ID:        uuid.NewV4().String(),
+		UserID:    requestUserID(r),
+		Size:      request.Size,
+		SHA256:    request.SHA256,
+		ExpiresAt: time.Now().Add(uploadExpiry()),
+	}
+	f, err := os.OpenFile(uploadPath(upload.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		writeInternalError(w, "Failed to create upload", err)
+		return
+	}
+	f.Close()
+	if err := database.Create(&upload).Error; err != nil {
+		os.Remove(uploadPath(upload.ID))
+		writeInternalError(w, "Failed to save upload", err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, upload)
+}
+
+//Called when GET /uploads/:id is called. The offset tells a client where to resume.
+func getUploadAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if upload, ok := requestUpload(w, r); ok {
+		writeJSON(w, http.StatusOK, upload)
+	}
+}
+
+//Called when DELETE /uploads/:id is called
+func deleteUploadAPIHandler(w http.ResponseWriter, r *http.Request) {
+	upload, ok := requestUpload(w, r)
+	if !ok {
+		return
+	}
+	if !activeUploads.Acquire(upload.ID) {
+		writeError(w, http.StatusConflict, mds.ErrorCodeConflict, "Upload is in use", nil)
+		return
+	}
+	defer activeUploads.Release(upload.ID)
+	if err := removeUpload(database, upload); err != nil {
+		writeInternalError(w, "Failed to remove upload", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//Called when PATCH /uploads/:id is called. The body is appended to the upload if the Upload-Offset header matches
+//its offset. Whatever arrived is kept if the connection drops, so the client can resume from the new offset.
+//Once the last byte arrives the checksum is verified and an upload that does not match is removed.
+func uploadChunkAPIHandler(w http.ResponseWriter, r *http.Request) {
+	offset, err := strconv.ParseInt(r.Header.Get(mds.UploadOffsetHeader), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Expected the offset of the chunk in "+mds.UploadOffsetHeader, missingFields(mds.UploadOffsetHeader))
+		return
+	}
+	id, _ := pathParam(r, "id")
+	if !activeUploads.Acquire(id) {
+		writeError(w, http.StatusConflict, mds.ErrorCodeConflict, "Another chunk of this upload is being sent", nil)
+		return
+	}
+	defer activeUploads.Release(id)
+	//Looked up once no other request can change it
+	upload, ok := requestUpload(w, r)
+	if !ok {
+		return
+	}
+	if upload.Complete {
+		writeError(w, http.StatusConflict, mds.ErrorCodeConflict, "Upload is already complete", nil)
+		return
+	}
+	if offset != upload.Offset {
+		writeError(w, http.StatusConflict, mds.ErrorCodeConflict, "Chunk does not start at the offset of the upload", map[string]int64{"offset": upload.Offset})
+		return
+	}
+
+	written, err := appendChunk(upload, r.Body)
+	if err == errChunkTooLarge {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Chunk goes past the size of the upload", map[string]int64{"size": upload.Size})
+		return
+	}
+	if err != nil && written == 0 {
+		writeInternalError(w, "Failed to write upload chunk", err)
+		return
+	}
+	upload.Offset += written
+	upload.ExpiresAt = time.Now().Add(uploadExpiry())
+	if upload.Offset == upload.Size {
+		checksum, err := checksumFile(uploadPath(upload.ID))
+		if err != nil {
+			writeInternalError(w, "Failed to verify upload", err)
+			return
+		}
+		if checksum != upload.SHA256 {
+			//The client has to start over, there is no telling which chunk was wrong
+			removeUpload(database, upload)
+			writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Checksum of the bundle does not match", map[string]string{"expected": upload.SHA256, "actual": checksum})
+			return
+		}
+		upload.Complete = true
+	}
+	if err := database.Save(&upload).Error; err != nil {
+		writeInternalError(w, "Failed to save upload", err)
+		return
+	}
+	if err != nil {
+		//Most likely the client went away, this is only seen if it is still listening
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Chunk was only partly received", map[string]int64{"offset": upload.Offset})
+		return
+	}
+	writeJSON(w, http.StatusOK, upload)
+}
+
+//errChunkTooLarge Returned by appendChunk when a chunk holds more than the rest of the upload
+var errChunkTooLarge = errors.New("Chunk goes past the size of the upload")
+
+//appendChunk Writes a chunk at the offset of an upload and returns how much of it was written.
+//If reading the chunk fails part way, what was read is kept and returned with the error.
+func appendChunk(upload mds.Upload, chunk io.Reader) (int64, error) {
+	f, err := os.OpenFile(uploadPath(upload.ID), os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	//Anything after the offset is left from a request that failed before the offset was saved
+	if err := f.Truncate(upload.Offset); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(upload.Offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	remaining := upload.Size - upload.Offset
+	written, copyErr := io.Copy(f, io.LimitReader(chunk, remaining+1))
+	if written > remaining {
+		f.Truncate(upload.Offset)
+		return 0, errChunkTooLarge
+	}
+	//The offset must never get ahead of what is on disk
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return written, copyErr
+}
+
+//readUploadField Gets the complete upload named in the upload field of a deployment form.
+//Returns nil if the field was not sent. Writes an error response and returns false if the upload cannot be used.
+func readUploadField(w http.ResponseWriter, r *http.Request) (*mds.Upload, bool) {
+	id := r.FormValue(uploadField)
+	if id == "" {
+		return nil, true
+	}
+	var upload mds.Upload
+	if database.Where("id = ? AND user_id = ?", id, requestUserID(r)).First(&upload).RecordNotFound() {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Upload "+id+" does not exist", nil)
+		return nil, false
+	}
+	if !upload.Complete {
+		writeError(w, http.StatusBadRequest, mds.ErrorCodeBadRequest, "Upload "+id+" is not complete", map[string]int64{"offset": upload.Offset, "size": upload.Size})
+		return nil, false
+	}
+	return &upload, true
+}
+
+//moveUpload Moves the data of a complete upload into a new application directory and removes the upload
+func moveUpload(upload mds.Upload) (string, error) {
+	if !activeUploads.Acquire(upload.ID) {
+		return "", errors.New("Upload is in use")
+	}
+	defer activeUploads.Release(upload.ID)
+	destination, err := GetNewApplicationDirectory()
+	if err != nil {
+		return "", err
+	}
+	bundlePath := filepath.Join(destination, "application.tar.gz")
+	//Renaming fails if the data and application directories are on different file systems
+	if err := os.Rename(uploadPath(upload.ID), bundlePath); err != nil {
+		if err = copyFile(uploadPath(upload.ID), bundlePath); err != nil {
+			os.RemoveAll(destination)
+			return "", err
+		}
+	}
+	if err := removeUpload(database, upload); err != nil {
+		log.Warningf("Failed to remove used upload %s: %s", upload.ID, err.Error())
+	}
+	return destination, nil
+}
+
+//copyFile Copies a file and syncs the copy
+func copyFile(source string, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}